@@ -1,3 +1,8 @@
 module ollama-openai-proxy
 
-go 1.21 
\ No newline at end of file
+go 1.21
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	gopkg.in/yaml.v3 v3.0.1
+)
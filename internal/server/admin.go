@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// PromptDebugResponse is the exact prompt and options a request renders to.
+type PromptDebugResponse struct {
+	Model    string          `json:"model"`
+	Prompt   string          `json:"prompt,omitempty"`
+	Messages []OllamaMessage `json:"messages,omitempty"`
+	Options  any             `json:"options"`
+}
+
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminKey := adminAPIKey()
+		if adminKey == "" {
+			sendError(w, r, "Admin API is disabled", "invalid_request_error", "admin_disabled", http.StatusNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(apiKeyFromRequest(r)), []byte(adminKey)) != 1 {
+			sendError(w, r, "Invalid admin API key", "invalid_request_error", "invalid_api_key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminPrompt renders a model + messages pair the same way a chat
+// completion would, so template problems can be seen without a packet capture.
+func handleAdminPrompt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var openAIReq OpenAIChatRequest
+	if err := decodeJSONBody(r.Body, &openAIReq); err != nil {
+		sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+
+	if openAIReq.Model == "" {
+		sendError(w, r, "Model is required", "invalid_request_error", "invalid_model", http.StatusBadRequest)
+		return
+	}
+
+	// only model presets apply here, the caller is holding the admin key
+	if _, _, ok := resolveRequest(r.Context(), &openAIReq, ""); !ok {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, openAIReq.Model)
+		return
+	}
+	if err := enforceRoleAlternation(&openAIReq, 0); err != nil {
+		sendMessageError(w, r, err)
+		return
+	}
+	ollamaReq, err := buildOllamaRequest(r.Context(), openAIReq)
+	if err != nil {
+		sendError(w, r, "Invalid image: %s", "invalid_request_error", "invalid_image", http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, PromptDebugResponse{
+		Model:    ollamaReq.Model,
+		Prompt:   ollamaReq.Prompt,
+		Messages: ollamaReq.Messages,
+		Options:  ollamaReq.Options,
+	})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header clients can set to name a conversation. Without it the first
+// system and user messages identify one, which follow-up turns resend.
+const SESSION_HEADER = "X-Session-ID"
+
+// sessionKey identifies the conversation a request belongs to, for routing
+// its turns to the same backend.
+func sessionKey(r *http.Request, req OpenAIChatRequest) string {
+	if id := r.Header.Get(SESSION_HEADER); id != "" {
+		return id
+	}
+
+	h := sha256.New()
+	h.Write([]byte(req.User))
+	seen := map[string]bool{}
+	for _, msg := range req.Messages {
+		if (msg.Role != "system" && msg.Role != "user") || seen[msg.Role] {
+			continue
+		}
+		seen[msg.Role] = true
+		h.Write([]byte{0})
+		h.Write([]byte(msg.Role + ":" + msg.Content))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// affinityScore ranks backends for a session by rendezvous hashing: each
+// session prefers the backend with the highest score, and when that one
+// goes away only its own sessions move elsewhere.
+func affinityScore(session string, b *backend) uint64 {
+	sum := sha256.Sum256([]byte(session + "\x00" + b.url))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ModelAlias maps requested model names onto local ones. Pattern is a glob
+// (`*`, `?`) unless Regex is set; each wildcard or regex group is a capture
+// that Target can reference as `$1`, `$2`, ...
+type ModelAlias struct {
+	Pattern string `yaml:"pattern"`
+	Regex   bool   `yaml:"regex"`
+	Target  string `yaml:"target"`
+}
+
+type compiledAlias struct {
+	re     *regexp.Regexp
+	target string
+}
+
+// modelAliases are the compiled model_aliases.patterns, see setup.
+var modelAliases []compiledAlias
+
+// aliasOverrides are aliases switched with POST /admin/aliases, by
+// lowercased name. They win over model_aliases.map until the proxy restarts.
+var aliasOverrides = struct {
+	sync.RWMutex
+	targets map[string]string
+}{targets: make(map[string]string)}
+
+// compileModelAliases prepares aliases for matching; validate reports its
+// error.
+func compileModelAliases(aliases []ModelAlias) ([]compiledAlias, error) {
+	compiled := make([]compiledAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		expr := alias.Pattern
+		if !alias.Regex {
+			expr = regexp.QuoteMeta(expr)
+			expr = strings.ReplaceAll(expr, `\*`, "(.*)")
+			expr = strings.ReplaceAll(expr, `\?`, "(.)")
+		}
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q is not a regular expression: %w", alias.Pattern, err)
+		}
+		compiled = append(compiled, compiledAlias{re: re, target: alias.Target})
+	}
+	return compiled, nil
+}
+
+// aliasModel maps model through the switched aliases, the configured
+// model_aliases.map, then model_aliases.patterns. ok is false if none has an alias
+// for it.
+func aliasModel(model string) (target string, ok bool) {
+	aliasOverrides.RLock()
+	target, ok = aliasOverrides.targets[strings.ToLower(model)]
+	aliasOverrides.RUnlock()
+	if ok {
+		return target, true
+	}
+	for name, target := range config.ModelAliases.Map {
+		if strings.EqualFold(name, model) {
+			return target, true
+		}
+	}
+	for _, alias := range modelAliases {
+		match := alias.re.FindStringSubmatchIndex(model)
+		if match == nil {
+			continue
+		}
+		return string(alias.re.ExpandString(nil, alias.target, model, match)), true
+	}
+	return model, false
+}
+
+// resolveModelAlias returns the model an alias points model at. Names
+// without an alias go to model_aliases.default if Ollama doesn't have them,
+// and are passed through otherwise. With model_aliases.strict they are
+// rejected instead, ok is false then.
+func resolveModelAlias(ctx context.Context, model string) (target string, ok bool) {
+	if target, ok := aliasModel(model); ok {
+		return target, true
+	}
+	if config.ModelAliases.Strict {
+		return model, false
+	}
+	if config.ModelAliases.Default != "" && !ollamaHasModel(ctx, model) {
+		return config.ModelAliases.Default, true
+	}
+	return model, true
+}
+
+// ollamaHasModel reports whether model is pulled on Ollama. Names of other
+// providers, and any model while Ollama can't be asked, count as present.
+func ollamaHasModel(ctx context.Context, model string) bool {
+	if provider, _ := splitProviderModel(model); provider != "ollama" {
+		return true
+	}
+	_, err := showModel(ctx, model)
+	return !errors.Is(err, errModelNotFound)
+}
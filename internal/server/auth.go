@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKey is a client key the proxy accepts, from api_keys in the config file
+// or from the keys file. Without any keys the proxy accepts every request.
+type APIKey struct {
+	Key string `yaml:"key"`
+	// shown in logs instead of the key
+	Name string `yaml:"name"`
+	// glob patterns of models the key may use, as the client names them;
+	// empty allows every model the proxy serves
+	Models []string `yaml:"models"`
+	// 0 falls back to rate_limit in the config
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute"`
+	// open streams at once, 0 falls back to max_streams_per_key
+	MaxStreams int `yaml:"max_streams"`
+	// RAG collections the key sees, defaults to its name; keys with the
+	// same namespace share collections
+	Namespace string `yaml:"namespace"`
+	// what usage records keep of prompts and responses: none (default),
+	// hashed, truncated or full
+	StoreContent string `yaml:"store_content"`
+}
+
+type apiKeyEntry struct {
+	APIKey
+	models []*regexp.Regexp
+	limits *clientLimits
+}
+
+// apiKeys is set from the configuration at startup.
+var apiKeys = newKeyStore(nil)
+
+type keyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*apiKeyEntry
+}
+
+func newKeyStore(keys []APIKey) *keyStore {
+	store := &keyStore{}
+	store.replace(keys)
+	return store
+}
+
+// replace swaps in a new set of keys, see refreshSecrets, and reports
+// whether it differs from the old one. Keys that stay keep their rate
+// limit state.
+func (s *keyStore) replace(keys []APIKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := len(keys) != len(s.keys)
+	entries := make(map[string]*apiKeyEntry, len(keys))
+	for _, k := range keys {
+		if old, ok := s.keys[k.Key]; ok && reflect.DeepEqual(old.APIKey, k) {
+			entries[k.Key] = old
+			continue
+		}
+		changed = true
+		entries[k.Key] = &apiKeyEntry{
+			APIKey: k,
+			models: compileGlobPatterns(k.Models),
+			limits: newClientLimits(k.RequestsPerMinute, k.TokensPerMinute),
+		}
+	}
+	s.keys = entries
+	return changed
+}
+
+func (s *keyStore) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys) > 0
+}
+
+func (s *keyStore) lookup(key string) *apiKeyEntry {
+	if key == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[key]
+}
+
+// find is the key with keyHash, see usageKeyHash, or without one the key
+// named keyName, and "" when no key matches.
+func (s *keyStore) find(keyName, keyHash string) string {
+	if keyName == "" && keyHash == "" {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, entry := range s.keys {
+		if keyHash != "" && usageKeyHash(key) == keyHash || keyHash == "" && entry.Name == keyName {
+			return key
+		}
+	}
+	return ""
+}
+
+// loadKeysFile reads a YAML list of APIKey.
+func loadKeysFile(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys file: %w", err)
+	}
+	var keys []APIKey
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid keys file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// authMiddleware rejects requests without a known API key once keys are
+// configured, and enforces the rate limits of the key or, without keys, of
+// the client's address. RoutePolicy can switch either off for a route.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		features := routeFeaturesFor(r.Context())
+		limit := func(limits *clientLimits) {
+			if features.rateLimit {
+				rateLimit(w, r, limits, next)
+			} else {
+				next.ServeHTTP(w, r)
+			}
+		}
+		if !apiKeys.enabled() || !features.auth {
+			limit(addressLimits.get(clientAddress(r)))
+			return
+		}
+
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			sendError(w, r, "You didn't provide an API key. Send it in the Authorization header as `Bearer <key>`", "invalid_request_error", "missing_api_key", http.StatusUnauthorized)
+			return
+		}
+		entry := apiKeys.lookup(key)
+		if entry == nil {
+			sendError(w, r, "Incorrect API key provided", "invalid_request_error", "invalid_api_key", http.StatusUnauthorized)
+			return
+		}
+		limit(entry.limits)
+	})
+}
+
+// keyAllowsModel reports whether apiKey may use model. Unknown keys only
+// get this far while authentication is off, so they may use anything.
+func keyAllowsModel(apiKey string, model string) bool {
+	entry := apiKeys.lookup(apiKey)
+	return entry == nil || len(entry.models) == 0 || matchesAnyPattern(entry.models, model)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	off := false
+	tests := []struct {
+		name   string
+		keys   []APIKey
+		routes map[string]RoutePolicy
+		header string
+		want   int
+		// in the error, empty when the request gets through
+		wantCode string
+	}{
+		{"no keys configured", nil, nil, "", http.StatusOK, ""},
+		{"no keys configured, any key", nil, nil, "Bearer sk-anything", http.StatusOK, ""},
+		{"missing key", []APIKey{{Key: testKey}}, nil, "", http.StatusUnauthorized, "missing_api_key"},
+		{"wrong key", []APIKey{{Key: testKey}}, nil, "Bearer sk-other", http.StatusUnauthorized, "invalid_api_key"},
+		{"key without Bearer", []APIKey{{Key: testKey}}, nil, "Basic " + testKey, http.StatusUnauthorized, "invalid_api_key"},
+		{"known key", []APIKey{{Key: testKey}}, nil, "Bearer " + testKey, http.StatusOK, ""},
+		{"auth off for the route", []APIKey{{Key: testKey}}, map[string]RoutePolicy{"/v1/models": {Auth: &off}}, "", http.StatusOK, ""},
+		{"auth off for another route", []APIKey{{Key: testKey}}, map[string]RoutePolicy{"/v1/embeddings": {Auth: &off}}, "", http.StatusUnauthorized, "missing_api_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{Routes: tt.routes}, tt.keys...)
+			handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			r = r.WithContext(withRoute(r.Context(), "/v1/models"))
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := errorCode(t, w); got != tt.wantCode {
+				t.Errorf("error code %q, want %q", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestKeyAllowsModel(t *testing.T) {
+	setConfig(t, Config{}, APIKey{Key: testKey, Models: []string{"llama3*", "mistral:7b"}}, APIKey{Key: "sk-any"})
+	tests := []struct {
+		key   string
+		model string
+		want  bool
+	}{
+		{testKey, "llama3:8b", true},
+		{testKey, "mistral:7b", true},
+		{testKey, "mistral:latest", false},
+		{"sk-any", "mistral:latest", true},
+		{"sk-unknown", "mistral:latest", true},
+	}
+	for _, tt := range tests {
+		if got := keyAllowsModel(tt.key, tt.model); got != tt.want {
+			t.Errorf("keyAllowsModel(%s, %s) = %v, want %v", tt.key, tt.model, got, tt.want)
+		}
+	}
+}
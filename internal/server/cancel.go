@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errCanceledByAdmin = errors.New("request canceled by an administrator")
+
+// runningRequest is a request that can be canceled through /admin/cancel.
+type runningRequest struct {
+	id      string
+	apiKey  string
+	model   string
+	started time.Time
+	cancel  context.CancelCauseFunc
+}
+
+type requestRegistry struct {
+	sync.Mutex
+	requests map[string]*runningRequest
+}
+
+var runningRequests = &requestRegistry{requests: make(map[string]*runningRequest)}
+
+// track derives a context that /admin/cancel can cancel and registers it
+// under id until done is called.
+func (reg *requestRegistry) track(ctx context.Context, id, apiKey, model string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	reg.Lock()
+	reg.requests[id] = &runningRequest{id: id, apiKey: apiKey, model: model, started: time.Now(), cancel: cancel}
+	reg.Unlock()
+
+	return ctx, func() {
+		reg.Lock()
+		delete(reg.requests, id)
+		reg.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelMatching cancels every running request match accepts and returns
+// their IDs.
+func (reg *requestRegistry) cancelMatching(match func(*runningRequest) bool) []string {
+	reg.Lock()
+	defer reg.Unlock()
+	canceled := []string{}
+	for id, req := range reg.requests {
+		if match(req) {
+			req.cancel(errCanceledByAdmin)
+			canceled = append(canceled, id)
+		}
+	}
+	return canceled
+}
+
+type CancelResponse struct {
+	Canceled []string `json:"canceled"`
+}
+
+// handleAdminCancel cancels all running requests of an API key and/or on
+// models matching a glob, for incident response.
+func handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		APIKey string `json:"api_key"`
+		Model  string `json:"model"`
+	}
+	if err := decodeJSONBody(r.Body, &body); err != nil {
+		sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	if body.APIKey == "" && body.Model == "" {
+		sendError(w, r, "api_key or model is required", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+
+	var model []string
+	if body.Model != "" {
+		model = []string{body.Model}
+	}
+	patterns := compileGlobPatterns(model)
+	canceled := runningRequests.cancelMatching(func(req *runningRequest) bool {
+		return (body.APIKey == "" || req.apiKey == body.APIKey) &&
+			(body.Model == "" || matchesAnyPattern(patterns, req.model))
+	})
+	tenantFromContext(r.Context()).logger.Printf("admin canceled %d requests (model=%q, by key: %t)", len(canceled), body.Model, body.APIKey != "")
+	writeJSON(w, CancelResponse{Canceled: canceled})
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Finished generations within this window make up the throughput the wait
+// estimate is based on
+const THROUGHPUT_WINDOW = 5 * time.Minute
+
+// generationSlots is the queue of max_concurrent_generations and
+// max_queued_generations, see setup.
+var generationSlots = newGenerationQueue(0, 0)
+
+// ModelConcurrency limits the generations of one model, for models a host
+// can only run a few of at once. model_concurrency in the config file sets
+// them per Ollama model name, on top of max_concurrent_generations. A
+// request waits for a slot of the first model it asks for and keeps it
+// through fallbacks.
+type ModelConcurrency struct {
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// requests that may wait once all slots are busy, 0 for no limit
+	MaxQueued int `yaml:"max_queued"`
+}
+
+// modelSlots are the queues of model_concurrency, see setup.
+var modelSlots map[string]*generationQueue
+
+func newModelQueues(limits map[string]ModelConcurrency) map[string]*generationQueue {
+	queues := make(map[string]*generationQueue, len(limits))
+	for model, limit := range limits {
+		queues[model] = newGenerationQueue(limit.MaxConcurrent, limit.MaxQueued)
+	}
+	return queues
+}
+
+// CapacityResponse is the 503 for a full queue, with what a client needs to
+// decide when to come back.
+type CapacityResponse struct {
+	ErrorResponse
+	Queue QueueStatus `json:"queue"`
+}
+
+type QueueStatus struct {
+	Depth int `json:"depth"`
+	// omitted until a generation has finished to base it on
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds,omitempty"`
+}
+
+// capacityError rejects a request because the queue is full, or because
+// it waited longer than queue_timeout.
+type capacityError struct {
+	depth    int
+	wait     time.Duration // 0 when unknown
+	timedOut bool
+}
+
+func (e *capacityError) Error() string {
+	if e.timedOut {
+		return "timed out waiting for a generation slot, " + strconv.Itoa(e.depth) + " requests waiting"
+	}
+	return "generation queue is full, " + strconv.Itoa(e.depth) + " requests waiting"
+}
+
+// generationQueue hands out generation slots in the order requests ask for
+// them, and keeps track of how many wait and how fast slots free up.
+type generationQueue struct {
+	slots     slots
+	maxQueued int
+
+	mu       sync.Mutex
+	waiting  int
+	finished []time.Time
+}
+
+func newGenerationQueue(concurrency, maxQueued int) *generationQueue {
+	return &generationQueue{slots: newSlots(concurrency), maxQueued: maxQueued}
+}
+
+// acquire takes a generation slot, waiting for one as long as ctx allows
+// and at most queue_timeout. onQueued is called when the request has to
+// wait. A full queue fails with a *capacityError right away, and so does
+// the timeout once it passes.
+func (q *generationQueue) acquire(ctx context.Context, onQueued func()) (release func(), err error) {
+	if q == nil || q.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return q.releaser(), nil
+	default:
+	}
+
+	q.mu.Lock()
+	if q.maxQueued > 0 && q.waiting >= q.maxQueued {
+		err := &capacityError{depth: q.waiting, wait: q.estimateWaitLocked(q.waiting + 1)}
+		q.mu.Unlock()
+		return nil, err
+	}
+	q.waiting++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.waiting--
+		q.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if config.QueueTimeout > 0 {
+		timer := time.NewTimer(config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	onQueued()
+	select {
+	case q.slots <- struct{}{}:
+		return q.releaser(), nil
+	case <-timeout:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return nil, &capacityError{depth: q.waiting, wait: q.estimateWaitLocked(q.waiting), timedOut: true}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// depth is how many requests are waiting for a slot.
+func (q *generationQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+func (q *generationQueue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-q.slots
+			q.mu.Lock()
+			q.finished = append(q.finished, time.Now())
+			q.mu.Unlock()
+		})
+	}
+}
+
+// estimateWaitLocked is how long until a request at position in the queue
+// gets a slot, at the rate slots were released within THROUGHPUT_WINDOW.
+func (q *generationQueue) estimateWaitLocked(position int) time.Duration {
+	now := time.Now()
+	cutoff := now.Add(-THROUGHPUT_WINDOW)
+	i := 0
+	for i < len(q.finished) && q.finished[i].Before(cutoff) {
+		i++
+	}
+	q.finished = q.finished[i:]
+	if len(q.finished) == 0 {
+		return 0
+	}
+
+	// right after startup the window isn't full yet
+	span := now.Sub(q.finished[0])
+	if span < time.Second {
+		span = time.Second
+	}
+	perSecond := float64(len(q.finished)) / span.Seconds()
+	return time.Duration(float64(position) / perSecond * float64(time.Second))
+}
+
+func sendCapacityError(w http.ResponseWriter, r *http.Request, err *capacityError) {
+	resp := CapacityResponse{Queue: QueueStatus{Depth: err.depth}}
+	resp.Error.Message = localizeError(r, "The server is at capacity with %d requests waiting, please retry later", err.depth)
+	resp.Error.Type = "server_error"
+	resp.Error.Code = "queue_full"
+	if err.timedOut {
+		resp.Error.Message = localizeError(r, "Timed out waiting for the server with %d requests waiting, please retry later", err.depth)
+		resp.Error.Code = "queue_timeout"
+	}
+	if err.wait > 0 {
+		seconds := math.Round(err.wait.Seconds()*10) / 10
+		resp.Queue.EstimatedWaitSeconds = &seconds
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.wait.Seconds()))))
+	}
+
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	writeJSON(w, resp)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acquireResult is how a request fared in a generationQueue: slot, queued,
+// queue_full or queue_timeout.
+func acquireResult(t *testing.T, ctx context.Context, q *generationQueue) (string, <-chan error) {
+	t.Helper()
+	queued := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.acquire(ctx, func() { queued <- struct{}{} })
+		done <- err
+	}()
+	select {
+	case <-queued:
+		return "queued", done
+	case err := <-done:
+		var capErr *capacityError
+		switch {
+		case err == nil:
+			return "slot", done
+		case errors.As(err, &capErr) && capErr.timedOut:
+			return "queue_timeout", done
+		case errors.As(err, &capErr):
+			return "queue_full", done
+		}
+		t.Fatal(err)
+	}
+	return "", done
+}
+
+func TestGenerationQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		maxQueued   int
+		// requests holding a slot and waiting for one before
+		held, waiting int
+		want          string
+	}{
+		{"no limit", 0, 0, 5, 0, "slot"},
+		{"free slot", 2, 1, 1, 0, "slot"},
+		{"queue with room", 1, 2, 1, 1, "queued"},
+		{"unbounded queue", 1, 0, 1, 3, "queued"},
+		{"full queue", 1, 1, 1, 1, "queue_full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{})
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			// the waiting requests give up before the config is put back
+			t.Cleanup(func() {
+				cancel()
+				wg.Wait()
+			})
+			q := newGenerationQueue(tt.concurrency, tt.maxQueued)
+			for i := 0; i < tt.held; i++ {
+				if _, err := q.acquire(ctx, func() { t.Error("a request waited for a free slot") }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.waiting; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					q.acquire(ctx, func() {})
+				}()
+			}
+			for q.depth() < tt.waiting {
+				time.Sleep(time.Millisecond)
+			}
+			got, done := acquireResult(t, ctx, q)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if got == "queued" {
+				cancel()
+				<-done
+			}
+		})
+	}
+}
+
+func TestGenerationQueueWaits(t *testing.T) {
+	setConfig(t, Config{QueueTimeout: 20 * time.Millisecond})
+	q := newGenerationQueue(1, 0)
+	release, err := q.acquire(context.Background(), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, done := acquireResult(t, context.Background(), q)
+	if got != "queued" {
+		t.Fatalf("got %s, want queued", got)
+	}
+	var capErr *capacityError
+	if err := <-done; !errors.As(err, &capErr) || !capErr.timedOut {
+		t.Errorf("after queue_timeout: %v, want a timed out capacity error", err)
+	}
+
+	config.QueueTimeout = 0
+	_, done = acquireResult(t, context.Background(), q)
+	release()
+	if err := <-done; err != nil {
+		t.Errorf("after the slot was released: %v", err)
+	}
+	if q.depth() != 0 {
+		t.Errorf("depth %d after the queue emptied", q.depth())
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Defaults of POST /v1/chunks
+const (
+	CHUNK_DEFAULT_SIZE = 512
+	CHUNK_MAX_INPUT    = 4 << 20 // bytes of text per request
+)
+
+// ChunkRequest asks for text to be split into chunks of at most ChunkSize
+// tokens, consecutive chunks sharing about Overlap tokens.
+type ChunkRequest struct {
+	// optional, counts each chunk's tokens with the model's tokenizer
+	Model     string `json:"model,omitempty"`
+	Input     string `json:"input"`
+	Strategy  string `json:"strategy,omitempty"` // "tokens" (default) or "sentences"
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	Overlap   int    `json:"overlap,omitempty"`
+}
+
+type ChunkResponse struct {
+	Object string  `json:"object"`
+	Model  string  `json:"model,omitempty"`
+	Data   []Chunk `json:"data"`
+}
+
+type Chunk struct {
+	Object string `json:"object"`
+	Index  int    `json:"index"`
+	Text   string `json:"text"`
+	// byte offsets of Text in the input
+	Start  int `json:"start"`
+	End    int `json:"end"`
+	Tokens int `json:"tokens"`
+}
+
+// handleChunks serves POST /v1/chunks, a helper for RAG ingestion that
+// chunks text the way the proxy counts tokens.
+func handleChunks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ChunkRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if req.Input == "" || len(req.Input) > CHUNK_MAX_INPUT {
+		sendParamError(w, r, "Input must be non-empty text of at most %d bytes", "invalid_input", "input", http.StatusBadRequest, CHUNK_MAX_INPUT)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = "tokens"
+	}
+	if req.Strategy != "tokens" && req.Strategy != "sentences" {
+		sendParamError(w, r, "Unsupported strategy `%s`", "invalid_strategy", "strategy", http.StatusBadRequest, req.Strategy)
+		return
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = CHUNK_DEFAULT_SIZE
+	}
+	if req.ChunkSize < 0 {
+		sendParamError(w, r, "chunk_size must be positive", "invalid_chunk_size", "chunk_size", http.StatusBadRequest)
+		return
+	}
+	if req.Overlap < 0 || req.Overlap >= req.ChunkSize {
+		sendParamError(w, r, "overlap must be at least 0 and less than chunk_size", "invalid_overlap", "overlap", http.StatusBadRequest)
+		return
+	}
+
+	model := ""
+	if req.Model != "" {
+		var ok bool
+		if model, ok = resolveModelAlias(r.Context(), req.Model); !ok {
+			sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, req.Model)
+			return
+		}
+		if !modelPermitted(apiKeyFromRequest(r), req.Model, model) {
+			sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, req.Model)
+			return
+		}
+	}
+
+	chunks := chunkText(req.Input, req.Strategy, req.ChunkSize, req.Overlap)
+	if model != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout(r))
+		defer cancel()
+		if err := countChunkTokens(ctx, model, chunks); err != nil {
+			sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+			return
+		}
+	}
+	writeJSON(w, ChunkResponse{Object: "list", Model: req.Model, Data: chunks})
+}
+
+// textSpan is a byte range of the input.
+type textSpan struct{ start, end int }
+
+// chunkText packs words, or whole sentences, into chunks of at most size
+// tokens as translate.EstimateTokens counts them. A sentence too long for a
+// chunk is split into words, a single word too long for one makes a chunk of
+// its own.
+func chunkText(text, strategy string, size, overlap int) []Chunk {
+	var units []textSpan
+	if strategy == "sentences" {
+		for _, sentence := range splitSentences(text) {
+			if translate.EstimateTokens(text[sentence.start:sentence.end]) > size {
+				units = append(units, splitWords(text, sentence)...)
+				continue
+			}
+			units = append(units, sentence)
+		}
+	} else {
+		units = splitWords(text, textSpan{0, len(text)})
+	}
+
+	tokens := func(first, last int) int {
+		return translate.EstimateTokens(text[units[first].start:units[last].end])
+	}
+	chunks := []Chunk{}
+	for first := 0; first < len(units); {
+		last := first
+		for last+1 < len(units) && tokens(first, last+1) <= size {
+			last++
+		}
+		span := textSpan{units[first].start, units[last].end}
+		chunks = append(chunks, Chunk{
+			Object: "chunk",
+			Index:  len(chunks),
+			Text:   text[span.start:span.end],
+			Start:  span.start,
+			End:    span.end,
+			Tokens: tokens(first, last),
+		})
+		if last == len(units)-1 {
+			break
+		}
+
+		// start the next chunk with the trailing units that fit the overlap,
+		// but always move forward
+		next := last + 1
+		for overlap > 0 && next-1 > first && tokens(next-1, last) <= overlap {
+			next--
+		}
+		first = next
+	}
+	return chunks
+}
+
+// splitWords returns the whitespace-separated words of text within span.
+func splitWords(text string, span textSpan) []textSpan {
+	var words []textSpan
+	start := -1
+	for i, r := range text[span.start:span.end] {
+		i += span.start
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				words = append(words, textSpan{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, textSpan{start, span.end})
+	}
+	return words
+}
+
+// splitSentences splits text after ., ! or ? followed by whitespace, and at
+// blank lines. Surrounding whitespace is not part of a sentence.
+func splitSentences(text string) []textSpan {
+	var sentences []textSpan
+	add := func(start, end int) {
+		segment := text[start:end]
+		trimmed := strings.TrimLeftFunc(segment, unicode.IsSpace)
+		start += len(segment) - len(trimmed)
+		trimmed = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		if trimmed != "" {
+			sentences = append(sentences, textSpan{start, start + len(trimmed)})
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(text); {
+		r, width := utf8.DecodeRuneInString(text[i:])
+		i += width
+		switch {
+		case r == '.' || r == '!' || r == '?':
+			if next, _ := utf8.DecodeRuneInString(text[i:]); i == len(text) || unicode.IsSpace(next) {
+				add(start, i)
+				start = i
+			}
+		case r == '\n' && strings.HasPrefix(strings.TrimLeft(text[i:], " \t"), "\n"):
+			add(start, i)
+			start = i
+		}
+	}
+	add(start, len(text))
+	return sentences
+}
+
+// countChunkTokens replaces the estimated token counts of chunks with the
+// model's own, which Ollama reports when embedding. Ollama has no tokenize
+// endpoint, so this runs an embedding per chunk, EMBEDDING_CONCURRENCY at a
+// time.
+func countChunkTokens(ctx context.Context, model string, chunks []Chunk) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, EMBEDDING_CONCURRENCY)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := range chunks {
+		wg.Add(1)
+		go func(chunk *Chunk) {
+			defer wg.Done()
+			var err error
+			defer func() {
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}()
+			defer recoverAsError(&err)
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+			chunk.Tokens, err = countTokens(ctx, model, chunk.Text)
+		}(&chunks[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func countTokens(ctx context.Context, model string, text string) (int, error) {
+	var body bytes.Buffer
+	if err := writeJSON(&body, OllamaEmbedRequest{Model: model, Input: text}); err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	b := ollamaBackends.pick("")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/api/embed", &body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	tagUpstreamRequest(ctx, req, model)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return 0, &upstreamError{upstream: "ollama", model: model, status: resp.StatusCode, body: string(data)}
+	}
+
+	var embedResp OllamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		return 0, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return embedResp.PromptEvalCount, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Tokens of the common chat templates, removed whatever the model says its
+// own stop tokens are
+var COMMON_TEMPLATE_TOKENS = []string{
+	"<|im_end|>", "<|im_start|>", "</s>", "<|eot_id|>", "<|end|>",
+	"<|endoftext|>", "<end_of_turn>", "<start_of_turn>",
+}
+
+// the flattened prompt ends every turn with "role: ", models like to echo it
+var trailingRoleLabel = regexp.MustCompile(`(?i)\s*\b(assistant|user|system)\s*:\s*$`)
+
+// outputCleaner removes template artifacts from generated text as it comes
+// in. Text that could still turn into a template token or a trailing role
+// label is held back until it can't, or until flush.
+type outputCleaner struct {
+	tokens  []string
+	pending string
+}
+
+func newOutputCleaner(ctx context.Context, req OllamaRequest) *outputCleaner {
+	if !config.StopTokenCleanup {
+		return &outputCleaner{}
+	}
+
+	tokens := COMMON_TEMPLATE_TOKENS
+	if providerFor(req).Type == PROVIDER_OLLAMA {
+		if info, err := showModel(ctx, req.Model); err == nil {
+			tokens = append(info.stopTokens(), tokens...)
+		}
+	}
+	return &outputCleaner{tokens: slices.DeleteFunc(slices.Clone(tokens), func(t string) bool { return t == "" })}
+}
+
+func (c *outputCleaner) write(text string) string {
+	if !config.StopTokenCleanup {
+		return text
+	}
+	c.pending += text
+	for _, token := range c.tokens {
+		c.pending = strings.ReplaceAll(c.pending, token, "")
+	}
+
+	keep := len(c.pending)
+	for _, token := range c.tokens {
+		for k := min(len(token)-1, len(c.pending)); k > 0; k-- {
+			if strings.HasSuffix(c.pending, token[:k]) {
+				keep = min(keep, len(c.pending)-k)
+				break
+			}
+		}
+	}
+	wordStart := strings.LastIndexFunc(c.pending, unicode.IsSpace) + 1
+	if word := strings.ToLower(c.pending[wordStart:]); word != "" && isRoleLabelPrefix(word) {
+		keep = min(keep, wordStart)
+	}
+	for keep > 0 && unicode.IsSpace(rune(c.pending[keep-1])) {
+		keep--
+	}
+
+	ready := c.pending[:keep]
+	c.pending = c.pending[keep:]
+	return ready
+}
+
+func (c *outputCleaner) flush() string {
+	text := trailingRoleLabel.ReplaceAllString(c.pending, "")
+	c.pending = ""
+	return text
+}
+
+func isRoleLabelPrefix(word string) bool {
+	for _, label := range []string{"assistant:", "user:", "system:"} {
+		if strings.HasPrefix(label, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupOutput removes template artifacts from a finished answer.
+func cleanupOutput(ctx context.Context, req OllamaRequest, text string) string {
+	c := newOutputCleaner(ctx, req)
+	return c.write(text) + c.flush()
+}
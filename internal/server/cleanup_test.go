@@ -0,0 +1,36 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputCleaner(t *testing.T) {
+	tests := []struct {
+		name    string
+		cleanup bool
+		chunks  []string
+		want    string
+	}{
+		{"plain text", true, []string{"Hello ", "world"}, "Hello world"},
+		{"template token", true, []string{"Hello world<|im_end|>"}, "Hello world"},
+		{"token across chunks", true, []string{"Hello world<|im", "_end|>"}, "Hello world"},
+		{"trailing role label", true, []string{"Hello world\n\nuser", ":"}, "Hello world"},
+		{"role label inside", true, []string{"the user: said"}, "the user: said"},
+		{"cleanup off", false, []string{"Hello world<|im_end|>"}, "Hello world<|im_end|>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{StopTokenCleanup: tt.cleanup})
+			c := &outputCleaner{tokens: COMMON_TEMPLATE_TOKENS}
+			var got strings.Builder
+			for _, chunk := range tt.chunks {
+				got.WriteString(c.write(chunk))
+			}
+			got.WriteString(c.flush())
+			if got.String() != tt.want {
+				t.Errorf("cleaned %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
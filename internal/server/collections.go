@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Collection is a collection as the API shows it.
+type Collection struct {
+	ID             string `json:"id"`
+	Object         string `json:"object"`
+	EmbeddingModel string `json:"embedding_model"`
+	Created        int64  `json:"created"`
+	Records        int    `json:"records"`
+}
+
+type CollectionList struct {
+	Object string       `json:"object"`
+	Data   []Collection `json:"data"`
+}
+
+type CreateCollectionRequest struct {
+	Name           string `json:"name"`
+	EmbeddingModel string `json:"embedding_model,omitempty"`
+}
+
+type DeletedCollection struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// CollectionDocument is a document to add to a collection, embedded as a
+// whole or in chunks.
+type CollectionDocument struct {
+	ID       string            `json:"id,omitempty"`
+	Text     string            `json:"text"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type AddDocumentsRequest struct {
+	Documents []CollectionDocument `json:"documents"`
+	// chunk documents as /v1/chunks does, 0 embeds them whole
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	Overlap   int    `json:"overlap,omitempty"`
+	Strategy  string `json:"strategy,omitempty"`
+}
+
+type AddDocumentsResponse struct {
+	Object string         `json:"object"`
+	IDs    []string       `json:"ids"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+func (c *collection) api() Collection {
+	return Collection{ID: c.Name, Object: "collection", EmbeddingModel: c.EmbeddingModel, Created: c.Created, Records: c.size()}
+}
+
+// handleCollections manages the collections of the caller's namespace:
+//
+//	GET    /v1/collections                       list them
+//	POST   /v1/collections                       create one
+//	GET    /v1/collections/{name}                show one
+//	DELETE /v1/collections/{name}                delete one
+//	POST   /v1/collections/{name}/documents      embed and add documents
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if vectorIndex == nil {
+		sendError(w, r, "No vector store is configured", "invalid_request_error", "vector_store_disabled", http.StatusNotFound)
+		return
+	}
+	namespace := ragNamespace(r)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/collections"), "/")
+	name, sub, _ := strings.Cut(path, "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		list := CollectionList{Object: "list", Data: []Collection{}}
+		for _, c := range vectorIndex.list(namespace) {
+			list.Data = append(list.Data, c.api())
+		}
+		writeJSON(w, list)
+	case name == "" && r.Method == http.MethodPost:
+		handleCreateCollection(w, r, namespace)
+	case name != "" && sub == "" && r.Method == http.MethodGet:
+		c := vectorIndex.get(namespace, name)
+		if c == nil {
+			sendError(w, r, "Collection `%s` does not exist", "invalid_request_error", "collection_not_found", http.StatusNotFound, name)
+			return
+		}
+		writeJSON(w, c.api())
+	case name != "" && sub == "" && r.Method == http.MethodDelete:
+		err := vectorIndex.delete(namespace, name)
+		if errors.Is(err, errCollectionNotFound) {
+			sendError(w, r, "Collection `%s` does not exist", "invalid_request_error", "collection_not_found", http.StatusNotFound, name)
+			return
+		}
+		if err != nil {
+			sendError(w, r, "Error updating the vector store: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, DeletedCollection{ID: name, Object: "collection.deleted", Deleted: true})
+	case name != "" && sub == "documents" && r.Method == http.MethodPost:
+		c := vectorIndex.get(namespace, name)
+		if c == nil {
+			sendError(w, r, "Collection `%s` does not exist", "invalid_request_error", "collection_not_found", http.StatusNotFound, name)
+			return
+		}
+		handleAddDocuments(w, r, c)
+	case name != "" && sub != "" && sub != "documents":
+		sendError(w, r, "Not found", "invalid_request_error", "not_found", http.StatusNotFound)
+	default:
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCreateCollection(w http.ResponseWriter, r *http.Request, namespace string) {
+	var req CreateCollectionRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if !collectionNamePattern.MatchString(req.Name) {
+		sendParamError(w, r, "Collection names are 1 to 64 letters, digits, - or _", "invalid_collection_name", "name", http.StatusBadRequest)
+		return
+	}
+	if req.EmbeddingModel == "" {
+		req.EmbeddingModel = config.VectorStore.EmbeddingModel
+	}
+	if req.EmbeddingModel == "" {
+		sendParamError(w, r, "embedding_model is required", "invalid_model", "embedding_model", http.StatusBadRequest)
+		return
+	}
+	model, ok := resolveModelAlias(r.Context(), req.EmbeddingModel)
+	if !ok {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, req.EmbeddingModel)
+		return
+	}
+	if !modelPermitted(apiKeyFromRequest(r), req.EmbeddingModel, model) {
+		sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, req.EmbeddingModel)
+		return
+	}
+
+	c, err := vectorIndex.create(namespace, req.Name, model)
+	if errors.Is(err, errCollectionExists) {
+		sendParamError(w, r, "Collection `%s` already exists", "collection_exists", "name", http.StatusConflict, req.Name)
+		return
+	}
+	if err != nil {
+		sendError(w, r, "Error updating the vector store: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, c.api())
+}
+
+func handleAddDocuments(w http.ResponseWriter, r *http.Request, c *collection) {
+	var req AddDocumentsRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Documents) == 0 {
+		sendParamError(w, r, "Documents are required", "invalid_documents", "documents", http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = "tokens"
+	}
+	if req.ChunkSize < 0 || req.Overlap < 0 || (req.ChunkSize > 0 && req.Overlap >= req.ChunkSize) {
+		sendParamError(w, r, "overlap must be at least 0 and less than chunk_size", "invalid_overlap", "overlap", http.StatusBadRequest)
+		return
+	}
+
+	var records []VectorRecord
+	var texts []string
+	for i, doc := range req.Documents {
+		if strings.TrimSpace(doc.Text) == "" {
+			sendParamError(w, r, "documents[%d] has no text", "invalid_documents", "documents", http.StatusBadRequest, i)
+			return
+		}
+		if doc.ID == "" {
+			doc.ID = "doc_" + generateRandomString(16)
+		}
+		if req.ChunkSize == 0 {
+			records = append(records, VectorRecord{ID: doc.ID, Text: doc.Text, Metadata: doc.Metadata})
+			texts = append(texts, doc.Text)
+			continue
+		}
+		for _, chunk := range chunkText(doc.Text, req.Strategy, req.ChunkSize, req.Overlap) {
+			records = append(records, VectorRecord{ID: fmt.Sprintf("%s#%d", doc.ID, chunk.Index), Text: chunk.Text, Metadata: doc.Metadata})
+			texts = append(texts, chunk.Text)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout(r))
+	defer cancel()
+	vectors, tokens, err := embedAll(ctx, c.EmbeddingModel, texts)
+	if err != nil {
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	resp := AddDocumentsResponse{Object: "list", IDs: make([]string, len(records))}
+	for i := range records {
+		records[i].Embedding = vectors[i]
+		resp.IDs[i] = records[i].ID
+		resp.Usage.PromptTokens += embeddingTokens(tokens[i], texts[i])
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	if err := c.append(records); err != nil {
+		sendError(w, r, "Error updating the vector store: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+
+	tenantFromContext(r.Context()).recordUsage(r.Context(), apiKeyFromRequest(r), c.EmbeddingModel, Usage{PromptTokens: resp.Usage.PromptTokens, TotalTokens: resp.Usage.TotalTokens}, "", "")
+	writeJSON(w, resp)
+}
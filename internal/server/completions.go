@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"ollama-openai-proxy/translate"
+)
+
+// CompletionRequest is a legacy /v1/completions request.
+type CompletionRequest struct {
+	Model string `json:"model"`
+	// a string or an array of strings, one choice each
+	Prompt any    `json:"prompt"`
+	Suffix string `json:"suffix,omitempty"`
+	// 0 leaves it to the model, unlike OpenAI's default of 16
+	MaxTokens int  `json:"max_tokens,omitempty"`
+	Stream    bool `json:"stream,omitempty"`
+	// returns the prompt in front of the completion
+	Echo bool `json:"echo,omitempty"`
+
+	Temperature      *float64      `json:"temperature,omitempty"`
+	TopP             *float64      `json:"top_p,omitempty"`
+	Seed             *int          `json:"seed,omitempty"`
+	Stop             StopSequences `json:"stop,omitempty"`
+	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
+	User             string        `json:"user,omitempty"`
+
+	// vendor extensions, see ProxyExtensions; the fields below are their
+	// older top-level forms
+	Proxy  *ProxyExtensions `json:"x_proxy,omitempty"`
+	Ollama *OllamaExtension `json:"ollama,omitempty"`
+	// raw Ollama options such as num_ctx, see requestOllamaOptions
+	OllamaOptions map[string]any `json:"ollama_options,omitempty"`
+	Options       map[string]any `json:"options,omitempty"`
+}
+
+// CompletionResponse is a `text_completion`, also the shape of each event
+// of a stream.
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text  string `json:"text"`
+	Index int    `json:"index"`
+	// always null, Ollama has no log probabilities
+	Logprobs             any                            `json:"logprobs"`
+	FinishReason         *string                        `json:"finish_reason"`
+	ContentFilterResults map[string]ContentFilterResult `json:"content_filter_results,omitempty"`
+}
+
+// handleCompletions serves the legacy text completions API on Ollama's
+// /api/generate. The prompt is sent raw, without the model's template,
+// unless there is a suffix, which only the template knows how to place.
+// Rewrite rules, presets, schedule rules, parameter limits, the stream and
+// model slots and the output filter apply as they do to chat completions.
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body map[string]any
+	if err := decodeJSONBody(r.Body, &body); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if err := applyRewriteRules(body, r); err != nil {
+		sendError(w, r, "Error applying rewrite rules: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+	if err := validateExtensions(body, "/v1/completions"); err != nil {
+		sendParamError(w, r, err.format, err.code, err.param, err.status, err.args...)
+		return
+	}
+	var req CompletionRequest
+	if err := decodeRequest(body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Model == "" {
+		sendError(w, r, "Model is required", "invalid_request_error", "invalid_model", http.StatusBadRequest)
+		return
+	}
+	prompts, ok := embeddingInputs(req.Prompt)
+	if !ok {
+		sendParamError(w, r, "Prompt must be a non-empty string or array of strings", "invalid_prompt", "prompt", http.StatusBadRequest)
+		return
+	}
+	if req.Stream && len(prompts) > 1 {
+		sendParamError(w, r, "Only a single prompt can be streamed", "invalid_prompt", "prompt", http.StatusBadRequest)
+		return
+	}
+	keepAlive, apiErr := requestKeepAlive(r, req.Proxy, req.Ollama)
+	if apiErr != nil {
+		sendParamError(w, r, apiErr.format, apiErr.code, apiErr.param, apiErr.status, apiErr.args...)
+		return
+	}
+	options, apiErr := requestOllamaOptions(req.Proxy, req.OllamaOptions, req.Options)
+	if apiErr != nil {
+		sendParamError(w, r, apiErr.format, apiErr.code, apiErr.param, apiErr.status, apiErr.args...)
+		return
+	}
+	var filterErr *contentFilterError
+	if errors.As(filterPrompt(r.Context(), prompts...), &filterErr) {
+		sendContentFilterError(w, r, filterErr)
+		return
+	}
+
+	model, ok := resolveModelAlias(r.Context(), req.Model)
+	if !ok {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, req.Model)
+		return
+	}
+	apiKey := apiKeyFromRequest(r)
+	sampling := completionSampling(req, model)
+	// passed on as they are, see translate.Request
+	sampling.KeepAlive, sampling.OllamaOptions = keepAlive, options
+	applyPresets(&sampling, apiKey)
+	rule := applyScheduleRules(&sampling, time.Now())
+	if !modelPermitted(apiKey, req.Model, sampling.Model) {
+		sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, req.Model)
+		return
+	}
+	if apiErr := rule.allow(apiKey); apiErr != nil {
+		sendError(w, r, apiErr.format, apiErr.errorType, apiErr.code, apiErr.status, apiErr.args...)
+		return
+	}
+	if apiErr := enforceParameterLimits(&sampling); apiErr != nil {
+		sendParamError(w, r, apiErr.format, apiErr.code, apiErr.param, apiErr.status, apiErr.args...)
+		return
+	}
+	provider, model := splitProviderModel(sampling.Model)
+	if providerFor(OllamaRequest{Provider: provider}).Type != PROVIDER_OLLAMA {
+		sendError(w, r, "The model `%s` doesn't support text completions", "invalid_request_error", "model_not_supported", http.StatusBadRequest, req.Model)
+		return
+	}
+	modelPrefetcher.observe(apiKeyFromRequest(r), model)
+
+	requestID := "cmpl-" + generateRandomString(10)
+	tenantName := tenantFromContext(r.Context()).name
+	events.publish(Event{Type: EVENT_ACCEPTED, RequestID: requestID, Tenant: tenantName, Model: model})
+
+	ctx, untrack := runningRequests.track(withRequestID(r.Context(), requestID), requestID, apiKeyFromRequest(r), model)
+	defer untrack()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(r))
+	defer cancel()
+
+	if req.Stream {
+		releaseStream, err := openStreams.acquire(apiKey)
+		if err != nil {
+			sendCompletionError(w, r, ctx, err)
+			return
+		}
+		defer releaseStream()
+	}
+	queued := func() {
+		events.publish(Event{Type: EVENT_QUEUED, RequestID: requestID, Tenant: tenantName, Model: model})
+	}
+	releaseModel, err := modelSlots[model].acquire(ctx, queued)
+	if err != nil {
+		sendCompletionError(w, r, ctx, err)
+		return
+	}
+	defer releaseModel()
+	release, err := generationSlots.acquire(ctx, queued)
+	if err != nil {
+		sendCompletionError(w, r, ctx, err)
+		return
+	}
+	defer release()
+
+	created := getCurrentUnixTimestamp()
+	var stream *streamWriter
+	sendChunk := func(text string, finishReason *string, filterResults map[string]ContentFilterResult) error {
+		if stream == nil {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			stream = newStreamWriter(w)
+		}
+		return writeSSEData(stream, CompletionResponse{
+			ID:      requestID,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []CompletionChoice{{Text: text, FinishReason: finishReason, ContentFilterResults: filterResults}},
+		})
+	}
+
+	resp := CompletionResponse{ID: requestID, Object: "text_completion", Created: created, Model: req.Model, Usage: &Usage{}}
+	for i, prompt := range prompts {
+		ollamaReq := translate.Request(sampling, translate.Config{KeepAlive: modelKeepAlive(model)})
+		ollamaReq.Model, ollamaReq.Provider = model, provider
+		ollamaReq.Prompt, ollamaReq.Suffix, ollamaReq.Raw = prompt, req.Suffix, req.Suffix == ""
+
+		if req.Stream && req.Echo {
+			if err := sendChunk(prompt, nil, nil); err != nil {
+				break
+			}
+		}
+		first := true
+		dog := newWatchdog()
+		filter := newOutputFilter(ctx)
+		if req.Stream {
+			filter = newStreamFilter(ctx)
+		}
+		ollamaResp, err := sendUpstream(ctx, ollamaReq, func(text string) error {
+			if first {
+				first = false
+				events.publish(Event{Type: EVENT_FIRST_TOKEN, RequestID: requestID, Tenant: tenantName, Model: model})
+			}
+			if err := dog.write(text); err != nil {
+				return err
+			}
+			if req.Stream {
+				if text := filter.write(text); text != "" {
+					if err := sendChunk(text, nil, nil); err != nil {
+						return err
+					}
+				}
+				if err := filter.failed(); err != nil {
+					return err
+				}
+				if filter.blocked {
+					return errContentFiltered
+				}
+			}
+			return nil
+		})
+		lengthCapped := errors.Is(err, errWatchdogTripped)
+		if lengthCapped || errors.Is(err, errContentFiltered) {
+			err = nil
+		}
+		var text string
+		if err == nil && req.Stream {
+			text = filter.flush()
+			err = filter.failed()
+		}
+		if err != nil {
+			events.publish(Event{Type: EVENT_ERROR, RequestID: requestID, Tenant: tenantName, Model: model, Error: err.Error()})
+			if stream != nil {
+				// OpenAI reports errors mid-stream as an error event
+				var resp ErrorResponse
+				resp.Error.Message = localizeError(r, "Error calling Ollama API: %s", err)
+				resp.Error.Type = "server_error"
+				resp.Error.Code = "internal_error"
+				apiErr := upstreamAPIError(err)
+				if apiErr == nil {
+					// the proxy's own, such as a failed output classifier
+					errors.As(err, &apiErr)
+				}
+				if apiErr != nil {
+					resp.Error.Message = localizeError(r, apiErr.format, apiErr.args...)
+					resp.Error.Type = apiErr.errorType
+					resp.Error.Code = apiErr.code
+				}
+				writeSSEData(stream, resp)
+				stream.close()
+				return
+			}
+			sendCompletionError(w, r, ctx, err)
+			return
+		}
+
+		if !req.Stream {
+			text, err = filter.classify(ctx, filter.write(ollamaResp.Response)+filter.flush())
+			if err != nil {
+				sendError(w, r, "Error calling output classifier: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+				return
+			}
+		}
+		finishReason := translate.FinishReason(ollamaResp)
+		if lengthCapped {
+			finishReason = "length"
+		}
+		if filter.blocked {
+			finishReason = "content_filter"
+		}
+		usage := translate.Usage(ollamaReq, ollamaResp)
+		tenantFromContext(r.Context()).recordUsage(r.Context(), apiKey, req.Model, usage, prompt, ollamaResp.Response)
+		resp.Usage.PromptTokens += usage.PromptTokens
+		resp.Usage.CompletionTokens += usage.CompletionTokens
+		resp.Usage.TotalTokens += usage.TotalTokens
+
+		if req.Stream {
+			if text != "" {
+				sendChunk(text, nil, nil)
+			}
+			sendChunk("", &finishReason, filter.results())
+			continue
+		}
+		if req.Echo {
+			text = prompt + text
+		}
+		resp.Choices = append(resp.Choices, CompletionChoice{Text: text, Index: i, FinishReason: &finishReason, ContentFilterResults: filter.results()})
+	}
+	events.publish(Event{Type: EVENT_DONE, RequestID: requestID, Tenant: tenantName, Model: model, Usage: resp.Usage})
+
+	if req.Stream {
+		if stream != nil {
+			stream.Write([]byte("data: [DONE]\n\n"))
+			stream.close()
+		}
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// completionSampling holds the sampling parameters of req in a chat
+// request for model, so presets, schedule rules and parameter limits can
+// work on them as they do on chat completions. A preset's system prompt has
+// no place in a raw prompt and is dropped with the messages.
+func completionSampling(req CompletionRequest, model string) OpenAIChatRequest {
+	return OpenAIChatRequest{
+		Model:            model,
+		MaxTokens:        req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Seed:             req.Seed,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+	}
+}
+
+// writeSSEData writes v as one server-sent event.
+func writeSSEData(w *streamWriter, v any) error {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	if err := writeJSON(&buf, v); err != nil {
+		return err
+	}
+	// writeJSON ends with a newline, an event needs a blank line after it
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sendCompletionError answers a failed completion before anything was sent.
+func sendCompletionError(w http.ResponseWriter, r *http.Request, ctx context.Context, err error) {
+	var circuitErr *circuitOpenError
+	var capErr *capacityError
+	var limitErr *apiError
+	apiErr := upstreamAPIError(err)
+	switch {
+	case errors.Is(context.Cause(ctx), errCanceledByAdmin):
+		sendError(w, r, "Request canceled by an administrator", "server_error", "request_canceled", http.StatusServiceUnavailable)
+	case errors.As(err, &capErr):
+		sendCapacityError(w, r, capErr)
+	case errors.As(err, &circuitErr):
+		sendCircuitOpenError(w, r, circuitErr)
+	case apiErr == nil && errors.As(err, &limitErr):
+		// a limit of the proxy's own, such as too_many_streams
+		sendError(w, r, limitErr.format, limitErr.errorType, limitErr.code, limitErr.status, limitErr.args...)
+	case apiErr != nil:
+		sendUpstreamAPIError(w, r, apiErr, "prompt")
+	case errors.Is(err, context.DeadlineExceeded):
+		sendError(w, r, "Request deadline exceeded before generation finished", "timeout_error", "deadline_exceeded", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+	default:
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,1268 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings that differ between deployments. They are read
+// from a YAML file, then environment variables, then command line flags,
+// each overriding the one before; everything else is configured in code.
+type Config struct {
+	OllamaAPIBase string `yaml:"ollama_api_base"`
+	ListenAddr    string `yaml:"listen_addr"`
+	// addresses served for a tenant each instead of ListenAddr, see Listener
+	Listeners []Listener `yaml:"listeners"`
+	// tenant of the requests on listeners without one by organization, or
+	// organization/project, see tenantMiddleware
+	OrganizationTenants map[string]string `yaml:"organization_tenants"`
+	// Bearer token required on /admin/ endpoints, empty disables them
+	AdminAPIKey string `yaml:"admin_api_key"`
+	// Separate address serving Prometheus metrics, empty disables them
+	MetricsAddr string `yaml:"metrics_addr"`
+	// PEM certificate chain and private key the listeners serve HTTPS
+	// with, or secret references to them; empty serves plain HTTP
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// Upper bound for a single request, clients can only ask for less
+	RequestTimeout     time.Duration `yaml:"request_timeout"`
+	ReadHeaderTimeout  time.Duration `yaml:"read_header_timeout"`
+	ClientWriteTimeout time.Duration `yaml:"client_write_timeout"`
+	MaxGenerationTime  time.Duration `yaml:"max_generation_time"`
+	// longest a request waits for a generation slot, 0 for as long as it
+	// may run
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// open `stream: true` requests per API key, 0 for no limit
+	MaxStreamsPerKey int `yaml:"max_streams_per_key"`
+	// generations running at once across all models, 0 for no limit
+	MaxConcurrentGenerations int `yaml:"max_concurrent_generations"`
+	// requests that may wait for a generation slot once all are busy, 0
+	// for no limit. Past this they are turned away with a 503 that says
+	// how long the wait would have been.
+	MaxQueuedGenerations int `yaml:"max_queued_generations"`
+	// generate the n choices of a request at once, not one after another
+	ParallelChoices bool `yaml:"parallel_choices"`
+	// flatten messages into a "role: content" prompt for /api/generate
+	// instead of sending them to /api/chat, which applies the model's chat
+	// template
+	LegacyGenerateAPI bool `yaml:"legacy_generate_api"`
+	// L2-normalize embeddings, requests can override it with `normalize`
+	NormalizeEmbeddings bool `yaml:"normalize_embeddings"`
+	// directory of the results of embedding jobs, empty disables
+	// /v1/embeddings/jobs
+	EmbeddingJobsDir string `yaml:"embedding_jobs_dir"`
+	// merge consecutive same-role messages for alternating_role_models
+	// instead of rejecting the request
+	RepairRoleAlternation bool `yaml:"repair_role_alternation"`
+	// language of error messages when the client's Accept-Language names
+	// none the proxy has
+	ErrorLanguage string `yaml:"error_language"`
+	// ignore or reject unknown top-level request fields
+	UnknownFields string `yaml:"unknown_fields"`
+	// strip template tokens that leak into output when a model's template
+	// doesn't match how it was prompted, see outputCleaner
+	StopTokenCleanup bool `yaml:"stop_token_cleanup"`
+	// glob patterns of models pulled when Ollama doesn't have them, see
+	// pullModel; empty never pulls
+	AutoPull []string `yaml:"auto_pull"`
+	// Ollama's keep_alive by model name or glob, see modelKeepAlive; requests
+	// can ask for their own
+	KeepAlive map[string]string `yaml:"keep_alive"`
+	// upstreams by the prefix of `provider/model` names, see Provider;
+	// `ollama/` is always known and none other by default
+	Providers map[string]Provider `yaml:"providers"`
+	// Ollama backends in order of preference, see BackendTier; empty is a
+	// single tier with ollama_api_base
+	BackendTiers []BackendTier `yaml:"backend_tiers"`
+
+	// middlewares per route, see RoutePolicy
+	Routes map[string]RoutePolicy `yaml:"routes"`
+	// sampling parameter changes for a share of the traffic, see Experiment
+	Experiments []Experiment `yaml:"experiments"`
+	// reroutes and limits by time of day, see ScheduleRule
+	ScheduleRules []ScheduleRule `yaml:"schedule_rules"`
+
+	// glob patterns of the models served, empty serves every model that
+	// isn't denied
+	ModelAllowlist []string `yaml:"model_allowlist"`
+	// glob patterns of models never served, whoever asks
+	ModelDenylist []string `yaml:"model_denylist"`
+	// defaults by API key name or model name, see Preset
+	Presets map[string]Preset `yaml:"presets"`
+	// request rewrites evaluated in order, see RewriteRule
+	RewriteRules []RewriteRule `yaml:"rewrite_rules"`
+	// variants by requested model name, see SizeRoute
+	SizeRoutes map[string][]SizeRoute `yaml:"size_routes"`
+	// sampling parameter ranges by model glob, see ParameterLimit
+	ParameterLimits []ParameterLimit `yaml:"parameter_limits"`
+	// generation slots by Ollama model name, see ModelConcurrency
+	ModelConcurrency map[string]ModelConcurrency `yaml:"model_concurrency"`
+	// most generated tokens passed on per second, by API key name
+	StreamTokensPerSecond map[string]float64 `yaml:"stream_tokens_per_second"`
+	// language code of every answer by requested model name, see
+	// enforceLanguage
+	ResponseLanguages map[string]string `yaml:"response_languages"`
+	// x_metadata of every chat completion by requested model name, so
+	// downstream systems can trace which variant, policy or region answered
+	ResponseMetadata map[string]map[string]string `yaml:"response_metadata"`
+	// regular expressions ending a generation by model name, see stopMonitor
+	StopRegexes map[string][]string `yaml:"stop_regexes"`
+	// globs of models whose templates need alternating user/assistant turns
+	AlternatingRoleModels []string `yaml:"alternating_role_models"`
+	// system message arrangement by model glob, see SystemMessageRule
+	SystemMessageRules []SystemMessageRule `yaml:"system_message_rules"`
+	// requested model names going away, see Deprecation
+	DeprecatedModels map[string]Deprecation `yaml:"deprecated_models"`
+	OutputFilter     OutputFilter           `yaml:"output_filter"`
+
+	// Client keys, see APIKey. keys_file adds more from a file of their own.
+	APIKeys  []APIKey `yaml:"api_keys"`
+	KeysFile string   `yaml:"keys_file"`
+	// secret usage records identify API keys with, see usageKeyHash; may be
+	// a secret reference
+	UsageKeySecret string `yaml:"usage_key_secret"`
+
+	CORS         CORSConfig        `yaml:"cors"`
+	Log          LogConfig         `yaml:"log"`
+	VectorStore  VectorStoreConfig `yaml:"vector_store"`
+	ModelAliases ModelAliasConfig  `yaml:"model_aliases"`
+	Audio        AudioConfig       `yaml:"audio"`
+	Signing      SigningConfig     `yaml:"signing"`
+	Upstream     UpstreamConfig    `yaml:"upstream"`
+
+	ResponseCache ResponseCacheConfig `yaml:"response_cache"`
+	Retention     RetentionConfig     `yaml:"retention"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	Storage       StorageConfig       `yaml:"storage"`
+	Encryption    EncryptionConfig    `yaml:"encryption"`
+	Tracing       TracingConfig       `yaml:"tracing"`
+	Secrets       SecretsConfig       `yaml:"secrets"`
+	Eval          EvalConfig          `yaml:"eval"`
+
+	// how many of APIKeys are from KeysFile, at the end
+	keysFromFile int
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string      `yaml:"allowed_origins"`
+	AllowedHeaders []string      `yaml:"allowed_headers"`
+	MaxAge         time.Duration `yaml:"max_age"`
+}
+
+// VectorStoreConfig enables RAG collections and /v1/search, see vectorStore.
+type VectorStoreConfig struct {
+	// directory the collections are kept in
+	Path string `yaml:"path"`
+	// for collections created without one
+	EmbeddingModel string `yaml:"embedding_model"`
+}
+
+// ModelAliasConfig rewrites the model names clients ask for, such as the
+// OpenAI names tools hardcode, see resolveModelAlias.
+type ModelAliasConfig struct {
+	// requested name (case-insensitive) to the model it is served by
+	Map map[string]string `yaml:"map"`
+	// for names Map lacks, evaluated in order, the first match wins
+	Patterns []ModelAlias `yaml:"patterns"`
+	// model for names without an alias that Ollama doesn't have
+	Default string `yaml:"default"`
+	// reject names without an alias
+	Strict bool `yaml:"strict"`
+	// how long a conversation keeps the model and backend it started with
+	// after its last turn, see resolveSessionModel; 0 doesn't pin
+	SessionPinTTL time.Duration `yaml:"session_pin_ttl"`
+}
+
+// AudioConfig points the proxy at speech backends.
+type AudioConfig struct {
+	// ws(s):// URL of a streaming whisper backend, enables
+	// /v1/audio/transcriptions/stream
+	TranscriptionURL string `yaml:"transcription_url"`
+	// base URLs of OpenAI-compatible speech-to-text and text-to-speech
+	// APIs (http://host/v1), together they enable /v1/audio/chat
+	STTURL string `yaml:"stt_url"`
+	TTSURL string `yaml:"tts_url"`
+}
+
+// SigningConfig enables signed responses, see signingMiddleware.
+type SigningConfig struct {
+	// PEM private key, Ed25519, ECDSA P-256 or RSA
+	KeyFile string `yaml:"key_file"`
+	// kid of the signatures, a thumbprint of the key when empty
+	KeyID string `yaml:"key_id"`
+}
+
+// ResponseCacheConfig enables the cache of deterministic completions, see
+// completionCacheKey.
+type ResponseCacheConfig struct {
+	// 0 disables the cache
+	TTL time.Duration `yaml:"ttl"`
+	// of the in-memory cache
+	MaxEntries int `yaml:"max_entries"`
+	// keeps entries in Redis instead of memory
+	RedisURL string `yaml:"redis_url"`
+}
+
+// RateLimitConfig budgets API keys without limits of their own and, while
+// no keys are configured, client addresses. 0 means no limit.
+type RateLimitConfig struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute"`
+}
+
+// StorageConfig picks where usage records and state are kept, see Store.
+type StorageConfig struct {
+	// memory, sqlite or postgres; empty for usage files
+	Driver string `yaml:"driver"`
+	// file name for sqlite, connection string for postgres
+	DSN string `yaml:"dsn"`
+}
+
+// EncryptionConfig holds the keys stored prompts and responses are
+// encrypted with, per tenant, see sealContent.
+type EncryptionConfig struct {
+	// base64 AES-256 key per tenant name, "default" for the default tenant
+	Keys map[string]string `yaml:"keys"`
+	// shell command printing the key of the tenant in $TENANT, for tenants
+	// not in Keys
+	KeyCommand string `yaml:"key_command"`
+}
+
+// SecretsConfig tells the proxy where to resolve secret references, see
+// resolveSecret, and how often.
+type SecretsConfig struct {
+	// 0 resolves secrets and reads the keys file only at startup
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	VaultAddr       string        `yaml:"vault_addr"`
+	// may itself be a file: reference, e.g. to a Vault agent's token sink
+	VaultToken string `yaml:"vault_token"`
+	AWSRegion  string `yaml:"aws_region"`
+}
+
+// TracingConfig exports OpenTelemetry spans, see tracingMiddleware.
+type TracingConfig struct {
+	// base URL of an OTLP/HTTP collector, e.g. http://localhost:4318;
+	// empty disables tracing
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+}
+
+// EvalConfig samples requests for quality evaluation, see sampleForEval,
+// and checks alias switches for regressions, see changeAlias.
+type EvalConfig struct {
+	// percentage of generations captured, 0 disables sampling
+	SamplePercent float64 `yaml:"sample_percent"`
+	// model scoring the samples and regression checks, empty leaves
+	// samples unscored
+	JudgeModel string `yaml:"judge_model"`
+	// JSON lines of GoldenPrompt that alias switches are checked against
+	GoldenFile string `yaml:"golden_file"`
+}
+
+// RetentionConfig limits how long usage files keep what they record, see
+// enforceRetention. 0 keeps it forever.
+type RetentionConfig struct {
+	// days prompts and responses are kept in usage records
+	RequestsDays int `yaml:"requests_days"`
+	// days usage records are kept
+	UsageDays int `yaml:"usage_days"`
+}
+
+// UpstreamConfig tunes the HTTP client of upstream calls, see
+// newUpstreamClient.
+type UpstreamConfig struct {
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// longest wait for data, including for a model to load
+	ReadTimeout         time.Duration `yaml:"read_timeout"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	// retries of calls to Ollama that failed to connect or got a 502, 503
+	// or 504, see retryUpstream
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+type LogConfig struct {
+	// stderr when empty
+	File string `yaml:"file"`
+	UTC  bool   `yaml:"utc"`
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// pretty or json
+	Format string `yaml:"format"`
+}
+
+// DefaultConfig is the configuration with every setting at its default.
+func DefaultConfig() Config {
+	return Config{
+		OllamaAPIBase:      "http://localhost:11434",
+		ListenAddr:         ":8080",
+		RequestTimeout:     10 * time.Minute,
+		ReadHeaderTimeout:  10 * time.Second,
+		ClientWriteTimeout: 30 * time.Second,
+		MaxGenerationTime:  5 * time.Minute,
+
+		RepairRoleAlternation: true,
+		ErrorLanguage:         "en",
+		UnknownFields:         UNKNOWN_FIELDS_IGNORE,
+		StopTokenCleanup:      true,
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+			AllowedHeaders: []string{"Content-Type", "Authorization"},
+			MaxAge:         time.Hour,
+		},
+		Upstream: UpstreamConfig{
+			ConnectTimeout:      10 * time.Second,
+			ReadTimeout:         5 * time.Minute,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 16,
+			MaxRetries:          3,
+			RetryBackoff:        500 * time.Millisecond,
+		},
+		ResponseCache: ResponseCacheConfig{
+			MaxEntries: 1000,
+		},
+		Secrets: SecretsConfig{
+			RefreshInterval: 5 * time.Minute,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "ollama-openai-proxy",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: LOG_FORMAT_PRETTY,
+		},
+		OutputFilter: OutputFilter{
+			Action: FILTER_MASK,
+		},
+	}
+}
+
+// config is the configuration the proxy runs with, set once at startup.
+var config = DefaultConfig()
+
+// setting is one configuration value as it can be given in the environment
+// and on the command line.
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+	// given on the command line without a value
+	boolean bool
+}
+
+// Config file keys validate checks that have no environment variable or
+// flag, only the config file sets them
+var fileSettings = []string{
+	"api_keys", "listeners", "providers", "backend_tiers", "routes", "experiments", "schedule_rules", "model_aliases.patterns",
+	"presets", "rewrite_rules", "size_routes", "parameter_limits", "model_concurrency",
+	"stream_tokens_per_second", "response_languages", "response_metadata", "stop_regexes",
+	"alternating_role_models", "system_message_rules", "deprecated_models", "output_filter",
+}
+
+var settings = []setting{
+	{
+		key: "ollama_api_base", env: "OLLAMA_API_BASE", flag: "ollama-api-base",
+		usage: "base URL of the Ollama API",
+		set:   setString(func(c *Config) *string { return &c.OllamaAPIBase }),
+	},
+	{
+		key: "listen_addr", env: "LISTEN_ADDR", flag: "listen",
+		usage: "address to listen on",
+		set:   setString(func(c *Config) *string { return &c.ListenAddr }),
+	},
+	{
+		key: "organization_tenants", env: "ORGANIZATION_TENANTS", flag: "organization-tenants",
+		usage: "comma-separated organization=tenant or organization/project=tenant pairs requests are attributed by",
+		set:   setMap(func(c *Config) *map[string]string { return &c.OrganizationTenants }),
+	},
+	{
+		key: "admin_api_key", env: "ADMIN_API_KEY", flag: "admin-api-key",
+		usage: "bearer token for /admin/ endpoints (prefer the environment, flags show up in ps)",
+		set:   setString(func(c *Config) *string { return &c.AdminAPIKey }),
+	},
+	{
+		key: "metrics_addr", env: "METRICS_ADDR", flag: "metrics-addr",
+		usage: "address serving Prometheus metrics on /metrics, empty to disable",
+		set:   setString(func(c *Config) *string { return &c.MetricsAddr }),
+	},
+	{
+		key: "tls_cert", env: "TLS_CERT", flag: "tls-cert",
+		usage: "PEM certificate chain to serve HTTPS with, or a secret reference such as file:/etc/proxy/tls.crt",
+		set:   setString(func(c *Config) *string { return &c.TLSCert }),
+	},
+	{
+		key: "tls_key", env: "TLS_KEY", flag: "tls-key",
+		usage: "PEM private key of tls_cert, or a secret reference to it",
+		set:   setString(func(c *Config) *string { return &c.TLSKey }),
+	},
+	{
+		key: "keys_file", env: "API_KEYS_FILE", flag: "keys-file",
+		usage: "YAML file with the API keys clients must use",
+		set:   setString(func(c *Config) *string { return &c.KeysFile }),
+	},
+	{
+		key: "usage_key_secret", env: "USAGE_KEY_SECRET", flag: "usage-key-secret",
+		usage: "secret usage records hash API keys with, or a secret reference to it; empty records only key names",
+		set:   setString(func(c *Config) *string { return &c.UsageKeySecret }),
+	},
+	{
+		key: "request_timeout", env: "REQUEST_TIMEOUT", flag: "request-timeout",
+		usage: "upper bound for a single request",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.RequestTimeout }),
+	},
+	{
+		key: "read_header_timeout", env: "READ_HEADER_TIMEOUT", flag: "read-header-timeout",
+		usage: "time a client gets to send request headers",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.ReadHeaderTimeout }),
+	},
+	{
+		key: "client_write_timeout", env: "CLIENT_WRITE_TIMEOUT", flag: "client-write-timeout",
+		usage: "longest a single write to a client may take",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.ClientWriteTimeout }),
+	},
+	{
+		key: "max_generation_time", env: "MAX_GENERATION_TIME", flag: "max-generation-time",
+		usage: "server-side cap on a single generation",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.MaxGenerationTime }),
+	},
+	{
+		key: "queue_timeout", env: "QUEUE_TIMEOUT", flag: "queue-timeout",
+		usage: "longest a request waits for a generation slot, 0 for as long as it may run",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.QueueTimeout }),
+	},
+	{
+		key: "max_streams_per_key", env: "MAX_STREAMS_PER_KEY", flag: "max-streams-per-key",
+		usage: "streams an API key may have open at once, 0 for no limit",
+		set:   setInt(func(c *Config) *int { return &c.MaxStreamsPerKey }),
+	},
+	{
+		key: "max_concurrent_generations", env: "MAX_CONCURRENT_GENERATIONS", flag: "max-concurrent-generations",
+		usage: "generations running at once across all models, 0 for no limit",
+		set:   setInt(func(c *Config) *int { return &c.MaxConcurrentGenerations }),
+	},
+	{
+		key: "max_queued_generations", env: "MAX_QUEUED_GENERATIONS", flag: "max-queued-generations",
+		usage: "requests that may wait for a generation slot, 0 for no limit",
+		set:   setInt(func(c *Config) *int { return &c.MaxQueuedGenerations }),
+	},
+	{
+		key: "parallel_choices", env: "PARALLEL_CHOICES", flag: "parallel-choices",
+		usage:   "generate the n choices of a request at once instead of one after another",
+		set:     setBool(func(c *Config) *bool { return &c.ParallelChoices }),
+		boolean: true,
+	},
+	{
+		key: "legacy_generate_api", env: "LEGACY_GENERATE_API", flag: "legacy-generate-api",
+		usage:   "send a flattened prompt to /api/generate instead of messages to /api/chat",
+		set:     setBool(func(c *Config) *bool { return &c.LegacyGenerateAPI }),
+		boolean: true,
+	},
+	{
+		key: "normalize_embeddings", env: "NORMALIZE_EMBEDDINGS", flag: "normalize-embeddings",
+		usage:   "scale embedding vectors to unit length",
+		set:     setBool(func(c *Config) *bool { return &c.NormalizeEmbeddings }),
+		boolean: true,
+	},
+	{
+		key: "embedding_jobs_dir", env: "EMBEDDING_JOBS_DIR", flag: "embedding-jobs-dir",
+		usage: "directory of embedding job results, enables /v1/embeddings/jobs",
+		set:   setString(func(c *Config) *string { return &c.EmbeddingJobsDir }),
+	},
+	{
+		key: "repair_role_alternation", env: "REPAIR_ROLE_ALTERNATION", flag: "repair-role-alternation",
+		usage:   "merge consecutive same-role messages for alternating_role_models instead of rejecting the request",
+		set:     setBool(func(c *Config) *bool { return &c.RepairRoleAlternation }),
+		boolean: true,
+	},
+	{
+		key: "error_language", env: "ERROR_LANGUAGE", flag: "error-language",
+		usage: "language of error messages when Accept-Language names none the proxy has",
+		set:   setString(func(c *Config) *string { return &c.ErrorLanguage }),
+	},
+	{
+		key: "unknown_fields", env: "UNKNOWN_FIELDS", flag: "unknown-fields",
+		usage: "ignore or reject unknown top-level request fields",
+		set:   setString(func(c *Config) *string { return &c.UnknownFields }),
+	},
+	{
+		key: "stop_token_cleanup", env: "STOP_TOKEN_CLEANUP", flag: "stop-token-cleanup",
+		usage:   "strip chat template tokens that leak into answers",
+		set:     setBool(func(c *Config) *bool { return &c.StopTokenCleanup }),
+		boolean: true,
+	},
+	{
+		key: "response_cache.ttl", env: "RESPONSE_CACHE_TTL", flag: "response-cache-ttl",
+		usage: "how long deterministic completions are cached, 0 disables the cache",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.ResponseCache.TTL }),
+	},
+	{
+		key: "response_cache.max_entries", env: "RESPONSE_CACHE_MAX_ENTRIES", flag: "response-cache-max-entries",
+		usage: "completions kept by the in-memory response cache",
+		set:   setInt(func(c *Config) *int { return &c.ResponseCache.MaxEntries }),
+	},
+	{
+		key: "response_cache.redis_url", env: "RESPONSE_CACHE_REDIS_URL", flag: "response-cache-redis",
+		usage: "Redis to keep the response cache in instead of memory, e.g. redis://localhost:6379/0",
+		set:   setString(func(c *Config) *string { return &c.ResponseCache.RedisURL }),
+	},
+	{
+		key: "rate_limit.requests_per_minute", env: "RATE_LIMIT_REQUESTS_PER_MINUTE", flag: "rate-limit-requests",
+		usage: "requests per minute of keys without a limit of their own, or per client address without keys",
+		set:   setInt(func(c *Config) *int { return &c.RateLimit.RequestsPerMinute }),
+	},
+	{
+		key: "rate_limit.tokens_per_minute", env: "RATE_LIMIT_TOKENS_PER_MINUTE", flag: "rate-limit-tokens",
+		usage: "tokens per minute of keys without a limit of their own, or per client address without keys",
+		set:   setInt(func(c *Config) *int { return &c.RateLimit.TokensPerMinute }),
+	},
+	{
+		key: "storage.driver", env: "STORAGE_DRIVER", flag: "storage",
+		usage: "where usage records and state are kept: memory, sqlite or postgres, empty for usage files",
+		set:   setString(func(c *Config) *string { return &c.Storage.Driver }),
+	},
+	{
+		key: "storage.dsn", env: "STORAGE_DSN", flag: "storage-dsn",
+		usage: "SQLite file or Postgres connection string of the storage",
+		set:   setString(func(c *Config) *string { return &c.Storage.DSN }),
+	},
+	{
+		key: "encryption.keys", env: "ENCRYPTION_KEYS", flag: "encryption-keys",
+		usage: "comma-separated tenant=base64 key pairs stored prompts and responses are encrypted with",
+		set:   setMap(func(c *Config) *map[string]string { return &c.Encryption.Keys }),
+	},
+	{
+		key: "encryption.key_command", env: "ENCRYPTION_KEY_COMMAND", flag: "encryption-key-command",
+		usage: "shell command printing the base64 key of the tenant in $TENANT",
+		set:   setString(func(c *Config) *string { return &c.Encryption.KeyCommand }),
+	},
+	{
+		key: "secrets.refresh_interval", env: "SECRETS_REFRESH_INTERVAL", flag: "secrets-refresh-interval",
+		usage: "how often secret references and the keys file are read again, 0 for only at startup",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Secrets.RefreshInterval }),
+	},
+	{
+		key: "secrets.vault_addr", env: "VAULT_ADDR", flag: "vault-addr",
+		usage: "address of the Vault server vault: secret references are read from",
+		set:   setString(func(c *Config) *string { return &c.Secrets.VaultAddr }),
+	},
+	{
+		key: "secrets.vault_token", env: "VAULT_TOKEN", flag: "vault-token",
+		usage: "Vault token, or a file: reference to one",
+		set:   setString(func(c *Config) *string { return &c.Secrets.VaultToken }),
+	},
+	{
+		key: "secrets.aws_region", env: "AWS_REGION", flag: "aws-region",
+		usage: "AWS region aws-sm: secret references are read from",
+		set:   setString(func(c *Config) *string { return &c.Secrets.AWSRegion }),
+	},
+	{
+		key: "tracing.endpoint", env: "TRACING_ENDPOINT", flag: "tracing-endpoint",
+		usage: "base URL of an OTLP/HTTP collector to export traces to, empty disables tracing",
+		set:   setString(func(c *Config) *string { return &c.Tracing.Endpoint }),
+	},
+	{
+		key: "tracing.service_name", env: "TRACING_SERVICE_NAME", flag: "tracing-service-name",
+		usage: "service.name of the exported spans",
+		set:   setString(func(c *Config) *string { return &c.Tracing.ServiceName }),
+	},
+	{
+		key: "eval.sample_percent", env: "EVAL_SAMPLE_PERCENT", flag: "eval-sample-percent",
+		usage: "percentage of generations captured for quality evaluation, 0 disables it",
+		set:   setFloat(func(c *Config) *float64 { return &c.Eval.SamplePercent }),
+	},
+	{
+		key: "eval.judge_model", env: "EVAL_JUDGE_MODEL", flag: "eval-judge-model",
+		usage: "Ollama model scoring the evaluation samples, empty leaves them unscored",
+		set:   setString(func(c *Config) *string { return &c.Eval.JudgeModel }),
+	},
+	{
+		key: "eval.golden_file", env: "EVAL_GOLDEN_FILE", flag: "eval-golden-file",
+		usage: "JSON lines file of golden prompts alias switches are checked against",
+		set:   setString(func(c *Config) *string { return &c.Eval.GoldenFile }),
+	},
+	{
+		key: "retention.requests_days", env: "RETENTION_REQUESTS_DAYS", flag: "retention-requests-days",
+		usage: "days prompts and responses are kept in usage records, 0 for ever",
+		set:   setInt(func(c *Config) *int { return &c.Retention.RequestsDays }),
+	},
+	{
+		key: "retention.usage_days", env: "RETENTION_USAGE_DAYS", flag: "retention-usage-days",
+		usage: "days usage records are kept, 0 for ever",
+		set:   setInt(func(c *Config) *int { return &c.Retention.UsageDays }),
+	},
+	{
+		key: "upstream.connect_timeout", env: "UPSTREAM_CONNECT_TIMEOUT", flag: "upstream-connect-timeout",
+		usage: "longest an upstream connection may take to establish",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Upstream.ConnectTimeout }),
+	},
+	{
+		key: "upstream.read_timeout", env: "UPSTREAM_READ_TIMEOUT", flag: "upstream-read-timeout",
+		usage: "longest an upstream may go without sending data, model loads included",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Upstream.ReadTimeout }),
+	},
+	{
+		key: "upstream.idle_conn_timeout", env: "UPSTREAM_IDLE_CONN_TIMEOUT", flag: "upstream-idle-conn-timeout",
+		usage: "how long an unused upstream connection is kept open",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Upstream.IdleConnTimeout }),
+	},
+	{
+		key: "upstream.max_idle_conns_per_host", env: "UPSTREAM_MAX_IDLE_CONNS_PER_HOST", flag: "upstream-max-idle-conns",
+		usage: "unused connections kept open per upstream host",
+		set:   setInt(func(c *Config) *int { return &c.Upstream.MaxIdleConnsPerHost }),
+	},
+	{
+		key: "upstream.max_retries", env: "UPSTREAM_MAX_RETRIES", flag: "upstream-max-retries",
+		usage: "retries of Ollama calls that failed to connect or got a 502, 503 or 504, 0 to fail right away",
+		set:   setInt(func(c *Config) *int { return &c.Upstream.MaxRetries }),
+	},
+	{
+		key: "upstream.retry_backoff", env: "UPSTREAM_RETRY_BACKOFF", flag: "upstream-retry-backoff",
+		usage: "wait before the first retry, doubled for every further one",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.Upstream.RetryBackoff }),
+	},
+	{
+		key: "cors.allowed_origins", env: "CORS_ALLOWED_ORIGINS", flag: "cors-allowed-origins",
+		usage: "comma-separated origins allowed to call the API, * for any",
+		set:   setList(func(c *Config) *[]string { return &c.CORS.AllowedOrigins }),
+	},
+	{
+		key: "cors.allowed_headers", env: "CORS_ALLOWED_HEADERS", flag: "cors-allowed-headers",
+		usage: "comma-separated request headers browsers may send",
+		set:   setList(func(c *Config) *[]string { return &c.CORS.AllowedHeaders }),
+	},
+	{
+		key: "cors.max_age", env: "CORS_MAX_AGE", flag: "cors-max-age",
+		usage: "how long browsers may cache a preflight response",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.CORS.MaxAge }),
+	},
+	{
+		key: "log.file", env: "LOG_FILE", flag: "log-file",
+		usage: "file to log to instead of stderr",
+		set:   setString(func(c *Config) *string { return &c.Log.File }),
+	},
+	{
+		key: "log.utc", env: "LOG_UTC", flag: "log-utc",
+		usage:   "log timestamps in UTC",
+		set:     setBool(func(c *Config) *bool { return &c.Log.UTC }),
+		boolean: true,
+	},
+	{
+		key: "log.level", env: "LOG_LEVEL", flag: "log-level",
+		usage: "least severe level to log: debug, info, warn or error",
+		set:   setString(func(c *Config) *string { return &c.Log.Level }),
+	},
+	{
+		key: "log.format", env: "LOG_FORMAT", flag: "log-format",
+		usage: "log lines as pretty text or as json",
+		set:   setString(func(c *Config) *string { return &c.Log.Format }),
+	},
+	{
+		key: "vector_store.path", env: "VECTOR_STORE_PATH", flag: "vector-store",
+		usage: "directory to keep RAG collections in, enables /v1/collections and /v1/search",
+		set:   setString(func(c *Config) *string { return &c.VectorStore.Path }),
+	},
+	{
+		key: "vector_store.embedding_model", env: "VECTOR_STORE_EMBEDDING_MODEL", flag: "vector-store-embedding-model",
+		usage: "embedding model of collections created without one",
+		set:   setString(func(c *Config) *string { return &c.VectorStore.EmbeddingModel }),
+	},
+	{
+		key: "model_aliases.map", env: "MODEL_ALIASES_MAP", flag: "model-aliases",
+		usage: "comma-separated name=model aliases, e.g. gpt-4o=llama3.1:70b",
+		set:   setMap(func(c *Config) *map[string]string { return &c.ModelAliases.Map }),
+	},
+	{
+		key: "model_aliases.default", env: "MODEL_ALIASES_DEFAULT", flag: "default-model",
+		usage: "model for names without an alias that Ollama doesn't have",
+		set:   setString(func(c *Config) *string { return &c.ModelAliases.Default }),
+	},
+	{
+		key: "model_aliases.strict", env: "MODEL_ALIASES_STRICT", flag: "strict-model-aliases",
+		usage:   "reject model names without an alias",
+		set:     setBool(func(c *Config) *bool { return &c.ModelAliases.Strict }),
+		boolean: true,
+	},
+	{
+		key: "model_aliases.session_pin_ttl", env: "MODEL_ALIASES_SESSION_PIN_TTL", flag: "session-pin-ttl",
+		usage: "how long conversations keep their model and backend after their last turn, 0 doesn't pin",
+		set:   setDuration(func(c *Config) *time.Duration { return &c.ModelAliases.SessionPinTTL }),
+	},
+	{
+		key: "auto_pull", env: "AUTO_PULL", flag: "auto-pull",
+		usage: "comma-separated globs of models pulled when Ollama doesn't have them, e.g. llama3*,qwen2.5:*",
+		set:   setList(func(c *Config) *[]string { return &c.AutoPull }),
+	},
+	{
+		key: "model_allowlist", env: "MODEL_ALLOWLIST", flag: "model-allowlist",
+		usage: "comma-separated globs of the models served, empty for every model not denied",
+		set:   setList(func(c *Config) *[]string { return &c.ModelAllowlist }),
+	},
+	{
+		key: "model_denylist", env: "MODEL_DENYLIST", flag: "model-denylist",
+		usage: "comma-separated globs of models never served, e.g. *uncensored*",
+		set:   setList(func(c *Config) *[]string { return &c.ModelDenylist }),
+	},
+	{
+		key: "keep_alive", env: "KEEP_ALIVE", flag: "keep-alive",
+		usage: "comma-separated model=duration pairs of how long Ollama keeps models loaded, e.g. llama3*=1h,phi3=0",
+		set:   setMap(func(c *Config) *map[string]string { return &c.KeepAlive }),
+	},
+	{
+		key: "audio.transcription_url", env: "AUDIO_TRANSCRIPTION_URL", flag: "transcription-url",
+		usage: "WebSocket URL of a streaming whisper backend, enables /v1/audio/transcriptions/stream",
+		set:   setString(func(c *Config) *string { return &c.Audio.TranscriptionURL }),
+	},
+	{
+		key: "audio.stt_url", env: "AUDIO_STT_URL", flag: "stt-url",
+		usage: "base URL of an OpenAI-compatible speech-to-text API, with audio.tts_url enables /v1/audio/chat",
+		set:   setString(func(c *Config) *string { return &c.Audio.STTURL }),
+	},
+	{
+		key: "audio.tts_url", env: "AUDIO_TTS_URL", flag: "tts-url",
+		usage: "base URL of an OpenAI-compatible text-to-speech API",
+		set:   setString(func(c *Config) *string { return &c.Audio.TTSURL }),
+	},
+	{
+		key: "signing.key_file", env: "SIGNING_KEY_FILE", flag: "signing-key",
+		usage: "PEM private key to sign responses with (detached JWS in X-Signature)",
+		set:   setString(func(c *Config) *string { return &c.Signing.KeyFile }),
+	},
+	{
+		key: "signing.key_id", env: "SIGNING_KEY_ID", flag: "signing-key-id",
+		usage: "key ID of response signatures, a thumbprint of the key by default",
+		set:   setString(func(c *Config) *string { return &c.Signing.KeyID }),
+	},
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a duration such as 90s or 5m: %q", value)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not a whole number: %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setFloat(field func(*Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", value)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+func setList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+func setMap(field func(*Config) *map[string]string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		m := make(map[string]string)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("not a comma-separated list of name=value: %q", value)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		*field(c) = m
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// settingFlag holds a flag's raw value until the layers below it are loaded.
+type settingFlag struct {
+	value   string
+	boolean bool
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.boolean }
+
+// LoadConfig builds the configuration from the config file (-config or
+// $PROXY_CONFIG), the environment and args, and validates it.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("ollama-openai-proxy", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("PROXY_CONFIG"), "YAML config file")
+	for _, s := range settings {
+		fs.Var(&settingFlag{boolean: s.boolean}, s.flag, s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c := DefaultConfig()
+	sources := make(map[string]string)
+	if *configFile != "" {
+		if err := loadConfigFile(&c, *configFile); err != nil {
+			return Config{}, err
+		}
+		for _, s := range settings {
+			sources[s.key] = *configFile
+		}
+		for _, key := range fileSettings {
+			sources[key] = *configFile
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(&c, value); err != nil {
+				errs = append(errs, fmt.Errorf("$%s: %w", s.env, err))
+			}
+			sources[s.key] = "$" + s.env
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if err := s.set(&c, f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+				}
+				sources[s.key] = "-" + s.flag
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return Config{}, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	if err := c.validate(sources); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// addFileKeys appends the keys of KeysFile to APIKeys and checks them like
+// the rest. It runs in setupSecrets, so the command and New both start
+// with them.
+func (c *Config) addFileKeys() error {
+	if c.KeysFile == "" {
+		return nil
+	}
+	keys, err := loadKeysFile(c.KeysFile)
+	if err != nil {
+		return err
+	}
+	c.APIKeys = append(c.APIKeys, keys...)
+	c.keysFromFile = len(keys)
+	return c.validate(map[string]string{"api_keys": c.KeysFile})
+}
+
+func loadConfigFile(c *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	// a typo in a key should fail loudly rather than be ignored
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate checks the configuration, naming where each bad value came from.
+func (c Config) validate(sources map[string]string) error {
+	var errs []error
+	check := func(key string, ok bool, format string, args ...any) {
+		if ok {
+			return
+		}
+		source := sources[key]
+		if source == "" {
+			source = "default"
+		}
+		errs = append(errs, fmt.Errorf("%s (from %s): %s", key, source, fmt.Sprintf(format, args...)))
+	}
+
+	u, err := url.Parse(c.OllamaAPIBase)
+	check("ollama_api_base", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+		"must be an http(s) URL such as http://localhost:11434, got %q", c.OllamaAPIBase)
+	_, port, err := net.SplitHostPort(c.ListenAddr)
+	check("listen_addr", err == nil && port != "", "must be host:port or :port, got %q", c.ListenAddr)
+	if c.MetricsAddr != "" {
+		_, port, err := net.SplitHostPort(c.MetricsAddr)
+		check("metrics_addr", err == nil && port != "", "must be host:port or :port, got %q", c.MetricsAddr)
+		check("metrics_addr", c.MetricsAddr != c.ListenAddr, "must differ from listen_addr, metrics are not meant for API clients")
+	}
+	check("tls_cert", c.TLSCert != "" || c.TLSKey == "", "is required with tls_key")
+	check("tls_key", c.TLSKey != "" || c.TLSCert == "", "is required with tls_cert")
+
+	check("request_timeout", c.RequestTimeout > 0, "must be positive, got %s", c.RequestTimeout)
+	check("read_header_timeout", c.ReadHeaderTimeout > 0, "must be positive, got %s", c.ReadHeaderTimeout)
+	check("client_write_timeout", c.ClientWriteTimeout > 0, "must be positive, got %s", c.ClientWriteTimeout)
+	check("max_generation_time", c.MaxGenerationTime > 0, "must be positive, got %s", c.MaxGenerationTime)
+
+	check("queue_timeout", c.QueueTimeout >= 0, "must not be negative, got %s", c.QueueTimeout)
+	check("max_streams_per_key", c.MaxStreamsPerKey >= 0, "must not be negative, got %d", c.MaxStreamsPerKey)
+	check("max_concurrent_generations", c.MaxConcurrentGenerations >= 0, "must not be negative, got %d", c.MaxConcurrentGenerations)
+	check("max_queued_generations", c.MaxQueuedGenerations >= 0, "must not be negative, got %d", c.MaxQueuedGenerations)
+	_, translated := errorTranslations[c.ErrorLanguage]
+	check("unknown_fields", c.UnknownFields == UNKNOWN_FIELDS_IGNORE || c.UnknownFields == UNKNOWN_FIELDS_REJECT, "must be %s or %s", UNKNOWN_FIELDS_IGNORE, UNKNOWN_FIELDS_REJECT)
+	check("error_language", translated || c.ErrorLanguage == "en", "must be one of %s, got %q", strings.Join(errorLanguages(), ", "), c.ErrorLanguage)
+
+	check("upstream.connect_timeout", c.Upstream.ConnectTimeout > 0, "must be positive, got %s", c.Upstream.ConnectTimeout)
+	check("upstream.read_timeout", c.Upstream.ReadTimeout > 0, "must be positive, got %s", c.Upstream.ReadTimeout)
+	check("upstream.idle_conn_timeout", c.Upstream.IdleConnTimeout > 0, "must be positive, got %s", c.Upstream.IdleConnTimeout)
+	check("upstream.max_idle_conns_per_host", c.Upstream.MaxIdleConnsPerHost > 0, "must be positive, got %d", c.Upstream.MaxIdleConnsPerHost)
+	check("upstream.max_retries", c.Upstream.MaxRetries >= 0, "must not be negative, got %d", c.Upstream.MaxRetries)
+	check("upstream.retry_backoff", c.Upstream.RetryBackoff >= 0, "must not be negative, got %s", c.Upstream.RetryBackoff)
+
+	check("response_cache.ttl", c.ResponseCache.TTL >= 0, "must not be negative, got %s", c.ResponseCache.TTL)
+	check("response_cache.max_entries", c.ResponseCache.MaxEntries > 0, "must be positive, got %d", c.ResponseCache.MaxEntries)
+	if value := c.ResponseCache.RedisURL; value != "" {
+		u, err := url.Parse(value)
+		check("response_cache.redis_url", err == nil && u.Scheme == "redis" && u.Host != "",
+			"must be a redis:// URL such as redis://localhost:6379/0, got %q", value)
+	}
+
+	check("rate_limit.requests_per_minute", c.RateLimit.RequestsPerMinute >= 0, "must not be negative, got %d", c.RateLimit.RequestsPerMinute)
+	check("rate_limit.tokens_per_minute", c.RateLimit.TokensPerMinute >= 0, "must not be negative, got %d", c.RateLimit.TokensPerMinute)
+	switch c.Storage.Driver {
+	case "", STORAGE_MEMORY:
+	case STORAGE_SQLITE, STORAGE_POSTGRES:
+		check("storage.dsn", c.Storage.DSN != "", "is required for storage driver %s", c.Storage.Driver)
+	default:
+		check("storage.driver", false, "must be memory, sqlite or postgres, got %q", c.Storage.Driver)
+	}
+	for name, encoded := range c.Encryption.Keys {
+		// never echo the key itself
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		check("encryption.keys", err == nil && len(key) == 32, "key of tenant %q must be 32 bytes in base64", name)
+	}
+	check("secrets.refresh_interval", c.Secrets.RefreshInterval >= 0, "must not be negative, got %s", c.Secrets.RefreshInterval)
+	if value := c.Secrets.VaultAddr; value != "" {
+		u, err := url.Parse(value)
+		check("secrets.vault_addr", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"must be an http(s) URL such as https://vault:8200, got %q", value)
+	}
+	if value := c.Tracing.Endpoint; value != "" {
+		u, err := url.Parse(value)
+		check("tracing.endpoint", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"must be an http(s) URL such as http://localhost:4318, got %q", value)
+	}
+	check("tracing.service_name", c.Tracing.ServiceName != "", "must not be empty")
+	check("eval.sample_percent", c.Eval.SamplePercent >= 0 && c.Eval.SamplePercent <= 100, "must be between 0 and 100, got %g", c.Eval.SamplePercent)
+	check("retention.requests_days", c.Retention.RequestsDays >= 0, "must not be negative, got %d", c.Retention.RequestsDays)
+	check("retention.usage_days", c.Retention.UsageDays >= 0, "must not be negative, got %d", c.Retention.UsageDays)
+
+	seen := make(map[string]bool, len(c.APIKeys))
+	for i, k := range c.APIKeys {
+		// never echo the key itself
+		check("api_keys", k.Key != "", "key #%d (%s) is empty", i+1, k.Name)
+		check("api_keys", !seen[k.Key], "key #%d (%s) is listed twice", i+1, k.Name)
+		check("api_keys", k.RequestsPerMinute >= 0, "key #%d (%s) has a negative requests_per_minute", i+1, k.Name)
+		check("api_keys", k.TokensPerMinute >= 0, "key #%d (%s) has a negative tokens_per_minute", i+1, k.Name)
+		check("api_keys", k.MaxStreams >= 0, "key #%d (%s) has a negative max_streams", i+1, k.Name)
+		check("api_keys", validStoreContent(k.StoreContent), "key #%d (%s) has store_content %q, want none, hashed, truncated or full", i+1, k.Name, k.StoreContent)
+		seen[k.Key] = true
+	}
+
+	for name, p := range c.Providers {
+		// never echo the API key
+		check("providers", name != "" && name != "ollama" && !strings.Contains(name, "/"), "%q can't be a model name prefix, which is empty, ollama or has a slash", name)
+		check("providers", p.Type == PROVIDER_OLLAMA || p.Type == PROVIDER_OPENAI, "%s has type %q, want ollama or openai", name, p.Type)
+		u, err := url.Parse(p.BaseURL)
+		check("providers", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"%s has base_url %q, want an http(s) URL such as https://api.openai.com/v1", name, p.BaseURL)
+		check("providers", p.APIKey == "" || p.Type == PROVIDER_OPENAI, "%s has an api_key, which only openai providers are sent", name)
+	}
+
+	addrs := make(map[string]bool, len(c.Listeners))
+	tenantListeners := make(map[string]Listener)
+	for i, l := range c.Listeners {
+		_, _, err := net.SplitHostPort(l.Addr)
+		check("listeners", err == nil, "listener #%d has addr %q, want one such as :8081", i+1, l.Addr)
+		check("listeners", !addrs[l.Addr], "addr %q is listed twice", l.Addr)
+		check("listeners", l.Tenant != "" || l.LogFile == "" && l.UsageFile == "", "listener #%d (%s) has a log_file or usage_file but no tenant", i+1, l.Addr)
+		if first, ok := tenantListeners[l.Tenant]; ok && l.Tenant != "" {
+			check("listeners", l.LogFile == first.LogFile && l.UsageFile == first.UsageFile, "listeners of tenant %s have different log_file or usage_file", l.Tenant)
+		}
+		addrs[l.Addr] = true
+		if _, ok := tenantListeners[l.Tenant]; !ok {
+			tenantListeners[l.Tenant] = l
+		}
+	}
+
+	for org, name := range c.OrganizationTenants {
+		id, project, hasProject := strings.Cut(org, "/")
+		check("organization_tenants", id != "" && (!hasProject || project != "" && !strings.Contains(project, "/")) && name != "",
+			"%q=%q needs an organization or organization/project and a tenant", org, name)
+	}
+
+	tiers := make(map[string]bool, len(c.BackendTiers))
+	for i, tier := range c.BackendTiers {
+		check("backend_tiers", tier.Name != "", "tier #%d has no name", i+1)
+		check("backend_tiers", !tiers[tier.Name], "tier %q is listed twice", tier.Name)
+		check("backend_tiers", len(tier.URLs) > 0, "tier #%d (%s) has no urls", i+1, tier.Name)
+		check("backend_tiers", tier.MaxInflight >= 0, "tier #%d (%s) has a negative max_inflight", i+1, tier.Name)
+		for _, value := range tier.URLs {
+			u, err := url.Parse(value)
+			check("backend_tiers", err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"tier #%d (%s) has url %q, want an http(s) URL such as http://gpu-1:11434", i+1, tier.Name, value)
+		}
+		tiers[tier.Name] = true
+	}
+
+	for route := range c.Routes {
+		check("routes", strings.HasPrefix(route, "/v1/"), "%q is not an API route such as /v1/embeddings", route)
+	}
+	for _, l := range c.Listeners {
+		for route := range l.Routes {
+			check("listeners", strings.HasPrefix(route, "/v1/"), "listener %s has routes for %q, which is not an API route such as /v1/embeddings", l.Addr, route)
+		}
+	}
+
+	experiments := make(map[string]bool, len(c.Experiments))
+	for i, e := range c.Experiments {
+		check("experiments", e.Name != "", "experiment #%d has no name", i+1)
+		check("experiments", !experiments[e.Name], "experiment %q is listed twice", e.Name)
+		check("experiments", e.Percent > 0 && e.Percent <= 100, "experiment %q has percent %g, want more than 0 and at most 100", e.Name, e.Percent)
+		check("experiments", len(e.Adjust)+len(e.Set) > 0, "experiment %q changes no parameter", e.Name)
+		for _, params := range []map[string]float64{e.Adjust, e.Set} {
+			for name := range params {
+				_, ok := SAMPLING_DEFAULTS[name]
+				check("experiments", ok, "experiment %q changes %q, want temperature, top_p, presence_penalty or frequency_penalty", e.Name, name)
+			}
+		}
+		experiments[e.Name] = true
+	}
+	for i, rule := range c.ScheduleRules {
+		_, err := compileScheduleRule(rule)
+		check("schedule_rules", err == nil, "rule #%d (%s) %v", i+1, rule.Model, err)
+	}
+	c.validatePolicies(check)
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check("cors.allowed_origins", origin == "*" || (err == nil && u.Scheme != "" && u.Host != "" && u.Path == ""),
+			"%q is neither * nor an origin such as https://app.example.com", origin)
+	}
+	check("cors.max_age", c.CORS.MaxAge >= 0, "must not be negative, got %s", c.CORS.MaxAge)
+
+	names := make(map[string]bool, len(c.ModelAliases.Map))
+	for name, target := range c.ModelAliases.Map {
+		check("model_aliases.map", name != "" && target != "", "%q=%q needs both a name and a model", name, target)
+		check("model_aliases.map", !names[strings.ToLower(name)], "%q is listed twice", name)
+		names[strings.ToLower(name)] = true
+	}
+	_, err = compileModelAliases(c.ModelAliases.Patterns)
+	check("model_aliases.patterns", err == nil, "%v", err)
+	check("model_aliases.session_pin_ttl", c.ModelAliases.SessionPinTTL >= 0, "must not be negative, got %s", c.ModelAliases.SessionPinTTL)
+	check("model_aliases.strict", !c.ModelAliases.Strict || c.ModelAliases.Default == "",
+		"can't be combined with model_aliases.default, which serves every name without an alias")
+	for model, value := range c.KeepAlive {
+		_, ok := parseKeepAlive(value)
+		check("keep_alive", model != "" && ok, "%q=%q needs a model and a duration such as 30m or a number of seconds", model, value)
+	}
+
+	if c.Audio.TranscriptionURL != "" {
+		u, err := url.Parse(c.Audio.TranscriptionURL)
+		check("audio.transcription_url", err == nil && (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != "",
+			"must be a ws(s) URL such as ws://localhost:9090/stream, got %q", c.Audio.TranscriptionURL)
+	}
+	for key, value := range map[string]string{"audio.stt_url": c.Audio.STTURL, "audio.tts_url": c.Audio.TTSURL} {
+		if value != "" {
+			u, err := url.Parse(value)
+			check(key, err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"must be an http(s) URL such as http://localhost:8000/v1, got %q", value)
+		}
+	}
+	check("audio.stt_url", c.Audio.STTURL != "" || c.Audio.TTSURL == "", "is needed with audio.tts_url for voice chat")
+	check("audio.tts_url", c.Audio.TTSURL != "" || c.Audio.STTURL == "", "is needed with audio.stt_url for voice chat")
+
+	if c.Signing.KeyFile != "" {
+		_, err := loadResponseSigner(c.Signing.KeyFile, c.Signing.KeyID)
+		check("signing.key_file", err == nil, "%v", err)
+	}
+
+	if c.Log.File != "" {
+		f, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		check("log.file", err == nil, "can't be opened: %v", err)
+		if err == nil {
+			f.Close()
+		}
+	}
+	_, ok := logLevels[c.Log.Level]
+	check("log.level", ok, "must be debug, info, warn or error")
+	check("log.format", c.Log.Format == LOG_FORMAT_PRETTY || c.Log.Format == LOG_FORMAT_JSON, "must be %s or %s", LOG_FORMAT_PRETTY, LOG_FORMAT_JSON)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validatePolicies checks the request policies of validate, by model or API
+// key.
+func (c Config) validatePolicies(check func(key string, ok bool, format string, args ...any)) {
+	// presets and paces are by key name, never echo a key listed by mistake
+	keys := make(map[string]bool, len(c.APIKeys))
+	for _, k := range c.APIKeys {
+		keys[k.Key] = true
+	}
+	for name, p := range c.Presets {
+		if keys[name] {
+			check("presets", false, "a preset is by an API key, name the key and use its name")
+			continue
+		}
+		check("presets", (p.Temperature == nil || *p.Temperature >= 0) && (p.TopP == nil || *p.TopP >= 0) && p.MaxTokens >= 0,
+			"%s has a negative temperature, top_p or max_tokens", name)
+	}
+	for i, rule := range c.RewriteRules {
+		for _, message := range rule.InjectMessages {
+			check("rewrite_rules", KNOWN_ROLES[message.Role], "rule #%d injects a message with role %q", i+1, message.Role)
+		}
+	}
+	for model, routes := range c.SizeRoutes {
+		for _, route := range routes {
+			check("size_routes", route.Model != "" && route.MaxPromptTokens >= 0, "route of %s needs a model and a max_prompt_tokens that isn't negative", model)
+		}
+	}
+	params := samplingParams(&OpenAIChatRequest{})
+	for i, limit := range c.ParameterLimits {
+		check("parameter_limits", limit.Model != "", "limit #%d names no model", i+1)
+		check("parameter_limits", limit.Action == PARAM_CLAMP || limit.Action == PARAM_REJECT, "limit #%d (%s) has action %q, want clamp or reject", i+1, limit.Model, limit.Action)
+		for name, bounds := range limit.Ranges {
+			_, ok := params[name]
+			check("parameter_limits", ok, "limit #%d (%s) bounds %q, want temperature, top_p, presence_penalty or frequency_penalty", i+1, limit.Model, name)
+			check("parameter_limits", bounds.Min <= bounds.Max, "limit #%d (%s) has a min of %s above the max", i+1, limit.Model, name)
+		}
+	}
+	for model, limit := range c.ModelConcurrency {
+		check("model_concurrency", limit.MaxConcurrent > 0 && limit.MaxQueued >= 0, "%s needs a positive max_concurrent and a max_queued that isn't negative", model)
+	}
+	for name, rate := range c.StreamTokensPerSecond {
+		if keys[name] {
+			check("stream_tokens_per_second", false, "a rate is by an API key, name the key and use its name")
+			continue
+		}
+		check("stream_tokens_per_second", rate >= 0, "%s has a negative rate of %g", name, rate)
+	}
+	for model, code := range c.ResponseLanguages {
+		_, ok := languageNames[code]
+		check("response_languages", ok, "%s has language %q, want one of %s", model, code, strings.Join(sortedKeys(languageNames), ", "))
+	}
+	_, err := compileStopRegexes(c.StopRegexes)
+	check("stop_regexes", err == nil, "%v", err)
+	for i, rule := range c.SystemMessageRules {
+		check("system_message_rules", rule.Model != "", "rule #%d names no model", i+1)
+		switch rule.Strategy {
+		case SYSTEM_KEEP, SYSTEM_MERGE_FIRST, SYSTEM_MERGE_INTO_USER:
+		default:
+			check("system_message_rules", false, "rule #%d (%s) has strategy %q, want keep, merge_first or merge_into_user", i+1, rule.Model, rule.Strategy)
+		}
+	}
+	for model, d := range c.DeprecatedModels {
+		for _, date := range []string{d.DeprecatedAt, d.Sunset} {
+			_, err := time.Parse(time.DateOnly, date)
+			check("deprecated_models", date == "" || err == nil, "%s has date %q, want one such as 2025-06-30", model, date)
+		}
+	}
+	switch c.OutputFilter.Action {
+	case FILTER_MASK, FILTER_BLOCK, FILTER_ANNOTATE:
+	default:
+		check("output_filter", false, "has action %q, want mask, block or annotate", c.OutputFilter.Action)
+	}
+}
+
+// logOutput is where logs go unless a tenant logs to a file of its own.
+var logOutput io.Writer = os.Stderr
+
+// setupLogging makes the configured structured logger the default one, which
+// the standard logger writes through as well.
+func setupLogging(c LogConfig) error {
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		logOutput = f
+	}
+	slog.SetDefault(slog.New(newLogHandler(logOutput, c)))
+	defaultTenant.log = slog.Default()
+	return nil
+}
+
+// localProxyURL is the base URL of a proxy listening on addr on this host.
+func localProxyURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
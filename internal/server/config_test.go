@@ -0,0 +1,129 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		// in the error, empty for a valid config
+		want string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"max_concurrent_generations", func(c *Config) { c.MaxConcurrentGenerations = -1 }, "max_concurrent_generations (from default): must not be negative"},
+		{"max_queued_generations", func(c *Config) { c.MaxQueuedGenerations = -1 }, "max_queued_generations (from default): must not be negative"},
+		{"error_language", func(c *Config) { c.ErrorLanguage = "de" }, ""},
+		{"unknown error_language", func(c *Config) { c.ErrorLanguage = "it" }, `error_language (from default): must be one of en, de, es, fr, got "it"`},
+		{"unknown_fields", func(c *Config) { c.UnknownFields = "warn" }, "unknown_fields (from default): must be ignore or reject"},
+		{"preset temperature 0", func(c *Config) { c.Presets = map[string]Preset{"llama3": {Temperature: ptr(0.0)}} }, ""},
+		{"negative preset", func(c *Config) { c.Presets = map[string]Preset{"llama3": {TopP: ptr(-0.1)}} }, "llama3 has a negative"},
+		{
+			"preset by the API key",
+			func(c *Config) {
+				c.APIKeys = []APIKey{{Key: testKey, Name: "team-a"}}
+				c.Presets = map[string]Preset{testKey: {MaxTokens: 10}}
+			},
+			"a preset is by an API key",
+		},
+		{
+			"rate by the API key",
+			func(c *Config) {
+				c.APIKeys = []APIKey{{Key: testKey, Name: "team-a"}}
+				c.StreamTokensPerSecond = map[string]float64{testKey: 10}
+			},
+			"a rate is by an API key",
+		},
+		{
+			"listeners",
+			func(c *Config) {
+				c.Listeners = []Listener{
+					{Addr: ":8081", Tenant: "team-a", UsageFile: "team-a.jsonl"},
+					{Addr: "127.0.0.1:8082", Tenant: "team-a", UsageFile: "team-a.jsonl"},
+					{Addr: ":8083"},
+				}
+			},
+			"",
+		},
+		{
+			"listener routes",
+			func(c *Config) {
+				off := false
+				c.Listeners = []Listener{{Addr: ":8081", Routes: map[string]RoutePolicy{"/v1/embeddings": {Auth: &off}}}}
+			},
+			"",
+		},
+		{
+			"listener route that isn't one",
+			func(c *Config) {
+				c.Listeners = []Listener{{Addr: ":8081", Routes: map[string]RoutePolicy{"/admin/purge": {}}}}
+			},
+			`has routes for "/admin/purge"`,
+		},
+		{"listener addr", func(c *Config) { c.Listeners = []Listener{{Addr: "8081"}} }, `has addr "8081"`},
+		{"listener twice", func(c *Config) { c.Listeners = []Listener{{Addr: ":8081"}, {Addr: ":8081"}} }, `addr ":8081" is listed twice`},
+		{"listener files without tenant", func(c *Config) { c.Listeners = []Listener{{Addr: ":8081", UsageFile: "usage.jsonl"}} }, "but no tenant"},
+		{
+			"listeners of a tenant with other files",
+			func(c *Config) {
+				c.Listeners = []Listener{{Addr: ":8081", Tenant: "team-a", UsageFile: "a.jsonl"}, {Addr: ":8082", Tenant: "team-a", UsageFile: "b.jsonl"}}
+			},
+			"listeners of tenant team-a have different",
+		},
+		{
+			"organization tenants",
+			func(c *Config) {
+				c.OrganizationTenants = map[string]string{"org-research": "research", "org-research/proj_gpu": "research-gpu"}
+			},
+			"",
+		},
+		{"organization tenant without tenant", func(c *Config) { c.OrganizationTenants = map[string]string{"org-research": ""} }, `"org-research"="" needs`},
+		{"organization tenant without organization", func(c *Config) { c.OrganizationTenants = map[string]string{"/proj_gpu": "research"} }, `"/proj_gpu"="research" needs`},
+		{"organization tenant with a path", func(c *Config) { c.OrganizationTenants = map[string]string{"org/proj/x": "research"} }, `"org/proj/x"="research" needs`},
+		{
+			"backend tiers",
+			func(c *Config) {
+				c.BackendTiers = []BackendTier{
+					{Name: "lan", URLs: []string{"http://gpu-1:11434", "http://gpu-2:11434"}, MaxInflight: 4},
+					{Name: "cloud", URLs: []string{"https://ollama.example.com"}},
+				}
+			},
+			"",
+		},
+		{"backend tier without name", func(c *Config) { c.BackendTiers = []BackendTier{{URLs: []string{"http://gpu-1:11434"}}} }, "tier #1 has no name"},
+		{
+			"backend tier twice",
+			func(c *Config) {
+				c.BackendTiers = []BackendTier{{Name: "lan", URLs: []string{"http://gpu-1:11434"}}, {Name: "lan", URLs: []string{"http://gpu-2:11434"}}}
+			},
+			`tier "lan" is listed twice`,
+		},
+		{"backend tier without urls", func(c *Config) { c.BackendTiers = []BackendTier{{Name: "lan"}} }, "tier #1 (lan) has no urls"},
+		{"backend tier url", func(c *Config) { c.BackendTiers = []BackendTier{{Name: "lan", URLs: []string{"gpu-1:11434"}}} }, `has url "gpu-1:11434"`},
+		{
+			"backend tier max_inflight",
+			func(c *Config) {
+				c.BackendTiers = []BackendTier{{Name: "lan", URLs: []string{"http://gpu-1:11434"}, MaxInflight: -1}}
+			},
+			"negative max_inflight",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.change(&c)
+			err := c.validate(map[string]string{})
+			if err != nil && strings.Contains(err.Error(), testKey) {
+				t.Errorf("validate() = %v, which has the API key", err)
+			}
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validate() = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("validate() = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
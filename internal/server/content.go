@@ -0,0 +1,12 @@
+package server
+
+import "strings"
+
+// base64FromDataURL returns the payload of a base64 data URL.
+func base64FromDataURL(url string) (string, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", false
+	}
+	_, data, ok := strings.Cut(url, ";base64,")
+	return data, ok
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Messages of a stored prompt this large or larger are stored once by
+// their hash, so system prompts repeated in every request don't multiply
+// the storage
+const CONTENT_BLOB_MIN_SIZE = 1024
+
+// Starts a stored prompt that is a list of parts instead of the text itself
+const CONTENT_MANIFEST_MARKER = "\x1e"
+
+// Role prefixes of the messages in a prompt, see OllamaRequest.PromptText
+var promptRolePrefixes = []string{"system: ", "user: ", "assistant: ", "tool: "}
+
+// contentPart is a piece of a stored prompt: text, or the hash of a blob.
+type contentPart struct {
+	Hash string `json:"h,omitempty"`
+	Text string `json:"t,omitempty"`
+}
+
+// promptSegments splits a prompt into its messages. A message whose content
+// has a line looking like another message splits there too, which only
+// costs deduplication: the segments always add up to text.
+func promptSegments(text string) []string {
+	var segments []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if current.Len() > 0 && hasRolePrefix(line) {
+			segments = append(segments, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		segments = append(segments, current.String())
+	}
+	return segments
+}
+
+func hasRolePrefix(line string) bool {
+	for _, prefix := range promptRolePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeContent replaces the large messages of a prompt by the hashes of
+// blobs holding them. It returns what to store and the blobs by hash. A
+// prompt without large messages is stored as it is, unless it happens to
+// start like a list of parts. Encrypted prompts have no messages to tell
+// apart and are always stored as they are.
+func encodeContent(text string) (string, map[string]string) {
+	var parts []contentPart
+	blobs := make(map[string]string)
+	for _, segment := range promptSegments(text) {
+		if len(segment) < CONTENT_BLOB_MIN_SIZE {
+			if n := len(parts); n > 0 && parts[n-1].Hash == "" {
+				parts[n-1].Text += segment
+				continue
+			}
+			parts = append(parts, contentPart{Text: segment})
+			continue
+		}
+		sum := sha256.Sum256([]byte(segment))
+		hash := hex.EncodeToString(sum[:])
+		blobs[hash] = segment
+		parts = append(parts, contentPart{Hash: hash})
+	}
+	if len(blobs) == 0 && !strings.HasPrefix(text, CONTENT_MANIFEST_MARKER) {
+		return text, nil
+	}
+	manifest, _ := json.Marshal(parts)
+	return CONTENT_MANIFEST_MARKER + string(manifest), blobs
+}
+
+// decodeContent reassembles a stored prompt, looking its blobs up with blob.
+func decodeContent(stored string, blob func(hash string) (string, error)) (string, error) {
+	parts, ok := contentParts(stored)
+	if !ok {
+		return stored, nil
+	}
+	var text strings.Builder
+	for _, part := range parts {
+		if part.Hash == "" {
+			text.WriteString(part.Text)
+			continue
+		}
+		content, err := blob(part.Hash)
+		if err != nil {
+			return "", fmt.Errorf("content blob %s: %w", part.Hash, err)
+		}
+		text.WriteString(content)
+	}
+	return text.String(), nil
+}
+
+// contentHashes lists the blobs a stored prompt refers to.
+func contentHashes(stored string) []string {
+	parts, _ := contentParts(stored)
+	var hashes []string
+	for _, part := range parts {
+		if part.Hash != "" {
+			hashes = append(hashes, part.Hash)
+		}
+	}
+	return hashes
+}
+
+func contentParts(stored string) ([]contentPart, bool) {
+	manifest, ok := strings.CutPrefix(stored, CONTENT_MANIFEST_MARKER)
+	if !ok {
+		return nil, false
+	}
+	var parts []contentPart
+	if err := json.Unmarshal([]byte(manifest), &parts); err != nil {
+		return nil, false
+	}
+	return parts, true
+}
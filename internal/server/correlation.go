@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Header carrying the correlation ID on upstream calls
+const CORRELATION_HEADER = "X-Request-ID"
+
+type requestIDContextKey struct{}
+
+type requestCorrelation struct {
+	id    string
+	calls atomic.Int32
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	requestLogFromContext(ctx).setCompletionID(id)
+	return context.WithValue(ctx, requestIDContextKey{}, &requestCorrelation{id: id})
+}
+
+// tagUpstreamRequest gives an upstream call its own correlation ID derived
+// from the proxy request ID (a request can make several calls: re-prompts,
+// classifiers) and logs the mapping at debug level for matching against
+// Ollama's logs.
+func tagUpstreamRequest(ctx context.Context, req *http.Request, model string) {
+	c, ok := ctx.Value(requestIDContextKey{}).(*requestCorrelation)
+	if !ok {
+		return
+	}
+	correlationID := fmt.Sprintf("%s.%d", c.id, c.calls.Add(1))
+	req.Header.Set(CORRELATION_HEADER, correlationID)
+	tenantFromContext(ctx).log.Debug("upstream call", "request", c.id, "correlation_id", correlationID, "model", model)
+}
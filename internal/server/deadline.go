@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Headers a client can use to ask for a deadline shorter than the
+// configured request_timeout.
+// X-Stainless-Timeout is what the official OpenAI SDKs send.
+var requestTimeoutHeaders = []string{"X-Request-Timeout", "X-Stainless-Timeout"}
+
+// DeadlineExceededResponse is an OpenAI-style error that also reports how much
+// was generated before the deadline hit.
+type DeadlineExceededResponse struct {
+	ErrorResponse
+	Usage Usage `json:"usage"`
+}
+
+func requestTimeout(r *http.Request) time.Duration {
+	for _, header := range requestTimeoutHeaders {
+		timeout, ok := parseTimeout(r.Header.Get(header), config.RequestTimeout)
+		if ok && timeout < config.RequestTimeout {
+			return timeout
+		}
+	}
+	return config.RequestTimeout
+}
+
+// parseTimeout accepts plain seconds ("30", "2.5") or a Go duration ("90s").
+// Timeouts above limit come back as limit, so huge values don't overflow.
+func parseTimeout(value string, limit time.Duration) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if !(seconds > 0) {
+			return 0, false
+		}
+		if seconds >= limit.Seconds() {
+			return limit, true
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	timeout, err := time.ParseDuration(value)
+	return min(timeout, limit), err == nil && timeout > 0
+}
+
+func sendDeadlineExceeded(w http.ResponseWriter, r *http.Request, prompt string, partial string) {
+	resp := DeadlineExceededResponse{
+		Usage: Usage{
+			PromptTokens:     translate.EstimateTokens(prompt),
+			CompletionTokens: translate.EstimateTokens(partial),
+			TotalTokens:      translate.EstimateTokens(prompt + partial),
+		},
+	}
+	resp.Error.Message = localizeError(r, "Request deadline exceeded before generation finished")
+	resp.Error.Type = "timeout_error"
+	resp.Error.Code = "deadline_exceeded"
+
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(http.StatusGatewayTimeout)
+	writeJSON(w, resp)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Deprecation marks a model name as going away, by requested name in
+// deprecated_models of the config file, giving client teams time to migrate
+// before the name is removed. Dates are YYYY-MM-DD.
+type Deprecation struct {
+	DeprecatedAt string `yaml:"deprecated_at"` // optional, when it was deprecated
+	Sunset       string `yaml:"sunset"`        // optional, when it stops working
+	Replacement  string `yaml:"replacement"`   // optional, what to migrate to
+}
+
+// setDeprecationHeaders adds Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers for a deprecated model and returns the warning for the response
+// body, or "" when the model isn't deprecated.
+func setDeprecationHeaders(w http.ResponseWriter, model string) string {
+	d, ok := config.DeprecatedModels[model]
+	if !ok {
+		return ""
+	}
+
+	w.Header().Set("Deprecation", "true")
+	if at, err := time.Parse(time.DateOnly, d.DeprecatedAt); err == nil {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(at.Unix(), 10))
+	}
+
+	warning := fmt.Sprintf("The model `%s` is deprecated", model)
+	if sunset, err := time.Parse(time.DateOnly, d.Sunset); err == nil {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		warning += " and will be removed on " + d.Sunset
+	}
+	if d.Replacement != "" {
+		warning += fmt.Sprintf(", use `%s` instead", d.Replacement)
+	}
+	return warning
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Seconds clients are told to wait while the proxy is draining
+const DRAIN_RETRY_AFTER = 120
+
+// DrainStatus is what GET/POST/DELETE /admin/drain report back.
+type DrainStatus struct {
+	Draining         bool   `json:"draining"`
+	Message          string `json:"message,omitempty"`
+	RetryAfter       int    `json:"retry_after,omitempty"`
+	InflightRequests int64  `json:"inflight_requests"`
+}
+
+var drain struct {
+	sync.RWMutex
+	enabled    bool
+	message    string
+	retryAfter int
+}
+
+var inflightRequests atomic.Int64
+
+func drainStatus() DrainStatus {
+	drain.RLock()
+	defer drain.RUnlock()
+	return DrainStatus{
+		Draining:         drain.enabled,
+		Message:          drain.message,
+		RetryAfter:       drain.retryAfter,
+		InflightRequests: inflightRequests.Load(),
+	}
+}
+
+// drainMiddleware turns new requests away while draining and keeps count of
+// the ones in flight, so an operator can wait for them to finish.
+func drainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := drainStatus(); status.Draining {
+			w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+			sendError(w, r, status.Message, "server_error", "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+
+		inflightRequests.Add(1)
+		defer inflightRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminDrain shows (GET), enables (POST) or disables (DELETE) drain mode.
+// POST takes an optional {"message": "...", "retry_after": seconds} body.
+func handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Message    string `json:"message"`
+			RetryAfter int    `json:"retry_after"`
+		}
+		if r.ContentLength != 0 {
+			if err := decodeJSONBody(r.Body, &body); err != nil {
+				sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+				return
+			}
+		}
+		if body.Message == "" {
+			body.Message = "The proxy is down for maintenance, please retry later"
+		}
+		if body.RetryAfter <= 0 {
+			body.RetryAfter = DRAIN_RETRY_AFTER
+		}
+
+		drain.Lock()
+		drain.enabled = true
+		drain.message = body.Message
+		drain.retryAfter = body.RetryAfter
+		drain.Unlock()
+	case http.MethodDelete:
+		drain.Lock()
+		drain.enabled = false
+		drain.message = ""
+		drain.retryAfter = 0
+		drain.Unlock()
+	default:
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, drainStatus())
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReadyz goes unready while draining so load balancers stop sending traffic.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if drainStatus().Draining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	setConfig(t, Config{})
+	t.Cleanup(func() {
+		drain.Lock()
+		drain.enabled, drain.message, drain.retryAfter = false, "", 0
+		drain.Unlock()
+	})
+	next := drainMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// the steps run in order, each changing drain mode for the next
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		// the admin response, and the status of a request and of /readyz after
+		wantStatus  int
+		wantDrain   DrainStatus
+		wantRequest int
+		wantReady   int
+	}{
+		{"not draining", http.MethodGet, "", http.StatusOK, DrainStatus{}, http.StatusOK, http.StatusOK},
+		{"drain", http.MethodPost, "", http.StatusOK, DrainStatus{Draining: true, Message: "The proxy is down for maintenance, please retry later", RetryAfter: DRAIN_RETRY_AFTER}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"drain with a message", http.MethodPost, `{"message": "Upgrading to 2.0", "retry_after": 30}`, http.StatusOK, DrainStatus{Draining: true, Message: "Upgrading to 2.0", RetryAfter: 30}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"bad body", http.MethodPost, `{"message": `, http.StatusBadRequest, DrainStatus{}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"still draining", http.MethodGet, "", http.StatusOK, DrainStatus{Draining: true, Message: "Upgrading to 2.0", RetryAfter: 30}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"method", http.MethodPut, "", http.StatusMethodNotAllowed, DrainStatus{}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"undrain", http.MethodDelete, "", http.StatusOK, DrainStatus{}, http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleAdminDrain(w, httptest.NewRequest(tt.method, "/admin/drain", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("admin status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				var got DrainStatus
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.wantDrain {
+					t.Errorf("drain status %+v, want %+v", got, tt.wantDrain)
+				}
+			}
+
+			w = httptest.NewRecorder()
+			next.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+			if w.Code != tt.wantRequest {
+				t.Errorf("request status %d, want %d", w.Code, tt.wantRequest)
+			}
+			if w.Code == http.StatusServiceUnavailable {
+				if code := errorCode(t, w); code != "maintenance" {
+					t.Errorf("error code %q, want maintenance", code)
+				}
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("no Retry-After")
+				}
+			}
+
+			w = httptest.NewRecorder()
+			handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.wantReady {
+				t.Errorf("readyz status %d, want %d", w.Code, tt.wantReady)
+			}
+		})
+	}
+}
+
+// Requests let in before drain mode count as in flight until they finish.
+func TestDrainInflight(t *testing.T) {
+	setConfig(t, Config{})
+	t.Cleanup(func() {
+		drain.Lock()
+		drain.enabled = false
+		drain.Unlock()
+	})
+	running, finish := make(chan struct{}), make(chan struct{})
+	next := drainMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(running)
+		<-finish
+	}))
+	done := make(chan struct{})
+	go func() {
+		next.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+		close(done)
+	}()
+	<-running
+
+	w := httptest.NewRecorder()
+	handleAdminDrain(w, httptest.NewRequest(http.MethodPost, "/admin/drain", nil))
+	if got := drainStatus().InflightRequests; got != 1 {
+		t.Errorf("%d requests in flight while one runs, want 1", got)
+	}
+	close(finish)
+	<-done
+	if got := drainStatus().InflightRequests; got != 0 {
+		t.Errorf("%d requests in flight after it finished, want 0", got)
+	}
+}
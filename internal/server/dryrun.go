@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ollama-openai-proxy/translate"
+)
+
+// DryRunResponse describes what would have been sent upstream for a request
+// that was validated but not generated.
+type DryRunResponse struct {
+	Object      string        `json:"object"`
+	UpstreamURL string        `json:"upstream_url"`
+	Request     OllamaRequest `json:"request"`
+	Usage       Usage         `json:"usage"`
+}
+
+// isDryRun reports whether the client asked for validation only, either via
+// the X-Dry-Run header or the :validate endpoint.
+func isDryRun(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, ":validate") {
+		return true
+	}
+	dryRun, _ := strconv.ParseBool(r.Header.Get("X-Dry-Run"))
+	return dryRun
+}
+
+func sendDryRun(w http.ResponseWriter, ollamaReq OllamaRequest) {
+	promptTokens := translate.EstimateTokens(ollamaReq.PromptText())
+	writeJSON(w, DryRunResponse{
+		Object:      "chat.completion.dry_run",
+		UpstreamURL: upstreamURL(ollamaReq),
+		Request:     ollamaReq,
+		Usage: Usage{
+			PromptTokens: promptTokens,
+			TotalTokens:  promptTokens,
+		},
+	})
+}
@@ -0,0 +1,721 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest input file of an embedding job
+	EMBEDDING_JOB_MAX_BYTES = 100 << 20
+	// Texts embedded per generation slot, so a job takes turns with
+	// interactive requests instead of holding a slot throughout
+	EMBEDDING_JOB_BATCH = 64
+	// Pause before a job asks for a slot again when the queue is full
+	EMBEDDING_JOB_RETRY_INTERVAL = 5 * time.Second
+	// How long finished jobs and their results are kept
+	EMBEDDING_JOB_RETENTION = 24 * time.Hour
+)
+
+// Embedding job statuses
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_COMPLETED = "completed"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// EmbeddingJob is an embedding job as the API shows it.
+type EmbeddingJob struct {
+	ID     string `json:"id"`
+	Object string `json:"object"`
+	Model  string `json:"model"`
+	// where the vectors go instead of the results file
+	Collection string `json:"collection,omitempty"`
+	Status     string `json:"status"`
+	// texts in the file, and how many are embedded so far
+	Total      int    `json:"total"`
+	Completed  int    `json:"completed"`
+	CreatedAt  int64  `json:"created_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// download of the vectors, once the job completed
+	ResultsURL string         `json:"results_url,omitempty"`
+	Usage      EmbeddingUsage `json:"usage"`
+}
+
+type EmbeddingJobList struct {
+	Object string         `json:"object"`
+	Data   []EmbeddingJob `json:"data"`
+}
+
+// EmbeddingJobResult is a line of a job's results file.
+type EmbeddingJobResult struct {
+	ID        string            `json:"id"`
+	Embedding []float64         `json:"embedding"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// embeddingJob is a job in progress or finished, owned by a namespace as
+// collections are, see ragNamespace.
+type embeddingJob struct {
+	mu        sync.Mutex
+	api       EmbeddingJob
+	namespace string
+	docs      []CollectionDocument
+	cancel    context.CancelFunc
+	finished  time.Time
+
+	// Ollama model after aliases, and who usage is recorded for; the
+	// journal only has the key's name and usageKeyHash
+	model   string
+	apiKey  string
+	keyName string
+	keyHash string
+	tenant  string
+	// length of the results file after the last batch
+	resultsBytes int64
+	// set once DELETE removed the job's files, so nothing writes them again
+	deleted bool
+}
+
+// embeddingJobRecord is the journal entry of a job, <id>.json in
+// embedding_jobs_dir. It is rewritten after every batch, and the texts of
+// an unfinished job are kept next to it in <id>.input.jsonl, so a restart
+// can carry on where the job was, see restoreEmbeddingJobs.
+type embeddingJobRecord struct {
+	Job          EmbeddingJob `json:"job"`
+	Namespace    string       `json:"namespace"`
+	Model        string       `json:"resolved_model"`
+	KeyName      string       `json:"key_name,omitempty"`
+	KeyHash      string       `json:"key_hash,omitempty"`
+	Tenant       string       `json:"tenant,omitempty"`
+	ResultsBytes int64        `json:"results_bytes"`
+	Finished     time.Time    `json:"finished"`
+}
+
+var embeddingJobs = struct {
+	sync.Mutex
+	jobs map[string]*embeddingJob
+}{jobs: make(map[string]*embeddingJob)}
+
+func (j *embeddingJob) view() EmbeddingJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.api
+}
+
+func (j *embeddingJob) resultsFile() string {
+	return filepath.Join(config.EmbeddingJobsDir, j.api.ID+".jsonl")
+}
+
+func (j *embeddingJob) journalFile() string {
+	return filepath.Join(config.EmbeddingJobsDir, j.api.ID+".json")
+}
+
+func (j *embeddingJob) inputFile() string {
+	return filepath.Join(config.EmbeddingJobsDir, j.api.ID+".input.jsonl")
+}
+
+// saveJournal rewrites the journal entry of j. Callers hold j.mu.
+func (j *embeddingJob) saveJournal() error {
+	if j.deleted {
+		return nil
+	}
+	return saveJournalEntry(j.journalFile(), embeddingJobRecord{
+		Job:          j.api,
+		Namespace:    j.namespace,
+		Model:        j.model,
+		KeyName:      j.keyName,
+		KeyHash:      j.keyHash,
+		Tenant:       j.tenant,
+		ResultsBytes: j.resultsBytes,
+		Finished:     j.finished,
+	})
+}
+
+// removeFiles deletes everything j keeps on disk. Callers hold j.mu.
+func (j *embeddingJob) removeFiles() {
+	os.Remove(j.resultsFile())
+	os.Remove(j.inputFile())
+	os.Remove(j.journalFile())
+}
+
+// handleEmbeddingJobs embeds files of texts in the background, for corpora
+// too large for one /v1/embeddings request:
+//
+//	POST   /v1/embeddings/jobs               start a job
+//	GET    /v1/embeddings/jobs               list the caller's jobs
+//	GET    /v1/embeddings/jobs/{id}          status and progress of a job
+//	GET    /v1/embeddings/jobs/{id}/results  download the vectors
+//	DELETE /v1/embeddings/jobs/{id}          cancel a job and delete it
+func handleEmbeddingJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if config.EmbeddingJobsDir == "" {
+		sendError(w, r, "Embedding jobs are not enabled on this proxy", "invalid_request_error", "not_found", http.StatusNotFound)
+		return
+	}
+	sweepEmbeddingJobs(time.Now())
+	namespace := ragNamespace(r)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/embeddings/jobs"), "/")
+	id, sub, _ := strings.Cut(path, "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := EmbeddingJobList{Object: "list", Data: []EmbeddingJob{}}
+			embeddingJobs.Lock()
+			for _, job := range embeddingJobs.jobs {
+				if job.namespace == namespace {
+					list.Data = append(list.Data, job.view())
+				}
+			}
+			embeddingJobs.Unlock()
+			sort.Slice(list.Data, func(i, j int) bool { return list.Data[i].CreatedAt > list.Data[j].CreatedAt })
+			writeJSON(w, list)
+		case http.MethodPost:
+			createEmbeddingJob(w, r, namespace)
+		default:
+			sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	embeddingJobs.Lock()
+	job := embeddingJobs.jobs[id]
+	embeddingJobs.Unlock()
+	if job == nil || job.namespace != namespace {
+		sendError(w, r, "Embedding job `%s` does not exist", "invalid_request_error", "job_not_found", http.StatusNotFound, id)
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		writeJSON(w, job.view())
+	case sub == "" && r.Method == http.MethodDelete:
+		job.cancel()
+		embeddingJobs.Lock()
+		delete(embeddingJobs.jobs, id)
+		embeddingJobs.Unlock()
+		job.mu.Lock()
+		job.deleted = true
+		job.removeFiles()
+		job.mu.Unlock()
+		view := job.view()
+		if view.Status == JOB_QUEUED || view.Status == JOB_RUNNING {
+			view.Status = JOB_CANCELLED
+		}
+		writeJSON(w, view)
+	case sub == "results" && r.Method == http.MethodGet:
+		view := job.view()
+		if view.Status != JOB_COMPLETED || view.Collection != "" {
+			sendError(w, r, "Embedding job `%s` has no results to download", "invalid_request_error", "results_not_ready", http.StatusConflict, id)
+			return
+		}
+		f, err := os.Open(job.resultsFile())
+		if err != nil {
+			sendError(w, r, "Error reading the results: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".jsonl"))
+		io.Copy(w, f)
+	case sub != "" && sub != "results":
+		sendError(w, r, "Not found", "invalid_request_error", "not_found", http.StatusNotFound)
+	default:
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createEmbeddingJob takes a multipart form with the texts as `file`, JSONL
+// or CSV, the embedding `model` and optionally the `collection` to add the
+// vectors to. The file is read and checked before the job is accepted.
+func createEmbeddingJob(w http.ResponseWriter, r *http.Request, namespace string) {
+	r.Body = http.MaxBytesReader(w, r.Body, EMBEDDING_JOB_MAX_BYTES+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		sendParamError(w, r, "file must be a JSONL or CSV file of texts", "invalid_file", "file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	requested := r.FormValue("model")
+	var c *collection
+	if name := r.FormValue("collection"); name != "" {
+		if vectorIndex == nil {
+			sendError(w, r, "No vector store is configured", "invalid_request_error", "vector_store_disabled", http.StatusNotFound)
+			return
+		}
+		if c = vectorIndex.get(namespace, name); c == nil {
+			sendError(w, r, "Collection `%s` does not exist", "invalid_request_error", "collection_not_found", http.StatusNotFound, name)
+			return
+		}
+		if requested == "" {
+			requested = c.EmbeddingModel
+		}
+		if requested != c.EmbeddingModel {
+			sendParamError(w, r, "Collection `%s` is embedded with `%s`", "invalid_model", "model", http.StatusBadRequest, name, c.EmbeddingModel)
+			return
+		}
+	}
+	if requested == "" {
+		sendError(w, r, "Model is required", "invalid_request_error", "invalid_model", http.StatusBadRequest)
+		return
+	}
+	model, ok := resolveModelAlias(r.Context(), requested)
+	if !ok {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, requested)
+		return
+	}
+	apiKey := apiKeyFromRequest(r)
+	if !modelPermitted(apiKey, requested, model) {
+		sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, requested)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "jsonl"
+		if strings.EqualFold(filepath.Ext(header.Filename), ".csv") {
+			format = "csv"
+		}
+	}
+	var docs []CollectionDocument
+	switch format {
+	case "jsonl":
+		docs, err = readJSONLTexts(file)
+	case "csv":
+		docs, err = readCSVTexts(file)
+	default:
+		sendParamError(w, r, "Unsupported format `%s`, use jsonl or csv", "invalid_format", "format", http.StatusBadRequest, format)
+		return
+	}
+	if err == nil && len(docs) == 0 {
+		err = errors.New("it has no texts")
+	}
+	if err != nil {
+		sendParamError(w, r, "Invalid file: %s", "invalid_file", "file", http.StatusBadRequest, err)
+		return
+	}
+	for i := range docs {
+		if docs[i].ID == "" {
+			docs[i].ID = "doc_" + generateRandomString(16)
+		}
+	}
+
+	job := &embeddingJob{
+		api: EmbeddingJob{
+			ID:        "embjob-" + generateRandomString(16),
+			Object:    "embedding.job",
+			Model:     requested,
+			Status:    JOB_QUEUED,
+			Total:     len(docs),
+			CreatedAt: getCurrentUnixTimestamp(),
+		},
+		namespace: namespace,
+		docs:      docs,
+		model:     model,
+		apiKey:    apiKey,
+		keyHash:   usageKeyHash(apiKey),
+		tenant:    tenantFromContext(r.Context()).name,
+	}
+	if entry := apiKeys.lookup(apiKey); entry != nil {
+		job.keyName = entry.Name
+	}
+	if c != nil {
+		job.api.Collection = c.Name
+	}
+	if err := saveJobInput(job); err != nil {
+		job.removeFiles()
+		sendError(w, r, "Error saving the embedding job: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+	// the job outlives the request, but keeps its tenant and key for usage
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	job.cancel = cancel
+	embeddingJobs.Lock()
+	embeddingJobs.jobs[job.api.ID] = job
+	embeddingJobs.Unlock()
+	log.Printf("embedding job %s: %d texts with %s", job.api.ID, len(docs), model)
+	go runEmbeddingJob(ctx, job, c)
+
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job.view())
+}
+
+// saveJobInput journals a job that was just accepted: its texts, then its
+// entry.
+func saveJobInput(job *embeddingJob) error {
+	var lines bytes.Buffer
+	for _, doc := range job.docs {
+		if err := writeJSON(&lines, doc); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(job.inputFile(), lines.Bytes(), 0o600); err != nil {
+		return err
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.saveJournal()
+}
+
+// readJSONLTexts reads one text per line: a JSON string, or an object with
+// `text` and optionally `id` and `metadata`.
+func readJSONLTexts(r io.Reader) ([]CollectionDocument, error) {
+	var docs []CollectionDocument
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), EMBEDDING_JOB_MAX_BYTES)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var doc CollectionDocument
+		if data[0] == '"' {
+			if err := json.Unmarshal(data, &doc.Text); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		} else if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if strings.TrimSpace(doc.Text) == "" {
+			return nil, fmt.Errorf("line %d has no text", line)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, scanner.Err()
+}
+
+// readCSVTexts reads a CSV file with a header row. The `text` column is
+// embedded, an `id` column names the texts and the other columns are kept
+// as metadata.
+func readCSVTexts(r io.Reader) ([]CollectionDocument, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no header row: %w", err)
+	}
+	textColumn := -1
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), "text") {
+			textColumn = i
+		}
+	}
+	if textColumn < 0 {
+		return nil, errors.New("the header row has no text column")
+	}
+	var docs []CollectionDocument
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		doc := CollectionDocument{Text: row[textColumn]}
+		if strings.TrimSpace(doc.Text) == "" {
+			return nil, fmt.Errorf("line %d has no text", line)
+		}
+		for i, value := range row {
+			name := strings.TrimSpace(header[i])
+			switch {
+			case i == textColumn || value == "":
+			case strings.EqualFold(name, "id"):
+				doc.ID = value
+			default:
+				if doc.Metadata == nil {
+					doc.Metadata = make(map[string]string)
+				}
+				doc.Metadata[name] = value
+			}
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// runEmbeddingJob embeds the texts of job batch by batch, each batch with
+// a generation slot of its own, and writes the vectors to the results file
+// or adds them to c. A job restored after a restart starts after the last
+// batch its journal recorded.
+func runEmbeddingJob(ctx context.Context, job *embeddingJob, c *collection) {
+	t := tenantFromContext(ctx)
+	resumed := job.api.Completed > 0
+	err := func() error {
+		var results *os.File
+		if c == nil {
+			// a batch written after the last journal entry is written again
+			f, err := os.OpenFile(job.resultsFile(), os.O_CREATE|os.O_WRONLY, 0o600)
+			if err == nil {
+				err = f.Truncate(job.resultsBytes)
+			}
+			if err == nil {
+				_, err = f.Seek(job.resultsBytes, io.SeekStart)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to open the results file: %w", err)
+			}
+			defer f.Close()
+			results = f
+		}
+
+		for start := job.api.Completed; start < len(job.docs); start += EMBEDDING_JOB_BATCH {
+			docs := job.docs[start:min(start+EMBEDDING_JOB_BATCH, len(job.docs))]
+			texts := make([]string, len(docs))
+			for i, doc := range docs {
+				texts[i] = doc.Text
+			}
+			vectors, counts, err := embedJobBatch(ctx, job, job.model, texts)
+			if err != nil {
+				return err
+			}
+
+			var tokens int
+			var lines bytes.Buffer
+			records := make([]VectorRecord, len(docs))
+			for i, doc := range docs {
+				tokens += embeddingTokens(counts[i], doc.Text)
+				records[i] = VectorRecord{ID: doc.ID, Text: doc.Text, Metadata: doc.Metadata, Embedding: vectors[i]}
+				if c == nil {
+					if config.NormalizeEmbeddings {
+						normalizeVector(vectors[i])
+					}
+					if err := writeJSON(&lines, EmbeddingJobResult{ID: doc.ID, Embedding: vectors[i], Metadata: doc.Metadata}); err != nil {
+						return err
+					}
+				}
+			}
+			if c != nil {
+				if resumed {
+					// the batch may have reached the collection before the
+					// restart, but not the journal
+					records = withoutStoredRecords(c, records)
+					resumed = false
+				}
+				if err := c.append(records); err != nil {
+					return fmt.Errorf("failed to update the vector store: %w", err)
+				}
+			} else if _, err := results.Write(lines.Bytes()); err != nil {
+				return fmt.Errorf("failed to write the results: %w", err)
+			}
+
+			t.recordUsage(ctx, job.apiKey, job.api.Model, Usage{PromptTokens: tokens, TotalTokens: tokens}, "", "")
+			job.mu.Lock()
+			job.api.Completed += len(docs)
+			job.api.Usage.PromptTokens += tokens
+			job.api.Usage.TotalTokens += tokens
+			job.resultsBytes += int64(lines.Len())
+			err = job.saveJournal()
+			job.mu.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to write the journal: %w", err)
+			}
+		}
+		return nil
+	}()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	defer func() {
+		if err := job.saveJournal(); err != nil {
+			log.Printf("embedding job %s: failed to write the journal: %v", job.api.ID, err)
+		}
+	}()
+	os.Remove(job.inputFile())
+	job.docs = nil
+	job.finished = time.Now()
+	job.api.FinishedAt = job.finished.Unix()
+	switch {
+	case ctx.Err() != nil:
+		job.api.Status = JOB_CANCELLED
+		log.Printf("embedding job %s cancelled after %d of %d texts", job.api.ID, job.api.Completed, job.api.Total)
+	case err != nil:
+		job.api.Status = JOB_FAILED
+		job.api.Error = err.Error()
+		log.Printf("embedding job %s failed after %d of %d texts: %v", job.api.ID, job.api.Completed, job.api.Total, err)
+	default:
+		job.api.Status = JOB_COMPLETED
+		if c == nil {
+			job.api.ResultsURL = "/v1/embeddings/jobs/" + job.api.ID + "/results"
+		}
+		log.Printf("embedding job %s completed, %d texts", job.api.ID, job.api.Total)
+	}
+}
+
+// embedJobBatch embeds texts once it gets a generation slot, waiting its
+// turn behind interactive requests for as long as the queue is full.
+func embedJobBatch(ctx context.Context, job *embeddingJob, model string, texts []string) ([][]float64, []int, error) {
+	for {
+		release, err := generationSlots.acquire(ctx, func() {})
+		var capErr *capacityError
+		if errors.As(err, &capErr) {
+			select {
+			case <-time.After(EMBEDDING_JOB_RETRY_INTERVAL):
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		job.mu.Lock()
+		job.api.Status = JOB_RUNNING
+		job.mu.Unlock()
+		vectors, tokens, err := embedAll(ctx, model, texts)
+		release()
+		return vectors, tokens, err
+	}
+}
+
+// sweepEmbeddingJobs forgets jobs finished longer than
+// EMBEDDING_JOB_RETENTION ago, and deletes their results.
+func sweepEmbeddingJobs(now time.Time) {
+	embeddingJobs.Lock()
+	defer embeddingJobs.Unlock()
+	for id, job := range embeddingJobs.jobs {
+		job.mu.Lock()
+		expired := !job.finished.IsZero() && now.Sub(job.finished) > EMBEDDING_JOB_RETENTION
+		job.mu.Unlock()
+		if expired {
+			delete(embeddingJobs.jobs, id)
+			job.mu.Lock()
+			job.removeFiles()
+			job.mu.Unlock()
+		}
+	}
+}
+
+// withoutStoredRecords drops the records c already has by ID.
+func withoutStoredRecords(c *collection, records []VectorRecord) []VectorRecord {
+	c.mu.RLock()
+	stored := make(map[string]bool, len(c.records))
+	for _, record := range c.records {
+		stored[record.ID] = true
+	}
+	c.mu.RUnlock()
+	kept := records[:0]
+	for _, record := range records {
+		if !stored[record.ID] {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// restoreEmbeddingJobs reads the journal of embedding_jobs_dir at startup.
+// Finished jobs are listed again until EMBEDDING_JOB_RETENTION is up. Jobs
+// a restart interrupted carry on after their last batch, or fail with the
+// reason when they can't, e.g. because their collection is gone, so
+// clients polling them see how they ended.
+func restoreEmbeddingJobs() {
+	readJournal(config.EmbeddingJobsDir, func(path string, data []byte) error {
+		var record embeddingJobRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if record.Job.ID == "" {
+			return errors.New("no job ID")
+		}
+		job := &embeddingJob{
+			api:          record.Job,
+			namespace:    record.Namespace,
+			cancel:       func() {},
+			finished:     record.Finished,
+			model:        record.Model,
+			apiKey:       apiKeys.find(record.KeyName, record.KeyHash),
+			keyName:      record.KeyName,
+			keyHash:      record.KeyHash,
+			tenant:       record.Tenant,
+			resultsBytes: record.ResultsBytes,
+		}
+		embeddingJobs.Lock()
+		embeddingJobs.jobs[job.api.ID] = job
+		embeddingJobs.Unlock()
+		if job.api.Status != JOB_QUEUED && job.api.Status != JOB_RUNNING {
+			return nil
+		}
+		if err := resumeEmbeddingJob(job); err != nil {
+			job.mu.Lock()
+			job.finished = time.Now()
+			job.api.FinishedAt = job.finished.Unix()
+			job.api.Status = JOB_FAILED
+			job.api.Error = "interrupted by a restart of the proxy and not resumable: " + err.Error()
+			os.Remove(job.inputFile())
+			if err := job.saveJournal(); err != nil {
+				log.Printf("embedding job %s: failed to write the journal: %v", job.api.ID, err)
+			}
+			job.mu.Unlock()
+			log.Printf("embedding job %s failed after a restart: %v", job.api.ID, err)
+		}
+		return nil
+	})
+}
+
+// resumeEmbeddingJob starts a job the journal shows unfinished again.
+func resumeEmbeddingJob(job *embeddingJob) error {
+	f, err := os.Open(job.inputFile())
+	if err != nil {
+		return fmt.Errorf("its texts are gone: %w", err)
+	}
+	docs, err := readJSONLTexts(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("its texts are unreadable: %w", err)
+	}
+	if len(docs) != job.api.Total {
+		return fmt.Errorf("%d of its %d texts are left", len(docs), job.api.Total)
+	}
+	var c *collection
+	if job.api.Collection != "" {
+		if vectorIndex != nil {
+			c = vectorIndex.get(job.namespace, job.api.Collection)
+		}
+		if c == nil {
+			return fmt.Errorf("collection %s does not exist anymore", job.api.Collection)
+		}
+	}
+	if job.apiKey == "" && (job.keyName != "" || job.keyHash != "") {
+		return errors.New("its API key is not configured anymore")
+	}
+	t := defaultTenant
+	if job.tenant != "" {
+		if t = tenants[job.tenant]; t == nil {
+			return fmt.Errorf("tenant %s is not configured anymore", job.tenant)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), tenantContextKey{}, t))
+	job.mu.Lock()
+	job.docs = docs
+	job.cancel = cancel
+	job.api.Status = JOB_QUEUED
+	job.mu.Unlock()
+	log.Printf("embedding job %s: resuming after %d of %d texts", job.api.ID, job.api.Completed, job.api.Total)
+	go runEmbeddingJob(ctx, job, c)
+	return nil
+}
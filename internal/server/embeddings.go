@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Inputs of one request embedded at the same time
+const EMBEDDING_CONCURRENCY = 4
+
+type EmbeddingRequest struct {
+	Model          string `json:"model"`
+	Input          any    `json:"input"`
+	EncodingFormat string `json:"encoding_format,omitempty"`
+	User           string `json:"user,omitempty"`
+	// vendor extensions, see ProxyExtensions
+	Proxy *ProxyExtensions `json:"x_proxy,omitempty"`
+	// L2-normalize the vectors, defaults to normalize_embeddings; older form
+	// of x_proxy.normalize
+	Normalize *bool `json:"normalize,omitempty"`
+}
+
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type Embedding struct {
+	Object string `json:"object"`
+	Index  int    `json:"index"`
+	// []float64, or a base64 string of little-endian float32s
+	Embedding any `json:"embedding"`
+}
+
+type OllamaEmbedRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+	// cut inputs to the context length; chunking turns it off, so a chunk
+	// beyond it fails instead of being counted short
+	Truncate bool `json:"truncate"`
+}
+
+type OllamaEmbedResponse struct {
+	Embeddings      [][]float64 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body map[string]any
+	if err := decodeJSONBody(r.Body, &body); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if err := validateExtensions(body, "/v1/embeddings"); err != nil {
+		sendParamError(w, r, err.format, err.code, err.param, err.status, err.args...)
+		return
+	}
+	var req EmbeddingRequest
+	if err := decodeRequest(body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Model == "" {
+		sendError(w, r, "Model is required", "invalid_request_error", "invalid_model", http.StatusBadRequest)
+		return
+	}
+	inputs, ok := embeddingInputs(req.Input)
+	if !ok {
+		sendParamError(w, r, "Input must be a non-empty string or array of strings", "invalid_input", "input", http.StatusBadRequest)
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		sendParamError(w, r, "Unsupported encoding_format `%s`", "invalid_encoding_format", "encoding_format", http.StatusBadRequest, req.EncodingFormat)
+		return
+	}
+
+	model, ok := resolveModelAlias(r.Context(), req.Model)
+	if !ok {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, req.Model)
+		return
+	}
+	if !modelPermitted(apiKeyFromRequest(r), req.Model, model) {
+		sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, req.Model)
+		return
+	}
+	modelPrefetcher.observe(apiKeyFromRequest(r), model)
+
+	requestID := "embd-" + generateRandomString(10)
+	tenantName := tenantFromContext(r.Context()).name
+	events.publish(Event{Type: EVENT_ACCEPTED, RequestID: requestID, Tenant: tenantName, Model: model})
+
+	ctx, untrack := runningRequests.track(withRequestID(r.Context(), requestID), requestID, apiKeyFromRequest(r), model)
+	defer untrack()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(r))
+	defer cancel()
+
+	vectors, tokens, err := embedCached(ctx, w, r, tenantName, model, inputs)
+	if err != nil {
+		events.publish(Event{Type: EVENT_ERROR, RequestID: requestID, Tenant: tenantName, Model: model, Error: err.Error()})
+		if errors.Is(context.Cause(ctx), errCanceledByAdmin) {
+			sendError(w, r, "Request canceled by an administrator", "server_error", "request_canceled", http.StatusServiceUnavailable)
+			return
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			sendError(w, r, "Request deadline exceeded before generation finished", "timeout_error", "deadline_exceeded", http.StatusGatewayTimeout)
+			return
+		}
+		var circuitErr *circuitOpenError
+		if errors.As(err, &circuitErr) {
+			sendCircuitOpenError(w, r, circuitErr)
+			return
+		}
+		if apiErr := upstreamAPIError(err); apiErr != nil {
+			sendUpstreamAPIError(w, r, apiErr, "input")
+			return
+		}
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+
+	normalize := config.NormalizeEmbeddings
+	if req.Proxy != nil && req.Proxy.Normalize != nil {
+		normalize = *req.Proxy.Normalize
+	} else if req.Normalize != nil {
+		normalize = *req.Normalize
+	}
+	resp := EmbeddingResponse{Object: "list", Data: make([]Embedding, len(vectors)), Model: req.Model}
+	for i, vector := range vectors {
+		if normalize {
+			normalizeVector(vector)
+		}
+		resp.Data[i] = Embedding{Object: "embedding", Index: i, Embedding: vector}
+		if req.EncodingFormat == "base64" {
+			resp.Data[i].Embedding = encodeEmbeddingBase64(vector)
+		}
+		resp.Usage.PromptTokens += embeddingTokens(tokens[i], inputs[i])
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+
+	usage := Usage{PromptTokens: resp.Usage.PromptTokens, TotalTokens: resp.Usage.TotalTokens}
+	tenantFromContext(r.Context()).recordUsage(r.Context(), apiKeyFromRequest(r), req.Model, usage, "", "")
+	events.publish(Event{Type: EVENT_DONE, RequestID: requestID, Tenant: tenantName, Model: model, Usage: &usage})
+	writeJSON(w, resp)
+}
+
+// embeddingInputs accepts a string or an array of strings. Token arrays
+// aren't supported, Ollama only embeds text.
+func embeddingInputs(input any) ([]string, bool) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, v != ""
+	case []any:
+		inputs := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			inputs[i] = s
+		}
+		return inputs, len(inputs) > 0
+	}
+	return nil, false
+}
+
+// normalizeVector scales v to unit length in place. Some Ollama embedding
+// models return unnormalized vectors, while cosine similarity code often
+// assumes unit length and just takes the dot product. The zero vector is
+// left as it is.
+func normalizeVector(v []float64) {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	if sum == 0 {
+		return
+	}
+	norm := math.Sqrt(sum)
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+// embeddingTokens is Ollama's prompt_eval_count for an input, estimated
+// for cached inputs and servers that don't report it.
+func embeddingTokens(count int, input string) int {
+	if count == 0 {
+		return translate.EstimateTokens(input)
+	}
+	return count
+}
+
+// embedCached answers the inputs it can from the response cache and embeds
+// the rest, caching them. The token counts of cached inputs are 0.
+func embedCached(ctx context.Context, w http.ResponseWriter, r *http.Request, tenant, model string, inputs []string) ([][]float64, []int, error) {
+	if completionCache == nil || !routeFeaturesFor(ctx).cache {
+		return embedAll(ctx, model, inputs)
+	}
+	vectors := make([][]float64, len(inputs))
+	tokens := make([]int, len(inputs))
+	keys := make([]string, len(inputs))
+	var missing []int
+	var missingInputs []string
+	for i, input := range inputs {
+		keys[i] = embeddingCacheKey(tenant, model, input)
+		if !cacheBypassed(r) {
+			if vector, ok := completionCache.getEmbedding(ctx, keys[i]); ok {
+				metrics.cacheLookups.add(1, tenant, "hit")
+				vectors[i] = vector
+				continue
+			}
+			metrics.cacheLookups.add(1, tenant, "miss")
+		}
+		missing = append(missing, i)
+		missingInputs = append(missingInputs, input)
+	}
+	if len(missing) == 0 {
+		w.Header().Set(CACHE_HEADER, "HIT")
+		return vectors, tokens, nil
+	}
+	w.Header().Set(CACHE_HEADER, "MISS")
+
+	embedded, embeddedTokens, err := embedAll(ctx, model, missingInputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for j, i := range missing {
+		vectors[i] = embedded[j]
+		tokens[i] = embeddedTokens[j]
+		completionCache.putEmbedding(ctx, keys[i], embedded[j])
+	}
+	return vectors, tokens, nil
+}
+
+// embedAll embeds every input with its own upstream call, up to
+// EMBEDDING_CONCURRENCY at a time. The first failure cancels the rest.
+func embedAll(ctx context.Context, model string, inputs []string) ([][]float64, []int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	vectors := make([][]float64, len(inputs))
+	tokens := make([]int, len(inputs))
+	sem := make(chan struct{}, EMBEDDING_CONCURRENCY)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input string) {
+			defer wg.Done()
+			var err error
+			defer func() {
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}()
+			defer recoverAsError(&err)
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+			vectors[i], tokens[i], err = embed(ctx, model, input)
+		}(i, input)
+	}
+	wg.Wait()
+	return vectors, tokens, firstErr
+}
+
+func embed(ctx context.Context, model string, input string) ([]float64, int, error) {
+	var body bytes.Buffer
+	if err := writeJSON(&body, OllamaEmbedRequest{Model: model, Input: input, Truncate: true}); err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// the backend of the last call, held until its body is read; a missing
+	// model is pulled there
+	var b *backend
+	var probe bool
+	defer func() {
+		if b != nil {
+			b.end(probe)
+		}
+	}()
+	send := func() (*http.Response, error) {
+		if b != nil {
+			b.end(probe)
+			b = nil
+		}
+		picked := ollamaBackends.pick("")
+		isProbe, err := picked.allow()
+		if err != nil {
+			return nil, err
+		}
+		b, probe = picked, isProbe
+		b.begin()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/api/embed", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+		tagUpstreamRequest(ctx, req, model)
+		start := time.Now()
+		resp, err := upstreamClient.Do(req)
+		if ctx.Err() == nil {
+			b.observe(time.Since(start), backendFailed(resp, err), probe)
+		}
+		return resp, err
+	}
+	resp, err := retryUpstream(ctx, model, send)
+	if err == nil && resp.StatusCode == http.StatusNotFound && autoPullAllowed(model) {
+		resp.Body.Close()
+		if err := pullModel(ctx, b.url, model); err != nil {
+			return nil, 0, err
+		}
+		resp, err = retryUpstream(ctx, model, send)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, 0, &upstreamError{upstream: "ollama", model: model, status: resp.StatusCode, body: string(data)}
+	}
+
+	var embedResp OllamaEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if len(embedResp.Embeddings) != 1 {
+		return nil, 0, fmt.Errorf("failed to parse response: %d embeddings for one input", len(embedResp.Embeddings))
+	}
+	return embedResp.Embeddings[0], embedResp.PromptEvalCount, nil
+}
+
+// encodeEmbeddingBase64 packs a vector the way OpenAI does for
+// encoding_format "base64": little-endian float32s.
+func encodeEmbeddingBase64(vector []float64) string {
+	buf := make([]byte, 4*len(vector))
+	for i, f := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(f)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEmbedAllTokens(t *testing.T) {
+	counts := map[string]int{"hello": 2, "hello world": 3, "no count": 0}
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OllamaEmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		writeJSON(w, OllamaEmbedResponse{Embeddings: [][]float64{{1, 0}}, PromptEvalCount: counts[req.Input]})
+	}))
+	defer ollama.Close()
+	cfg := DefaultConfig()
+	cfg.OllamaAPIBase = ollama.URL
+	setConfig(t, cfg)
+	oldBackends := ollamaBackends
+	ollamaBackends = newBackendPool(backendTiers())
+	t.Cleanup(func() { ollamaBackends = oldBackends })
+
+	tests := []struct {
+		name   string
+		inputs []string
+		want   []int
+	}{
+		{"one input", []string{"hello"}, []int{2}},
+		{"several inputs", []string{"hello world", "hello"}, []int{3, 2}},
+		{"no prompt_eval_count", []string{"no count"}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vectors, tokens, err := embedAll(context.Background(), "nomic-embed-text", tt.inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vectors) != len(tt.inputs) {
+				t.Errorf("%d vectors for %d inputs", len(vectors), len(tt.inputs))
+			}
+			if !slices.Equal(tokens, tt.want) {
+				t.Errorf("tokens %v, want %v", tokens, tt.want)
+			}
+		})
+	}
+}
+
+// The backend counts an embedding in flight until its response is read.
+func TestEmbedHoldsBackend(t *testing.T) {
+	var b *backend
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// long enough for the client to have the headers
+		time.Sleep(20 * time.Millisecond)
+		if inflight := b.inflight.Load(); inflight != 1 {
+			t.Errorf("%d embeddings in flight while the body is sent, want 1", inflight)
+		}
+		writeJSON(w, OllamaEmbedResponse{Embeddings: [][]float64{{1, 0}}, PromptEvalCount: 1})
+	}))
+	defer ollama.Close()
+	cfg := DefaultConfig()
+	cfg.OllamaAPIBase = ollama.URL
+	setConfig(t, cfg)
+	oldBackends := ollamaBackends
+	ollamaBackends = newBackendPool(backendTiers())
+	t.Cleanup(func() { ollamaBackends = oldBackends })
+	b = ollamaBackends.tiers[0][0]
+
+	if _, _, err := embed(context.Background(), "nomic-embed-text", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if inflight := b.inflight.Load(); inflight != 0 {
+		t.Errorf("%d embeddings in flight after the response was read", inflight)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Stored prompts and responses encrypted with the tenant's key start with
+// this, followed by the base64 nonce and AES-256-GCM ciphertext
+const ENCRYPTED_CONTENT_PREFIX = "enc:v1:"
+
+// Tenant name of the default tenant's key in encryption.keys
+const DEFAULT_TENANT_KEY = "default"
+
+// Longest encryption.key_command may take per tenant
+const KEY_COMMAND_TIMEOUT = 30 * time.Second
+
+// contentKey returns the AEAD of a tenant's key from encryption.keys or, for
+// tenants not listed there, from encryption.key_command. It returns nil
+// when the tenant has no key, and its content is stored as it is.
+func contentKey(tenantName string) (cipher.AEAD, error) {
+	name := tenantName
+	if name == "" {
+		name = DEFAULT_TENANT_KEY
+	}
+	encoded, ok := config.Encryption.Keys[name]
+	if !ok && config.Encryption.KeyCommand != "" {
+		var err error
+		if encoded, err = runKeyCommand(name); err != nil {
+			return nil, fmt.Errorf("encryption key of tenant %s: %w", name, err)
+		}
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key of tenant %s must be 32 bytes in base64", name)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// runKeyCommand asks a KMS or secret manager for a tenant's key through
+// encryption.key_command, run by the shell with $TENANT set. It prints the
+// base64 key, or nothing for a tenant without one.
+func runKeyCommand(tenantName string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KEY_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", config.Encryption.KeyCommand)
+	cmd.Env = append(os.Environ(), "TENANT="+tenantName)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("key command failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setupEncryption loads the keys of every tenant opened so far.
+func setupEncryption() error {
+	var err error
+	if defaultTenant.aead, err = contentKey(""); err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		if t.aead, err = contentKey(t.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealContent encrypts stored content. Hashes stay as they are, so
+// repeated prompts can still be counted.
+func sealContent(aead cipher.AEAD, text string) string {
+	if aead == nil || text == "" || strings.HasPrefix(text, "sha256:") {
+		return text
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return ENCRYPTED_CONTENT_PREFIX + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(text), nil))
+}
+
+func openContent(aead cipher.AEAD, text string) (string, error) {
+	encoded, ok := strings.CutPrefix(text, ENCRYPTED_CONTENT_PREFIX)
+	if !ok {
+		return text, nil
+	}
+	if aead == nil {
+		return "", errors.New("no key to decrypt with")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted content")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("wrong key or corrupted content")
+	}
+	return string(plain), nil
+}
+
+// runDecrypt implements the `decrypt` subcommand: usage records on stdin
+// are written to stdout with their prompts and responses decrypted.
+func runDecrypt() {
+	keys := make(map[string]cipher.AEAD)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 64<<20)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for line := 1; scanner.Scan(); line++ {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: not a usage record: %v\n", line, err)
+			os.Exit(1)
+		}
+		aead, ok := keys[record.Tenant]
+		if !ok {
+			var err error
+			if aead, err = contentKey(record.Tenant); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			keys[record.Tenant] = aead
+		}
+		var err error
+		if record.Prompt, err = openContent(aead, record.Prompt); err == nil {
+			record.Response, err = openContent(aead, record.Response)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", line, err)
+			os.Exit(1)
+		}
+		writeJSON(out, record)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// testContentKey is a base64 AES-256 key whose bytes are all b.
+func testContentKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestContentKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption EncryptionConfig
+		tenant     string
+		// the key, "" for none
+		want string
+		// in the error, empty for none
+		wantErr string
+	}{
+		{"no keys", EncryptionConfig{}, "research", "", ""},
+		{"default tenant", EncryptionConfig{Keys: map[string]string{DEFAULT_TENANT_KEY: testContentKey(1)}}, "", testContentKey(1), ""},
+		{"listed tenant", EncryptionConfig{Keys: map[string]string{"research": testContentKey(2)}}, "research", testContentKey(2), ""},
+		{"unlisted tenant", EncryptionConfig{Keys: map[string]string{"research": testContentKey(2)}}, "sales", "", ""},
+		{
+			"key command",
+			EncryptionConfig{Keys: map[string]string{"research": testContentKey(2)}, KeyCommand: `[ "$TENANT" = sales ] && echo ` + testContentKey(3)},
+			"sales", testContentKey(3), "",
+		},
+		{"key command without a key", EncryptionConfig{KeyCommand: "true"}, "sales", "", ""},
+		{"key command failing", EncryptionConfig{KeyCommand: "exit 3"}, "sales", "", "key command failed"},
+		{"short key", EncryptionConfig{Keys: map[string]string{"research": base64.StdEncoding.EncodeToString([]byte("short"))}}, "research", "", "must be 32 bytes"},
+		{"not base64", EncryptionConfig{Keys: map[string]string{"research": "not base64!"}}, "research", "", "must be 32 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{Encryption: tt.encryption})
+			aead, err := contentKey(tt.tenant)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("error %v, want none", err)
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %v, want one with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if (aead == nil) != (tt.want == "") {
+				t.Fatalf("key %v, want %q", aead, tt.want)
+			}
+			if aead == nil {
+				return
+			}
+			setConfig(t, Config{Encryption: EncryptionConfig{Keys: map[string]string{"want": tt.want}}})
+			want, _ := contentKey("want")
+			if _, err := openContent(want, sealContent(aead, "hello")); err != nil {
+				t.Errorf("content sealed with the tenant's key doesn't open with %s: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSealContent(t *testing.T) {
+	setConfig(t, Config{Encryption: EncryptionConfig{Keys: map[string]string{"a": testContentKey(1), "b": testContentKey(2)}}})
+	keyA, _ := contentKey("a")
+	keyB, _ := contentKey("b")
+	tamper := func(sealed string) string {
+		data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, ENCRYPTED_CONTENT_PREFIX))
+		data[len(data)-1] ^= 1
+		return ENCRYPTED_CONTENT_PREFIX + base64.StdEncoding.EncodeToString(data)
+	}
+	tests := []struct {
+		name string
+		seal cipher.AEAD
+		text string
+		// how the stored text is changed before it is opened
+		change func(string) string
+		open   cipher.AEAD
+		// whether the stored text is encrypted
+		wantSealed bool
+		// in the error, empty when the text comes back
+		wantErr string
+	}{
+		{"round trip", keyA, "user: hello", nil, keyA, true, ""},
+		{"no key", nil, "user: hello", nil, nil, false, ""},
+		{"empty", keyA, "", nil, keyA, false, ""},
+		{"hash", keyA, "sha256:2cf24dba5fb0a30e", nil, keyA, false, ""},
+		{"plain text opened with a key", nil, "user: hello", nil, keyA, false, ""},
+		{"wrong key", keyA, "user: hello", nil, keyB, true, "wrong key"},
+		{"key gone", keyA, "user: hello", nil, nil, true, "no key"},
+		{"tampered", keyA, "user: hello", tamper, keyA, true, "wrong key or corrupted"},
+		{"truncated", keyA, "user: hello", func(string) string { return ENCRYPTED_CONTENT_PREFIX + "AAAA" }, keyA, true, "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := sealContent(tt.seal, tt.text)
+			if sealed := strings.HasPrefix(stored, ENCRYPTED_CONTENT_PREFIX); sealed != tt.wantSealed {
+				t.Errorf("stored %q, want it encrypted: %v", stored, tt.wantSealed)
+			}
+			if tt.wantSealed && strings.Contains(stored, tt.text) {
+				t.Errorf("stored %q has the plain text", stored)
+			}
+			if tt.change != nil {
+				stored = tt.change(stored)
+			}
+			got, err := openContent(tt.open, stored)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("error %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error %v, want one with %q", err, tt.wantErr)
+			case tt.wantErr == "" && got != tt.text:
+				t.Errorf("opened %q, want %q", got, tt.text)
+			}
+		})
+	}
+
+	if sealContent(keyA, "user: hello") == sealContent(keyA, "user: hello") {
+		t.Error("the same text sealed twice is the same ciphertext")
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Samples kept in the evaluation queue, the oldest are dropped
+const EVAL_QUEUE_SIZE = 1000
+
+// Latest judge scores of a model its trend compares with the ones before
+const EVAL_TREND_WINDOW = 20
+
+// Longest the judge model may take to score a sample
+const EVAL_JUDGE_TIMEOUT = 2 * time.Minute
+
+// EvalSample is a production request/response pair captured for quality
+// evaluation, see eval.sample_percent.
+type EvalSample struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	KeyName  string    `json:"key_name,omitempty"`
+	Model    string    `json:"model"`
+	Prompt   string    `json:"prompt"`
+	Response string    `json:"response"`
+	// 1 to 10 from eval.judge_model, unset until it scored the sample
+	Score *float64 `json:"score,omitempty"`
+	// what the judge said about it
+	Judgement string `json:"judgement,omitempty"`
+}
+
+// EvalTrend sums up the judge scores of a model's samples.
+type EvalTrend struct {
+	Model   string `json:"model"`
+	Samples int    `json:"samples"`
+	Scored  int    `json:"scored"`
+	// mean of all scores, of the latest EVAL_TREND_WINDOW and of as many
+	// before those
+	Score         *float64 `json:"score,omitempty"`
+	RecentScore   *float64 `json:"recent_score,omitempty"`
+	PreviousScore *float64 `json:"previous_score,omitempty"`
+}
+
+type EvalSamplesResponse struct {
+	Object string        `json:"object"`
+	Data   []*EvalSample `json:"data"`
+}
+
+type EvalTrendsResponse struct {
+	Object string      `json:"object"`
+	Data   []EvalTrend `json:"data"`
+}
+
+// evalQueue keeps the latest samples in memory, oldest first. Samples wait
+// in judge for the judge model.
+type evalQueue struct {
+	mu      sync.Mutex
+	samples []*EvalSample
+	judge   chan *EvalSample
+}
+
+var evals = &evalQueue{judge: make(chan *EvalSample, EVAL_QUEUE_SIZE)}
+
+// sampleForEval captures eval.sample_percent of the generations into the
+// evaluation queue. Keys whose store_content is none or hashed are never
+// sampled, truncated ones only with what it keeps.
+func sampleForEval(t *tenant, apiKey, keyName, model, prompt, response string) {
+	if config.Eval.SamplePercent <= 0 || prompt == "" || mathrand.Float64()*100 >= config.Eval.SamplePercent {
+		return
+	}
+	mode := STORE_CONTENT_FULL
+	if entry := apiKeys.lookup(apiKey); entry != nil && entry.StoreContent != "" {
+		mode = entry.StoreContent
+	}
+	if mode == STORE_CONTENT_NONE || mode == STORE_CONTENT_HASHED {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	sample := &EvalSample{
+		ID:       "eval_" + hex.EncodeToString(id),
+		Time:     time.Now().UTC(),
+		Tenant:   t.name,
+		KeyName:  keyName,
+		Model:    model,
+		Prompt:   redact(mode, prompt),
+		Response: redact(mode, response),
+	}
+	evals.mu.Lock()
+	evals.samples = append(evals.samples, sample)
+	if len(evals.samples) > EVAL_QUEUE_SIZE {
+		evals.samples = evals.samples[len(evals.samples)-EVAL_QUEUE_SIZE:]
+	}
+	evals.mu.Unlock()
+	metrics.evalSamples.add(1, model)
+
+	if config.Eval.JudgeModel == "" {
+		return
+	}
+	select {
+	case evals.judge <- sample:
+	default:
+		// the judge is behind, the sample stays unscored
+	}
+}
+
+// runEvalJudge scores queued samples with the judge model one at a time, so
+// evaluation never takes more than one generation slot from traffic.
+func runEvalJudge() {
+	for sample := range evals.judge {
+		score, judgement, err := judgeSample(sample)
+		if err != nil {
+			log.Printf("failed to judge eval sample %s: %v", sample.ID, err)
+			continue
+		}
+		evals.mu.Lock()
+		sample.Score, sample.Judgement = &score, judgement
+		evals.mu.Unlock()
+		metrics.evalScoreSum.add(score, sample.Model)
+		metrics.evalScored.add(1, sample.Model)
+	}
+}
+
+var judgeScorePattern = regexp.MustCompile(`\b(10|[1-9])\b`)
+
+// judgeSample asks the judge model for a score from 1 to 10 and a short
+// reason.
+func judgeSample(sample *EvalSample) (float64, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), EVAL_JUDGE_TIMEOUT)
+	defer cancel()
+	return askJudge(ctx, "Rate how well the answer below responds to the prompt, for helpfulness, "+
+		"correctness and clarity, on a scale from 1 (useless) to 10 (excellent).\n\n"+
+		"Prompt:\n"+sample.Prompt+"\n\nAnswer:\n"+sample.Response)
+}
+
+// askJudge has eval.judge_model answer question with a score from 1 to 10
+// and the sentence it gives for it.
+func askJudge(ctx context.Context, question string) (float64, string, error) {
+	resp, err := sendToOllama(ctx, OllamaRequest{
+		Model:  config.Eval.JudgeModel,
+		Prompt: question + "\n\nReply with the score alone on the first line and one sentence explaining it on the second.",
+		Stream: true,
+	}, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	text := strings.TrimSpace(resp.Response)
+	first, rest, _ := strings.Cut(text, "\n")
+	match := judgeScorePattern.FindString(first)
+	if match == "" {
+		return 0, "", fmt.Errorf("judge reply has no score: %q", text)
+	}
+	score, _ := strconv.ParseFloat(match, 64)
+	return score, strings.TrimSpace(rest), nil
+}
+
+// trends sums up the samples per model.
+func (q *evalQueue) trends() []EvalTrend {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	samples := make(map[string]int)
+	scores := make(map[string][]float64)
+	for _, sample := range q.samples {
+		samples[sample.Model]++
+		if sample.Score != nil {
+			scores[sample.Model] = append(scores[sample.Model], *sample.Score)
+		}
+	}
+	mean := func(values []float64) *float64 {
+		if len(values) == 0 {
+			return nil
+		}
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		sum /= float64(len(values))
+		return &sum
+	}
+
+	trends := []EvalTrend{}
+	for _, model := range sortedKeys(samples) {
+		s := scores[model]
+		recent := s[max(len(s)-EVAL_TREND_WINDOW, 0):]
+		previous := s[max(len(s)-2*EVAL_TREND_WINDOW, 0) : len(s)-len(recent)]
+		trends = append(trends, EvalTrend{
+			Model:         model,
+			Samples:       samples[model],
+			Scored:        len(s),
+			Score:         mean(s),
+			RecentScore:   mean(recent),
+			PreviousScore: mean(previous),
+		})
+	}
+	return trends
+}
+
+// handleAdminEvalSamples lists the queued samples, newest first, optionally
+// of one model and only the latest limit of them.
+func handleAdminEvalSamples(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := EVAL_QUEUE_SIZE
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			sendParamError(w, r, "limit must be a positive whole number", "invalid_value", "limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	model := r.URL.Query().Get("model")
+
+	resp := EvalSamplesResponse{Object: "list", Data: []*EvalSample{}}
+	evals.mu.Lock()
+	for i := len(evals.samples) - 1; i >= 0 && len(resp.Data) < limit; i-- {
+		if sample := evals.samples[i]; model == "" || sample.Model == model {
+			copied := *sample
+			resp.Data = append(resp.Data, &copied)
+		}
+	}
+	evals.mu.Unlock()
+	writeJSON(w, resp)
+}
+
+// handleAdminEvalTrends serves the quality trend of every sampled model.
+func handleAdminEvalTrends(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, EvalTrendsResponse{Object: "list", Data: evals.trends()})
+}
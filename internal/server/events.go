@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Request lifecycle event types
+const (
+	EVENT_ACCEPTED    = "accepted"
+	EVENT_QUEUED      = "queued"
+	EVENT_FIRST_TOKEN = "first_token"
+	EVENT_DONE        = "done"
+	EVENT_ERROR       = "error"
+)
+
+// How many events a slow subscriber may fall behind before events are dropped for it
+const EVENT_BUFFER_SIZE = 256
+
+// Event is one step in the life of a request, as streamed on /admin/events.
+type Event struct {
+	Type      string    `json:"type"`
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Usage     *Usage    `json:"usage,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// eventBus fans events out to every subscriber without ever blocking the
+// request that publishes them.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+var events = &eventBus{subscribers: make(map[chan Event]struct{})}
+
+func (b *eventBus) subscribe() chan Event {
+	ch := make(chan Event, EVENT_BUFFER_SIZE)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	metrics.observeEvent(ev)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+var eventUpgrader = websocket.Upgrader{
+	// the admin key already guards this endpoint
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleAdminEvents streams request lifecycle events as JSON WebSocket messages.
+func handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sub := events.subscribe()
+	defer events.unsubscribe(sub)
+
+	// nothing is expected from the client, reading only notices it going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-sub:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+)
+
+// Variants of an experiment: requests whose parameters it changed, and
+// requests it matched but left alone to compare with
+const (
+	VARIANT_TREATMENT = "treatment"
+	VARIANT_CONTROL   = "control"
+)
+
+// Ollama's defaults of the sampling parameters, which an experiment's
+// adjustments start from when the request doesn't set them
+var SAMPLING_DEFAULTS = map[string]float64{
+	"temperature":       0.8,
+	"top_p":             0.9,
+	"presence_penalty":  0,
+	"frequency_penalty": 0,
+}
+
+// Experiment changes the sampling parameters of a share of the chat
+// completions for models matching Models, from experiments in the config
+// file. Usage records and the access log tag every matching request with
+// the experiment and its variant, so the treatment can be compared with
+// the control group on real traffic.
+type Experiment struct {
+	Name string `yaml:"name"`
+	// glob patterns of models as the client names them; empty matches all
+	Models []string `yaml:"models"`
+	// share of the matching requests that get the treatment
+	Percent float64 `yaml:"percent"`
+	// added to the request's value, e.g. temperature: -0.2
+	Adjust map[string]float64 `yaml:"adjust"`
+	// replaces the request's value
+	Set map[string]float64 `yaml:"set"`
+}
+
+// experimentAssignment is the variant a request got, decided once so that
+// the fallback models of a request fare alike.
+type experimentAssignment struct {
+	experiment *Experiment
+	variant    string
+}
+
+// applyExperiment puts a request for model into the first experiment
+// matching it and, for the treatment, changes its parameters. It runs after
+// presets and schedule rules, and parameter limits still apply. Work that
+// isn't a client request, without an access log to tag, is left alone.
+func applyExperiment(ctx context.Context, req *OpenAIChatRequest, model string) {
+	l := requestLogFromContext(ctx)
+	if l == nil {
+		return
+	}
+	a := l.experimentAssignment()
+	if a == nil {
+		a = assignExperiment(model)
+		l.setExperimentAssignment(a)
+	}
+	if a.experiment == nil || a.variant != VARIANT_TREATMENT || !experimentMatches(a.experiment, model) {
+		return
+	}
+
+	params := samplingParams(req)
+	for name, delta := range a.experiment.Adjust {
+		value := SAMPLING_DEFAULTS[name]
+		if *params[name] != nil {
+			value = **params[name]
+		}
+		// a new value, the request of every fallback model shares the old one
+		*params[name] = ptr(value + delta)
+	}
+	for name, value := range a.experiment.Set {
+		*params[name] = ptr(value)
+	}
+}
+
+func assignExperiment(model string) *experimentAssignment {
+	for i := range config.Experiments {
+		e := &config.Experiments[i]
+		if !experimentMatches(e, model) {
+			continue
+		}
+		variant := VARIANT_CONTROL
+		if rand.Float64()*100 < e.Percent {
+			variant = VARIANT_TREATMENT
+		}
+		return &experimentAssignment{experiment: e, variant: variant}
+	}
+	return &experimentAssignment{}
+}
+
+func experimentMatches(e *Experiment, model string) bool {
+	return len(e.Models) == 0 || matchesAnyPattern(compileGlobPatterns(e.Models), model)
+}
+
+// experimentFromContext is the experiment and variant of the request, empty
+// for requests outside every experiment.
+func experimentFromContext(ctx context.Context) (string, string) {
+	a := requestLogFromContext(ctx).experimentAssignment()
+	if a == nil || a.experiment == nil {
+		return "", ""
+	}
+	return a.experiment.Name, a.variant
+}
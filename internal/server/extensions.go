@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// extensionField is a field of the x_proxy object, see extensionFields.
+type extensionField struct {
+	name        string
+	description string
+	// JSON Schema of the value, in the subset checkSchema knows
+	schema map[string]any
+	// paths of the endpoints taking the field
+	endpoints []string
+}
+
+// The proxy's own request fields. They go under x_proxy so they can't
+// collide with fields OpenAI adds later; GET /v1/extensions/schema
+// publishes them, and requests are checked against it before anything else
+// reads the body. The older top-level forms (top_k, models, ollama,
+// ollama_options, options, normalize) still work, x_proxy wins over them.
+var extensionFields = []extensionField{
+	{
+		name:        "top_k",
+		description: "sample only from the k most likely tokens",
+		schema:      map[string]any{"type": "integer", "minimum": 0},
+		endpoints:   []string{"/v1/chat/completions"},
+	},
+	{
+		name:        "models",
+		description: "models tried in order when the model fails, OpenRouter style",
+		schema:      map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		endpoints:   []string{"/v1/chat/completions"},
+	},
+	{
+		name:        "keep_alive",
+		description: "how long Ollama keeps the model loaded after the request: a duration such as \"30m\" or seconds; negative keeps it loaded, 0 unloads it right away",
+		schema:      map[string]any{"type": []any{"string", "number"}},
+		endpoints:   []string{"/v1/chat/completions", "/v1/completions"},
+	},
+	{
+		name:        "ollama_options",
+		description: "raw Ollama options such as num_ctx, passed on as they are",
+		schema:      map[string]any{"type": "object"},
+		endpoints:   []string{"/v1/chat/completions", "/v1/completions"},
+	},
+	{
+		name:        "normalize",
+		description: "L2-normalize the vectors, defaults to normalize_embeddings",
+		schema:      map[string]any{"type": "boolean"},
+		endpoints:   []string{"/v1/embeddings"},
+	},
+}
+
+// extensionSchema is the JSON Schema of x_proxy on endpoint.
+func extensionSchema(endpoint string) map[string]any {
+	properties := make(map[string]any)
+	for _, field := range extensionFields {
+		if !slices.Contains(field.endpoints, endpoint) {
+			continue
+		}
+		property := map[string]any{"description": field.description}
+		for key, value := range field.schema {
+			property[key] = value
+		}
+		properties[field.name] = property
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "x_proxy on " + endpoint,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// extensionEndpoints are the endpoints taking x_proxy, in order.
+func extensionEndpoints() []string {
+	var endpoints []string
+	for _, field := range extensionFields {
+		for _, endpoint := range field.endpoints {
+			if !slices.Contains(endpoints, endpoint) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return endpoints
+}
+
+// handleExtensionSchema publishes the schema of x_proxy, by endpoint path,
+// or for the one named by ?endpoint=.
+func handleExtensionSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if endpoint := r.URL.Query().Get("endpoint"); endpoint != "" {
+		if !slices.Contains(extensionEndpoints(), endpoint) {
+			sendParamError(w, r, "%s takes no extensions", "invalid_value", "endpoint", http.StatusNotFound, endpoint)
+			return
+		}
+		writeJSON(w, extensionSchema(endpoint))
+		return
+	}
+	schemas := make(map[string]any)
+	for _, endpoint := range extensionEndpoints() {
+		schemas[endpoint] = extensionSchema(endpoint)
+	}
+	writeJSON(w, schemas)
+}
+
+// validateExtensions checks the x_proxy object of a request body against
+// the schema of endpoint.
+func validateExtensions(body map[string]any, endpoint string) *apiError {
+	value, ok := body["x_proxy"]
+	if !ok || value == nil {
+		return nil
+	}
+	return checkSchema(value, extensionSchema(endpoint), "x_proxy")
+}
+
+// checkSchema reports the first place value breaks schema, with path as
+// the param of the error. It knows the subset of JSON Schema the extension
+// schemas use: type, minimum, items, properties and additionalProperties.
+func checkSchema(value any, schema map[string]any, path string) *apiError {
+	if types := schemaTypes(schema); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return hasSchemaType(value, t) }) {
+		err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_type", "%s must be of type %s", path, strings.Join(types, " or "))
+		err.param = path
+		return err
+	}
+	if minimum, ok := schema["minimum"].(int); ok {
+		if n, isNumber := value.(json.Number); isNumber {
+			if f, _ := n.Float64(); f < float64(minimum) {
+				err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_value", "%s must be at least %d", path, minimum)
+				err.param = path
+				return err
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		array, _ := value.([]any)
+		for i, item := range array {
+			if err := checkSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	object, isObject := value.(map[string]any)
+	properties, ok := schema["properties"].(map[string]any)
+	if !isObject || !ok {
+		return nil
+	}
+	for _, name := range sortedKeys(object) {
+		property, known := properties[name].(map[string]any)
+		if !known {
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				err := newAPIError(http.StatusBadRequest, "invalid_request_error", "unknown_parameter", "%s is not an extension of this endpoint, see GET /v1/extensions/schema", path+"."+name)
+				err.param = path + "." + name
+				return err
+			}
+			continue
+		}
+		if err := checkSchema(object[name], property, path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaTypes is the type of schema as a list, empty for any type.
+func schemaTypes(schema map[string]any) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := make([]string, 0, len(t))
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// hasSchemaType reports whether a value decoded by decodeJSONBody is of
+// the JSON Schema type t.
+func hasSchemaType(value any, t string) bool {
+	switch v := value.(type) {
+	case string:
+		return t == "string"
+	case bool:
+		return t == "boolean"
+	case json.Number:
+		if t == "integer" {
+			_, err := v.Int64()
+			return err == nil
+		}
+		return t == "number"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case nil:
+		return t == "null"
+	}
+	return false
+}
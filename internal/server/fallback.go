@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// upstreamAttempt is one model of a request's fallback list, resolved and
+// rendered for its upstream.
+type upstreamAttempt struct {
+	requestedModel string
+	openAIReq      OpenAIChatRequest
+	ollamaReq      OllamaRequest
+}
+
+// fallbackModels lists the models to try in order: `model` followed by the
+// OpenRouter-style `models` list.
+func fallbackModels(openAIReq OpenAIChatRequest) []string {
+	var models []string
+	seen := make(map[string]bool)
+	for _, model := range append([]string{openAIReq.Model}, openAIReq.Models...) {
+		if model == "" || seen[model] {
+			continue
+		}
+		seen[model] = true
+		models = append(models, model)
+	}
+	return models
+}
+
+// prepareAttempts resolves the request for every model in its fallback list.
+// The primary model has to be usable; fallbacks that aren't (not allowed,
+// role rules they can't take) are left out.
+func prepareAttempts(ctx context.Context, openAIReq OpenAIChatRequest, apiKey string, logger *log.Logger) ([]*upstreamAttempt, error) {
+	var attempts []*upstreamAttempt
+	for i, model := range fallbackModels(openAIReq) {
+		attempt, err := prepareAttempt(ctx, openAIReq, model, apiKey)
+		if err != nil && i == 0 {
+			return nil, err
+		}
+		if err != nil {
+			logger.Printf("fallback model %s skipped: %v", model, err)
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, nil
+}
+
+func prepareAttempt(ctx context.Context, openAIReq OpenAIChatRequest, model string, apiKey string) (*upstreamAttempt, error) {
+	openAIReq.Model = model
+	openAIReq.Models = nil
+	openAIReq.Messages = append([]ChatMessage(nil), openAIReq.Messages...)
+
+	clientMessages := len(openAIReq.Messages)
+	requestedModel, rule, ok := resolveRequest(ctx, &openAIReq, apiKey)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "invalid_request_error", "model_not_found", "The model `%s` does not exist", requestedModel)
+	}
+
+	if err := enforceRoleAlternation(&openAIReq, len(openAIReq.Messages)-clientMessages); err != nil {
+		return nil, err
+	}
+
+	if !modelPermitted(apiKey, requestedModel, openAIReq.Model) {
+		return nil, newAPIError(http.StatusForbidden, "invalid_request_error", "model_not_allowed", "The model `%s` is not available on this proxy", requestedModel)
+	}
+	if err := rule.allow(apiKey); err != nil {
+		return nil, err
+	}
+
+	if err := enforceParameterLimits(&openAIReq); err != nil {
+		return nil, err
+	}
+
+	ollamaReq, err := buildOllamaRequest(ctx, openAIReq)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return nil, err
+	}
+	if err != nil && ctx.Err() != nil {
+		// the client went away while images were fetched
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_image", "Invalid image: %s", err)
+	}
+	return &upstreamAttempt{requestedModel: requestedModel, openAIReq: openAIReq, ollamaReq: ollamaReq}, nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestSuite is a YAML file of requests and what their responses must look
+// like, run with the `test` subcommand against a running proxy.
+type TestSuite struct {
+	BaseURL string        `yaml:"base_url"`
+	APIKey  string        `yaml:"api_key"`
+	Tests   []TestFixture `yaml:"tests"`
+}
+
+type TestFixture struct {
+	Name    string            `yaml:"name"`
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    any               `yaml:"body"`
+	Expect  TestExpectation   `yaml:"expect"`
+}
+
+// TestExpectation lists assertions on a response. JSON keys are dotted
+// paths into the response body, e.g. "choices.0.message.role".
+type TestExpectation struct {
+	Status   int            `yaml:"status"`
+	JSON     map[string]any `yaml:"json"`
+	Contains []string       `yaml:"contains"`
+}
+
+// runFixtures implements the `test` subcommand.
+func runFixtures(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	baseURL := fs.String("url", "", "base URL of the proxy, overrides base_url from the suite")
+	timeout := fs.Duration("timeout", 2*time.Minute, "timeout per request")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ollama-openai-proxy test [-url URL] suite.yaml...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	failed := 0
+	total := 0
+	for _, path := range fs.Args() {
+		suite, err := loadTestSuite(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if *baseURL != "" {
+			suite.BaseURL = *baseURL
+		}
+		if suite.BaseURL == "" {
+			suite.BaseURL = localProxyURL(config.ListenAddr)
+		}
+
+		for _, fixture := range suite.Tests {
+			total++
+			if err := fixture.run(client, suite); err != nil {
+				failed++
+				fmt.Printf("FAIL %s: %v\n", fixture.Name, err)
+				continue
+			}
+			fmt.Printf("PASS %s\n", fixture.Name)
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d failed\n", total-failed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func loadTestSuite(path string) (*TestSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suite: %w", err)
+	}
+	var suite TestSuite
+	if err := yaml.Unmarshal(data, &suite); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &suite, nil
+}
+
+func (f TestFixture) run(client *http.Client, suite *TestSuite) error {
+	method := f.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	path := f.Path
+	if path == "" {
+		path = "/v1/chat/completions"
+	}
+
+	var body io.Reader
+	if f.Body != nil {
+		data, err := json.Marshal(f.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(suite.BaseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	if suite.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+suite.APIKey)
+	}
+	for name, value := range f.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	expectedStatus := f.Expect.Status
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("expected status %d, got %d: %s", expectedStatus, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	for _, want := range f.Expect.Contains {
+		if !bytes.Contains(respBody, []byte(want)) {
+			return fmt.Errorf("response does not contain %q", want)
+		}
+	}
+
+	if len(f.Expect.JSON) == 0 {
+		return nil
+	}
+	var doc any
+	if err := json.Unmarshal(respBody, &doc); err != nil {
+		return fmt.Errorf("response is not JSON: %w", err)
+	}
+	for path, want := range f.Expect.JSON {
+		got, ok := lookupJSONPath(doc, path)
+		if !ok {
+			return fmt.Errorf("%s: not found in response", path)
+		}
+		// go through JSON so YAML ints compare equal to JSON numbers
+		var normalized any
+		if err := remarshal(want, &normalized); err != nil {
+			return fmt.Errorf("%s: invalid expected value: %w", path, err)
+		}
+		if !reflect.DeepEqual(got, normalized) {
+			return fmt.Errorf("%s: expected %v, got %v", path, normalized, got)
+		}
+	}
+	return nil
+}
+
+func lookupJSONPath(doc any, path string) (any, bool) {
+	current := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errorTranslations maps the English message formats passed to sendError to
+// their translations.
+var errorTranslations = map[string]map[string]string{
+	"de": {
+		"Admin API is disabled": "Die Admin-API ist deaktiviert",
+		"Invalid admin API key": "Ungültiger Admin-API-Schlüssel",
+		"You didn't provide an API key. Send it in the Authorization header as `Bearer <key>`": "Es wurde kein API-Schlüssel angegeben. Senden Sie ihn im Authorization-Header als `Bearer <key>`",
+		"Incorrect API key provided":                                                    "Ungültiger API-Schlüssel",
+		"Rate limit of %d requests per minute reached":                                  "Limit von %d Anfragen pro Minute erreicht",
+		"The server is at capacity with %d requests waiting, please retry later":        "Der Server ist ausgelastet, %d Anfragen warten bereits, bitte später erneut versuchen",
+		"The model backend is failing and temporarily unavailable, retry in %d seconds": "Das Modell-Backend fällt aus und ist vorübergehend nicht verfügbar, bitte in %d Sekunden erneut versuchen",
+		"The model `%s` is not installed on Ollama":                                     "Das Modell `%s` ist auf Ollama nicht installiert",
+		"The model `%s` is overloaded, please retry later":                              "Das Modell `%s` ist überlastet, bitte später erneut versuchen",
+		"The input exceeds the context length of the model `%s`":                        "Die Eingabe überschreitet die Kontextlänge des Modells `%s`",
+		"Timed out waiting for the server with %d requests waiting, please retry later": "Zeitüberschreitung beim Warten auf den Server, %d Anfragen warten, bitte später erneut versuchen",
+		"Too many concurrent streams for this API key, the limit is %d":                 "Zu viele gleichzeitige Streams für diesen API-Schlüssel, das Limit ist %d",
+		"Method not allowed":                                                   "Methode nicht erlaubt",
+		"Invalid request body":                                                 "Ungültiger Request-Body",
+		"Model is required":                                                    "Ein Modell ist erforderlich",
+		"Messages array is empty":                                              "Das messages-Array ist leer",
+		"Invalid image: %s":                                                    "Ungültiges Bild: %s",
+		"The model `%s` is not available on this proxy":                        "Das Modell `%s` ist auf diesem Proxy nicht verfügbar",
+		"Error applying rewrite rules: %s":                                     "Fehler beim Anwenden der Rewrite-Regeln: %s",
+		"Error calling Ollama API: %s":                                         "Fehler beim Aufruf der Ollama-API: %s",
+		"The prompt was rejected by the content filter, flagged as %s":         "Der Prompt wurde vom Inhaltsfilter abgelehnt, markiert als %s",
+		"%s must be a duration such as \"30m\" or a number of seconds, got %v": "%s muss eine Dauer wie \"30m\" oder eine Anzahl Sekunden sein, erhalten: %v",
+		"Error calling output classifier: %s":                                  "Fehler beim Aufruf des Ausgabe-Klassifikators: %s",
+		"Internal server error":                                                "Interner Serverfehler",
+		"The model `%s` does not exist":                                        "Das Modell `%s` existiert nicht",
+		"Exactly one of model or template is required":                         "Genau eines von model oder template ist erforderlich",
+		"Template `%s` does not exist":                                         "Das Template `%s` existiert nicht",
+		"The model `%s` is not served by Ollama, its template is unknown":      "Das Modell `%s` wird nicht von Ollama bereitgestellt, sein Template ist unbekannt",
+		"Error rendering template: %s":                                         "Fehler beim Rendern des Templates: %s",
+		"Request canceled by an administrator":                                 "Anfrage von einem Administrator abgebrochen",
+		"api_key or model is required":                                         "api_key oder model ist erforderlich",
+		"Input must be a non-empty string or array of strings":                 "input muss ein nicht leerer String oder ein Array von Strings sein",
+		"Unsupported encoding_format `%s`":                                     "Nicht unterstütztes encoding_format `%s`",
+		"%s must be between %s and %s for model %s":                            "%s muss zwischen %s und %s liegen (Modell %s)",
+		"Request deadline exceeded before generation finished":                 "Die Frist der Anfrage ist abgelaufen, bevor die Generierung fertig war",
+		"The proxy is down for maintenance, please retry later":                "Der Proxy wird gerade gewartet, bitte später erneut versuchen",
+		"messages[%d]: role is required":                                       "messages[%d]: eine Rolle ist erforderlich",
+		"messages[%d]: unknown role %q":                                        "messages[%d]: unbekannte Rolle %q",
+		"messages[%d]: expected a %s message, %s requires alternating user/assistant roles starting with user": "messages[%d]: erwartet wurde eine %s-Nachricht, %s verlangt abwechselnde user/assistant-Rollen, beginnend mit user",
+		"tools[%d] must be a function with a name":                                                             "tools[%d] muss eine Funktion mit Namen sein",
+		"Tool `%s` in tool_choice is not among tools":                                                          "Das Tool `%s` aus tool_choice ist nicht in tools enthalten",
+		"tool_choice must be none, auto, required or a function":                                               "tool_choice muss none, auto, required oder eine Funktion sein",
+		"The model `%s` does not support tools":                                                                "Das Modell `%s` unterstützt keine Tools",
+		"messages[%d]: tool_calls[%d].function.arguments is not valid JSON":                                    "messages[%d]: tool_calls[%d].function.arguments ist kein gültiges JSON",
+		"messages[%d]: tool_call_id is required for tool messages":                                             "messages[%d]: tool_call_id ist für tool-Nachrichten erforderlich",
+		"Input must be non-empty text of at most %d bytes":                                                     "Die Eingabe muss ein nicht leerer Text von höchstens %d Bytes sein",
+		"Unsupported strategy `%s`":                                                                            "Nicht unterstützte Strategie `%s`",
+		"chunk_size must be positive":                                                                          "chunk_size muss positiv sein",
+		"n must be between 1 and %d":                                                                           "n muss zwischen 1 und %d liegen",
+		"overlap must be at least 0 and less than chunk_size":                                                  "overlap muss mindestens 0 und kleiner als chunk_size sein",
+		"response_format.json_schema.schema must be a JSON schema object":                                      "response_format.json_schema.schema muss ein JSON-Schema-Objekt sein",
+		"Unsupported response_format type `%s`":                                                                "Nicht unterstützter response_format-Typ `%s`",
+		"No vector store is configured":                                                                        "Es ist kein Vektorspeicher konfiguriert",
+		"Query is required":                                                                                    "Eine Suchanfrage ist erforderlich",
+		"top_k must be between 1 and %d":                                                                       "top_k muss zwischen 1 und %d liegen",
+		"Error searching the vector store: %s":                                                                 "Fehler beim Durchsuchen des Vektorspeichers: %s",
+		"Collection `%s` does not exist":                                                                       "Die Sammlung `%s` existiert nicht",
+		"Collection `%s` already exists":                                                                       "Die Sammlung `%s` existiert bereits",
+		"Collection names are 1 to 64 letters, digits, - or _":                                                 "Sammlungsnamen bestehen aus 1 bis 64 Buchstaben, Ziffern, - oder _",
+		"embedding_model is required":                                                                          "embedding_model ist erforderlich",
+		"Documents are required":                                                                               "Dokumente sind erforderlich",
+		"documents[%d] has no text":                                                                            "documents[%d] enthält keinen Text",
+		"Error updating the vector store: %s":                                                                  "Fehler beim Aktualisieren des Vektorspeichers: %s",
+		"Not found":                                                                                            "Nicht gefunden",
+		"Streaming transcription is not enabled on this proxy":                                                 "Streaming-Transkription ist auf diesem Proxy nicht aktiviert",
+		"This endpoint only accepts WebSocket connections":                                                     "Dieser Endpunkt akzeptiert nur WebSocket-Verbindungen",
+		"Error connecting to the transcription backend: %s":                                                    "Fehler beim Verbinden mit dem Transkriptions-Backend: %s",
+		"Transcription stream exceeded the request timeout":                                                    "Der Transkriptions-Stream hat das Zeitlimit der Anfrage überschritten",
+		"Transcription backend failed: %s":                                                                     "Das Transkriptions-Backend ist fehlgeschlagen: %s",
+		"Voice chat is not enabled on this proxy":                                                              "Sprachchat ist auf diesem Proxy nicht aktiviert",
+		"file must be an audio file":                                                                           "file muss eine Audiodatei sein",
+		"messages must be a JSON array of chat messages":                                                       "messages muss ein JSON-Array von Chat-Nachrichten sein",
+		"Error calling the speech-to-text backend: %s":                                                         "Fehler beim Aufruf des Speech-to-Text-Backends: %s",
+		"No speech was recognized in the audio":                                                                "Im Audio wurde keine Sprache erkannt",
+		"Error reading the chat completion: %s":                                                                "Fehler beim Lesen der Chat-Completion: %s",
+		"Error calling the text-to-speech backend: %s":                                                         "Fehler beim Aufruf des Text-to-Speech-Backends: %s",
+		"Response signing is not enabled on this proxy":                                                        "Das Signieren von Antworten ist auf diesem Proxy nicht aktiviert",
+		"Embedding jobs are not enabled on this proxy":                                                         "Embedding-Jobs sind auf diesem Proxy nicht aktiviert",
+		"Embedding job `%s` does not exist":                                                                    "Der Embedding-Job `%s` existiert nicht",
+		"Embedding job `%s` has no results to download":                                                        "Der Embedding-Job `%s` hat keine Ergebnisse zum Herunterladen",
+		"Error reading the results: %s":                                                                        "Fehler beim Lesen der Ergebnisse: %s",
+		"Collection `%s` is embedded with `%s`":                                                                "Die Sammlung `%s` ist mit `%s` eingebettet",
+		"file must be a JSONL or CSV file of texts":                                                            "file muss eine JSONL- oder CSV-Datei mit Texten sein",
+		"Unsupported format `%s`, use jsonl or csv":                                                            "Nicht unterstütztes Format `%s`, verwenden Sie jsonl oder csv",
+		"Invalid file: %s":                                                                                     "Ungültige Datei: %s",
+		"Error saving the embedding job: %s":                                                                   "Fehler beim Speichern des Embedding-Jobs: %s",
+		"%s.%s can't be set there, use the request field %s":                                                   "%s.%s kann dort nicht gesetzt werden, verwenden Sie das Anfragefeld %s",
+		"The Ollama option %s is not available on this proxy":                                                  "Die Ollama-Option %s ist auf diesem Proxy nicht verfügbar",
+		"%s must be of type %s":                                                                                "%s muss vom Typ %s sein",
+		"%s must be at least %d":                                                                               "%s muss mindestens %d sein",
+		"%s is not an extension of this endpoint, see GET /v1/extensions/schema":                               "%s ist keine Erweiterung dieses Endpunkts, siehe GET /v1/extensions/schema",
+		"%s takes no extensions":                                                                               "%s nimmt keine Erweiterungen an",
+	},
+	"fr": {
+		"Admin API is disabled": "L'API d'administration est désactivée",
+		"Invalid admin API key": "Clé d'API d'administration invalide",
+		"You didn't provide an API key. Send it in the Authorization header as `Bearer <key>`": "Aucune clé d'API fournie. Envoyez-la dans l'en-tête Authorization sous la forme `Bearer <key>`",
+		"Incorrect API key provided":                                                    "Clé d'API incorrecte",
+		"Rate limit of %d requests per minute reached":                                  "Limite de %d requêtes par minute atteinte",
+		"The server is at capacity with %d requests waiting, please retry later":        "Le serveur est saturé, %d requêtes sont en attente, veuillez réessayer plus tard",
+		"The model backend is failing and temporarily unavailable, retry in %d seconds": "Le backend du modèle est défaillant et temporairement indisponible, réessayez dans %d secondes",
+		"The model `%s` is not installed on Ollama":                                     "Le modèle `%s` n'est pas installé sur Ollama",
+		"The model `%s` is overloaded, please retry later":                              "Le modèle `%s` est surchargé, réessayez plus tard",
+		"The input exceeds the context length of the model `%s`":                        "L'entrée dépasse la longueur de contexte du modèle `%s`",
+		"Timed out waiting for the server with %d requests waiting, please retry later": "Délai d'attente du serveur dépassé, %d requêtes sont en attente, veuillez réessayer plus tard",
+		"Too many concurrent streams for this API key, the limit is %d":                 "Trop de flux simultanés pour cette clé d'API, la limite est de %d",
+		"Method not allowed":                                                   "Méthode non autorisée",
+		"Invalid request body":                                                 "Corps de requête invalide",
+		"Model is required":                                                    "Un modèle est requis",
+		"Messages array is empty":                                              "Le tableau messages est vide",
+		"Invalid image: %s":                                                    "Image invalide : %s",
+		"The model `%s` is not available on this proxy":                        "Le modèle `%s` n'est pas disponible sur ce proxy",
+		"Error applying rewrite rules: %s":                                     "Erreur lors de l'application des règles de réécriture : %s",
+		"Error calling Ollama API: %s":                                         "Erreur lors de l'appel à l'API Ollama : %s",
+		"The prompt was rejected by the content filter, flagged as %s":         "Le prompt a été rejeté par le filtre de contenu, signalé comme %s",
+		"%s must be a duration such as \"30m\" or a number of seconds, got %v": "%s doit être une durée comme \"30m\" ou un nombre de secondes, reçu : %v",
+		"Error calling output classifier: %s":                                  "Erreur lors de l'appel au classificateur de sortie : %s",
+		"Internal server error":                                                "Erreur interne du serveur",
+		"The model `%s` does not exist":                                        "Le modèle `%s` n'existe pas",
+		"Exactly one of model or template is required":                         "Exactement un des champs model ou template est requis",
+		"Template `%s` does not exist":                                         "Le modèle de prompt `%s` n'existe pas",
+		"The model `%s` is not served by Ollama, its template is unknown":      "Le modèle `%s` n'est pas servi par Ollama, son modèle de prompt est inconnu",
+		"Error rendering template: %s":                                         "Erreur lors du rendu du modèle de prompt : %s",
+		"Request canceled by an administrator":                                 "Requête annulée par un administrateur",
+		"api_key or model is required":                                         "api_key ou model est requis",
+		"Input must be a non-empty string or array of strings":                 "input doit être une chaîne non vide ou un tableau de chaînes",
+		"Unsupported encoding_format `%s`":                                     "encoding_format `%s` non pris en charge",
+		"%s must be between %s and %s for model %s":                            "%s doit être compris entre %s et %s pour le modèle %s",
+		"Request deadline exceeded before generation finished":                 "Le délai de la requête a expiré avant la fin de la génération",
+		"The proxy is down for maintenance, please retry later":                "Le proxy est en maintenance, veuillez réessayer plus tard",
+		"messages[%d]: role is required":                                       "messages[%d] : le rôle est requis",
+		"messages[%d]: unknown role %q":                                        "messages[%d] : rôle inconnu %q",
+		"messages[%d]: expected a %s message, %s requires alternating user/assistant roles starting with user": "messages[%d] : message %s attendu, %s exige une alternance des rôles user/assistant commençant par user",
+		"tools[%d] must be a function with a name":                                                             "tools[%d] doit être une fonction avec un nom",
+		"Tool `%s` in tool_choice is not among tools":                                                          "L'outil `%s` de tool_choice ne figure pas dans tools",
+		"tool_choice must be none, auto, required or a function":                                               "tool_choice doit valoir none, auto, required ou une fonction",
+		"The model `%s` does not support tools":                                                                "Le modèle `%s` ne prend pas en charge les outils",
+		"messages[%d]: tool_calls[%d].function.arguments is not valid JSON":                                    "messages[%d] : tool_calls[%d].function.arguments n'est pas du JSON valide",
+		"messages[%d]: tool_call_id is required for tool messages":                                             "messages[%d] : tool_call_id est requis pour les messages tool",
+		"Input must be non-empty text of at most %d bytes":                                                     "L'entrée doit être un texte non vide d'au plus %d octets",
+		"Unsupported strategy `%s`":                                                                            "Stratégie `%s` non prise en charge",
+		"chunk_size must be positive":                                                                          "chunk_size doit être positif",
+		"n must be between 1 and %d":                                                                           "n doit être compris entre 1 et %d",
+		"overlap must be at least 0 and less than chunk_size":                                                  "overlap doit être au moins 0 et inférieur à chunk_size",
+		"response_format.json_schema.schema must be a JSON schema object":                                      "response_format.json_schema.schema doit être un objet de schéma JSON",
+		"Unsupported response_format type `%s`":                                                                "Type de response_format `%s` non pris en charge",
+		"No vector store is configured":                                                                        "Aucune base vectorielle n'est configurée",
+		"Query is required":                                                                                    "La requête est obligatoire",
+		"top_k must be between 1 and %d":                                                                       "top_k doit être compris entre 1 et %d",
+		"Error searching the vector store: %s":                                                                 "Erreur lors de la recherche dans la base vectorielle : %s",
+		"Collection `%s` does not exist":                                                                       "La collection `%s` n'existe pas",
+		"Collection `%s` already exists":                                                                       "La collection `%s` existe déjà",
+		"Collection names are 1 to 64 letters, digits, - or _":                                                 "Les noms de collection comportent de 1 à 64 lettres, chiffres, - ou _",
+		"embedding_model is required":                                                                          "embedding_model est obligatoire",
+		"Documents are required":                                                                               "Des documents sont requis",
+		"documents[%d] has no text":                                                                            "documents[%d] ne contient pas de texte",
+		"Error updating the vector store: %s":                                                                  "Erreur lors de la mise à jour de la base vectorielle : %s",
+		"Not found":                                                                                            "Introuvable",
+		"Streaming transcription is not enabled on this proxy":                                                 "La transcription en continu n'est pas activée sur ce proxy",
+		"This endpoint only accepts WebSocket connections":                                                     "Ce point de terminaison n'accepte que les connexions WebSocket",
+		"Error connecting to the transcription backend: %s":                                                    "Erreur de connexion au backend de transcription : %s",
+		"Transcription stream exceeded the request timeout":                                                    "Le flux de transcription a dépassé le délai de la requête",
+		"Transcription backend failed: %s":                                                                     "Le backend de transcription a échoué : %s",
+		"Voice chat is not enabled on this proxy":                                                              "Le chat vocal n'est pas activé sur ce proxy",
+		"file must be an audio file":                                                                           "file doit être un fichier audio",
+		"messages must be a JSON array of chat messages":                                                       "messages doit être un tableau JSON de messages de chat",
+		"Error calling the speech-to-text backend: %s":                                                         "Erreur lors de l'appel au backend de reconnaissance vocale : %s",
+		"No speech was recognized in the audio":                                                                "Aucune parole n'a été reconnue dans l'audio",
+		"Error reading the chat completion: %s":                                                                "Erreur lors de la lecture de la complétion : %s",
+		"Error calling the text-to-speech backend: %s":                                                         "Erreur lors de l'appel au backend de synthèse vocale : %s",
+		"Response signing is not enabled on this proxy":                                                        "La signature des réponses n'est pas activée sur ce proxy",
+		"Embedding jobs are not enabled on this proxy":                                                         "Les tâches d'embedding ne sont pas activées sur ce proxy",
+		"Embedding job `%s` does not exist":                                                                    "La tâche d'embedding `%s` n'existe pas",
+		"Embedding job `%s` has no results to download":                                                        "La tâche d'embedding `%s` n'a pas de résultats à télécharger",
+		"Error reading the results: %s":                                                                        "Erreur lors de la lecture des résultats : %s",
+		"Collection `%s` is embedded with `%s`":                                                                "La collection `%s` est vectorisée avec `%s`",
+		"file must be a JSONL or CSV file of texts":                                                            "file doit être un fichier JSONL ou CSV de textes",
+		"Unsupported format `%s`, use jsonl or csv":                                                            "Format `%s` non pris en charge, utilisez jsonl ou csv",
+		"Invalid file: %s":                                                                                     "Fichier invalide : %s",
+		"Error saving the embedding job: %s":                                                                   "Erreur lors de l'enregistrement de la tâche d'embedding : %s",
+		"%s.%s can't be set there, use the request field %s":                                                   "%s.%s ne peut pas être défini ici, utilisez le champ de requête %s",
+		"The Ollama option %s is not available on this proxy":                                                  "L'option Ollama %s n'est pas disponible sur ce proxy",
+		"%s must be of type %s":                                                                                "%s doit être de type %s",
+		"%s must be at least %d":                                                                               "%s doit être au moins %d",
+		"%s is not an extension of this endpoint, see GET /v1/extensions/schema":                               "%s n'est pas une extension de ce point de terminaison, voir GET /v1/extensions/schema",
+		"%s takes no extensions":                                                                               "%s n'accepte aucune extension",
+	},
+	"es": {
+		"Admin API is disabled": "La API de administración está desactivada",
+		"Invalid admin API key": "Clave de API de administración no válida",
+		"You didn't provide an API key. Send it in the Authorization header as `Bearer <key>`": "No se proporcionó ninguna clave de API. Envíela en el encabezado Authorization como `Bearer <key>`",
+		"Incorrect API key provided":                                                    "Clave de API incorrecta",
+		"Rate limit of %d requests per minute reached":                                  "Se alcanzó el límite de %d solicitudes por minuto",
+		"The server is at capacity with %d requests waiting, please retry later":        "El servidor está al límite de su capacidad con %d solicitudes en espera, inténtelo de nuevo más tarde",
+		"The model backend is failing and temporarily unavailable, retry in %d seconds": "El backend del modelo está fallando y no está disponible temporalmente, inténtelo de nuevo en %d segundos",
+		"The model `%s` is not installed on Ollama":                                     "El modelo `%s` no está instalado en Ollama",
+		"The model `%s` is overloaded, please retry later":                              "El modelo `%s` está sobrecargado, inténtelo de nuevo más tarde",
+		"The input exceeds the context length of the model `%s`":                        "La entrada supera la longitud de contexto del modelo `%s`",
+		"Timed out waiting for the server with %d requests waiting, please retry later": "Se agotó el tiempo de espera del servidor con %d solicitudes en espera, inténtelo de nuevo más tarde",
+		"Too many concurrent streams for this API key, the limit is %d":                 "Demasiados streams simultáneos para esta clave de API, el límite es %d",
+		"Method not allowed":                                                   "Método no permitido",
+		"Invalid request body":                                                 "Cuerpo de la solicitud no válido",
+		"Model is required":                                                    "Se requiere un modelo",
+		"Messages array is empty":                                              "El array messages está vacío",
+		"Invalid image: %s":                                                    "Imagen no válida: %s",
+		"The model `%s` is not available on this proxy":                        "El modelo `%s` no está disponible en este proxy",
+		"Error applying rewrite rules: %s":                                     "Error al aplicar las reglas de reescritura: %s",
+		"Error calling Ollama API: %s":                                         "Error al llamar a la API de Ollama: %s",
+		"The prompt was rejected by the content filter, flagged as %s":         "El prompt fue rechazado por el filtro de contenido, marcado como %s",
+		"%s must be a duration such as \"30m\" or a number of seconds, got %v": "%s debe ser una duración como \"30m\" o un número de segundos, recibido: %v",
+		"Error calling output classifier: %s":                                  "Error al llamar al clasificador de salida: %s",
+		"Internal server error":                                                "Error interno del servidor",
+		"The model `%s` does not exist":                                        "El modelo `%s` no existe",
+		"Exactly one of model or template is required":                         "Se requiere exactamente uno de model o template",
+		"Template `%s` does not exist":                                         "La plantilla `%s` no existe",
+		"The model `%s` is not served by Ollama, its template is unknown":      "El modelo `%s` no lo sirve Ollama, su plantilla es desconocida",
+		"Error rendering template: %s":                                         "Error al renderizar la plantilla: %s",
+		"Request canceled by an administrator":                                 "Solicitud cancelada por un administrador",
+		"api_key or model is required":                                         "Se requiere api_key o model",
+		"Input must be a non-empty string or array of strings":                 "input debe ser una cadena no vacía o un array de cadenas",
+		"Unsupported encoding_format `%s`":                                     "encoding_format `%s` no admitido",
+		"%s must be between %s and %s for model %s":                            "%s debe estar entre %s y %s para el modelo %s",
+		"Request deadline exceeded before generation finished":                 "Se superó el plazo de la solicitud antes de terminar la generación",
+		"The proxy is down for maintenance, please retry later":                "El proxy está en mantenimiento, vuelva a intentarlo más tarde",
+		"messages[%d]: role is required":                                       "messages[%d]: se requiere un rol",
+		"messages[%d]: unknown role %q":                                        "messages[%d]: rol desconocido %q",
+		"messages[%d]: expected a %s message, %s requires alternating user/assistant roles starting with user": "messages[%d]: se esperaba un mensaje %s, %s requiere alternar los roles user/assistant empezando por user",
+		"tools[%d] must be a function with a name":                                                             "tools[%d] debe ser una función con nombre",
+		"Tool `%s` in tool_choice is not among tools":                                                          "La herramienta `%s` de tool_choice no está en tools",
+		"tool_choice must be none, auto, required or a function":                                               "tool_choice debe ser none, auto, required o una función",
+		"The model `%s` does not support tools":                                                                "El modelo `%s` no admite herramientas",
+		"messages[%d]: tool_calls[%d].function.arguments is not valid JSON":                                    "messages[%d]: tool_calls[%d].function.arguments no es JSON válido",
+		"messages[%d]: tool_call_id is required for tool messages":                                             "messages[%d]: tool_call_id es obligatorio para los mensajes tool",
+		"Input must be non-empty text of at most %d bytes":                                                     "La entrada debe ser un texto no vacío de como máximo %d bytes",
+		"Unsupported strategy `%s`":                                                                            "Estrategia `%s` no admitida",
+		"chunk_size must be positive":                                                                          "chunk_size debe ser positivo",
+		"n must be between 1 and %d":                                                                           "n debe estar entre 1 y %d",
+		"overlap must be at least 0 and less than chunk_size":                                                  "overlap debe ser al menos 0 y menor que chunk_size",
+		"response_format.json_schema.schema must be a JSON schema object":                                      "response_format.json_schema.schema debe ser un objeto de esquema JSON",
+		"Unsupported response_format type `%s`":                                                                "Tipo de response_format `%s` no admitido",
+		"No vector store is configured":                                                                        "No hay ningún almacén vectorial configurado",
+		"Query is required":                                                                                    "La consulta es obligatoria",
+		"top_k must be between 1 and %d":                                                                       "top_k debe estar entre 1 y %d",
+		"Error searching the vector store: %s":                                                                 "Error al buscar en el almacén vectorial: %s",
+		"Collection `%s` does not exist":                                                                       "La colección `%s` no existe",
+		"Collection `%s` already exists":                                                                       "La colección `%s` ya existe",
+		"Collection names are 1 to 64 letters, digits, - or _":                                                 "Los nombres de colección tienen de 1 a 64 letras, dígitos, - o _",
+		"embedding_model is required":                                                                          "embedding_model es obligatorio",
+		"Documents are required":                                                                               "Se requieren documentos",
+		"documents[%d] has no text":                                                                            "documents[%d] no tiene texto",
+		"Error updating the vector store: %s":                                                                  "Error al actualizar el almacén vectorial: %s",
+		"Not found":                                                                                            "No encontrado",
+		"Streaming transcription is not enabled on this proxy":                                                 "La transcripción en streaming no está habilitada en este proxy",
+		"This endpoint only accepts WebSocket connections":                                                     "Este endpoint solo acepta conexiones WebSocket",
+		"Error connecting to the transcription backend: %s":                                                    "Error al conectar con el backend de transcripción: %s",
+		"Transcription stream exceeded the request timeout":                                                    "El flujo de transcripción superó el tiempo límite de la solicitud",
+		"Transcription backend failed: %s":                                                                     "El backend de transcripción falló: %s",
+		"Voice chat is not enabled on this proxy":                                                              "El chat de voz no está habilitado en este proxy",
+		"file must be an audio file":                                                                           "file debe ser un archivo de audio",
+		"messages must be a JSON array of chat messages":                                                       "messages debe ser un array JSON de mensajes de chat",
+		"Error calling the speech-to-text backend: %s":                                                         "Error al llamar al backend de voz a texto: %s",
+		"No speech was recognized in the audio":                                                                "No se reconoció voz en el audio",
+		"Error reading the chat completion: %s":                                                                "Error al leer la respuesta del chat: %s",
+		"Error calling the text-to-speech backend: %s":                                                         "Error al llamar al backend de texto a voz: %s",
+		"Response signing is not enabled on this proxy":                                                        "La firma de respuestas no está habilitada en este proxy",
+		"Embedding jobs are not enabled on this proxy":                                                         "Los trabajos de embeddings no están habilitados en este proxy",
+		"Embedding job `%s` does not exist":                                                                    "El trabajo de embeddings `%s` no existe",
+		"Embedding job `%s` has no results to download":                                                        "El trabajo de embeddings `%s` no tiene resultados para descargar",
+		"Error reading the results: %s":                                                                        "Error al leer los resultados: %s",
+		"Collection `%s` is embedded with `%s`":                                                                "La colección `%s` está vectorizada con `%s`",
+		"file must be a JSONL or CSV file of texts":                                                            "file debe ser un archivo JSONL o CSV de textos",
+		"Unsupported format `%s`, use jsonl or csv":                                                            "Formato `%s` no compatible, use jsonl o csv",
+		"Invalid file: %s":                                                                                     "Archivo no válido: %s",
+		"Error saving the embedding job: %s":                                                                   "Error al guardar el trabajo de embeddings: %s",
+		"%s.%s can't be set there, use the request field %s":                                                   "%s.%s no se puede establecer ahí, use el campo de la solicitud %s",
+		"The Ollama option %s is not available on this proxy":                                                  "La opción de Ollama %s no está disponible en este proxy",
+		"%s must be of type %s":                                                                                "%s debe ser de tipo %s",
+		"%s must be at least %d":                                                                               "%s debe ser al menos %d",
+		"%s is not an extension of this endpoint, see GET /v1/extensions/schema":                               "%s no es una extensión de este endpoint, consulte GET /v1/extensions/schema",
+		"%s takes no extensions":                                                                               "%s no acepta extensiones",
+	},
+}
+
+// errorLanguage picks the best language we have from Accept-Language.
+func errorLanguage(r *http.Request) string {
+	type preference struct {
+		language string
+		q        float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if language == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		preferences = append(preferences, preference{language, q})
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+
+	for _, p := range preferences {
+		if p.q <= 0 {
+			continue
+		}
+		if _, ok := errorTranslations[p.language]; ok || p.language == "en" {
+			return p.language
+		}
+	}
+	return config.ErrorLanguage
+}
+
+// errorLanguages are the languages of error messages, English first.
+func errorLanguages() []string {
+	languages := []string{"en"}
+	for language := range errorTranslations {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages[1:])
+	return languages
+}
+
+// localizeError translates an error message format and fills it in. Messages
+// without args are used verbatim, so operator-provided text is safe to pass.
+func localizeError(r *http.Request, format string, args ...any) string {
+	if translated, ok := errorTranslations[errorLanguage(r)][format]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorLanguage(t *testing.T) {
+	tests := []struct {
+		name           string
+		errorLanguage  string
+		acceptLanguage string
+		want           string
+	}{
+		{"no Accept-Language", "en", "", "en"},
+		{"translated", "en", "de-DE,de;q=0.9", "de"},
+		{"by preference", "en", "it;q=0.9,fr;q=0.5,es;q=0.8", "es"},
+		{"untranslated", "en", "it", "en"},
+		{"configured language", "fr", "it", "fr"},
+		{"English asked for", "fr", "en-US", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{ErrorLanguage: tt.errorLanguage})
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			if got := errorLanguage(r); got != tt.want {
+				t.Errorf("errorLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// How many decoded images to keep around. Vision chats resend every image on
+// every turn, so even a small cache saves most of the decoding.
+const IMAGE_CACHE_SIZE = 64
+
+var errUnsupportedImageURL = errors.New("image_url must be a base64 data URL or an http(s) URL")
+
+type imageCacheEntry struct {
+	key    [sha256.Size]byte
+	base64 string
+}
+
+// imageCache is a small LRU of decoded images keyed by the hash of the URL
+// they came from.
+type imageCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+var decodedImages = newImageCache(IMAGE_CACHE_SIZE)
+
+func newImageCache(size int) *imageCache {
+	return &imageCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+func (c *imageCache) get(key [sha256.Size]byte) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*imageCacheEntry).base64, true
+}
+
+func (c *imageCache) put(key [sha256.Size]byte, image string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&imageCacheEntry{key: key, base64: image})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*imageCacheEntry).key)
+	}
+}
+
+// resolveImage turns an image_url into the raw base64 Ollama expects, going
+// through the cache so an image repeated across turns is decoded (or fetched)
+// only once.
+func resolveImage(ctx context.Context, url string) (string, error) {
+	key := sha256.Sum256([]byte(url))
+	if image, ok := decodedImages.get(key); ok {
+		return image, nil
+	}
+
+	var image string
+	var err error
+	if strings.HasPrefix(url, "data:") {
+		image, err = decodeDataURL(url)
+	} else {
+		image, err = fetchImage(ctx, url)
+	}
+	if err != nil {
+		return "", err
+	}
+	decodedImages.put(key, image)
+	return image, nil
+}
+
+func decodeDataURL(url string) (string, error) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", errUnsupportedImageURL
+	}
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return "", errUnsupportedImageURL
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 image data: %w", err)
+	}
+	if contentType := http.DetectContentType(data); !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("image_url does not contain an image (detected %s)", contentType)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
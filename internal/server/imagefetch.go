@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Max size of an image_url that points at an http(s) URL
+const IMAGE_FETCH_MAX_BYTES = 20 << 20
+
+// fetchImage downloads a remote image through the outbound policy and
+// returns it base64 encoded.
+func fetchImage(ctx context.Context, rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		return "", errUnsupportedImageURL
+	}
+
+	data, err := fetchOutbound(ctx, rawURL, IMAGE_FETCH_MAX_BYTES)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch image: %w", err)
+	}
+	if contentType := http.DetectContentType(data); !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("image_url does not point at an image (detected %s)", contentType)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
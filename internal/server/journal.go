@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Asynchronous jobs keep a journal entry on disk for as long as they are
+// listed: <id>.json in their directory, the job's state rewritten whenever
+// it changes. On startup readJournal hands every entry back to the job
+// API, which resumes what a crash or restart interrupted, or fails it with
+// the reason, so clients polling a job always see how it ended.
+
+// saveJournalEntry replaces the journal entry at path with record. The new
+// entry is written next to it first and renamed over it, so a crash leaves
+// either the old entry or the new one, never half of one.
+func saveJournalEntry(path string, record any) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJournal calls restore with every journal entry in dir. Entries that
+// can't be read or restored are logged and skipped, and the leftovers of
+// writes a crash interrupted are removed.
+func readJournal(dir string, restore func(path string, data []byte) error) {
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "*.json.tmp"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Printf("failed to read the journal of %s: %v", dir, err)
+		return
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = restore(path, data)
+		}
+		if err != nil {
+			log.Printf("skipping journal entry %s: %v", path, err)
+		}
+	}
+}
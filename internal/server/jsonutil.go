@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// What to do with request fields the proxy doesn't know about
+const (
+	UNKNOWN_FIELDS_IGNORE = "ignore"
+	UNKNOWN_FIELDS_REJECT = "reject"
+)
+
+// Deepest nesting of objects/arrays accepted in a request body
+const MAX_JSON_DEPTH = 64
+
+// writeJSON encodes v straight into w. HTML escaping is off, it turns the
+// `<` and `&` of every code snippet into \u003c and \u0026.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// decodeJSONBody decodes a request body, refusing anything nested deeper
+// than MAX_JSON_DEPTH. Numbers in generic values stay json.Number, so large
+// integers like seeds survive a round trip untouched.
+func decodeJSONBody(r io.Reader, v any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := checkJSONDepth(data, MAX_JSON_DEPTH); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// decodeRequest converts a generic request body into its struct, applying
+// unknown_fields to top-level fields.
+func decodeRequest(body map[string]any, v any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if config.UnknownFields == UNKNOWN_FIELDS_REJECT {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func checkJSONDepth(data []byte, max int) error {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > max {
+				return fmt.Errorf("nested deeper than %d levels", max)
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		unknownFields string
+		body          string
+		// in the error, empty for none
+		want string
+	}{
+		{"known fields", UNKNOWN_FIELDS_REJECT, `{"model": "llama3", "input": "hi"}`, ""},
+		{"unknown field ignored", UNKNOWN_FIELDS_IGNORE, `{"model": "llama3", "input": "hi", "dimensions": 256}`, ""},
+		{"unknown field rejected", UNKNOWN_FIELDS_REJECT, `{"model": "llama3", "input": "hi", "dimensions": 256}`, `unknown field "dimensions"`},
+		{"too deep", UNKNOWN_FIELDS_IGNORE, `{"model": "llama3", "input": ` + strings.Repeat("[", MAX_JSON_DEPTH+1) + strings.Repeat("]", MAX_JSON_DEPTH+1) + `}`, "nested"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{UnknownFields: tt.unknownFields})
+			var body map[string]any
+			err := decodeJSONBody(strings.NewReader(tt.body), &body)
+			if err == nil {
+				var req EmbeddingRequest
+				err = decodeRequest(body, &req)
+				if err == nil && req.Model != "llama3" {
+					t.Errorf("model %q, want llama3", req.Model)
+				}
+			}
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("error %v, want none", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("error %v, want one with %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header clients can set Ollama's keep_alive with instead of the body field
+const KEEP_ALIVE_HEADER = "X-Ollama-Keep-Alive"
+
+// requestKeepAlive is the keep_alive a request asks for, from x_proxy, its
+// `ollama` extension or else KEEP_ALIVE_HEADER, as a duration Ollama
+// parses. It is empty when the request doesn't ask, and an error names the
+// field when the value isn't a duration.
+func requestKeepAlive(r *http.Request, proxy *ProxyExtensions, ext *OllamaExtension) (string, *apiError) {
+	if proxy != nil && proxy.KeepAlive != nil {
+		return bodyKeepAlive("x_proxy.keep_alive", proxy.KeepAlive)
+	}
+	if ext != nil && ext.KeepAlive != nil {
+		return bodyKeepAlive("ollama.keep_alive", ext.KeepAlive)
+	}
+	if value := r.Header.Get(KEEP_ALIVE_HEADER); value != "" {
+		keepAlive, ok := parseKeepAlive(value)
+		if !ok {
+			return "", keepAliveError(KEEP_ALIVE_HEADER, value)
+		}
+		return keepAlive, nil
+	}
+	return "", nil
+}
+
+// bodyKeepAlive parses the keep_alive field param, a string or a number.
+func bodyKeepAlive(param string, value any) (string, *apiError) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	keepAlive, ok := parseKeepAlive(text)
+	if !ok {
+		return "", keepAliveError(param, value)
+	}
+	return keepAlive, nil
+}
+
+func keepAliveError(param string, value any) *apiError {
+	err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_value", "%s must be a duration such as \"30m\" or a number of seconds, got %v", param, value)
+	err.param = param
+	return err
+}
+
+// parseKeepAlive accepts seconds ("300", "-1") or a Go duration ("30m"),
+// and returns it as a Go duration, which is what Ollama takes as a string.
+func parseKeepAlive(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)).String(), true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return "", false
+	}
+	return d.String(), true
+}
+
+// modelKeepAlive is the keep_alive configured for an Ollama model, empty
+// to leave it to Ollama. An exact name wins over patterns, and the longest
+// pattern matching wins over shorter ones.
+func modelKeepAlive(model string) string {
+	if value, ok := config.KeepAlive[model]; ok {
+		keepAlive, _ := parseKeepAlive(value)
+		return keepAlive
+	}
+	best := ""
+	for _, pattern := range sortedKeys(config.KeepAlive) {
+		if len(pattern) > len(best) && matchesAnyPattern(compileGlobPatterns([]string{pattern}), model) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	keepAlive, _ := parseKeepAlive(config.KeepAlive[best])
+	return keepAlive
+}
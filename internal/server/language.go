@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// How many times to re-prompt a model that answered in the wrong language
+const LANGUAGE_MAX_REPROMPTS = 1
+
+var languageNames = map[string]string{
+	"en": "English",
+	"de": "German",
+	"fr": "French",
+	"es": "Spanish",
+	"it": "Italian",
+	"nl": "Dutch",
+	"pt": "Portuguese",
+}
+
+// A handful of very common words per language is enough to tell them apart
+// on anything longer than a sentence.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "in", "that", "it", "you", "for", "with", "this", "not", "be"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "sie", "mit", "ein", "eine", "zu", "den", "auf", "sind"},
+	"fr": {"le", "la", "les", "et", "est", "un", "une", "des", "pas", "que", "vous", "pour", "dans", "avec", "sont"},
+	"es": {"el", "la", "los", "las", "y", "es", "un", "una", "que", "de", "no", "para", "con", "por", "son"},
+	"it": {"il", "la", "di", "che", "e", "è", "un", "una", "non", "per", "sono", "con", "gli", "del", "questo"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "van", "dat", "zijn", "met", "voor", "ik", "je", "op", "ook"},
+	"pt": {"o", "a", "os", "as", "e", "é", "um", "uma", "que", "não", "para", "com", "do", "da", "são"},
+}
+
+// Below this many stopword hits the text is too short to judge
+const LANGUAGE_MIN_EVIDENCE = 3
+
+func injectLanguageInstruction(req *OpenAIChatRequest, language string) {
+	name, ok := languageNames[language]
+	if !ok {
+		return
+	}
+	instruction := "Always answer in " + name + ", even if the user writes in another language."
+	for i, msg := range req.Messages {
+		if msg.Role == "system" {
+			req.Messages[i].Content = msg.Content + "\n\n" + instruction
+			return
+		}
+	}
+	req.Messages = append([]ChatMessage{{Role: "system", Content: instruction}}, req.Messages...)
+}
+
+// detectLanguage returns the best matching language code, or "" when the
+// text doesn't carry enough evidence.
+func detectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	scores := make(map[string]int)
+	for language, stopwords := range languageStopwords {
+		set := make(map[string]struct{}, len(stopwords))
+		for _, word := range stopwords {
+			set[word] = struct{}{}
+		}
+		for _, word := range words {
+			if _, ok := set[word]; ok {
+				scores[language]++
+			}
+		}
+	}
+
+	best, bestScore := "", 0
+	for language, score := range scores {
+		if score > bestScore || (score == bestScore && language < best) {
+			best, bestScore = language, score
+		}
+	}
+	if bestScore < LANGUAGE_MIN_EVIDENCE {
+		return ""
+	}
+	return best
+}
+
+func isInLanguage(text string, language string) bool {
+	detected := detectLanguage(text)
+	return detected == "" || detected == language
+}
+
+// enforceLanguage re-prompts the model while its answer is detectably in
+// another language than the one required.
+func enforceLanguage(ctx context.Context, openAIReq OpenAIChatRequest, language string, resp *OllamaResponse, generate func(OllamaRequest) (*OllamaResponse, error)) (*OllamaResponse, error) {
+	name, ok := languageNames[language]
+	if !ok {
+		return resp, nil
+	}
+
+	for i := 0; i < LANGUAGE_MAX_REPROMPTS && !isInLanguage(resp.Response, language); i++ {
+		openAIReq.Messages = append(openAIReq.Messages,
+			ChatMessage{Role: "assistant", Content: resp.Response},
+			ChatMessage{Role: "user", Content: "Repeat your previous answer in " + name + " only."},
+		)
+		ollamaReq, err := buildOllamaRequest(ctx, openAIReq)
+		if err != nil {
+			return resp, err
+		}
+		resp, err = generate(ollamaReq)
+		if err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log output formats, see log.format
+const (
+	LOG_FORMAT_PRETTY = "pretty"
+	LOG_FORMAT_JSON   = "json"
+)
+
+// Longest X-Request-ID taken from a client, longer ones are replaced
+const MAX_REQUEST_ID_LENGTH = 128
+
+// Routes logged at debug level only, as probes hit them all the time
+var QUIET_ROUTES = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogHandler writes records to w in the configured format and at the
+// configured level.
+func newLogHandler(w io.Writer, c LogConfig) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logLevels[c.Level]}
+	if c.UTC {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Value = slog.TimeValue(a.Value.Time().UTC())
+			}
+			return a
+		}
+	}
+	if c.Format == LOG_FORMAT_JSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return &prettyHandler{w: w, mu: &sync.Mutex{}, opts: opts}
+}
+
+// prettyHandler writes a record like the standard logger does, followed by
+// its attributes as key=value pairs.
+type prettyHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	opts  *slog.HandlerOptions
+	attrs []slog.Attr
+	group string
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	t := slog.Time(slog.TimeKey, r.Time)
+	if h.opts.ReplaceAttr != nil {
+		t = h.opts.ReplaceAttr(nil, t)
+	}
+	buf.WriteString(t.Value.Time().Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(r.Level.String() + " ")
+	}
+	buf.WriteString(r.Message)
+	for _, a := range h.attrs {
+		writePrettyAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writePrettyAttr(&buf, h.group, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + a.Key
+		}
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.group = h.group + name + "."
+	return &c
+}
+
+func writePrettyAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			writePrettyAttr(buf, prefix+a.Key+".", g)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \"=") {
+		value = fmt.Sprintf("%q", value)
+	}
+	buf.WriteString(" " + prefix + a.Key + "=" + value)
+}
+
+// requestLog collects what the access log line of a request reports from
+// the handlers that learn it.
+type requestLog struct {
+	mu           sync.Mutex
+	completionID string
+	model        string
+	usage        Usage
+	experiment   *experimentAssignment
+}
+
+type requestLogContextKey struct{}
+
+func requestLogFromContext(ctx context.Context) *requestLog {
+	l, _ := ctx.Value(requestLogContextKey{}).(*requestLog)
+	return l
+}
+
+func (l *requestLog) setCompletionID(id string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.completionID = id
+}
+
+func (l *requestLog) experimentAssignment() *experimentAssignment {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.experiment
+}
+
+func (l *requestLog) setExperimentAssignment(a *experimentAssignment) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.experiment = a
+}
+
+// addUsage records a generation, requests with several of them report the
+// model of the last and the tokens of all.
+func (l *requestLog) addUsage(model string, usage Usage) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.model = model
+	l.usage.PromptTokens += usage.PromptTokens
+	l.usage.CompletionTokens += usage.CompletionTokens
+	l.usage.TotalTokens += usage.TotalTokens
+}
+
+// requestLogMiddleware takes the request ID from the client's X-Request-ID
+// or makes one up, echoes it on the response and logs one line per request
+// with its status, latency, API key name, organization, model and tokens.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(CORRELATION_HEADER)
+		if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = "req_" + hex.EncodeToString(b)
+		}
+		w.Header().Set(CORRELATION_HEADER, id)
+
+		l := &requestLog{}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogContextKey{}, l)))
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case QUIET_ROUTES[r.URL.Path]:
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+		}
+		if s := spanFromContext(r.Context()); s != nil {
+			attrs = append(attrs, slog.String("trace_id", hex.EncodeToString(s.traceID[:])))
+		}
+		if entry := apiKeys.lookup(apiKeyFromRequest(r)); entry != nil && entry.Name != "" {
+			attrs = append(attrs, slog.String("key", entry.Name))
+		}
+		if org, _ := r.Context().Value(organizationContextKey{}).(organization); org.id != "" {
+			attrs = append(attrs, slog.String("organization", org.id))
+			if org.project != "" {
+				attrs = append(attrs, slog.String("project", org.project))
+			}
+		}
+		l.mu.Lock()
+		if l.completionID != "" {
+			attrs = append(attrs, slog.String("completion_id", l.completionID))
+		}
+		if l.model != "" {
+			attrs = append(attrs,
+				slog.String("model", l.model),
+				slog.Int("prompt_tokens", l.usage.PromptTokens),
+				slog.Int("completion_tokens", l.usage.CompletionTokens))
+		}
+		if e := l.experiment; e != nil && e.experiment != nil {
+			attrs = append(attrs, slog.String("experiment", e.experiment.Name), slog.String("variant", e.variant))
+		}
+		l.mu.Unlock()
+		tenantFromContext(r.Context()).log.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// newTenantLoggers log through the configured handler writing to w, with
+// the tenant's name on every record.
+func newTenantLoggers(w io.Writer, name string) (*slog.Logger, *log.Logger) {
+	h := newLogHandler(w, config.Log).WithAttrs([]slog.Attr{slog.String("tenant", name)})
+	return slog.New(h), slog.NewLogLogger(h, slog.LevelInfo)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the latency histogram buckets
+var METRICS_LATENCY_BUCKETS = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// proxyMetrics are the Prometheus metrics served on metrics_addr. Request
+// metrics are fed by lifecycle events, so they cover exactly what
+// /admin/events shows.
+type proxyMetrics struct {
+	httpResponses    *counterVec
+	requests         *counterVec
+	requestErrors    *counterVec
+	requestDuration  *histogramVec
+	timeToFirstToken *histogramVec
+	promptTokens     *counterVec
+	completionTokens *counterVec
+	streamedTokens   *counterVec
+	upstreamDuration *histogramVec
+	cacheLookups     *counterVec
+	upstreamRetries  *counterVec
+	evalSamples      *counterVec
+	evalScoreSum     *counterVec
+	evalScored       *counterVec
+
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+var metrics = newProxyMetrics()
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		httpResponses:    newCounterVec("ollama_proxy_http_responses_total", "HTTP responses by route and status code.", "tenant", "route", "code"),
+		requests:         newCounterVec("ollama_proxy_requests_total", "Requests that reached a model, by outcome.", "tenant", "model", "outcome"),
+		requestErrors:    newCounterVec("ollama_proxy_request_errors_total", "Requests that reached a model and failed.", "tenant", "model"),
+		requestDuration:  newHistogramVec("ollama_proxy_request_duration_seconds", "Time from accepting a request to its last byte.", "tenant", "model"),
+		timeToFirstToken: newHistogramVec("ollama_proxy_time_to_first_token_seconds", "Time from accepting a request to the first generated token.", "tenant", "model"),
+		promptTokens:     newCounterVec("ollama_proxy_prompt_tokens_total", "Prompt tokens of finished requests.", "tenant", "model"),
+		completionTokens: newCounterVec("ollama_proxy_completion_tokens_total", "Completion tokens of finished requests.", "tenant", "model"),
+		streamedTokens:   newCounterVec("ollama_proxy_streamed_tokens_total", "Tokens sent to clients as stream deltas.", "tenant", "model"),
+		upstreamDuration: newHistogramVec("ollama_proxy_upstream_duration_seconds", "Duration of calls to the upstream, per model and outcome.", "model", "outcome"),
+		cacheLookups:     newCounterVec("ollama_proxy_response_cache_lookups_total", "Response cache lookups of deterministic requests, by result.", "tenant", "result"),
+		upstreamRetries:  newCounterVec("ollama_proxy_upstream_retries_total", "Upstream calls retried after a transient failure, per model.", "model"),
+		evalSamples:      newCounterVec("ollama_proxy_eval_samples_total", "Generations captured for quality evaluation, per model.", "model"),
+		evalScoreSum:     newCounterVec("ollama_proxy_eval_score_sum", "Sum of the judge scores of evaluation samples, per model.", "model"),
+		evalScored:       newCounterVec("ollama_proxy_eval_scored_total", "Evaluation samples scored by the judge model, per model.", "model"),
+		started:          make(map[string]time.Time),
+	}
+}
+
+// observeEvent updates the request metrics. It runs for every event, before
+// subscribers get it.
+func (m *proxyMetrics) observeEvent(ev Event) {
+	m.mu.Lock()
+	started, ok := m.started[ev.RequestID]
+	switch ev.Type {
+	case EVENT_ACCEPTED:
+		m.started[ev.RequestID] = ev.Time
+	case EVENT_DONE, EVENT_ERROR:
+		delete(m.started, ev.RequestID)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	elapsed := ev.Time.Sub(started).Seconds()
+	switch ev.Type {
+	case EVENT_FIRST_TOKEN:
+		m.timeToFirstToken.observe(elapsed, ev.Tenant, ev.Model)
+	case EVENT_DONE:
+		m.requests.add(1, ev.Tenant, ev.Model, "done")
+		m.requestDuration.observe(elapsed, ev.Tenant, ev.Model)
+		if ev.Usage != nil {
+			m.promptTokens.add(float64(ev.Usage.PromptTokens), ev.Tenant, ev.Model)
+			m.completionTokens.add(float64(ev.Usage.CompletionTokens), ev.Tenant, ev.Model)
+		}
+	case EVENT_ERROR:
+		m.requests.add(1, ev.Tenant, ev.Model, "error")
+		m.requestErrors.add(1, ev.Tenant, ev.Model)
+		m.requestDuration.observe(elapsed, ev.Tenant, ev.Model)
+	}
+}
+
+func (m *proxyMetrics) observeUpstream(model string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.upstreamDuration.observe(time.Since(start).Seconds(), model, outcome)
+}
+
+func (m *proxyMetrics) write(w io.Writer) {
+	m.httpResponses.write(w)
+	m.requests.write(w)
+	m.requestErrors.write(w)
+	m.requestDuration.write(w)
+	m.timeToFirstToken.write(w)
+	m.promptTokens.write(w)
+	m.completionTokens.write(w)
+	m.streamedTokens.write(w)
+	m.upstreamDuration.write(w)
+	m.cacheLookups.write(w)
+	m.upstreamRetries.write(w)
+	m.evalSamples.write(w)
+	m.evalScoreSum.write(w)
+	m.evalScored.write(w)
+
+	m.mu.Lock()
+	inflight := len(m.started)
+	m.mu.Unlock()
+	writeGauge(w, "ollama_proxy_requests_in_flight", "Requests accepted and not finished yet.", float64(inflight))
+	writeGauge(w, "ollama_proxy_queue_depth", "Requests waiting for a generation slot.", float64(generationSlots.depth()))
+	writeModelQueueDepths(w)
+	writeBackendCircuits(w)
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// metricsMiddleware counts responses of route by status code. It also
+// records the route for RoutePolicy.
+func metricsMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(withRoute(r.Context(), route)))
+		metrics.httpResponses.add(1, tenantFromContext(r.Context()).name, route, strconv.Itoa(rec.status))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets WebSocket endpoints take over the connection.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !s.wroteHeader {
+		s.status = http.StatusSwitchingProtocols
+		s.wroteHeader = true
+	}
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach Flush and write deadlines.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// counterVec is a counter per combination of label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with METRICS_LATENCY_BUCKETS per combination
+// of label values.
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(METRICS_LATENCY_BUCKETS))}
+		h.series[key] = s
+	}
+	for i, bound := range METRICS_LATENCY_BUCKETS {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range METRICS_LATENCY_BUCKETS {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(v))
+}
+
+// writeModelQueueDepths writes the queue depth of every model of
+// model_concurrency.
+func writeModelQueueDepths(w io.Writer) {
+	if len(modelSlots) == 0 {
+		return
+	}
+	const name = "ollama_proxy_model_queue_depth"
+	fmt.Fprintf(w, "# HELP %s Requests waiting for a slot of their model.\n# TYPE %s gauge\n", name, name)
+	for _, model := range sortedKeys(modelSlots) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{"model"}, model, "", ""), formatValue(float64(modelSlots[model].depth())))
+	}
+}
+
+// writeBackendCircuits writes whether the circuit of every Ollama backend
+// is open.
+func writeBackendCircuits(w io.Writer) {
+	const name = "ollama_proxy_backend_circuit_open"
+	fmt.Fprintf(w, "# HELP %s Whether calls to the backend fail fast after consecutive failures.\n# TYPE %s gauge\n", name, name)
+	for _, tier := range ollamaBackends.tiers {
+		for _, b := range tier {
+			open := 0.0
+			if b.circuitOpen() {
+				open = 1
+			}
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{"backend"}, b.url, "", ""), formatValue(open))
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders the label set of key, plus an extra label if given.
+func formatLabels(names []string, key string, extraName, extraValue string) string {
+	values := strings.Split(key, "\xff")
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
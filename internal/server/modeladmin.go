@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ModelPullRequest is the body of POST /admin/models/pull.
+type ModelPullRequest struct {
+	Model string `json:"model"`
+	// false answers once the pull is done instead of streaming its progress
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// ModelCopyRequest is the body of POST /admin/models/copy.
+type ModelCopyRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// handleAdminModels manages the models of an Ollama backend, so operators
+// don't need access to the Ollama host. Requests go to the first backend,
+// ollama_api_base unless backend_tiers lists others, or to the one named by
+// ?backend=<url>:
+//
+//	GET    /admin/models          installed models (/api/tags)
+//	GET    /admin/models/running  loaded models (/api/ps)
+//	GET    /admin/models/{name}   details of a model (/api/show)
+//	POST   /admin/models/pull     pull a model, streaming Ollama's progress (/api/pull)
+//	POST   /admin/models/copy     copy a model to a new name (/api/copy)
+//	DELETE /admin/models/{name}   delete a model (/api/delete)
+//
+// Ollama's answers are passed on as they are.
+func handleAdminModels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	b := ollamaBackends.tiers[0][0]
+	if url := r.URL.Query().Get("backend"); url != "" {
+		if b = ollamaBackends.find(url); b == nil {
+			sendParamError(w, r, "%s is not an Ollama backend of this proxy", "invalid_value", "backend", http.StatusBadRequest, url)
+			return
+		}
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/models"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		relayOllama(w, r, http.MethodGet, b.url+"/api/tags", nil)
+	case r.Method == http.MethodGet && name == "running":
+		relayOllama(w, r, http.MethodGet, b.url+"/api/ps", nil)
+	case r.Method == http.MethodGet:
+		relayOllama(w, r, http.MethodPost, b.url+"/api/show", map[string]string{"model": name})
+	case r.Method == http.MethodPost && name == "pull":
+		var req ModelPullRequest
+		if err := decodeJSONBody(r.Body, &req); err != nil || req.Model == "" {
+			sendError(w, r, "model is required", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+			return
+		}
+		stream := req.Stream == nil || *req.Stream
+		log.Printf("admin: pulling model %s on %s", req.Model, b.url)
+		if relayOllama(w, r, http.MethodPost, b.url+"/api/pull", map[string]any{"model": req.Model, "stream": stream}) {
+			forgetModelInfo(req.Model)
+		}
+	case r.Method == http.MethodPost && name == "copy":
+		var req ModelCopyRequest
+		if err := decodeJSONBody(r.Body, &req); err != nil || req.Source == "" || req.Destination == "" {
+			sendError(w, r, "source and destination are required", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: copying model %s to %s on %s", req.Source, req.Destination, b.url)
+		if relayOllama(w, r, http.MethodPost, b.url+"/api/copy", req) {
+			forgetModelInfo(req.Destination)
+		}
+	case r.Method == http.MethodDelete && name != "":
+		log.Printf("admin: deleting model %s on %s", name, b.url)
+		if relayOllama(w, r, http.MethodDelete, b.url+"/api/delete", map[string]string{"model": name}) {
+			forgetModelInfo(name)
+		}
+	default:
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// relayOllama sends a call to Ollama and passes its answer on, flushing
+// as it goes so pull progress arrives as it happens. It reports whether
+// Ollama answered with a success; a streamed pull that fails reports its
+// error in the last line of a 200.
+func relayOllama(w http.ResponseWriter, r *http.Request, method, url string, body any) bool {
+	var data io.Reader
+	if body != nil {
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, body); err != nil {
+			sendError(w, r, "Internal server error", "server_error", "internal_error", http.StatusInternalServerError)
+			return false
+		}
+		data = &buf
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, url, data)
+	if err != nil {
+		sendError(w, r, "Internal server error", "server_error", "internal_error", http.StatusInternalServerError)
+		return false
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		}
+		return false
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return false
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return resp.StatusCode < http.StatusBadRequest
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long /api/show results are reused, they only change when a model is re-pulled
+const MODEL_INFO_TTL = 10 * time.Minute
+
+// OllamaShowResponse is the part of /api/show the proxy uses.
+type OllamaShowResponse struct {
+	Template   string    `json:"template"`
+	Parameters string    `json:"parameters"`
+	ModifiedAt time.Time `json:"modified_at"`
+	// e.g. "completion", "tools", "vision"; empty on older Ollama versions
+	Capabilities []string `json:"capabilities"`
+}
+
+// stopTokens returns the stop sequences from the model's Modelfile parameters.
+func (s *OllamaShowResponse) stopTokens() []string {
+	var tokens []string
+	for _, line := range strings.Split(s.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "stop" {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "stop"))
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		tokens = append(tokens, value)
+	}
+	return tokens
+}
+
+type modelInfoEntry struct {
+	info    *OllamaShowResponse
+	err     error
+	fetched time.Time
+}
+
+var modelInfoCache = struct {
+	sync.Mutex
+	entries map[string]modelInfoEntry
+}{entries: make(map[string]modelInfoEntry)}
+
+// showModel returns /api/show for model, cached for MODEL_INFO_TTL. Failures
+// are cached too so a missing model doesn't cost a call per request.
+func showModel(ctx context.Context, model string) (*OllamaShowResponse, error) {
+	modelInfoCache.Lock()
+	entry, ok := modelInfoCache.entries[model]
+	modelInfoCache.Unlock()
+	if ok && time.Since(entry.fetched) < MODEL_INFO_TTL {
+		return entry.info, entry.err
+	}
+
+	info, err := fetchModelInfo(ctx, model)
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	modelInfoCache.Lock()
+	modelInfoCache.entries[model] = modelInfoEntry{info: info, err: err, fetched: time.Now()}
+	modelInfoCache.Unlock()
+	return info, err
+}
+
+// forgetModelInfo drops what is cached of model, e.g. once it was pulled.
+func forgetModelInfo(model string) {
+	modelInfoCache.Lock()
+	delete(modelInfoCache.entries, model)
+	modelInfoCache.Unlock()
+}
+
+func fetchModelInfo(ctx context.Context, model string) (*OllamaShowResponse, error) {
+	body, err := json.Marshal(map[string]string{"model": model})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ollamaBackends.pick("").url+"/api/show", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errModelNotFound, model)
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ollama API error (status %d): %s", resp.StatusCode, string(data))
+	}
+
+	var info OllamaShowResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &info, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Status updates for streams waiting on a model that isn't loaded yet, so
+// UIs can show that the model is warming up instead of a silent hang
+const (
+	MODEL_LOAD_STATUS = true
+	// How long to wait for the first token before the first update, a
+	// quick load sends none
+	MODEL_LOAD_STATUS_DELAY = 2 * time.Second
+	// Time between updates
+	MODEL_LOAD_STATUS_INTERVAL = 5 * time.Second
+	// Longest wait for /api/ps before a model is assumed to be loaded
+	MODEL_LOAD_CHECK_TIMEOUT = time.Second
+)
+
+// STATUS_EVENTS_HEADER asks for the updates as `status` events instead of
+// SSE comments, which OpenAI clients skip.
+const STATUS_EVENTS_HEADER = "X-Status-Events"
+
+// StatusEvent is the data of a `status` event.
+type StatusEvent struct {
+	Status string `json:"status"`
+	Model  string `json:"model"`
+	// estimated from the model's last load, omitted before one was seen
+	Percent *int `json:"percent,omitempty"`
+}
+
+// OllamaPsResponse is the part of /api/ps the proxy uses.
+type OllamaPsResponse struct {
+	Models []struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	} `json:"models"`
+}
+
+// modelLoadTimes are how long the last cold load of each model took.
+var modelLoadTimes = struct {
+	sync.Mutex
+	took map[string]time.Duration
+}{took: make(map[string]time.Duration)}
+
+// modelLoaded reports whether Ollama has model in memory. When it can't be
+// told, the model counts as loaded.
+func modelLoaded(ctx context.Context, model string) bool {
+	ctx, cancel := context.WithTimeout(ctx, MODEL_LOAD_CHECK_TIMEOUT)
+	defer cancel()
+	ps, err := fetchRunningModels(ctx)
+	if err != nil {
+		return true
+	}
+	for _, m := range ps.Models {
+		if m.Name == model || m.Model == model {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchRunningModels(ctx context.Context) (*OllamaPsResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ollamaBackends.pick("").url+"/api/ps", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama API error (status %d)", resp.StatusCode)
+	}
+	var ps OllamaPsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &ps, nil
+}
+
+// modelLoadWatch sends load status updates on a stream until the first
+// token arrives.
+type modelLoadWatch struct {
+	model   string
+	cold    bool
+	started time.Time
+	once    sync.Once
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// watchModelLoad starts sending updates on stream if req's model isn't
+// loaded. stop must be called before anything else is written to stream.
+func watchModelLoad(ctx context.Context, r *http.Request, stream *sseStream, req OllamaRequest) *modelLoadWatch {
+	watch := &modelLoadWatch{model: req.Model, started: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	if !MODEL_LOAD_STATUS || providerFor(req).Type != PROVIDER_OLLAMA || modelLoaded(ctx, req.Model) {
+		close(watch.stopped)
+		return watch
+	}
+	watch.cold = true
+	asEvents, _ := strconv.ParseBool(r.Header.Get(STATUS_EVENTS_HEADER))
+
+	go func() {
+		defer close(watch.stopped)
+		timer := time.NewTimer(MODEL_LOAD_STATUS_DELAY)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-watch.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			status := StatusEvent{Status: "loading", Model: req.Model, Percent: watch.percent()}
+			var err error
+			if asEvents {
+				err = stream.namedEvent("status", status)
+			} else if status.Percent != nil {
+				err = stream.comment(fmt.Sprintf("loading model %s (%d%%)", req.Model, *status.Percent))
+			} else {
+				err = stream.comment("loading model " + req.Model)
+			}
+			if err != nil {
+				return
+			}
+			timer.Reset(MODEL_LOAD_STATUS_INTERVAL)
+		}
+	}()
+	return watch
+}
+
+// percent estimates how far the load is from how long the last one took.
+func (w *modelLoadWatch) percent() *int {
+	modelLoadTimes.Lock()
+	took, ok := modelLoadTimes.took[w.model]
+	modelLoadTimes.Unlock()
+	if !ok || took <= 0 {
+		return nil
+	}
+	percent := min(99, int(100*time.Since(w.started)/took))
+	return &percent
+}
+
+// stop ends the updates and waits for one being sent.
+func (w *modelLoadWatch) stop() {
+	w.once.Do(func() { close(w.done) })
+	<-w.stopped
+}
+
+// finish stops the updates and remembers how long a cold load took.
+func (w *modelLoadWatch) finish(resp *OllamaResponse) {
+	w.stop()
+	if w.cold && resp != nil && resp.LoadDuration > 0 {
+		modelLoadTimes.Lock()
+		modelLoadTimes.took[w.model] = time.Duration(resp.LoadDuration)
+		modelLoadTimes.Unlock()
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The compiled model_allowlist and model_denylist, see setup. They apply
+// regardless of who is asking.
+var (
+	allowedModelPatterns []*regexp.Regexp
+	deniedModelPatterns  []*regexp.Regexp
+)
+
+func compileGlobPatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		compiled = append(compiled, regexp.MustCompile("(?i)^"+expr+"$"))
+	}
+	return compiled
+}
+
+func matchesAnyPattern(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func modelAllowed(model string) bool {
+	if matchesAnyPattern(deniedModelPatterns, model) {
+		return false
+	}
+	return len(allowedModelPatterns) == 0 || matchesAnyPattern(allowedModelPatterns, model)
+}
+
+// modelPermitted reports whether apiKey may ask for requested, which
+// resolved to resolved. Both go through the policy with and without their
+// provider prefix, so `ollama/llama3` gets no further than `llama3` would.
+func modelPermitted(apiKey, requested, resolved string) bool {
+	_, requestedName := splitProviderModel(requested)
+	_, resolvedName := splitProviderModel(resolved)
+	for _, model := range []string{requested, requestedName, resolved, resolvedName} {
+		if !modelAllowed(model) {
+			return false
+		}
+	}
+	return keyAllowsModel(apiKey, requested) && keyAllowsModel(apiKey, requestedName)
+}
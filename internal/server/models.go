@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Model is an entry of /v1/models.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// OllamaTagsResponse is the part of /api/tags the proxy uses.
+type OllamaTagsResponse struct {
+	Models []struct {
+		Name       string    `json:"name"`
+		ModifiedAt time.Time `json:"modified_at"`
+	} `json:"models"`
+}
+
+var errModelNotFound = errors.New("model not found")
+
+func newModel(name string, modifiedAt time.Time) Model {
+	// pulled from a namespace (user/model, hf.co/user/model) or the library
+	ownedBy := "library"
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		ownedBy = name[:i]
+	}
+	var created int64
+	if !modifiedAt.IsZero() {
+		created = modifiedAt.Unix()
+	}
+	return Model{ID: name, Object: "model", Created: created, OwnedBy: ownedBy}
+}
+
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if id := strings.TrimPrefix(r.URL.Path, "/v1/models/"); id != r.URL.Path && id != "" {
+		handleModel(w, r, id)
+		return
+	}
+
+	tags, err := fetchTags(r.Context())
+	if err != nil {
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+
+	list := ModelList{Object: "list", Data: []Model{}}
+	for _, m := range tags.Models {
+		if modelAllowed(m.Name) && keyAllowsModel(apiKeyFromRequest(r), m.Name) {
+			list.Data = append(list.Data, newModel(m.Name, m.ModifiedAt))
+		}
+	}
+	writeJSON(w, list)
+}
+
+func handleModel(w http.ResponseWriter, r *http.Request, id string) {
+	if !modelPermitted(apiKeyFromRequest(r), id, id) {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, id)
+		return
+	}
+
+	info, err := showModel(r.Context(), id)
+	if errors.Is(err, errModelNotFound) {
+		sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, id)
+		return
+	}
+	if err != nil {
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, newModel(id, info.ModifiedAt))
+}
+
+func fetchTags(ctx context.Context) (*OllamaTagsResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ollamaBackends.pick("").url+"/api/tags", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("ollama API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var tags OllamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &tags, nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Ollama options that have a request field of their own, which is what
+// presets, parameter limits and experiments act on, so ollama_options can't
+// set them
+var MODELED_OLLAMA_OPTIONS = map[string]string{
+	"temperature":       "temperature",
+	"top_p":             "top_p",
+	"top_k":             "top_k",
+	"seed":              "seed",
+	"stop":              "stop",
+	"num_predict":       "max_tokens",
+	"presence_penalty":  "presence_penalty",
+	"frequency_penalty": "frequency_penalty",
+}
+
+// Ollama options clients may not set, e.g. to keep them from changing how
+// a shared host places models on its GPUs
+var BLOCKED_OLLAMA_OPTIONS = []string{
+	// "num_gpu", "main_gpu", "num_thread",
+}
+
+// requestOllamaOptions checks the raw Ollama options of a request, from
+// x_proxy.ollama_options, ollama_options or else options, which is where
+// OpenAI SDKs put extra_body={"options": {...}}. They are passed on as they
+// are, e.g. num_ctx or mirostat, for Ollama to check.
+func requestOllamaOptions(proxy *ProxyExtensions, ollamaOptions, options map[string]any) (map[string]any, *apiError) {
+	param := "ollama_options"
+	switch {
+	case proxy != nil && proxy.OllamaOptions != nil:
+		ollamaOptions, param = proxy.OllamaOptions, "x_proxy.ollama_options"
+	case ollamaOptions == nil:
+		ollamaOptions, param = options, "options"
+	}
+	for _, name := range sortedKeys(ollamaOptions) {
+		if field, ok := MODELED_OLLAMA_OPTIONS[name]; ok {
+			err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_parameter", "%s.%s can't be set there, use the request field %s", param, name, field)
+			err.param = param + "." + name
+			return nil, err
+		}
+		if slices.Contains(BLOCKED_OLLAMA_OPTIONS, name) {
+			err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_parameter", "The Ollama option %s is not available on this proxy", name)
+			err.param = param + "." + name
+			return nil, err
+		}
+	}
+	return ollamaOptions, nil
+}
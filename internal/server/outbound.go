@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Policy for every fetch the proxy makes on its own (remote images today),
+// as opposed to calls to the Ollama upstream. Host patterns are globs.
+var (
+	OUTBOUND_ALLOWED_HOSTS = []string{}
+	OUTBOUND_DENIED_HOSTS  = []string{}
+)
+
+const (
+	OUTBOUND_MAX_BYTES     = 20 << 20
+	OUTBOUND_TIMEOUT       = 10 * time.Second
+	OUTBOUND_MAX_REDIRECTS = 5
+	// Allow fetching from loopback/private addresses, only for trusted setups
+	OUTBOUND_ALLOW_PRIVATE = false
+)
+
+var (
+	allowedOutboundHosts = compileGlobPatterns(OUTBOUND_ALLOWED_HOSTS)
+	deniedOutboundHosts  = compileGlobPatterns(OUTBOUND_DENIED_HOSTS)
+)
+
+var errPrivateAddress = errors.New("destination is a private address")
+
+// outboundClient checks the address it actually connects to, after DNS
+// resolution, so a hostname can't pass the check and then rebind to an
+// internal IP. It ignores proxy environment variables for the same reason.
+var outboundClient = &http.Client{
+	Timeout: OUTBOUND_TIMEOUT,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: OUTBOUND_TIMEOUT,
+			Control: checkDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   OUTBOUND_TIMEOUT,
+		ResponseHeaderTimeout: OUTBOUND_TIMEOUT,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= OUTBOUND_MAX_REDIRECTS {
+			return errors.New("too many redirects")
+		}
+		return checkOutboundURL(req.URL)
+	},
+}
+
+// fetchOutbound GETs rawURL under the outbound policy and returns at most
+// maxBytes of body (capped by OUTBOUND_MAX_BYTES).
+func fetchOutbound(ctx context.Context, rawURL string, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 || maxBytes > OUTBOUND_MAX_BYTES {
+		maxBytes = OUTBOUND_MAX_BYTES
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if err := checkOutboundURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: status %d", u.Host, resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", u.Host, err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+func checkOutboundURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if matchesAnyPattern(deniedOutboundHosts, host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	if len(allowedOutboundHosts) > 0 && !matchesAnyPattern(allowedOutboundHosts, host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	return nil
+}
+
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	if OUTBOUND_ALLOW_PRIVATE {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// errContentFiltered stops a streamed generation the output filter blocked,
+// nothing more of it would be sent.
+var errContentFiltered = errors.New("output blocked by the content filter")
+
+// Output filter actions
+const (
+	FILTER_MASK     = "mask"     // replace flagged words with asterisks
+	FILTER_BLOCK    = "block"    // cut the answer off, finish_reason "content_filter"
+	FILTER_ANNOTATE = "annotate" // leave the text, report it in content_filter_results
+)
+
+// OutputFilter is a brand-safety filter applied to generated text, from
+// output_filter in the config file.
+type OutputFilter struct {
+	// matched case-insensitively as whole words, reported as "profanity"
+	Words []string `yaml:"words"`
+	// more word lists by the category they are reported as, e.g.
+	// "competitors": {"acme"}
+	Categories map[string][]string `yaml:"categories"`
+	Action     string              `yaml:"action"`
+	// Optional Ollama model asked to label the whole answer SAFE or UNSAFE
+	// with one of CLASSIFIER_CATEGORIES. It only sees complete answers, so
+	// its verdict can't mask single words: with FILTER_MASK a flagged answer
+	// is blocked instead.
+	ClassifierModel string `yaml:"classifier_model"`
+	// Check the client's messages against the word lists too. Unless Action
+	// is annotate, a flagged prompt is rejected with a 400 content_filter
+	// error naming the categories.
+	CheckPrompts bool `yaml:"check_prompts"`
+}
+
+// Category of Words in content_filter_results
+const FILTER_CATEGORY_WORDS = "profanity"
+
+// Categories the classifier model picks from, "unsafe" when it names none
+var CLASSIFIER_CATEGORIES = []string{"hate", "harassment", "sexual", "violence", "self_harm", "profanity"}
+
+// Bytes of a stream held back for the classifier model at a time. Each
+// window goes out once the classifier passed the answer up to its end.
+const CLASSIFIER_WINDOW = 400
+
+// categoryPattern is the word list of a category, see OutputFilter.
+type categoryPattern struct {
+	category string
+	re       *regexp.Regexp
+}
+
+// The word lists of output_filter, see setup
+var (
+	outputFilterPatterns  []categoryPattern
+	outputFilterLookahead int
+)
+
+func compileCategoryPatterns(f OutputFilter) []categoryPattern {
+	var patterns []categoryPattern
+	if re := compileWordList(f.Words); re != nil {
+		patterns = append(patterns, categoryPattern{category: FILTER_CATEGORY_WORDS, re: re})
+	}
+	for _, category := range sortedKeys(f.Categories) {
+		if re := compileWordList(f.Categories[category]); re != nil {
+			patterns = append(patterns, categoryPattern{category: category, re: re})
+		}
+	}
+	return patterns
+}
+
+// longestEntry is the length of the longest entry of the word lists of f,
+// how much of a stream has to be held back for an entry of several words.
+func longestEntry(f OutputFilter) int {
+	longest := 0
+	for _, word := range f.Words {
+		longest = max(longest, len(word))
+	}
+	for _, words := range f.Categories {
+		for _, word := range words {
+			longest = max(longest, len(word))
+		}
+	}
+	return longest
+}
+
+func compileWordList(words []string) *regexp.Regexp {
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// outputFilter runs output_filter over text that arrives in pieces. It holds
+// back as much as the longest list entry, up to a word boundary, so no
+// flagged word or phrase gets through split across chunks. A stream filter
+// also holds back CLASSIFIER_WINDOW for the classifier model.
+type outputFilter struct {
+	pending string
+	// categories flagged so far
+	detected map[string]bool
+	blocked  bool
+	// the route's guardrails are switched off, see RoutePolicy
+	off bool
+
+	// stream filters only: the text waiting for the classifier, what it
+	// passed so far, and why it couldn't be asked
+	ctx          context.Context
+	streaming    bool
+	unclassified string
+	classified   string
+	err          error
+}
+
+func newOutputFilter(ctx context.Context) *outputFilter {
+	return &outputFilter{detected: make(map[string]bool), off: !routeFeaturesFor(ctx).guardrails}
+}
+
+// newStreamFilter is an outputFilter for a stream, which also asks the
+// classifier model as the text comes in.
+func newStreamFilter(ctx context.Context) *outputFilter {
+	f := newOutputFilter(ctx)
+	f.ctx = ctx
+	f.streaming = true
+	return f
+}
+
+// write takes the next piece of generated text and returns what can be
+// passed on now.
+func (f *outputFilter) write(text string) string {
+	if f.blocked || f.err != nil {
+		return ""
+	}
+	if len(outputFilterPatterns) == 0 || f.off {
+		return f.hold(text, false)
+	}
+	f.pending += text
+	limit := len(f.pending) - outputFilterLookahead
+	for limit > 0 && !utf8.RuneStart(f.pending[limit]) {
+		limit--
+	}
+	if limit <= 0 {
+		return ""
+	}
+	cut := strings.LastIndexFunc(f.pending[:limit], func(r rune) bool { return !isWordRune(r) })
+	if cut < 0 {
+		return ""
+	}
+	cut = f.matchStart(cut + 1)
+	ready := f.process(f.pending[:cut])
+	f.pending = f.pending[cut:]
+	// nothing follows a block, the classifier gets the rest now
+	return f.hold(ready, f.blocked)
+}
+
+// matchStart moves cut back to the start of a match it would split, so an
+// entry of several words goes out whole with a later piece.
+func (f *outputFilter) matchStart(cut int) int {
+	for moved := true; moved; {
+		moved = false
+		for _, p := range outputFilterPatterns {
+			for _, loc := range p.re.FindAllStringIndex(f.pending, -1) {
+				if loc[0] < cut && loc[1] > cut {
+					cut, moved = loc[0], true
+				}
+			}
+		}
+	}
+	return cut
+}
+
+// flush returns whatever was held back, at the end of the generation.
+func (f *outputFilter) flush() string {
+	if f.blocked || f.err != nil {
+		return ""
+	}
+	ready := f.pending
+	f.pending = ""
+	return f.hold(f.process(ready), true)
+}
+
+// hold passes the text of a stream on a CLASSIFIER_WINDOW at a time, once
+// the classifier found the answer so far safe; final asks about the rest.
+func (f *outputFilter) hold(text string, final bool) string {
+	if !f.streaming || config.OutputFilter.ClassifierModel == "" || f.off {
+		return text
+	}
+	f.unclassified += text
+	if f.unclassified == "" || !final && len(f.unclassified) < CLASSIFIER_WINDOW {
+		return ""
+	}
+	window := f.unclassified
+	f.unclassified = ""
+	category, err := classifierVerdict(f.ctx, f.classified+window)
+	if err != nil {
+		f.err = err
+		return ""
+	}
+	if category != "" {
+		f.detected[category] = true
+		if config.OutputFilter.Action != FILTER_ANNOTATE {
+			f.blocked = true
+			return ""
+		}
+	}
+	f.classified += window
+	return window
+}
+
+// failed is the error of the classifier that stopped a stream, if any.
+func (f *outputFilter) failed() error {
+	if f.err == nil {
+		return nil
+	}
+	return newAPIError(http.StatusInternalServerError, "server_error", "internal_error", "Error calling output classifier: %s", f.err)
+}
+
+func (f *outputFilter) process(text string) string {
+	if len(outputFilterPatterns) == 0 || f.off {
+		return text
+	}
+	// a block cuts the text off at the first flagged word, whichever its
+	// category, and only reports that one
+	cut, category := -1, ""
+	for _, p := range outputFilterPatterns {
+		if loc := p.re.FindStringIndex(text); loc != nil && (cut < 0 || loc[0] < cut) {
+			cut, category = loc[0], p.category
+		}
+	}
+	if cut < 0 {
+		return text
+	}
+
+	switch config.OutputFilter.Action {
+	case FILTER_BLOCK:
+		f.detected[category] = true
+		f.blocked = true
+		return text[:cut]
+	case FILTER_ANNOTATE:
+		f.detectAll(text)
+		return text
+	default:
+		f.detectAll(text)
+		for _, p := range outputFilterPatterns {
+			text = p.re.ReplaceAllStringFunc(text, func(word string) string {
+				return strings.Repeat("*", len([]rune(word)))
+			})
+		}
+		return text
+	}
+}
+
+func (f *outputFilter) detectAll(text string) {
+	for _, p := range outputFilterPatterns {
+		if p.re.MatchString(text) {
+			f.detected[p.category] = true
+		}
+	}
+}
+
+// classify asks the classifier model about a complete answer and returns the
+// answer to send, which is empty when the verdict blocked it.
+func (f *outputFilter) classify(ctx context.Context, text string) (string, error) {
+	if config.OutputFilter.ClassifierModel == "" || f.off || f.blocked || text == "" {
+		return text, nil
+	}
+	category, err := classifierVerdict(ctx, text)
+	if err != nil || category == "" {
+		return text, err
+	}
+	f.detected[category] = true
+	if config.OutputFilter.Action == FILTER_ANNOTATE {
+		return text, nil
+	}
+	f.blocked = true
+	return "", nil
+}
+
+// classifierVerdict asks the classifier model about text and returns the
+// category it flagged it as, empty when it found it safe.
+func classifierVerdict(ctx context.Context, text string) (string, error) {
+	resp, err := sendToOllama(ctx, OllamaRequest{
+		Model: config.OutputFilter.ClassifierModel,
+		Prompt: "Is the following text unsafe for a brand-safe, customer-facing product " +
+			"(" + strings.Join(CLASSIFIER_CATEGORIES, ", ") + ")? " +
+			"Answer with exactly one word, SAFE or UNSAFE, and if it is unsafe, " +
+			"the category it falls into on the next line.\n\nText:\n" + text,
+		Stream: true,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	verdict := strings.ToLower(resp.Response)
+	if !strings.Contains(verdict, "unsafe") {
+		return "", nil
+	}
+	for _, c := range CLASSIFIER_CATEGORIES {
+		if strings.Contains(verdict, c) || strings.Contains(verdict, strings.ReplaceAll(c, "_", "-")) {
+			return c, nil
+		}
+	}
+	return "unsafe", nil
+}
+
+// results reports every category of the word lists and each one the
+// classifier flagged, so clients can tell which rule fired.
+func (f *outputFilter) results() map[string]ContentFilterResult {
+	if f.off || len(outputFilterPatterns) == 0 && config.OutputFilter.ClassifierModel == "" {
+		return nil
+	}
+	return filterResults(outputFilterPatterns, f.detected)
+}
+
+func filterResults(patterns []categoryPattern, detected map[string]bool) map[string]ContentFilterResult {
+	results := make(map[string]ContentFilterResult)
+	for _, p := range patterns {
+		results[p.category] = ContentFilterResult{}
+	}
+	for category := range detected {
+		results[category] = ContentFilterResult{Filtered: config.OutputFilter.Action != FILTER_ANNOTATE, Detected: true}
+	}
+	return results
+}
+
+// contentFilterError is a prompt output_filter rejects, see CheckPrompts.
+type contentFilterError struct {
+	categories []string
+	results    map[string]ContentFilterResult
+}
+
+func (e *contentFilterError) Error() string {
+	return "prompt flagged as " + strings.Join(e.categories, ", ")
+}
+
+// filterPrompt checks the texts of a prompt against the word lists of
+// output_filter when it checks prompts, returning a *contentFilterError for
+// a flagged one.
+func filterPrompt(ctx context.Context, texts ...string) error {
+	if !config.OutputFilter.CheckPrompts || config.OutputFilter.Action == FILTER_ANNOTATE || !routeFeaturesFor(ctx).guardrails {
+		return nil
+	}
+	detected := make(map[string]bool)
+	for _, text := range texts {
+		for _, p := range outputFilterPatterns {
+			if p.re.MatchString(text) {
+				detected[p.category] = true
+			}
+		}
+	}
+	if len(detected) == 0 {
+		return nil
+	}
+	categories := sortedKeys(detected)
+	return &contentFilterError{categories: categories, results: filterResults(outputFilterPatterns, detected)}
+}
+
+// sendContentFilterError answers a rejected prompt the way Azure OpenAI
+// does, with the categories that fired in innererror.
+func sendContentFilterError(w http.ResponseWriter, r *http.Request, err *contentFilterError) {
+	resp := ErrorResponse{}
+	resp.Error.Message = localizeError(r, "The prompt was rejected by the content filter, flagged as %s", strings.Join(err.categories, ", "))
+	resp.Error.Type = "invalid_request_error"
+	resp.Error.Param = "prompt"
+	resp.Error.Code = "content_filter"
+	resp.Error.InnerError = &ContentFilterInnerError{Code: "ResponsibleAIPolicyViolation", ContentFilterResult: err.results}
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(http.StatusBadRequest)
+	writeJSON(w, resp)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
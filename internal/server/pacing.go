@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenPacer spaces out tokens so no more than a fixed rate goes through,
+// shared by the choices of a request.
+type tokenPacer struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// newTokenPacer paces apiKey by the stream_tokens_per_second of its name,
+// which is handy to demo production-like pacing or to keep one generation
+// from flooding a slow downstream link. It returns nil when the key isn't
+// paced.
+func newTokenPacer(apiKey string) *tokenPacer {
+	entry := apiKeys.lookup(apiKey)
+	if entry == nil || entry.Name == "" {
+		return nil
+	}
+	rate := config.StreamTokensPerSecond[entry.Name]
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenPacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the next token may go out. Ollama sends roughly one token
+// per chunk, so callers call it once per chunk.
+func (p *tokenPacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestNewTokenPacer(t *testing.T) {
+	keys := []APIKey{{Key: testKey, Name: "demo"}, {Key: "sk-unnamed"}}
+	rates := map[string]float64{"demo": 20, "sk-unnamed": 5, "": 5}
+	tests := []struct {
+		name   string
+		apiKey string
+		want   bool
+	}{
+		{"named key", testKey, true},
+		{"unnamed key", "sk-unnamed", false},
+		{"no key", "", false},
+		{"unknown key", "sk-unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{StreamTokensPerSecond: rates}, keys...)
+			if pacer := newTokenPacer(tt.apiKey); (pacer != nil) != tt.want {
+				t.Errorf("newTokenPacer(%q) = %v, want paced: %t", tt.apiKey, pacer, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// What to do with a sampling parameter outside its allowed range
+const (
+	PARAM_CLAMP  = "clamp"  // move it to the nearest bound
+	PARAM_REJECT = "reject" // fail the request with a 400
+)
+
+type ParamRange struct {
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+}
+
+// ParameterLimit bounds the sampling parameters (`temperature`, `top_p`,
+// `presence_penalty`, `frequency_penalty`) of the models matching Model,
+// from parameter_limits in the config file. The first matching entry
+// applies.
+type ParameterLimit struct {
+	Model  string                `yaml:"model"`
+	Action string                `yaml:"action"`
+	Ranges map[string]ParamRange `yaml:"ranges"`
+}
+
+// parameterLimitPatterns are the models of parameter_limits, see setup.
+var parameterLimitPatterns []*regexp.Regexp
+
+func compileParameterLimitPatterns(limits []ParameterLimit) []*regexp.Regexp {
+	models := make([]string, len(limits))
+	for i, limit := range limits {
+		models[i] = limit.Model
+	}
+	return compileGlobPatterns(models)
+}
+
+func samplingParams(req *OpenAIChatRequest) map[string]**float64 {
+	return map[string]**float64{
+		"temperature":       &req.Temperature,
+		"top_p":             &req.TopP,
+		"presence_penalty":  &req.PresencePenalty,
+		"frequency_penalty": &req.FrequencyPenalty,
+	}
+}
+
+// enforceParameterLimits clamps or rejects the sampling parameters of req
+// according to the first parameter_limits entry for its model. Unset
+// parameters are left alone.
+func enforceParameterLimits(req *OpenAIChatRequest) *apiError {
+	for i, re := range parameterLimitPatterns {
+		if !re.MatchString(req.Model) {
+			continue
+		}
+		limit := config.ParameterLimits[i]
+		params := samplingParams(req)
+		for name, bounds := range limit.Ranges {
+			value, ok := params[name]
+			if !ok || *value == nil || (**value >= bounds.Min && **value <= bounds.Max) {
+				continue
+			}
+			if limit.Action == PARAM_REJECT {
+				err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_parameter",
+					"%s must be between %s and %s for model %s", name, formatFloat(bounds.Min), formatFloat(bounds.Max), req.Model)
+				err.param = name
+				return err
+			}
+			// a new value, the request of every fallback model shares the old one
+			*value = ptr(min(max(**value, bounds.Min), bounds.Max))
+		}
+		return nil
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,794 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Most choices a request may ask for with n
+const MAX_CHOICES = 8
+
+// errHandled ends a pipeline whose stage already answered the request.
+var errHandled = errors.New("request handled")
+
+// apiError is a stage failure answered with an OpenAI-style error.
+type apiError struct {
+	status    int
+	errorType string
+	code      string
+	param     string
+	format    string
+	args      []any
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+func newAPIError(status int, errorType, code, format string, args ...any) *apiError {
+	return &apiError{status: status, errorType: errorType, code: code, format: format, args: args}
+}
+
+// chatPipeline carries one chat completion through its stages:
+// validate → route → cache → acquire slot → generate → translate. Every stage runs
+// under the request context and the pipeline stops as soon as it is done.
+type chatPipeline struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	ctx    context.Context
+	logger *log.Logger
+
+	requestID  string
+	tenantName string
+	openAIReq  OpenAIChatRequest
+	attempts   []*upstreamAttempt
+	attempt    *upstreamAttempt
+	// the n choices generated on attempt
+	choices []*choice
+
+	cancel        context.CancelFunc
+	release       func()
+	releaseStream func()
+
+	// set for `stream: true` requests, per attempt; the stream of the
+	// first choice
+	stream *sseStream
+
+	// watchers of the stream, see shareRequested
+	shareToken string
+	share      *sharedStream
+
+	// set while the completion is to be cached, see lookupCache; answers of
+	// a fallback model aren't
+	cacheKey string
+
+	firstToken sync.Once
+	responded  bool
+}
+
+// choice is one of the n completions a request asks for.
+type choice struct {
+	index int
+	req   OllamaRequest
+	resp  *OllamaResponse
+	// set for streams
+	stream  *sseStream
+	cleaner *outputCleaner
+	filter  *outputFilter
+	// cut off by the watchdog
+	lengthCapped bool
+}
+
+func newChatPipeline(w http.ResponseWriter, r *http.Request) *chatPipeline {
+	return &chatPipeline{
+		w:          w,
+		r:          r,
+		ctx:        r.Context(),
+		logger:     tenantFromContext(r.Context()).logger,
+		tenantName: tenantFromContext(r.Context()).name,
+	}
+}
+
+func (p *chatPipeline) run() {
+	defer func() {
+		if p.release != nil {
+			p.release()
+		}
+		if p.releaseStream != nil {
+			p.releaseStream()
+		}
+		if p.cancel != nil {
+			p.cancel()
+		}
+		if p.share != nil {
+			sharedStreams.close(p.shareToken, p.share)
+		}
+	}()
+
+	if err := p.runStages(); err != nil {
+		p.fail(err)
+	}
+}
+
+func (p *chatPipeline) runStages() (err error) {
+	defer recoverAsError(&err)
+
+	stages := []func() error{p.validate, p.route, p.lookupCache, p.acquireSlot, p.generate, p.translate}
+	for _, stage := range stages {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		if err := stage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail answers the request with err, unless a stage already did or the
+// response has started.
+func (p *chatPipeline) fail(err error) {
+	if errors.Is(err, errHandled) {
+		return
+	}
+	if errors.Is(context.Cause(p.ctx), errCanceledByAdmin) {
+		err = newAPIError(http.StatusServiceUnavailable, "server_error", "request_canceled", "Request canceled by an administrator")
+	}
+	if p.requestID != "" {
+		events.publish(Event{Type: EVENT_ERROR, RequestID: p.requestID, Tenant: p.tenantName, Model: p.model(), Error: err.Error()})
+	}
+	if p.stream != nil && p.stream.started() {
+		p.failStream(err)
+		return
+	}
+	if p.responded {
+		p.logger.Printf("request %s: %v", p.requestID, err)
+		return
+	}
+
+	var msgErr *messageError
+	var apiErr *apiError
+	var capErr *capacityError
+	var circuitErr *circuitOpenError
+	var filterErr *contentFilterError
+	switch {
+	case errors.As(err, &capErr):
+		sendCapacityError(p.w, p.r, capErr)
+	case errors.As(err, &circuitErr):
+		sendCircuitOpenError(p.w, p.r, circuitErr)
+	case errors.As(err, &msgErr):
+		sendMessageError(p.w, p.r, msgErr)
+	case errors.As(err, &filterErr):
+		sendContentFilterError(p.w, p.r, filterErr)
+	case errors.As(err, &apiErr) && apiErr.param != "":
+		sendParamError(p.w, p.r, apiErr.format, apiErr.code, apiErr.param, apiErr.status, apiErr.args...)
+	case errors.As(err, &apiErr):
+		sendError(p.w, p.r, apiErr.format, apiErr.errorType, apiErr.code, apiErr.status, apiErr.args...)
+	case errors.Is(err, context.DeadlineExceeded):
+		var prompt, partial string
+		if p.attempt != nil {
+			prompt = p.attempt.ollamaReq.PromptText()
+		}
+		if len(p.choices) > 0 && p.choices[0].resp != nil {
+			partial = p.choices[0].resp.Response
+		}
+		sendDeadlineExceeded(p.w, p.r, prompt, partial)
+	case errors.Is(err, context.Canceled):
+		// the client is gone, nobody to answer
+		p.logger.Printf("request %s: canceled by client", p.requestID)
+	default:
+		p.logger.Printf("request %s: %v", p.requestID, err)
+		sendError(p.w, p.r, "Internal server error", "server_error", "internal_error", http.StatusInternalServerError)
+	}
+}
+
+// failStream ends a stream that already started with an error event.
+func (p *chatPipeline) failStream(err error) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		p.stream.fail(p.r, apiErr.format, apiErr.errorType, apiErr.code, apiErr.args...)
+	case errors.Is(err, context.DeadlineExceeded):
+		p.stream.fail(p.r, "Request deadline exceeded before generation finished", "timeout_error", "deadline_exceeded")
+	case errors.Is(err, context.Canceled):
+		p.logger.Printf("request %s: canceled by client", p.requestID)
+	default:
+		p.logger.Printf("request %s: %v", p.requestID, err)
+		p.stream.fail(p.r, "Internal server error", "server_error", "internal_error")
+	}
+	if err := p.stream.close(); err != nil {
+		p.logger.Printf("request %s: %v", p.requestID, err)
+	}
+}
+
+func (p *chatPipeline) model() string {
+	if p.attempt != nil {
+		return p.attempt.ollamaReq.Model
+	}
+	if len(p.attempts) > 0 {
+		return p.attempts[0].ollamaReq.Model
+	}
+	return p.openAIReq.Model
+}
+
+// validate decodes the request and rejects malformed ones.
+func (p *chatPipeline) validate() error {
+	if p.r.Method != http.MethodPost {
+		return newAPIError(http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+	}
+
+	var body map[string]any
+	if err := decodeJSONBody(p.r.Body, &body); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_body", "Invalid request body: %s", err)
+	}
+	if err := applyRewriteRules(body, p.r); err != nil {
+		return newAPIError(http.StatusInternalServerError, "server_error", "internal_error", "Error applying rewrite rules: %s", err)
+	}
+
+	if err := validateExtensions(body, "/v1/chat/completions"); err != nil {
+		return err
+	}
+	if err := decodeRequest(body, &p.openAIReq); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_body", "Invalid request body: %s", err)
+	}
+	if ext := p.openAIReq.Proxy; ext != nil {
+		if ext.TopK != nil {
+			p.openAIReq.TopK = ext.TopK
+		}
+		if ext.Models != nil {
+			p.openAIReq.Models = ext.Models
+		}
+	}
+
+	if len(p.openAIReq.Messages) == 0 {
+		return newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_messages", "Messages array is empty")
+	}
+
+	if p.openAIReq.Model == "" && len(p.openAIReq.Models) > 0 {
+		p.openAIReq.Model = p.openAIReq.Models[0]
+	}
+	if p.openAIReq.Model == "" {
+		return newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_model", "Model is required")
+	}
+	if p.openAIReq.N < 0 || p.openAIReq.N > MAX_CHOICES {
+		err := newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_parameter", "n must be between 1 and %d", MAX_CHOICES)
+		err.param = "n"
+		return err
+	}
+
+	if err := validateMessageRoles(p.openAIReq.Messages); err != nil {
+		return err
+	}
+	if err := validateTools(p.openAIReq); err != nil {
+		return err
+	}
+	if err := validateResponseFormat(p.openAIReq.ResponseFormat); err != nil {
+		return err
+	}
+	contents := make([]string, len(p.openAIReq.Messages))
+	for i, msg := range p.openAIReq.Messages {
+		contents[i] = msg.Content
+	}
+	if err := filterPrompt(p.ctx, contents...); err != nil {
+		return err
+	}
+	p.openAIReq.Session = sessionKey(p.r, p.openAIReq)
+	keepAlive, apiErr := requestKeepAlive(p.r, p.openAIReq.Proxy, p.openAIReq.Ollama)
+	if apiErr != nil {
+		return apiErr
+	}
+	p.openAIReq.KeepAlive = keepAlive
+	options, apiErr := requestOllamaOptions(p.openAIReq.Proxy, p.openAIReq.OllamaOptions, p.openAIReq.Options)
+	if apiErr != nil {
+		return apiErr
+	}
+	p.openAIReq.OllamaOptions = options
+	return nil
+}
+
+// route resolves the request for each model it may be served by, and opens
+// the stream for watchers when asked to share it. Dry runs end here.
+func (p *chatPipeline) route() error {
+	attempts, err := prepareAttempts(p.ctx, p.openAIReq, apiKeyFromRequest(p.r), p.logger)
+	if err != nil {
+		setDeprecationHeaders(p.w, p.openAIReq.Model)
+		return err
+	}
+	if len(p.openAIReq.Tools) > 0 {
+		if attempts, err = dropToolIncapableAttempts(p.ctx, attempts, p.logger); err != nil {
+			return err
+		}
+	}
+	addModelStopTokens(p.ctx, attempts)
+	p.attempts = attempts
+
+	if isDryRun(p.r) {
+		sendDryRun(p.w, attempts[0].ollamaReq)
+		return errHandled
+	}
+
+	modelPrefetcher.observe(apiKeyFromRequest(p.r), attempts[0].ollamaReq.Model)
+
+	p.requestID = "chatcmpl-" + generateRandomString(10)
+	events.publish(Event{Type: EVENT_ACCEPTED, RequestID: p.requestID, Tenant: p.tenantName, Model: p.model()})
+
+	ctx, untrack := runningRequests.track(withRequestID(p.r.Context(), p.requestID), p.requestID, apiKeyFromRequest(p.r), attempts[0].ollamaReq.Model)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout(p.r))
+	p.ctx = ctx
+	p.cancel = func() {
+		cancel()
+		untrack()
+	}
+
+	if p.openAIReq.Stream && shareRequested(p.r) {
+		p.shareToken, p.share = sharedStreams.open()
+		p.w.Header().Set(SHARE_TOKEN_HEADER, p.shareToken)
+	}
+	return nil
+}
+
+// lookupCache answers deterministic requests from the response cache.
+// Misses are cached once they are generated.
+func (p *chatPipeline) lookupCache() error {
+	if completionCache == nil || !routeFeaturesFor(p.ctx).cache || p.openAIReq.N > 1 {
+		return nil
+	}
+	key, ok := completionCacheKey(p.tenantName, p.attempts)
+	if !ok {
+		return nil
+	}
+	if !cacheBypassed(p.r) {
+		if cached, ok := completionCache.get(p.ctx, key); ok {
+			metrics.cacheLookups.add(1, p.tenantName, "hit")
+			p.w.Header().Set(CACHE_HEADER, "HIT")
+			p.attempt = p.attempts[0]
+			if err := p.serveCached(cached); err != nil {
+				return err
+			}
+			return errHandled
+		}
+		metrics.cacheLookups.add(1, p.tenantName, "miss")
+	}
+	p.w.Header().Set(CACHE_HEADER, "MISS")
+	p.cacheKey = key
+	return nil
+}
+
+// serveCached answers with a cached completion like translate would have.
+func (p *chatPipeline) serveCached(cached *cachedCompletion) error {
+	warning := setDeprecationHeaders(p.w, p.attempt.requestedModel)
+	model := p.attempt.openAIReq.Model
+	tenantFromContext(p.r.Context()).recordUsage(p.r.Context(), apiKeyFromRequest(p.r), model, cached.Usage, p.attempt.ollamaReq.PromptText(), cached.Content)
+	events.publish(Event{Type: EVENT_DONE, RequestID: p.requestID, Tenant: p.tenantName, Model: model, Usage: &cached.Usage})
+	p.responded = true
+
+	if p.openAIReq.Stream {
+		p.stream = newSSEStream(p.w, p.requestID, model, config.ResponseMetadata[p.attempt.requestedModel])
+		p.stream.share = p.share
+		var streamUsage *Usage
+		if opts := p.openAIReq.StreamOptions; opts != nil && opts.IncludeUsage {
+			streamUsage = &cached.Usage
+		}
+		if err := p.stream.delta(cached.Content); err != nil {
+			return err
+		}
+		if err := p.stream.images(cached.Images); err != nil {
+			return err
+		}
+		if err := p.stream.toolCalls(cached.ToolCalls); err != nil {
+			return err
+		}
+		if err := p.stream.finish(cached.FinishReason, nil, streamUsage); err != nil {
+			return err
+		}
+		return p.stream.close()
+	}
+
+	sw := newStreamWriter(p.w)
+	writeJSON(sw, OpenAIChatResponse{
+		ID:      p.requestID,
+		Object:  "chat.completion",
+		Created: getCurrentUnixTimestamp(),
+		Model:   model,
+		Choices: []Choice{
+			{
+				Index: 0,
+				Message: ChatMessage{
+					Role:      "assistant",
+					Content:   cached.Content,
+					Images:    cached.Images,
+					ToolCalls: cached.ToolCalls,
+				},
+				FinishReason: cached.FinishReason,
+			},
+		},
+		Usage:    cached.Usage,
+		Metadata: config.ResponseMetadata[p.attempt.requestedModel],
+		Warning:  warning,
+	})
+	return sw.close()
+}
+
+// acquireSlot waits for a free slot of the model, then for a free generation
+// slot, for as long as the request may run. Streams also take one of their key's stream slots, which they
+// don't wait for.
+func (p *chatPipeline) acquireSlot() error {
+	if p.openAIReq.Stream {
+		releaseStream, err := openStreams.acquire(apiKeyFromRequest(p.r))
+		if err != nil {
+			return err
+		}
+		p.releaseStream = releaseStream
+	}
+
+	queued := func() {
+		events.publish(Event{Type: EVENT_QUEUED, RequestID: p.requestID, Tenant: p.tenantName, Model: p.model()})
+	}
+	releaseModel, err := modelSlots[p.model()].acquire(p.ctx, queued)
+	if err != nil {
+		return err
+	}
+	release, err := generationSlots.acquire(p.ctx, queued)
+	if err != nil {
+		releaseModel()
+		return err
+	}
+	p.release = func() {
+		release()
+		releaseModel()
+	}
+	return nil
+}
+
+// generate runs the generation, falling back to the next model of the
+// request on upstream failures. Streamed requests send their deltas from
+// here and can only fall back until the first one went out.
+func (p *chatPipeline) generate() error {
+	pacer := newTokenPacer(apiKeyFromRequest(p.r))
+	var err error
+	for i, attempt := range p.attempts {
+		p.attempt = attempt
+		if p.openAIReq.Stream {
+			// headers have to be final before the first delta
+			setDeprecationHeaders(p.w, attempt.requestedModel)
+			p.stream = newSSEStream(p.w, p.requestID, attempt.openAIReq.Model, config.ResponseMetadata[attempt.requestedModel])
+			p.stream.share = p.share
+		}
+		p.choices = newChoices(p.ctx, attempt.ollamaReq, p.openAIReq.N, p.stream)
+		err = p.generateChoices(pacer)
+		if err == nil || p.ctx.Err() != nil || i == len(p.attempts)-1 || (p.stream != nil && p.stream.started()) {
+			break
+		}
+		p.logger.Printf("request %s: model %s failed, falling back to %s: %v", p.requestID, attempt.openAIReq.Model, p.attempts[i+1].openAIReq.Model, err)
+	}
+	p.release()
+
+	var circuitErr *circuitOpenError
+	if err != nil && p.ctx.Err() == nil && !errors.As(err, &circuitErr) {
+		if apiErr := upstreamAPIError(err); apiErr != nil {
+			return apiErr
+		}
+		return newAPIError(http.StatusInternalServerError, "server_error", "internal_error", "Error calling Ollama API: %s", err)
+	}
+	return err
+}
+
+// newChoices sets up the n choices of req. With more than one, each gets a
+// seed of its own, counting up from the request's seed if it has one.
+func newChoices(ctx context.Context, req OllamaRequest, n int, stream *sseStream) []*choice {
+	choices := make([]*choice, max(n, 1))
+	seed := int(rand.Int31())
+	if req.Options.Seed != nil {
+		seed = *req.Options.Seed
+	}
+	for i := range choices {
+		c := &choice{index: i, req: req}
+		if len(choices) > 1 {
+			c.req.Options.Seed = ptr(seed + i)
+		}
+		if stream != nil {
+			c.stream = stream
+			if i > 0 {
+				c.stream = stream.choice(i)
+			}
+			c.cleaner = newOutputCleaner(ctx, req)
+			c.filter = newStreamFilter(ctx)
+		}
+		choices[i] = c
+	}
+	return choices
+}
+
+// generateChoices generates the choices one after another, or all at once
+// with parallel_choices, their stream chunks interleaved then. The first
+// choice to fail cancels the others.
+func (p *chatPipeline) generateChoices(pacer *tokenPacer) error {
+	if !config.ParallelChoices || len(p.choices) == 1 {
+		for _, c := range p.choices {
+			if err := p.generateChoice(p.ctx, c, pacer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(p.ctx)
+	defer cancel(nil)
+	var wg sync.WaitGroup
+	for _, c := range p.choices {
+		wg.Add(1)
+		go func(c *choice) {
+			defer wg.Done()
+			var err error
+			defer func() {
+				if err != nil {
+					cancel(err)
+				}
+			}()
+			defer recoverAsError(&err)
+			err = p.generateChoice(ctx, c, pacer)
+		}(c)
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// generateChoice runs the generation of c, sending its deltas if streamed.
+func (p *chatPipeline) generateChoice(ctx context.Context, c *choice, pacer *tokenPacer) error {
+	generate := func(req OllamaRequest) (*OllamaResponse, error) {
+		stop := newStopMonitor(p.attempt.requestedModel)
+		dog := newWatchdog()
+		streamed := 0
+		var load *modelLoadWatch
+		if c.stream != nil && c.index == 0 {
+			load = watchModelLoad(ctx, p.r, c.stream, req)
+		}
+		resp, err := sendUpstream(ctx, req, func(text string) error {
+			if load != nil {
+				load.stop()
+			}
+			p.firstToken.Do(func() {
+				s := spanFromContext(p.ctx)
+				s.setAttr("gen_ai.response.time_to_first_token_ms", s.elapsed().Milliseconds())
+				events.publish(Event{Type: EVENT_FIRST_TOKEN, RequestID: p.requestID, Tenant: p.tenantName, Model: req.Model})
+			})
+			if err := pacer.wait(ctx); err != nil {
+				return err
+			}
+			if err := dog.write(text); err != nil {
+				return err
+			}
+			err := stop.write(text)
+			if c.stream == nil {
+				return err
+			}
+			if errors.Is(err, errStopMatched) {
+				// only send up to the end of the match
+				cut := stop.text()
+				text = cut[min(streamed, len(cut)):]
+			}
+			streamed += len(text)
+			metrics.streamedTokens.add(1, p.tenantName, req.Model)
+			if serr := c.stream.delta(c.filter.write(c.cleaner.write(text))); serr != nil {
+				return serr
+			}
+			if ferr := c.filter.failed(); ferr != nil {
+				return ferr
+			}
+			if err == nil && c.filter.blocked {
+				return errContentFiltered
+			}
+			return err
+		})
+		if load != nil {
+			load.finish(resp)
+		}
+		switch {
+		case errors.Is(err, errStopMatched):
+			resp.Response = stop.text()
+			resp.Done = true
+			err = nil
+		case errors.Is(err, errWatchdogTripped):
+			c.lengthCapped = true
+			resp.Done = true
+			err = nil
+		case errors.Is(err, errContentFiltered):
+			// translateStream ends the choice with finish_reason
+			// "content_filter" and the usage so far
+			resp.Done = true
+			err = nil
+		}
+		return resp, err
+	}
+
+	resp, err := generate(c.req)
+	if err == nil && c.stream == nil && len(resp.ToolCalls) == 0 && c.req.Format == nil {
+		// a streamed answer is out already, there is nothing to re-prompt,
+		// and JSON output isn't a language
+		resp, err = enforceLanguage(ctx, p.attempt.openAIReq, config.ResponseLanguages[p.attempt.requestedModel], resp, generate)
+	}
+	c.resp = resp
+	return err
+}
+
+// usage is the token usage of all choices. As with OpenAI, the prompt
+// counts once.
+func (p *chatPipeline) usage() Usage {
+	usage := translate.Usage(p.choices[0].req, p.choices[0].resp)
+	for _, c := range p.choices[1:] {
+		completionTokens := translate.Usage(c.req, c.resp).CompletionTokens
+		usage.CompletionTokens += completionTokens
+		usage.TotalTokens += completionTokens
+	}
+	return usage
+}
+
+// translate turns the upstream answers into an OpenAI chat completion and
+// sends it.
+func (p *chatPipeline) translate() error {
+	if p.stream != nil {
+		return p.translateStream()
+	}
+
+	warning := setDeprecationHeaders(p.w, p.attempt.requestedModel)
+	ollamaReq := p.attempt.ollamaReq
+
+	openAIResp := OpenAIChatResponse{
+		ID:       p.requestID,
+		Object:   "chat.completion",
+		Created:  getCurrentUnixTimestamp(),
+		Model:    p.attempt.openAIReq.Model,
+		Usage:    p.usage(),
+		Metadata: config.ResponseMetadata[p.attempt.requestedModel],
+		Warning:  warning,
+	}
+	for _, c := range p.choices {
+		filter := newOutputFilter(p.ctx)
+		content := cleanupOutput(p.ctx, c.req, c.resp.Response)
+		content, err := filter.classify(p.ctx, filter.write(content)+filter.flush())
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, "server_error", "internal_error", "Error calling output classifier: %s", err)
+		}
+		finishReason := translate.FinishReason(c.resp)
+		if c.lengthCapped {
+			finishReason = "length"
+			setWatchdogWarning(p.w)
+		}
+		toolCalls := openAIToolCalls(c.resp.ToolCalls)
+		if len(toolCalls) > 0 {
+			finishReason = "tool_calls"
+		}
+		if filter.blocked {
+			finishReason = "content_filter"
+		}
+		openAIResp.Choices = append(openAIResp.Choices, Choice{
+			Index: c.index,
+			Message: ChatMessage{
+				Role:    "assistant",
+				Content: content,
+				Images:  c.resp.Images,
+
+				ToolCalls: toolCalls,
+			},
+			FinishReason:         finishReason,
+			ContentFilterResults: filter.results(),
+		})
+	}
+
+	first := openAIResp.Choices[0]
+	tenantFromContext(p.r.Context()).recordUsage(p.r.Context(), apiKeyFromRequest(p.r), openAIResp.Model, openAIResp.Usage, ollamaReq.PromptText(), first.Message.Content)
+	if p.cacheKey != "" && p.attempt == p.attempts[0] {
+		completionCache.put(p.ctx, p.cacheKey, cachedCompletion{Content: first.Message.Content, Images: first.Message.Images, ToolCalls: first.Message.ToolCalls, FinishReason: first.FinishReason, Usage: openAIResp.Usage})
+	}
+	events.publish(Event{Type: EVENT_DONE, RequestID: p.requestID, Tenant: p.tenantName, Model: openAIResp.Model, Usage: &openAIResp.Usage})
+
+	p.responded = true
+	sw := newStreamWriter(p.w)
+	writeJSON(sw, openAIResp)
+	if err := sw.close(); err != nil {
+		p.logger.Printf("request %s: %v", p.requestID, err)
+	}
+	return nil
+}
+
+// translateStream sends what the cleaners and filters still hold back and
+// ends the stream.
+func (p *chatPipeline) translateStream() error {
+	finishReasons := make([]string, len(p.choices))
+	var firstToolCalls []ToolCall
+	for i, c := range p.choices {
+		if err := c.stream.delta(c.filter.write(c.cleaner.flush()) + c.filter.flush()); err != nil {
+			return err
+		}
+		if err := c.filter.failed(); err != nil {
+			return err
+		}
+		if err := c.stream.images(c.resp.Images); err != nil {
+			return err
+		}
+		toolCalls := openAIToolCalls(c.resp.ToolCalls)
+		if err := c.stream.toolCalls(toolCalls); err != nil {
+			return err
+		}
+		finishReasons[i] = translate.FinishReason(c.resp)
+		if c.lengthCapped {
+			finishReasons[i] = "length"
+		}
+		if len(toolCalls) > 0 {
+			finishReasons[i] = "tool_calls"
+		}
+		if c.filter.blocked {
+			finishReasons[i] = "content_filter"
+		}
+		if i == 0 {
+			firstToolCalls = toolCalls
+		}
+	}
+
+	first := p.choices[0]
+	usage := p.usage()
+	tenantFromContext(p.r.Context()).recordUsage(p.r.Context(), apiKeyFromRequest(p.r), p.attempt.openAIReq.Model, usage, p.attempt.ollamaReq.PromptText(), first.stream.content.String())
+	if p.cacheKey != "" && p.attempt == p.attempts[0] {
+		completionCache.put(p.ctx, p.cacheKey, cachedCompletion{Content: first.stream.content.String(), Images: first.resp.Images, ToolCalls: firstToolCalls, FinishReason: finishReasons[0], Usage: usage})
+	}
+	events.publish(Event{Type: EVENT_DONE, RequestID: p.requestID, Tenant: p.tenantName, Model: p.attempt.openAIReq.Model, Usage: &usage})
+
+	for i, c := range p.choices {
+		if err := c.stream.end(finishReasons[i], c.filter.results()); err != nil {
+			return err
+		}
+	}
+	var streamUsage *Usage
+	if opts := p.openAIReq.StreamOptions; opts != nil && opts.IncludeUsage {
+		streamUsage = &usage
+	}
+	if err := p.stream.done(streamUsage); err != nil {
+		return err
+	}
+	p.responded = true
+	if err := p.stream.close(); err != nil {
+		p.logger.Printf("request %s: %v", p.requestID, err)
+	}
+	return nil
+}
+
+// slots is a counting semaphore whose acquire gives up with the context.
+// A nil slots never blocks.
+type slots chan struct{}
+
+func newSlots(n int) slots {
+	if n <= 0 {
+		return nil
+	}
+	return make(slots, n)
+}
+
+func (s slots) acquire(ctx context.Context) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	select {
+	case s <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-s }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// recoverAsError turns a panic in the calling goroutine into *err, so it
+// ends up as an error event instead of taking the process down. Use as
+// `defer recoverAsError(&err)` in goroutines the proxy starts.
+func recoverAsError(err *error) {
+	if v := recover(); v != nil {
+		*err = fmt.Errorf("panic: %v\n%s", v, debug.Stack())
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Speculative prefetch: learn which model an API key tends to ask for next
+// (e.g. an embeddings model right after a burst of chat) and load it ahead
+// of time so the request doesn't wait for a cold start
+const (
+	PREFETCH_ENABLED = false
+	// Requests of a key this close together count as one pipeline
+	PREFETCH_WINDOW = time.Minute
+	// A model is only loaded once the prediction is backed by enough
+	// observations and likely enough
+	PREFETCH_MIN_SAMPLES     = 5
+	PREFETCH_MIN_PROBABILITY = 0.5
+	// How long after a prefetch the model is assumed to still be loaded
+	PREFETCH_COOLDOWN = 5 * time.Minute
+)
+
+// transition counts per model are halved past this, so old patterns fade
+const prefetchMaxSamples = 1000
+
+type lastRequest struct {
+	model string
+	at    time.Time
+}
+
+type prefetcher struct {
+	mu          sync.Mutex
+	last        map[string]lastRequest
+	transitions map[string]map[string]int
+	warmed      map[string]time.Time
+}
+
+var modelPrefetcher = &prefetcher{
+	last:        make(map[string]lastRequest),
+	transitions: make(map[string]map[string]int),
+	warmed:      make(map[string]time.Time),
+}
+
+// observe records that apiKey asked for model and prefetches the model it
+// is predicted to ask for next.
+func (p *prefetcher) observe(apiKey, model string) {
+	if !PREFETCH_ENABLED {
+		return
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	if prev, ok := p.last[apiKey]; ok && prev.model != model && now.Sub(prev.at) <= PREFETCH_WINDOW {
+		p.count(prev.model, model)
+	}
+	p.last[apiKey] = lastRequest{model: model, at: now}
+	// the model is loaded now anyway
+	p.warmed[model] = now
+
+	next, ok := p.predict(model)
+	if ok && now.Sub(p.warmed[next]) > PREFETCH_COOLDOWN {
+		p.warmed[next] = now
+	} else {
+		ok = false
+	}
+	p.mu.Unlock()
+
+	if ok {
+		go func() {
+			var err error
+			defer func() {
+				if err != nil {
+					log.Printf("prefetch %s after %s: %v", next, model, err)
+				}
+			}()
+			defer recoverAsError(&err)
+			err = warmModel(next)
+		}()
+	}
+}
+
+func (p *prefetcher) count(from, to string) {
+	next := p.transitions[from]
+	if next == nil {
+		next = make(map[string]int)
+		p.transitions[from] = next
+	}
+	next[to]++
+
+	total := 0
+	for _, n := range next {
+		total += n
+	}
+	if total > prefetchMaxSamples {
+		for m, n := range next {
+			if n/2 == 0 {
+				delete(next, m)
+			} else {
+				next[m] = n / 2
+			}
+		}
+	}
+}
+
+func (p *prefetcher) predict(model string) (string, bool) {
+	var best string
+	total, bestCount := 0, 0
+	for next, n := range p.transitions[model] {
+		total += n
+		if n > bestCount {
+			best, bestCount = next, n
+		}
+	}
+	if total < PREFETCH_MIN_SAMPLES || float64(bestCount)/float64(total) < PREFETCH_MIN_PROBABILITY {
+		return "", false
+	}
+	return best, modelAllowed(best)
+}
+
+// warmModel makes Ollama load model without generating anything. Embedding
+// models can't generate, they are loaded through /api/embed instead. The
+// model stays loaded for its keep_alive, if one is configured.
+func warmModel(model string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	fields := fmt.Sprintf(`"model":%q`, model)
+	if keepAlive := modelKeepAlive(model); keepAlive != "" {
+		fields += fmt.Sprintf(`,"keep_alive":%q`, keepAlive)
+	}
+	err := postOllama(ctx, "/api/generate", "{"+fields+"}")
+	if err != nil {
+		err = postOllama(ctx, "/api/embed", "{"+fields+`,"input":[]}`)
+	}
+	return err
+}
+
+func postOllama(ctx context.Context, path string, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ollamaBackends.pick("").url+path, bytes.NewBufferString(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ollama API error (status %d): %s", resp.StatusCode, string(data))
+	}
+	return nil
+}
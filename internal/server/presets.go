@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Preset holds default generation parameters for a consuming app. Fields left
+// out are not applied.
+// The presets config maps the name of an API key or a model name to one.
+// They only fill in what the client omitted; a key preset wins over a model
+// preset.
+type Preset struct {
+	Temperature  *float64 `yaml:"temperature"`
+	TopP         *float64 `yaml:"top_p"`
+	MaxTokens    int      `yaml:"max_tokens"`
+	SystemPrompt string   `yaml:"system_prompt"`
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func applyPresets(req *OpenAIChatRequest, apiKey string) {
+	if entry := apiKeys.lookup(apiKey); entry != nil && entry.Name != "" {
+		if p, ok := config.Presets[entry.Name]; ok {
+			applyPreset(req, p)
+		}
+	}
+	if p, ok := config.Presets[req.Model]; ok {
+		applyPreset(req, p)
+	}
+}
+
+func applyPreset(req *OpenAIChatRequest, p Preset) {
+	if req.Temperature == nil && p.Temperature != nil {
+		req.Temperature = ptr(*p.Temperature)
+	}
+	if req.TopP == nil && p.TopP != nil {
+		req.TopP = ptr(*p.TopP)
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = p.MaxTokens
+	}
+	if p.SystemPrompt != "" && !hasSystemMessage(req.Messages) {
+		req.Messages = append([]ChatMessage{{Role: "system", Content: p.SystemPrompt}}, req.Messages...)
+	}
+}
+
+func hasSystemMessage(messages []ChatMessage) bool {
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			return true
+		}
+	}
+	return false
+}
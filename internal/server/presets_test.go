@@ -0,0 +1,53 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyPresets(t *testing.T) {
+	keys := []APIKey{{Key: testKey, Name: "team-a"}, {Key: "sk-unnamed"}}
+	presets := map[string]Preset{
+		"team-a":   {Temperature: ptr(0.0), SystemPrompt: "Answer as team A."},
+		"llama3":   {Temperature: ptr(0.7), TopP: ptr(0.9), MaxTokens: 512},
+		"sk-other": {MaxTokens: 1},
+	}
+	tests := []struct {
+		name   string
+		apiKey string
+		req    OpenAIChatRequest
+		want   OpenAIChatRequest
+	}{
+		{
+			"model preset",
+			"",
+			OpenAIChatRequest{Model: "llama3"},
+			OpenAIChatRequest{Model: "llama3", Temperature: ptr(0.7), TopP: ptr(0.9), MaxTokens: 512},
+		},
+		{
+			"key preset by name wins, temperature 0 included",
+			testKey,
+			OpenAIChatRequest{Model: "llama3"},
+			OpenAIChatRequest{Model: "llama3", Temperature: ptr(0.0), TopP: ptr(0.9), MaxTokens: 512,
+				Messages: []ChatMessage{{Role: "system", Content: "Answer as team A."}}},
+		},
+		{
+			"client values stay",
+			testKey,
+			OpenAIChatRequest{Model: "llama3", Temperature: ptr(1.0), MaxTokens: 64, Messages: []ChatMessage{{Role: "system", Content: "Be brief."}}},
+			OpenAIChatRequest{Model: "llama3", Temperature: ptr(1.0), TopP: ptr(0.9), MaxTokens: 64, Messages: []ChatMessage{{Role: "system", Content: "Be brief."}}},
+		},
+		{"unnamed key", "sk-unnamed", OpenAIChatRequest{Model: "phi3"}, OpenAIChatRequest{Model: "phi3"}},
+		{"not by the key itself", "sk-other", OpenAIChatRequest{Model: "phi3"}, OpenAIChatRequest{Model: "phi3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{Presets: presets}, keys...)
+			req := tt.req
+			applyPresets(&req, tt.apiKey)
+			if !reflect.DeepEqual(req, tt.want) {
+				t.Errorf("applyPresets() = %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Backend API flavors a provider can speak
+const (
+	PROVIDER_OLLAMA = "ollama"
+	PROVIDER_OPENAI = "openai" // OpenAI-compatible chat completions (OpenAI, vLLM, ...)
+)
+
+// Provider is an upstream selected by an OpenRouter-style `provider/model`
+// model name, configured by its prefix in `providers`.
+type Provider struct {
+	// ollama or openai
+	Type    string `yaml:"type"`
+	BaseURL string `yaml:"base_url"`
+	// bearer token of openai providers, may be a secret reference
+	APIKey string `yaml:"api_key"`
+}
+
+// ollamaProvider is the `ollama/` prefix, which is always known and served
+// by backend_tiers.
+var ollamaProvider = Provider{Type: PROVIDER_OLLAMA}
+
+// lookupProvider is the provider with the model name prefix name.
+func lookupProvider(name string) (Provider, bool) {
+	if name == "ollama" {
+		return ollamaProvider, true
+	}
+	provider, ok := config.Providers[name]
+	return provider, ok
+}
+
+// splitProviderModel splits `provider/model` into the provider name and the
+// model name the provider knows it by. Ollama names can contain slashes
+// themselves (`hf.co/user/repo`), so only known prefixes are split off.
+func splitProviderModel(model string) (string, string) {
+	if prefix, rest, ok := strings.Cut(model, "/"); ok {
+		if _, known := lookupProvider(prefix); known && rest != "" {
+			return prefix, rest
+		}
+	}
+	return "ollama", model
+}
+
+func providerFor(req OllamaRequest) Provider {
+	if provider, ok := lookupProvider(req.Provider); ok {
+		return provider
+	}
+	return ollamaProvider
+}
+
+// usesBackendTiers reports whether req goes to the Ollama backends of
+// backend_tiers rather than a provider's own base URL.
+func usesBackendTiers(req OllamaRequest) bool {
+	return req.Provider == "" || req.Provider == "ollama"
+}
+
+// upstreamURL is where a request is sent.
+func upstreamURL(req OllamaRequest) string {
+	provider := providerFor(req)
+	switch {
+	case provider.Type == PROVIDER_OPENAI:
+		return provider.BaseURL + "/chat/completions"
+	case usesBackendTiers(req):
+		return ollamaBackends.pick(req.Session).url + ollamaEndpoint(req)
+	}
+	return provider.BaseURL + ollamaEndpoint(req)
+}
+
+// sendUpstream sends a generation to the provider it was routed to, with
+// sendToOllama's semantics.
+func sendUpstream(ctx context.Context, req OllamaRequest, onChunk func(text string) error) (resp *OllamaResponse, err error) {
+	start := time.Now()
+	defer func() { metrics.observeUpstream(req.Model, start, err) }()
+	if providerFor(req).Type == PROVIDER_OPENAI {
+		return sendToOpenAI(ctx, req, onChunk)
+	}
+	return sendToOllama(ctx, req, onChunk)
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+			// OpenRouter-style generated images
+			Images    []ContentPart `json:"images"`
+			ToolCalls []ToolCall    `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// sendToOpenAI streams a generation from an OpenAI-compatible backend. The
+// messages are sent as they are, not as the flattened prompt.
+func sendToOpenAI(ctx context.Context, req OllamaRequest, onChunk func(text string) error) (*OllamaResponse, error) {
+	ollamaResp := &OllamaResponse{Model: req.Model}
+
+	messages := make([]map[string]any, 0, len(req.OpenAIMessages))
+	for _, msg := range req.OpenAIMessages {
+		var content any = msg.Content
+		if len(msg.ImageURLs) > 0 {
+			parts := []ContentPart{{Type: "text", Text: msg.Content}}
+			for _, url := range msg.ImageURLs {
+				parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+			}
+			content = parts
+		}
+		message := map[string]any{"role": msg.Role, "content": content}
+		if len(msg.ToolCalls) > 0 {
+			message["tool_calls"] = msg.ToolCalls
+			if msg.Content == "" {
+				message["content"] = nil
+			}
+		}
+		if msg.ToolCallID != "" {
+			message["tool_call_id"] = msg.ToolCallID
+		}
+		messages = append(messages, message)
+	}
+	body := map[string]any{
+		"model":    req.Model,
+		"messages": messages,
+		"stream":   true,
+		// for the token counts
+		"stream_options": map[string]any{"include_usage": true},
+	}
+	if req.Options.NumPredict > 0 {
+		body["max_tokens"] = req.Options.NumPredict
+	}
+	if req.Options.Temperature != nil {
+		body["temperature"] = *req.Options.Temperature
+	}
+	if req.Options.TopP != nil {
+		body["top_p"] = *req.Options.TopP
+	}
+	if req.Options.TopK != nil {
+		// vLLM knows it, OpenAI doesn't
+		body["top_k"] = *req.Options.TopK
+	}
+	if req.Options.Seed != nil {
+		body["seed"] = *req.Options.Seed
+	}
+	if req.Options.PresencePenalty != nil {
+		body["presence_penalty"] = *req.Options.PresencePenalty
+	}
+	if req.Options.FrequencyPenalty != nil {
+		body["frequency_penalty"] = *req.Options.FrequencyPenalty
+	}
+	if len(req.Options.Stop) > 0 {
+		body["stop"] = req.Options.Stop
+	}
+	if req.ResponseFormat != nil {
+		body["response_format"] = req.ResponseFormat
+	}
+	if len(req.Tools) > 0 {
+		body["tools"] = req.Tools
+		if req.ToolChoice != nil {
+			body["tool_choice"] = req.ToolChoice
+		}
+	}
+
+	var jsonData bytes.Buffer
+	if err := writeJSON(&jsonData, body); err != nil {
+		return ollamaResp, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, upstreamURL(req), &jsonData)
+	if err != nil {
+		return ollamaResp, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	if key := providerAPIKey(req.Provider); key != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+key)
+	}
+	tagUpstreamRequest(ctx, httpReq, req.Provider+"/"+req.Model)
+
+	resp, err := upstreamClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ollamaResp, ctx.Err()
+		}
+		return ollamaResp, fmt.Errorf("failed to connect to %s: %w", req.Provider, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return ollamaResp, &upstreamError{upstream: req.Provider, model: req.Model, status: resp.StatusCode, body: string(data)}
+	}
+
+	var text strings.Builder
+	// tool calls come in pieces, keyed by their index
+	var calls []ToolCall
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			ollamaResp.Done = true
+			break
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			ollamaResp.Response = text.String()
+			return ollamaResp, fmt.Errorf("failed to read response: %w", err)
+		}
+		if chunk.Usage != nil {
+			ollamaResp.PromptEvalCount = chunk.Usage.PromptTokens
+			ollamaResp.EvalCount = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" && onChunk != nil {
+				if err := onChunk(choice.Delta.Content); err != nil {
+					ollamaResp.Response = text.String()
+					return ollamaResp, err
+				}
+			}
+			text.WriteString(choice.Delta.Content)
+			for _, image := range choice.Delta.Images {
+				if image.ImageURL == nil {
+					continue
+				}
+				if data, ok := base64FromDataURL(image.ImageURL.URL); ok {
+					ollamaResp.Images = append(ollamaResp.Images, data)
+				}
+			}
+			for _, call := range choice.Delta.ToolCalls {
+				index := len(calls)
+				if call.Index != nil {
+					index = *call.Index
+				}
+				for len(calls) <= index {
+					calls = append(calls, ToolCall{})
+				}
+				calls[index].Function.Name += call.Function.Name
+				calls[index].Function.Arguments += call.Function.Arguments
+			}
+			if choice.FinishReason != nil {
+				ollamaResp.Done = true
+				ollamaResp.DoneReason = *choice.FinishReason
+			}
+		}
+	}
+	ollamaResp.Response = text.String()
+	for _, call := range calls {
+		ollamaResp.ToolCalls = append(ollamaResp.ToolCalls, OllamaToolCall{
+			Function: OllamaToolCallFunction{Name: call.Function.Name, Arguments: json.RawMessage(call.Function.Arguments)},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ollamaResp, ctx.Err()
+		}
+		return ollamaResp, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !ollamaResp.Done {
+		return ollamaResp, fmt.Errorf("%s API error: stream ended early", req.Provider)
+	}
+	return ollamaResp, nil
+}
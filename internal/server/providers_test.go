@@ -0,0 +1,35 @@
+package server
+
+import "testing"
+
+func TestSplitProviderModel(t *testing.T) {
+	vllm := map[string]Provider{"vllm": {Type: PROVIDER_OPENAI, BaseURL: "http://localhost:8000/v1"}}
+	tests := []struct {
+		name         string
+		providers    map[string]Provider
+		model        string
+		wantProvider string
+		wantModel    string
+		wantType     string
+	}{
+		{"plain name", nil, "llama3", "ollama", "llama3", PROVIDER_OLLAMA},
+		{"ollama prefix", nil, "ollama/llama3", "ollama", "llama3", PROVIDER_OLLAMA},
+		{"no providers by default", nil, "openai/gpt-4o", "ollama", "openai/gpt-4o", PROVIDER_OLLAMA},
+		{"configured provider", vllm, "vllm/qwen2", "vllm", "qwen2", PROVIDER_OPENAI},
+		{"unconfigured provider", vllm, "openai/gpt-4o", "ollama", "openai/gpt-4o", PROVIDER_OLLAMA},
+		{"ollama name with slashes", vllm, "hf.co/user/repo", "ollama", "hf.co/user/repo", PROVIDER_OLLAMA},
+		{"prefix without model", vllm, "vllm/", "ollama", "vllm/", PROVIDER_OLLAMA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{Providers: tt.providers})
+			provider, model := splitProviderModel(tt.model)
+			if provider != tt.wantProvider || model != tt.wantModel {
+				t.Errorf("splitProviderModel(%q) = %q, %q, want %q, %q", tt.model, provider, model, tt.wantProvider, tt.wantModel)
+			}
+			if got := providerFor(OllamaRequest{Provider: provider}).Type; got != tt.wantType {
+				t.Errorf("provider %q has type %q, want %q", provider, got, tt.wantType)
+			}
+		})
+	}
+}
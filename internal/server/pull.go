@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Least time between two progress lines of a download in the log
+const PULL_PROGRESS_INTERVAL = 10 * time.Second
+
+// ollamaPullProgress is a line of Ollama's /api/pull stream.
+type ollamaPullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// modelPull is a pull in progress, waited for by every request that needs
+// the model.
+type modelPull struct {
+	done chan struct{}
+	err  error
+}
+
+var modelPulls = struct {
+	sync.Mutex
+	running map[string]*modelPull
+}{running: make(map[string]*modelPull)}
+
+// autoPullAllowed reports whether model may be pulled when Ollama doesn't
+// have it, see auto_pull.
+func autoPullAllowed(model string) bool {
+	return len(config.AutoPull) > 0 && matchesAnyPattern(compileGlobPatterns(config.AutoPull), model)
+}
+
+// pullModel pulls model onto the Ollama at baseURL and waits until it is
+// there. Requests for a model that is already being pulled wait for that
+// pull. A pull goes on when the requests waiting for it are gone, the next
+// request finds the model then.
+func pullModel(ctx context.Context, baseURL, model string) error {
+	key := baseURL + " " + model
+	modelPulls.Lock()
+	pull, ok := modelPulls.running[key]
+	if !ok {
+		pull = &modelPull{done: make(chan struct{})}
+		modelPulls.running[key] = pull
+		go func() {
+			pull.err = runPull(baseURL, model)
+			modelPulls.Lock()
+			delete(modelPulls.running, key)
+			modelPulls.Unlock()
+			close(pull.done)
+		}()
+	}
+	modelPulls.Unlock()
+
+	select {
+	case <-pull.done:
+		return pull.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func runPull(baseURL, model string) error {
+	log.Printf("model %s is not installed on %s, pulling it", model, baseURL)
+	start := time.Now()
+	body, err := json.Marshal(map[string]any{"model": model, "stream": true})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return &upstreamError{upstream: "ollama", model: model, status: resp.StatusCode, body: string(data)}
+	}
+
+	var status string
+	var logged time.Time
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var progress ollamaPullProgress
+		if err := decoder.Decode(&progress); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read pull progress: %w", err)
+		}
+		if progress.Error != "" {
+			log.Printf("pull of model %s failed: %s", model, progress.Error)
+			return &upstreamError{upstream: "ollama", model: model, body: progress.Error}
+		}
+		switch {
+		case progress.Status != status:
+			status = progress.Status
+			logged = time.Now()
+			log.Printf("pull of model %s: %s", model, status)
+		case progress.Total > 0 && time.Since(logged) >= PULL_PROGRESS_INTERVAL:
+			logged = time.Now()
+			log.Printf("pull of model %s: %s %d%% of %d MB", model, status, progress.Completed*100/progress.Total, progress.Total>>20)
+		}
+	}
+	if status != "success" {
+		return fmt.Errorf("pull of model %s ended with status %q", model, status)
+	}
+	forgetModelInfo(model)
+	log.Printf("model %s pulled in %s", model, time.Since(start).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client addresses rate limited at once, the least recently seen one is
+// forgotten for a new one beyond that
+const RATE_LIMIT_MAX_ADDRESSES = 10000
+
+// clientLimits are the request and token budgets of one API key or client
+// address. Either may be nil for no limit.
+type clientLimits struct {
+	requests *rateLimiter
+	tokens   *rateLimiter
+}
+
+type clientLimitsContextKey struct{}
+
+// newClientLimits budgets requests and tokens per minute, taking
+// rate_limit from the config for those that are 0. It returns nil when
+// neither is limited.
+func newClientLimits(requestsPerMinute, tokensPerMinute int) *clientLimits {
+	if requestsPerMinute == 0 {
+		requestsPerMinute = config.RateLimit.RequestsPerMinute
+	}
+	if tokensPerMinute == 0 {
+		tokensPerMinute = config.RateLimit.TokensPerMinute
+	}
+	if requestsPerMinute == 0 && tokensPerMinute == 0 {
+		return nil
+	}
+	limits := &clientLimits{}
+	if requestsPerMinute > 0 {
+		limits.requests = newRateLimiter(requestsPerMinute, time.Minute)
+	}
+	if tokensPerMinute > 0 {
+		limits.tokens = newRateLimiter(tokensPerMinute, time.Minute)
+	}
+	return limits
+}
+
+// rateLimit passes the request on while limits allow it, with the
+// x-ratelimit-* headers OpenAI sends. Tokens are only known once a request
+// is done, see chargeTokens, so a request is let through while the token
+// budget isn't used up and the budget may go into debt.
+func rateLimit(w http.ResponseWriter, r *http.Request, limits *clientLimits, next http.Handler) {
+	if limits == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if wait, ok := limits.tokens.ready(); !ok {
+		limits.setHeaders(w)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		sendError(w, r, "Rate limit of %d tokens per minute reached", "tokens", "rate_limit_exceeded", http.StatusTooManyRequests, int(limits.tokens.limit))
+		return
+	}
+	wait, ok := limits.requests.allow()
+	limits.setHeaders(w)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		sendError(w, r, "Rate limit of %d requests per minute reached", "requests", "rate_limit_exceeded", http.StatusTooManyRequests, int(limits.requests.limit))
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientLimitsContextKey{}, limits)))
+}
+
+func (l *clientLimits) setHeaders(w http.ResponseWriter) {
+	for kind, limiter := range map[string]*rateLimiter{"requests": l.requests, "tokens": l.tokens} {
+		if limiter == nil {
+			continue
+		}
+		remaining, reset := limiter.state()
+		w.Header().Set("x-ratelimit-limit-"+kind, strconv.Itoa(int(limiter.limit)))
+		w.Header().Set("x-ratelimit-remaining-"+kind, strconv.Itoa(remaining))
+		w.Header().Set("x-ratelimit-reset-"+kind, reset.Round(time.Millisecond).String())
+	}
+}
+
+// chargeTokens takes the tokens a request used from the budget it was let
+// through on.
+func chargeTokens(ctx context.Context, tokens int) {
+	if limits, ok := ctx.Value(clientLimitsContextKey{}).(*clientLimits); ok {
+		limits.tokens.charge(tokens)
+	}
+}
+
+// addressLimits rate limit clients by address while no API keys are
+// configured.
+var addressLimits = &addressLimitStore{order: list.New(), clients: make(map[string]*list.Element)}
+
+// addressLimitStore is an LRU of at most RATE_LIMIT_MAX_ADDRESSES clients.
+type addressLimitStore struct {
+	mu      sync.Mutex
+	order   *list.List
+	clients map[string]*list.Element
+}
+
+type addressLimitEntry struct {
+	addr   string
+	limits *clientLimits
+}
+
+// get returns the limits of a client address, nil when rate_limit sets none.
+func (s *addressLimitStore) get(addr string) *clientLimits {
+	if config.RateLimit.RequestsPerMinute == 0 && config.RateLimit.TokensPerMinute == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.clients[addr]; ok {
+		s.order.MoveToFront(elem)
+		return elem.Value.(*addressLimitEntry).limits
+	}
+	limits := newClientLimits(0, 0)
+	s.clients[addr] = s.order.PushFront(&addressLimitEntry{addr: addr, limits: limits})
+	for s.order.Len() > RATE_LIMIT_MAX_ADDRESSES {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.clients, oldest.Value.(*addressLimitEntry).addr)
+	}
+	return limits
+}
+
+// clientAddress is the IP address a request came from.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter is a token bucket holding up to limit tokens, refilled evenly
+// over per. Its methods do nothing on a nil rateLimiter.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(limit int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:    float64(limit),
+		interval: per / time.Duration(limit),
+		tokens:   float64(limit),
+		last:     time.Now(),
+	}
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens = min(l.limit, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+	l.last = now
+}
+
+// allow takes a token, or returns how long until the next one is available.
+func (l *rateLimiter) allow() (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return time.Duration((1 - l.tokens) * float64(l.interval)), false
+	}
+	l.tokens--
+	return 0, true
+}
+
+// ready reports whether a token is available, or how long until one is.
+func (l *rateLimiter) ready() (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if l.tokens < 1 {
+		return time.Duration((1 - l.tokens) * float64(l.interval)), false
+	}
+	return 0, true
+}
+
+// charge takes n tokens, going into debt if there aren't enough.
+func (l *rateLimiter) charge(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	l.tokens -= float64(n)
+}
+
+// state returns the whole tokens left and how long until the bucket is full.
+func (l *rateLimiter) state() (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	return max(0, int(l.tokens)), time.Duration((l.limit - l.tokens) * float64(l.interval))
+}
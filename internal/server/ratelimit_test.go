@@ -0,0 +1,137 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	off := false
+	tests := []struct {
+		name      string
+		rateLimit RateLimitConfig
+		keys      []APIKey
+		routes    map[string]RoutePolicy
+		// the requests made in a row, by key and client address
+		requests []string
+		// tokens each request used
+		tokens int
+		// the status of each request
+		want []int
+	}{
+		{"no limit", RateLimitConfig{}, nil, nil, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, 0, []int{200, 200, 200}},
+		{"by address", RateLimitConfig{RequestsPerMinute: 2}, nil, nil, []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.1"}, 0, []int{200, 200, 200, 429}},
+		{
+			"by key",
+			RateLimitConfig{RequestsPerMinute: 10},
+			[]APIKey{{Key: testKey, RequestsPerMinute: 1}, {Key: "sk-other"}},
+			nil,
+			[]string{testKey, "sk-other", testKey, "sk-other"},
+			0,
+			[]int{200, 200, 429, 200},
+		},
+		{"tokens", RateLimitConfig{TokensPerMinute: 100}, nil, nil, []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"}, 60, []int{200, 200, 429}},
+		{
+			"tokens by key",
+			RateLimitConfig{},
+			[]APIKey{{Key: testKey, TokensPerMinute: 50}},
+			nil,
+			[]string{testKey, testKey},
+			60,
+			[]int{200, 429},
+		},
+		{
+			"off for the route",
+			RateLimitConfig{RequestsPerMinute: 1},
+			nil,
+			map[string]RoutePolicy{"/v1/chat/completions": {RateLimit: &off}},
+			[]string{"10.0.0.1", "10.0.0.1"},
+			0,
+			[]int{200, 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{RateLimit: tt.rateLimit, Routes: tt.routes}, tt.keys...)
+			oldLimits := addressLimits
+			addressLimits = &addressLimitStore{order: list.New(), clients: make(map[string]*list.Element)}
+			t.Cleanup(func() { addressLimits = oldLimits })
+			handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chargeTokens(r.Context(), tt.tokens)
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			for i, client := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+				r = r.WithContext(withRoute(r.Context(), "/v1/chat/completions"))
+				if len(tt.keys) > 0 {
+					r.Header.Set("Authorization", "Bearer "+client)
+				} else {
+					r.RemoteAddr = client + ":51234"
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d of %s: status %d, want %d", i, client, w.Code, tt.want[i])
+				}
+				if w.Code == http.StatusTooManyRequests {
+					if code := errorCode(t, w); code != "rate_limit_exceeded" {
+						t.Errorf("request %d: error code %q, want rate_limit_exceeded", i, code)
+					}
+					if w.Header().Get("Retry-After") == "" {
+						t.Errorf("request %d: no Retry-After", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	setConfig(t, Config{})
+	limits := newClientLimits(3, 1000)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chargeTokens(r.Context(), 250)
+	})
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"x-ratelimit-limit-requests", "3"},
+		{"x-ratelimit-remaining-requests", "1"},
+		{"x-ratelimit-limit-tokens", "1000"},
+		{"x-ratelimit-remaining-tokens", "750"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rateLimit(httptest.NewRecorder(), r, limits, handler)
+	w := httptest.NewRecorder()
+	rateLimit(w, r, limits, handler)
+	for _, tt := range tests {
+		// headers are set before the second request charged its tokens
+		if got := w.Header().Get(tt.header); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAddressLimitStoreEvicts(t *testing.T) {
+	setConfig(t, Config{RateLimit: RateLimitConfig{RequestsPerMinute: 1}})
+	s := &addressLimitStore{order: list.New(), clients: make(map[string]*list.Element)}
+	first := s.get("10.0.0.0")
+	first.requests.allow()
+	for i := 1; i <= RATE_LIMIT_MAX_ADDRESSES; i++ {
+		s.get(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	if len(s.clients) != RATE_LIMIT_MAX_ADDRESSES {
+		t.Errorf("%d addresses kept, want %d", len(s.clients), RATE_LIMIT_MAX_ADDRESSES)
+	}
+	if _, ok := s.clients["10.0.0.0"]; ok {
+		t.Error("the least recently seen address was kept")
+	}
+	if _, ok := s.get("10.0.0.0").requests.allow(); !ok {
+		t.Error("an evicted address came back with its old budget")
+	}
+}
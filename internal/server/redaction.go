@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"unicode/utf8"
+)
+
+// What an API key's store_content keeps of the prompt and response of its
+// requests in usage records. By default neither is kept.
+const (
+	STORE_CONTENT_NONE      = "none"
+	STORE_CONTENT_HASHED    = "hashed"
+	STORE_CONTENT_TRUNCATED = "truncated"
+	STORE_CONTENT_FULL      = "full"
+)
+
+// How much of a text store_content: truncated keeps
+const STORED_CONTENT_MAX_RUNES = 200
+
+func validStoreContent(mode string) bool {
+	switch mode {
+	case "", STORE_CONTENT_NONE, STORE_CONTENT_HASHED, STORE_CONTENT_TRUNCATED, STORE_CONTENT_FULL:
+		return true
+	}
+	return false
+}
+
+// storeContentFor is the store_content of apiKey. Requests without a known
+// key keep nothing.
+func storeContentFor(apiKey string) string {
+	if entry := apiKeys.lookup(apiKey); entry != nil && entry.StoreContent != "" {
+		return entry.StoreContent
+	}
+	return STORE_CONTENT_NONE
+}
+
+// redact is what mode keeps of text: nothing, its SHA-256 so repeated
+// prompts can be counted without knowing them, its first
+// STORED_CONTENT_MAX_RUNES or all of it.
+func redact(mode, text string) string {
+	if text == "" {
+		return ""
+	}
+	switch mode {
+	case STORE_CONTENT_HASHED:
+		sum := sha256.Sum256([]byte(text))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	case STORE_CONTENT_TRUNCATED:
+		if utf8.RuneCountInString(text) <= STORED_CONTENT_MAX_RUNES {
+			return text
+		}
+		runes := []rune(text)
+		return string(runes[:STORED_CONTENT_MAX_RUNES]) + "…"
+	case STORE_CONTENT_FULL:
+		return text
+	}
+	return ""
+}
+
+// usageKeyHash is how usage records and journals identify apiKey without
+// keeping a working credential: its HMAC-SHA256 under usage_key_secret.
+// It is empty without the secret, and records only have the key's name.
+func usageKeyHash(apiKey string) string {
+	if apiKey == "" || config.UsageKeySecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(config.UsageKeySecret))
+	mac.Write([]byte(apiKey))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Judge score a new target's answer to a golden prompt needs to pass
+const REGRESSION_PASS_SCORE = 7
+
+// Share of the golden prompts that have to pass for an alias to switch
+const REGRESSION_PASS_RATE = 0.9
+
+// GoldenPrompt is a line of eval.golden_file.
+type GoldenPrompt struct {
+	Messages []ChatMessage `json:"messages"`
+	// the expected answer; when empty, the alias's current target is asked
+	// for it at check time
+	Baseline string `json:"baseline,omitempty"`
+}
+
+// AliasChangeRequest switches an alias, see handleAdminAliases.
+type AliasChangeRequest struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+	// switch without a regression check
+	Force bool `json:"force,omitempty"`
+	// move conversations pinned to the old target as well, see
+	// model_aliases.session_pin_ttl
+	Migrate bool `json:"migrate,omitempty"`
+}
+
+type RegressionResult struct {
+	// index of the golden prompt in eval.golden_file
+	Prompt    int     `json:"prompt"`
+	Score     float64 `json:"score"`
+	Judgement string  `json:"judgement,omitempty"`
+	Passed    bool    `json:"passed"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// RegressionReport is the outcome of an alias change: the regression check
+// of the new target against the current one, and whether the alias switched.
+type RegressionReport struct {
+	Alias string `json:"alias"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// share of the golden prompts that passed, and whether that is enough
+	Score   float64            `json:"score"`
+	Passed  bool               `json:"passed"`
+	Applied bool               `json:"applied"`
+	Results []RegressionResult `json:"results,omitempty"`
+	// conversations moved to the new target, with migrate
+	Migrated int `json:"migrated,omitempty"`
+}
+
+// AliasOverride is an alias switched at runtime.
+type AliasOverride struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+}
+
+type AliasOverridesResponse struct {
+	Object string          `json:"object"`
+	Data   []AliasOverride `json:"data"`
+}
+
+// loadGoldenPrompts reads eval.golden_file, one JSON prompt per line.
+func loadGoldenPrompts(path string) ([]GoldenPrompt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var prompts []GoldenPrompt
+	decoder := json.NewDecoder(f)
+	for {
+		var p GoldenPrompt
+		if err := decoder.Decode(&p); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("golden prompt #%d: %w", len(prompts)+1, err)
+		}
+		if len(p.Messages) == 0 {
+			return nil, fmt.Errorf("golden prompt #%d has no messages", len(prompts)+1)
+		}
+		prompts = append(prompts, p)
+	}
+	if len(prompts) == 0 {
+		return nil, errors.New("no golden prompts")
+	}
+	return prompts, nil
+}
+
+// checkRegression replays the golden prompts through to and has the judge
+// model compare every answer with the baseline, or with what from answers
+// when the prompt has none.
+func checkRegression(ctx context.Context, prompts []GoldenPrompt, from, to string) ([]RegressionResult, float64) {
+	results := make([]RegressionResult, len(prompts))
+	passed := 0
+	for i, p := range prompts {
+		results[i] = comparePrompt(ctx, p, from, to)
+		results[i].Prompt = i
+		if results[i].Passed {
+			passed++
+		}
+	}
+	return results, float64(passed) / float64(len(prompts))
+}
+
+func comparePrompt(ctx context.Context, p GoldenPrompt, from, to string) RegressionResult {
+	baseline := p.Baseline
+	if baseline == "" {
+		answer, err := generateGolden(ctx, from, p)
+		if err != nil {
+			return RegressionResult{Error: fmt.Sprintf("baseline from %s: %v", from, err)}
+		}
+		baseline = answer
+	}
+	candidate, err := generateGolden(ctx, to, p)
+	if err != nil {
+		return RegressionResult{Error: fmt.Sprintf("answer from %s: %v", to, err)}
+	}
+	score, judgement, err := askJudge(ctx, "Compare a candidate answer with a reference answer to the same prompt. "+
+		"Rate the candidate on a scale from 1 (wrong or useless next to the reference) to 10 "+
+		"(at least as correct, complete and helpful as the reference).\n\n"+
+		"Prompt:\n"+translate.Prompt(p.Messages)+"\n\nReference answer:\n"+baseline+"\n\nCandidate answer:\n"+candidate)
+	if err != nil {
+		return RegressionResult{Error: fmt.Sprintf("judge: %v", err)}
+	}
+	return RegressionResult{Score: score, Judgement: judgement, Passed: score >= REGRESSION_PASS_SCORE}
+}
+
+// generateGolden answers a golden prompt with model, at temperature 0 so
+// reruns compare alike.
+func generateGolden(ctx context.Context, model string, p GoldenPrompt) (string, error) {
+	temperature := 0.0
+	req, err := buildOllamaRequest(ctx, OpenAIChatRequest{Model: model, Messages: p.Messages, Temperature: &temperature})
+	if err != nil {
+		return "", err
+	}
+	resp, err := sendUpstream(ctx, req, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Response, nil
+}
+
+// handleAdminAliases lists the aliases switched at runtime (GET), switches
+// one once its new target passed the regression check (POST) or drops a
+// switch again (DELETE ?alias=).
+func handleAdminAliases(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	switch r.Method {
+	case http.MethodGet:
+		resp := AliasOverridesResponse{Object: "list", Data: []AliasOverride{}}
+		aliasOverrides.RLock()
+		for alias, target := range aliasOverrides.targets {
+			resp.Data = append(resp.Data, AliasOverride{Alias: alias, Target: target})
+		}
+		aliasOverrides.RUnlock()
+		sort.Slice(resp.Data, func(i, j int) bool { return resp.Data[i].Alias < resp.Data[j].Alias })
+		writeJSON(w, resp)
+	case http.MethodPost:
+		changeAlias(w, r)
+	case http.MethodDelete:
+		alias := strings.ToLower(r.URL.Query().Get("alias"))
+		aliasOverrides.Lock()
+		_, ok := aliasOverrides.targets[alias]
+		delete(aliasOverrides.targets, alias)
+		aliasOverrides.Unlock()
+		if !ok {
+			sendError(w, r, "The alias `%s` was not switched", "invalid_request_error", "alias_not_found", http.StatusNotFound, alias)
+			return
+		}
+		log.Printf("alias %s switched back to its configured target", alias)
+		if r.URL.Query().Get("migrate") == "true" {
+			log.Printf("alias %s: %d pinned conversations migrated", alias, unpinAlias(alias))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func changeAlias(w http.ResponseWriter, r *http.Request) {
+	var req AliasChangeRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	if req.Alias == "" || req.Target == "" {
+		sendError(w, r, "alias and target are required", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	from, _ := resolveModelAlias(r.Context(), req.Alias)
+	report := RegressionReport{Alias: req.Alias, From: from, To: req.Target}
+
+	if !req.Force {
+		if config.Eval.GoldenFile == "" || config.Eval.JudgeModel == "" {
+			sendError(w, r, "Regression checks need eval.golden_file and eval.judge_model, switch with force to skip them", "invalid_request_error", "regression_check_unavailable", http.StatusBadRequest)
+			return
+		}
+		prompts, err := loadGoldenPrompts(config.Eval.GoldenFile)
+		if err != nil {
+			log.Printf("failed to load golden prompts: %v", err)
+			sendError(w, r, "Failed to load the golden prompts", "server_error", "internal_error", http.StatusInternalServerError)
+			return
+		}
+		report.Results, report.Score = checkRegression(r.Context(), prompts, from, req.Target)
+		if r.Context().Err() != nil {
+			return
+		}
+		report.Passed = report.Score >= REGRESSION_PASS_RATE
+		log.Printf("regression check of alias %s from %s to %s: %.0f%% of %d golden prompts passed", req.Alias, from, req.Target, report.Score*100, len(prompts))
+	}
+
+	if report.Passed || req.Force {
+		aliasOverrides.Lock()
+		aliasOverrides.targets[strings.ToLower(req.Alias)] = req.Target
+		aliasOverrides.Unlock()
+		report.Applied = true
+		log.Printf("alias %s switched from %s to %s", req.Alias, from, req.Target)
+		if req.Migrate {
+			report.Migrated = unpinAlias(req.Alias)
+			log.Printf("alias %s: %d pinned conversations migrated", req.Alias, report.Migrated)
+		}
+	}
+	writeJSON(w, report)
+}
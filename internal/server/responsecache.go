@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CACHE_HEADER tells clients whether a cacheable completion was served from
+// the response cache (HIT) or generated (MISS).
+const CACHE_HEADER = "X-Cache"
+
+// Completions larger than this aren't cached
+const RESPONSE_CACHE_MAX_ENTRY_BYTES = 1 << 20
+
+// Keys in Redis are prefixed with this, so the cache can share a database
+const RESPONSE_CACHE_REDIS_PREFIX = "ollama-proxy:completion:"
+
+// How long a Redis command may take before the cache counts as a miss
+const RESPONSE_CACHE_REDIS_TIMEOUT = time.Second
+
+// cachedCompletion is what the cache keeps of a completion, enough to
+// answer both a plain and a streamed request.
+type cachedCompletion struct {
+	Content      string     `json:"content"`
+	Images       []string   `json:"images,omitempty"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason"`
+	Usage        Usage      `json:"usage"`
+}
+
+// cacheStore holds serialized completions until their TTL runs out.
+type cacheStore interface {
+	get(ctx context.Context, key string) ([]byte, bool, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+type responseCache struct {
+	store cacheStore
+	ttl   time.Duration
+}
+
+// completionCache is set at startup when response_cache.ttl is configured.
+var completionCache *responseCache
+
+func newResponseCache(c ResponseCacheConfig) *responseCache {
+	if c.TTL <= 0 {
+		return nil
+	}
+	cache := &responseCache{ttl: c.TTL, store: newMemoryCacheStore(c.MaxEntries)}
+	if c.RedisURL != "" {
+		cache.store = newRedisCacheStore(c.RedisURL)
+	}
+	return cache
+}
+
+// completionCacheKey is the hash of everything that decides what a request
+// generates: the upstream request of every attempt with its sampling
+// options, and the model name the response carries. Only deterministic
+// requests, at temperature 0 or with a seed, have one. Tenants don't share
+// entries.
+func completionCacheKey(tenant string, attempts []*upstreamAttempt) (string, bool) {
+	first := attempts[0].ollamaReq.Options
+	if !(first.Temperature != nil && *first.Temperature == 0) && first.Seed == nil {
+		return "", false
+	}
+	type keyedAttempt struct {
+		Request        OllamaRequest
+		Model          string
+		Provider       string
+		OpenAIMessages []ChatMessage
+		ToolChoice     any
+		ResponseFormat *ResponseFormat
+	}
+	keyed := make([]keyedAttempt, len(attempts))
+	for i, attempt := range attempts {
+		req := attempt.ollamaReq
+		// streamed and plain requests share entries
+		req.Stream = false
+		keyed[i] = keyedAttempt{req, attempt.openAIReq.Model, req.Provider, req.OpenAIMessages, req.ToolChoice, req.ResponseFormat}
+	}
+	data, err := json.Marshal(struct {
+		Tenant   string
+		Attempts []keyedAttempt
+	}{tenant, keyed})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// embeddingCacheKey is the hash of an embedding input. Embeddings don't
+// sample, so every input has one.
+func embeddingCacheKey(tenant, model, input string) string {
+	data, _ := json.Marshal([]string{"embedding", tenant, model, input})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the completion cached under key. A failing store is a miss.
+func (c *responseCache) get(ctx context.Context, key string) (*cachedCompletion, bool) {
+	data, ok, err := c.store.get(ctx, key)
+	if err != nil {
+		log.Printf("response cache: %v", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	var completion cachedCompletion
+	if err := json.Unmarshal(data, &completion); err != nil {
+		return nil, false
+	}
+	return &completion, true
+}
+
+func (c *responseCache) put(ctx context.Context, key string, completion cachedCompletion) {
+	data, err := json.Marshal(completion)
+	if err != nil || len(data) > RESPONSE_CACHE_MAX_ENTRY_BYTES {
+		return
+	}
+	if err := c.store.set(ctx, key, data, c.ttl); err != nil {
+		log.Printf("response cache: %v", err)
+	}
+}
+
+func (c *responseCache) getEmbedding(ctx context.Context, key string) ([]float64, bool) {
+	data, ok, err := c.store.get(ctx, key)
+	if err != nil {
+		log.Printf("response cache: %v", err)
+		return nil, false
+	}
+	var vector []float64
+	if !ok || json.Unmarshal(data, &vector) != nil {
+		return nil, false
+	}
+	return vector, true
+}
+
+func (c *responseCache) putEmbedding(ctx context.Context, key string, vector []float64) {
+	data, err := json.Marshal(vector)
+	if err != nil {
+		return
+	}
+	if err := c.store.set(ctx, key, data, c.ttl); err != nil {
+		log.Printf("response cache: %v", err)
+	}
+}
+
+// cacheBypassed reports whether the client asked for a fresh completion
+// with Cache-Control: no-cache. Its completion still refreshes the cache.
+func cacheBypassed(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// memoryCacheStore is an LRU of at most size entries.
+type memoryCacheStore struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newMemoryCacheStore(size int) *memoryCacheStore {
+	return &memoryCacheStore{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *memoryCacheStore) get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		s.order.Remove(elem)
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(elem)
+	return entry.value, true, nil
+}
+
+func (s *memoryCacheStore) set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &memoryCacheEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	if elem, ok := s.entries[key]; ok {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+// redisCacheStore keeps entries in Redis, so replicas of the proxy share
+// them and they survive restarts. It speaks just enough RESP for GET and
+// SET over one connection, dialed again after an error.
+type redisCacheStore struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// newRedisCacheStore takes a URL such as redis://:password@host:6379/0,
+// checked by the config validation.
+func newRedisCacheStore(rawURL string) *redisCacheStore {
+	u, _ := url.Parse(rawURL)
+	s := &redisCacheStore{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	s.password, _ = u.User.Password()
+	s.db, _ = strconv.Atoi(strings.TrimPrefix(u.Path, "/"))
+	return s
+}
+
+func (s *redisCacheStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", RESPONSE_CACHE_REDIS_PREFIX+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	return reply, true, nil
+}
+
+func (s *redisCacheStore) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(ctx, "SET", RESPONSE_CACHE_REDIS_PREFIX+key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// do sends a command and returns its reply, nil for a nil reply.
+func (s *redisCacheStore) do(ctx context.Context, args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(RESPONSE_CACHE_REDIS_TIMEOUT))
+	reply, err := s.roundTrip(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// the connection is in an unknown state
+		s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+func (s *redisCacheStore) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: RESPONSE_CACHE_REDIS_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(RESPONSE_CACHE_REDIS_TIMEOUT))
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := s.roundTrip("AUTH", s.password); err != nil {
+			conn.Close()
+			s.conn = nil
+			return fmt.Errorf("Redis AUTH failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			s.conn = nil
+			return fmt.Errorf("Redis SELECT failed: %w", err)
+		}
+	}
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (s *redisCacheStore) roundTrip(args ...string) ([]byte, error) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := s.conn.Write([]byte(cmd.String())); err != nil {
+		return nil, err
+	}
+
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty Redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(s.rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected Redis reply %q", line)
+}
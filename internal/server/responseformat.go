@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func validateResponseFormat(format *ResponseFormat) error {
+	if format == nil {
+		return nil
+	}
+	switch format.Type {
+	case "text", "json_object":
+		return nil
+	case "json_schema":
+		var schema map[string]any
+		if format.JSONSchema == nil || json.Unmarshal(format.JSONSchema.Schema, &schema) != nil {
+			return &apiError{
+				status: http.StatusBadRequest, errorType: "invalid_request_error", code: "invalid_response_format",
+				param: "response_format.json_schema", format: "response_format.json_schema.schema must be a JSON schema object",
+			}
+		}
+		return nil
+	}
+	return &apiError{
+		status: http.StatusBadRequest, errorType: "invalid_request_error", code: "invalid_response_format",
+		param: "response_format.type", format: "Unsupported response_format type `%s`", args: []any{format.Type},
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often usage files are checked against the retention config
+const RETENTION_INTERVAL = time.Hour
+
+// PurgeRequest selects the usage records POST /admin/purge deletes. Every
+// field that is set must match; at least one of them must be.
+type PurgeRequest struct {
+	Tenant string `json:"tenant,omitempty"`
+	// the records of a key by its usageKeyHash, which needs
+	// usage_key_secret
+	APIKey  string `json:"api_key,omitempty"`
+	KeyName string `json:"key_name,omitempty"`
+	KeyHash string `json:"key_hash,omitempty"`
+	// records from this time on, and before To
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+}
+
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (p PurgeRequest) matches(record *UsageRecord) bool {
+	return (p.Tenant == "" || p.Tenant == record.Tenant) &&
+		(p.KeyName == "" || p.KeyName == record.KeyName) &&
+		(p.KeyHash == "" || p.KeyHash == record.KeyHash) &&
+		(p.From == nil || !record.Time.Before(*p.From)) &&
+		(p.To == nil || record.Time.Before(*p.To))
+}
+
+// runRetention enforces the retention config every RETENTION_INTERVAL,
+// starting right away.
+func runRetention() {
+	for {
+		enforceRetention(time.Now())
+		time.Sleep(RETENTION_INTERVAL)
+	}
+}
+
+// enforceRetention removes prompts and responses older than
+// retention.requests_days and records older than retention.usage_days from
+// the usage records.
+func enforceRetention(now time.Time) {
+	days := func(n int) time.Time { return now.AddDate(0, 0, -n) }
+	changed, err := updateUsage(func(record *UsageRecord) bool {
+		if config.Retention.UsageDays > 0 && record.Time.Before(days(config.Retention.UsageDays)) {
+			return false
+		}
+		if config.Retention.RequestsDays > 0 && record.Time.Before(days(config.Retention.RequestsDays)) {
+			record.Prompt, record.Response = "", ""
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("failed to enforce retention: %v", err)
+	}
+	if changed > 0 {
+		log.Printf("retention: removed or trimmed %d usage records", changed)
+	}
+}
+
+// updateUsage passes every usage record to keep, see Store.UpdateUsage, in
+// the storage or else in the usage file of every tenant.
+func updateUsage(keep func(*UsageRecord) bool) (int, error) {
+	if dataStore != nil {
+		return dataStore.UpdateUsage(context.Background(), keep)
+	}
+	total := 0
+	for _, t := range tenants {
+		changed, err := t.rewriteUsage(keep)
+		total += changed
+		if err != nil {
+			return total, fmt.Errorf("usage file of tenant %s: %w", t.name, err)
+		}
+	}
+	return total, nil
+}
+
+// rewriteUsage passes every record of the usage file to keep, which may
+// change it, and writes the file anew without the ones it returns false
+// for. Lines that aren't records are kept as they are, records with an
+// api_key get its usageKeyHash instead. It returns how many records were
+// removed or changed.
+func (t *tenant) rewriteUsage(keep func(*UsageRecord) bool) (int, error) {
+	if t.usage == nil {
+		return 0, nil
+	}
+	t.usageMu.Lock()
+	defer t.usageMu.Unlock()
+
+	data, err := os.ReadFile(t.usageFile)
+	if err != nil {
+		return 0, err
+	}
+	var out bytes.Buffer
+	changed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var record UsageRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+		// records from before key_hash have the key itself
+		var legacy struct {
+			APIKey string `json:"api_key"`
+		}
+		if bytes.Contains(line, []byte(`"api_key"`)) {
+			json.Unmarshal(line, &legacy)
+		}
+		if legacy.APIKey != "" && record.KeyHash == "" {
+			record.KeyHash = usageKeyHash(legacy.APIKey)
+		}
+		before := record
+		if !keep(&record) {
+			changed++
+			continue
+		}
+		if record != before || legacy.APIKey != "" {
+			changed++
+			if line, err = json.Marshal(record); err != nil {
+				return 0, err
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	// replace the file in one go, so a crash never leaves half of it
+	tmp, err := os.CreateTemp(filepath.Dir(t.usageFile), filepath.Base(t.usageFile)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if info, err := os.Stat(t.usageFile); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err := os.Rename(tmp.Name(), t.usageFile); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(t.usageFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reopen usage file: %w", err)
+	}
+	t.usage.Close()
+	t.usage = f
+	return changed, nil
+}
+
+// hashUsageFileKeys rewrites the usage files that have API keys in their
+// records, from before records kept their key_hash instead.
+func hashUsageFileKeys() error {
+	if dataStore != nil {
+		return nil
+	}
+	changed, err := updateUsage(func(*UsageRecord) bool { return true })
+	if changed > 0 {
+		log.Printf("replaced the API keys of %d usage records by their key_hash", changed)
+	}
+	return err
+}
+
+// handleAdminPurge deletes usage records by tenant, API key and time range,
+// e.g. to honor a deletion request.
+func handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PurgeRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	if req == (PurgeRequest{}) {
+		sendError(w, r, "Select records by tenant, api_key, key_name, key_hash, from or to", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	if req.APIKey != "" {
+		// records only have the key's hash
+		hash := usageKeyHash(req.APIKey)
+		if hash == "" {
+			sendError(w, r, "Usage records identify keys by key_name without usage_key_secret", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+			return
+		}
+		if req.KeyHash != "" && req.KeyHash != hash {
+			writeJSON(w, PurgeResponse{})
+			return
+		}
+		req.APIKey, req.KeyHash = "", hash
+	}
+
+	purged, err := updateUsage(func(record *UsageRecord) bool { return !req.matches(record) })
+	if err != nil {
+		log.Printf("failed to purge usage records: %v", err)
+		sendError(w, r, "Failed to purge usage records", "server_error", "purge_failed", http.StatusInternalServerError)
+		return
+	}
+	resp := PurgeResponse{Purged: purged}
+	log.Printf("purged %d usage records", resp.Purged)
+	writeJSON(w, resp)
+}
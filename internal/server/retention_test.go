@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKey    = "sk-test-0f3c9a"
+	testSecret = "usage-secret"
+)
+
+func TestUsageKeyHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		key    string
+		empty  bool
+	}{
+		{"no secret", "", testKey, true},
+		{"no key", testSecret, "", true},
+		{"secret and key", testSecret, testKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{UsageKeySecret: tt.secret})
+			hash := usageKeyHash(tt.key)
+			if (hash == "") != tt.empty {
+				t.Fatalf("usageKeyHash(%q) = %q, want empty: %t", tt.key, hash, tt.empty)
+			}
+			if hash != "" && (strings.Contains(hash, tt.key) || !strings.HasPrefix(hash, "hmac-sha256:")) {
+				t.Errorf("usageKeyHash(%q) = %q, want an hmac-sha256: hash without the key", tt.key, hash)
+			}
+		})
+	}
+
+	setConfig(t, Config{UsageKeySecret: testSecret})
+	if usageKeyHash(testKey) == usageKeyHash("sk-other") {
+		t.Error("different keys hash alike")
+	}
+	hash := usageKeyHash(testKey)
+	config.UsageKeySecret = "another-secret"
+	if usageKeyHash(testKey) == hash {
+		t.Error("the hash doesn't depend on usage_key_secret")
+	}
+}
+
+func TestRecordUsageKeepsNoAPIKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		keys     []APIKey
+		apiKey   string
+		wantName string
+		wantHash bool
+	}{
+		{"named key", "", []APIKey{{Key: testKey, Name: "team-a"}}, testKey, "team-a", false},
+		{"named key with secret", testSecret, []APIKey{{Key: testKey, Name: "team-a"}}, testKey, "team-a", true},
+		{"unnamed key with secret", testSecret, []APIKey{{Key: testKey}}, testKey, "", true},
+		{"unnamed key", "", []APIKey{{Key: testKey}}, testKey, "", false},
+		{"no keys configured", testSecret, nil, testKey, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{UsageKeySecret: tt.secret}, tt.keys...)
+			store := newMemoryStore()
+			dataStore = store
+			(&tenant{name: "team"}).recordUsage(context.Background(), tt.apiKey, "llama3", Usage{PromptTokens: 3, TotalTokens: 3}, "", "")
+
+			if len(store.usage) != 1 {
+				t.Fatalf("%d usage records stored, want 1", len(store.usage))
+			}
+			record := store.usage[0]
+			if record.KeyName != tt.wantName {
+				t.Errorf("KeyName = %q, want %q", record.KeyName, tt.wantName)
+			}
+			if want := usageKeyHash(tt.apiKey); tt.wantHash && record.KeyHash != want || !tt.wantHash && record.KeyHash != "" {
+				t.Errorf("KeyHash = %q, want hash: %t", record.KeyHash, tt.wantHash)
+			}
+			line, _ := json.Marshal(record)
+			if strings.Contains(string(line), tt.apiKey) {
+				t.Errorf("record %s contains the API key", line)
+			}
+		})
+	}
+}
+
+func TestRewriteUsageHashesLegacyKeys(t *testing.T) {
+	setConfig(t, Config{UsageKeySecret: testSecret})
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	lines := `{"time":"2026-01-01T00:00:00Z","tenant":"team","api_key":"` + testKey + `","key_name":"team-a","model":"llama3","total_tokens":3}
+not a record
+{"time":"2026-01-02T00:00:00Z","tenant":"team","key_name":"team-b","model":"llama3","total_tokens":5}
+`
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := &tenant{name: "team", usage: f, usageFile: path}
+	t.Cleanup(func() { tn.usage.Close() })
+
+	changed, err := tn.rewriteUsage(func(*UsageRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 1 {
+		t.Errorf("rewriteUsage changed %d records, want 1", changed)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), testKey) || strings.Contains(string(data), `"api_key"`) {
+		t.Errorf("usage file still has the API key:\n%s", data)
+	}
+	if !strings.Contains(string(data), usageKeyHash(testKey)) {
+		t.Errorf("usage file lacks the key_hash of the API key:\n%s", data)
+	}
+	if !strings.Contains(string(data), "not a record\n") {
+		t.Errorf("usage file lost a line that isn't a record:\n%s", data)
+	}
+
+	// purging by the key finds the rewritten record
+	purge := PurgeRequest{KeyHash: usageKeyHash(testKey)}
+	changed, err = tn.rewriteUsage(func(r *UsageRecord) bool { return !purge.matches(r) })
+	if err != nil || changed != 1 {
+		t.Errorf("purge by key_hash removed %d records (%v), want 1", changed, err)
+	}
+}
+
+func TestHandleAdminPurge(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name       string
+		secret     string
+		body       string
+		wantStatus int
+		wantPurged int
+	}{
+		{"nothing selected", testSecret, `{}`, http.StatusBadRequest, 0},
+		{"by key name", testSecret, `{"key_name": "team-a"}`, http.StatusOK, 2},
+		{"by api key", testSecret, `{"api_key": "` + testKey + `"}`, http.StatusOK, 2},
+		{"by unknown api key", testSecret, `{"api_key": "sk-unknown"}`, http.StatusOK, 0},
+		{"by api key without secret", "", `{"api_key": "` + testKey + `"}`, http.StatusBadRequest, 0},
+		{"by api key and another hash", testSecret, `{"api_key": "` + testKey + `", "key_hash": "hmac-sha256:00"}`, http.StatusOK, 0},
+		{"by tenant and time", testSecret, `{"tenant": "team", "from": "2026-01-02T00:00:00Z", "to": "2026-01-03T00:00:00Z"}`, http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{UsageKeySecret: tt.secret})
+			store := newMemoryStore()
+			dataStore = store
+			for i, record := range []UsageRecord{
+				{Time: day(1), Tenant: "team", KeyName: "team-a", KeyHash: usageKeyHash(testKey)},
+				{Time: day(2), Tenant: "team", KeyName: "team-a", KeyHash: usageKeyHash(testKey)},
+				{Time: day(3), Tenant: "team", KeyName: "team-b", KeyHash: usageKeyHash("sk-other")},
+			} {
+				record.Model = "llama3"
+				record.TotalTokens = i
+				store.AppendUsage(context.Background(), record)
+			}
+
+			w := httptest.NewRecorder()
+			handleAdminPurge(w, httptest.NewRequest(http.MethodPost, "/admin/purge", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp PurgeResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Purged != tt.wantPurged || len(store.usage) != 3-tt.wantPurged {
+				t.Errorf("purged %d, %d records left, want %d purged", resp.Purged, len(store.usage), tt.wantPurged)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Upstream statuses worth retrying: Ollama answers 503 while it is busy or
+// still starting, proxies in front of it 502 and 504
+var RETRY_STATUS_CODES = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// Longest wait between two attempts, Retry-After included
+const RETRY_MAX_BACKOFF = 10 * time.Second
+
+// retryUpstream calls do until it gets an answer that isn't transient, as
+// often as upstream.max_retries allows, waiting upstream.retry_backoff
+// doubled for every retry and jittered in between. Only calls that haven't
+// produced anything yet are retried, so do must start a fresh request every
+// time. The last answer is returned as it is, whatever it is.
+func retryUpstream(ctx context.Context, model string, do func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := do()
+		if attempt >= config.Upstream.MaxRetries || ctx.Err() != nil || !transientUpstreamFailure(resp, err) {
+			return resp, err
+		}
+
+		backoff := config.Upstream.RetryBackoff << attempt
+		// half of it fixed, half random, so clients that failed together
+		// don't all come back at once
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		reason := "connection failed"
+		if err == nil {
+			reason = resp.Status
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				backoff = time.Duration(seconds) * time.Second
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		backoff = min(backoff, RETRY_MAX_BACKOFF)
+		metrics.upstreamRetries.add(1, model)
+		tenantFromContext(ctx).logger.Printf("upstream call for %s: %s, retrying in %s (retry %d of %d)", model, reason, backoff.Round(time.Millisecond), attempt+1, config.Upstream.MaxRetries)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// transientUpstreamFailure reports whether a call failed in a way that
+// should pass, such as Ollama restarting or loading a model.
+func transientUpstreamFailure(resp *http.Response, err error) bool {
+	if err == nil {
+		return RETRY_STATUS_CODES[resp.StatusCode]
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// RewriteRule adjusts matching requests before presets and routing apply.
+// Empty match fields match anything; Model and header values are globs.
+// The rewrite_rules of the config file are evaluated in order and every
+// matching rule applies, so a rule sees the model as swapped by the rules
+// before it.
+type RewriteRule struct {
+	Model   string            `yaml:"model"`
+	APIKey  string            `yaml:"api_key"`
+	Headers map[string]string `yaml:"headers"`
+
+	// Set and Remove work on top-level request fields, e.g. "temperature".
+	Set            map[string]any `yaml:"set"`
+	Remove         []string       `yaml:"remove"`
+	SwapModel      string         `yaml:"swap_model"`
+	InjectMessages []ChatMessage  `yaml:"inject_messages"` // prepended to the conversation
+}
+
+type compiledRewriteRule struct {
+	RewriteRule
+	model   *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// rewriteRules are the compiled rewrite_rules, see setup.
+var rewriteRules []compiledRewriteRule
+
+func compileRewriteRules(rules []RewriteRule) []compiledRewriteRule {
+	compiled := make([]compiledRewriteRule, 0, len(rules))
+	for _, rule := range rules {
+		c := compiledRewriteRule{RewriteRule: rule, headers: make(map[string]*regexp.Regexp)}
+		if rule.Model != "" {
+			c.model = compileGlobPatterns([]string{rule.Model})[0]
+		}
+		for name, value := range rule.Headers {
+			c.headers[name] = compileGlobPatterns([]string{value})[0]
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled
+}
+
+func (rule compiledRewriteRule) matches(body map[string]any, r *http.Request) bool {
+	if rule.model != nil {
+		model, _ := body["model"].(string)
+		if !rule.model.MatchString(model) {
+			return false
+		}
+	}
+	if rule.APIKey != "" && rule.APIKey != apiKeyFromRequest(r) {
+		return false
+	}
+	for name, re := range rule.headers {
+		if !re.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRewriteRules rewrites a decoded request body in place.
+func applyRewriteRules(body map[string]any, r *http.Request) error {
+	for _, rule := range rewriteRules {
+		if !rule.matches(body, r) {
+			continue
+		}
+		for _, key := range rule.Remove {
+			delete(body, key)
+		}
+		for key, value := range rule.Set {
+			body[key] = value
+		}
+		if rule.SwapModel != "" {
+			body["model"] = rule.SwapModel
+		}
+		if len(rule.InjectMessages) > 0 {
+			var injected []any
+			if err := remarshal(rule.InjectMessages, &injected); err != nil {
+				return err
+			}
+			messages, _ := body["messages"].([]any)
+			body["messages"] = append(injected, messages...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// RoutePolicy switches the optional middlewares of a route on or off, from
+// routes in the config file or Listener.Routes, keyed by the route as
+// metrics label it (e.g. /v1/embeddings, /v1/models/{id}). Unset fields
+// leave a middleware on; a listener's policy wins over the config's.
+type RoutePolicy struct {
+	// API key check, requests are then rate limited by client address
+	Auth *bool `yaml:"auth"`
+	// request and token rate limits
+	RateLimit *bool `yaml:"rate_limit"`
+	// output_filter and its classifier
+	Guardrails *bool `yaml:"guardrails"`
+	// response cache, see response_cache
+	Cache *bool `yaml:"cache"`
+}
+
+// routeFeatures are the middlewares in effect for a request.
+type routeFeatures struct {
+	auth       bool
+	rateLimit  bool
+	guardrails bool
+	cache      bool
+}
+
+type routeContextKey struct{}
+
+type listenerRoutesContextKey struct{}
+
+// withRoute records the route a request matched.
+func withRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, route)
+}
+
+// listenerRoutesMiddleware makes the route policies of a listener apply to
+// its requests.
+func listenerRoutesMiddleware(routes map[string]RoutePolicy, next http.Handler) http.Handler {
+	if len(routes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerRoutesContextKey{}, routes)))
+	})
+}
+
+// routeFeaturesFor merges the policies of the request's route. Work that
+// isn't a request, without a route, gets every middleware.
+func routeFeaturesFor(ctx context.Context) routeFeatures {
+	features := routeFeatures{auth: true, rateLimit: true, guardrails: true, cache: true}
+	route, ok := ctx.Value(routeContextKey{}).(string)
+	if !ok {
+		return features
+	}
+	apply := func(p RoutePolicy) {
+		set := func(feature *bool, value *bool) {
+			if value != nil {
+				*feature = *value
+			}
+		}
+		set(&features.auth, p.Auth)
+		set(&features.rateLimit, p.RateLimit)
+		set(&features.guardrails, p.Guardrails)
+		set(&features.cache, p.Cache)
+	}
+	apply(config.Routes[route])
+	if routes, ok := ctx.Value(listenerRoutesContextKey{}).(map[string]RoutePolicy); ok {
+		apply(routes[route])
+	}
+	return features
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"slices"
+)
+
+// addModelStopTokens appends the Modelfile stop tokens of each Ollama
+// attempt to the client's stop sequences. A stop option replaces the
+// Modelfile's list in Ollama, and without them the model runs on past the
+// end of its turn.
+func addModelStopTokens(ctx context.Context, attempts []*upstreamAttempt) {
+	for _, attempt := range attempts {
+		req := &attempt.ollamaReq
+		if len(req.Options.Stop) == 0 || providerFor(*req).Type != PROVIDER_OLLAMA {
+			continue
+		}
+		info, err := showModel(ctx, req.Model)
+		if err != nil {
+			continue
+		}
+		stops := slices.Clone(req.Options.Stop)
+		for _, token := range info.stopTokens() {
+			if !slices.Contains(stops, token) {
+				stops = append(stops, token)
+			}
+		}
+		req.Options.Stop = stops
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
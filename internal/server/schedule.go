@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // schedules name time zones, don't depend on the host's zoneinfo
+)
+
+// Schedule is a recurring time window. Days and Dates narrow it down to
+// weekdays ("mon" or "monday") or calendar dates ("2025-12-24"), empty
+// means every day. From and To are "15:04" times of day in Timezone
+// (default: local); a window with To before From runs over midnight, and
+// empty ones cover the whole day.
+type Schedule struct {
+	Days     []string `yaml:"days"`
+	Dates    []string `yaml:"dates"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	Timezone string   `yaml:"timezone"`
+}
+
+// ScheduleRule applies to the models matching Model while its schedule is
+// active, from schedule_rules in the config file: Target reroutes them
+// (provider prefixes work), a non-zero MaxTokens caps max_tokens and a
+// non-zero RequestsPerMinute limits each API key's requests for them.
+// The first active rule for a model applies.
+type ScheduleRule struct {
+	// glob of the model after aliases and presets
+	Model     string   `yaml:"model"`
+	Schedule  Schedule `yaml:"schedule"`
+	Target    string   `yaml:"target"`
+	MaxTokens int      `yaml:"max_tokens"`
+	// requests without a key share one budget
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+}
+
+type compiledScheduleRule struct {
+	ScheduleRule
+	model    *regexp.Regexp
+	days     []time.Weekday
+	location *time.Location
+	from     time.Duration
+	to       time.Duration
+
+	// RequestsPerMinute budgets by API key
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+// scheduleRules are the compiled schedule_rules, see setup.
+var scheduleRules []*compiledScheduleRule
+
+// compileScheduleRule checks rule and prepares it for matching; validate
+// reports its error.
+func compileScheduleRule(rule ScheduleRule) (*compiledScheduleRule, error) {
+	if rule.Model == "" {
+		return nil, errors.New("names no model")
+	}
+	if rule.Target == "" && rule.MaxTokens == 0 && rule.RequestsPerMinute == 0 {
+		return nil, errors.New("sets no target, max_tokens or requests_per_minute")
+	}
+	if rule.MaxTokens < 0 || rule.RequestsPerMinute < 0 {
+		return nil, errors.New("max_tokens and requests_per_minute must not be negative")
+	}
+	c := &compiledScheduleRule{
+		ScheduleRule: rule,
+		model:        compileGlobPatterns([]string{rule.Model})[0],
+		location:     time.Local,
+		limiters:     make(map[string]*rateLimiter),
+	}
+	if rule.Schedule.Timezone != "" {
+		location, err := time.LoadLocation(rule.Schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", rule.Schedule.Timezone)
+		}
+		c.location = location
+	}
+	for _, name := range rule.Schedule.Days {
+		day, ok := parseWeekday(name)
+		if !ok {
+			return nil, fmt.Errorf("day %q is not a weekday such as mon or monday", name)
+		}
+		c.days = append(c.days, day)
+	}
+	for _, date := range rule.Schedule.Dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("date %q is not a date such as 2025-12-24", date)
+		}
+	}
+	var err error
+	if c.from, err = parseTimeOfDay(rule.Schedule.From, 0); err != nil {
+		return nil, err
+	}
+	if c.to, err = parseTimeOfDay(rule.Schedule.To, 24*time.Hour); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+func parseTimeOfDay(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not a time of day such as 08:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (c *compiledScheduleRule) active(now time.Time) bool {
+	now = now.In(c.location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, c.location)
+	offset := now.Sub(midnight)
+
+	// an overnight window belongs to the day it started on
+	day := now
+	inWindow := offset >= c.from && offset < c.to
+	if c.to < c.from {
+		inWindow = offset >= c.from || offset < c.to
+		if offset < c.to {
+			day = now.AddDate(0, 0, -1)
+		}
+	}
+	if !inWindow {
+		return false
+	}
+	if len(c.days) > 0 && !slices.Contains(c.days, day.Weekday()) {
+		return false
+	}
+	if len(c.Schedule.Dates) > 0 && !slices.Contains(c.Schedule.Dates, day.Format("2006-01-02")) {
+		return false
+	}
+	return true
+}
+
+// allow takes a request of apiKey from the rule's RequestsPerMinute, or
+// fails with a 429 once the key used it up. A nil rule allows everything.
+func (c *compiledScheduleRule) allow(apiKey string) *apiError {
+	if c == nil || c.RequestsPerMinute == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	limiter, ok := c.limiters[apiKey]
+	if !ok {
+		limiter = newRateLimiter(c.RequestsPerMinute, time.Minute)
+		c.limiters[apiKey] = limiter
+	}
+	c.mu.Unlock()
+	if _, ok := limiter.allow(); !ok {
+		return newAPIError(http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "Rate limit of %d requests per minute reached", c.RequestsPerMinute)
+	}
+	return nil
+}
+
+// applyScheduleRules reroutes and limits req by the first schedule rule
+// active for its model at now, and returns that rule, nil for none. Its
+// RequestsPerMinute is left to the caller, see allow.
+func applyScheduleRules(req *OpenAIChatRequest, now time.Time) *compiledScheduleRule {
+	for _, rule := range scheduleRules {
+		if !rule.model.MatchString(req.Model) || !rule.active(now) {
+			continue
+		}
+		if rule.Target != "" {
+			req.Model = rule.Target
+		}
+		if rule.MaxTokens > 0 && (req.MaxTokens == 0 || req.MaxTokens > rule.MaxTokens) {
+			req.MaxTokens = rule.MaxTokens
+		}
+		return rule
+	}
+	return nil
+}
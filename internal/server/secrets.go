@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefixes of secret references, which config values holding secrets may
+// be instead of the secret itself:
+//
+//	file:/run/secrets/admin-key        contents of a file, e.g. a mounted secret
+//	vault:secret/data/proxy#admin_key  field of a Vault KV (v1 or v2) secret
+//	aws-sm:proxy/admin#key             AWS Secrets Manager secret, or a field of
+//	                                   its JSON value
+const (
+	SECRET_FILE_PREFIX  = "file:"
+	SECRET_VAULT_PREFIX = "vault:"
+	SECRET_AWS_PREFIX   = "aws-sm:"
+)
+
+// Longest a secret manager may take to answer
+const SECRET_FETCH_TIMEOUT = 10 * time.Second
+
+var secretsClient = &http.Client{Timeout: SECRET_FETCH_TIMEOUT}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, SECRET_FILE_PREFIX) ||
+		strings.HasPrefix(value, SECRET_VAULT_PREFIX) ||
+		strings.HasPrefix(value, SECRET_AWS_PREFIX)
+}
+
+// resolveSecret returns the secret a reference points at, and any other
+// value as it is.
+func resolveSecret(ctx context.Context, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SECRET_FILE_PREFIX):
+		data, err := os.ReadFile(strings.TrimPrefix(value, SECRET_FILE_PREFIX))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(value, SECRET_VAULT_PREFIX):
+		return readVaultSecret(ctx, strings.TrimPrefix(value, SECRET_VAULT_PREFIX))
+	case strings.HasPrefix(value, SECRET_AWS_PREFIX):
+		return readAWSSecret(ctx, strings.TrimPrefix(value, SECRET_AWS_PREFIX))
+	}
+	return value, nil
+}
+
+// readVaultSecret reads "path#field" from Vault's HTTP API.
+func readVaultSecret(ctx context.Context, ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	if field == "" {
+		return "", fmt.Errorf("vault secret %s names no #field", path)
+	}
+	if config.Secrets.VaultAddr == "" {
+		return "", fmt.Errorf("vault secret %s needs secrets.vault_addr", path)
+	}
+	token, err := resolveSecret(ctx, config.Secrets.VaultToken)
+	if err != nil {
+		return "", fmt.Errorf("vault token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(config.Secrets.VaultAddr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s for %s", resp.Status, path)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid vault response for %s: %w", path, err)
+	}
+	data := body.Data
+	// KV v2 nests the secret in data.data next to its metadata
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %s", path, field)
+	}
+	return value, nil
+}
+
+// readAWSSecret reads "secret-id" or "secret-id#field" from AWS Secrets
+// Manager with the credentials of the AWS_* environment variables.
+func readAWSSecret(ctx context.Context, ref string) (string, error) {
+	id, field, _ := strings.Cut(ref, "#")
+	region := config.Secrets.AWSRegion
+	if region == "" {
+		return "", fmt.Errorf("aws secret %s needs secrets.aws_region", id)
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("aws secret %s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", id)
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, region, "secretsmanager", accessKey, secretKey, time.Now().UTC())
+
+	resp, err := secretsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("secrets manager answered %s for %s: %s", resp.Status, id, message)
+	}
+	var secret struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary []byte `json:"SecretBinary"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid secrets manager response for %s: %w", id, err)
+	}
+	value := secret.SecretString
+	if value == "" {
+		value = string(secret.SecretBinary)
+	}
+	if field == "" {
+		return value, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("aws secret %s is not a JSON object", id)
+	}
+	v, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("aws secret %s has no string field %s", id, field)
+	}
+	return v, nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to req.
+func signAWSRequest(req *http.Request, body []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// secretSources are the config values as written, secret references
+// included, which refreshSecrets resolves again.
+var secretSources struct {
+	adminKey  string
+	apiKeys   []APIKey
+	providers map[string]string
+	tlsCert   string
+	tlsKey    string
+}
+
+// adminKey is the current admin API key, see adminAPIKey.
+var adminKey atomic.Pointer[string]
+
+func adminAPIKey() string {
+	if key := adminKey.Load(); key != nil {
+		return *key
+	}
+	return config.AdminAPIKey
+}
+
+// providerKeys are the current API keys of the providers.
+var providerKeys = struct {
+	sync.RWMutex
+	keys map[string]string
+}{keys: make(map[string]string)}
+
+func providerAPIKey(name string) string {
+	providerKeys.RLock()
+	defer providerKeys.RUnlock()
+	if key, ok := providerKeys.keys[name]; ok {
+		return key
+	}
+	return config.Providers[name].APIKey
+}
+
+// tlsCertificate is the current certificate of the listeners, see
+// listenerTLSConfig.
+var tlsCertificate atomic.Pointer[tls.Certificate]
+
+// loadTLSCertificate resolves tls_cert and tls_key and parses the pair.
+func loadTLSCertificate(ctx context.Context) (*tls.Certificate, error) {
+	certPEM, err := resolveSecret(ctx, secretSources.tlsCert)
+	if err != nil {
+		return nil, fmt.Errorf("tls_cert: %w", err)
+	}
+	keyPEM, err := resolveSecret(ctx, secretSources.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("tls_key: %w", err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("tls_cert and tls_key: %w", err)
+	}
+	return &cert, nil
+}
+
+// listenerTLSConfig is the TLS config of the listeners, nil without
+// tls_cert. Each handshake gets the current certificate, so a refreshed one
+// takes effect without a restart.
+func listenerTLSConfig() *tls.Config {
+	if secretSources.tlsCert == "" {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsCertificate.Load(), nil
+		},
+	}
+}
+
+// setupSecrets resolves the secret references of the admin key, the API
+// keys and the provider keys in place, remembering them for
+// refreshSecrets, after adding the keys of keys_file. It also loads the
+// TLS certificate and resolves usage_key_secret, which stays as it is so
+// records keep matching. It runs before anything reads them.
+func setupSecrets() error {
+	if err := config.addFileKeys(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	secretSources.adminKey = config.AdminAPIKey
+	secretSources.apiKeys = slices.Clone(config.APIKeys[:len(config.APIKeys)-config.keysFromFile])
+	secretSources.providers = make(map[string]string)
+	for name, p := range config.Providers {
+		secretSources.providers[name] = p.APIKey
+	}
+	secretSources.tlsCert, secretSources.tlsKey = config.TLSCert, config.TLSKey
+
+	var err error
+	if config.AdminAPIKey, err = resolveSecret(ctx, config.AdminAPIKey); err != nil {
+		return fmt.Errorf("admin_api_key: %w", err)
+	}
+	if config.UsageKeySecret, err = resolveSecret(ctx, config.UsageKeySecret); err != nil {
+		return fmt.Errorf("usage_key_secret: %w", err)
+	}
+	if config.APIKeys, err = resolveAPIKeys(ctx, config.APIKeys); err != nil {
+		return err
+	}
+	for name, p := range config.Providers {
+		if p.APIKey, err = resolveSecret(ctx, p.APIKey); err != nil {
+			return fmt.Errorf("providers.%s.api_key: %w", name, err)
+		}
+		config.Providers[name] = p
+	}
+	if secretSources.tlsCert != "" {
+		cert, err := loadTLSCertificate(ctx)
+		if err != nil {
+			return err
+		}
+		tlsCertificate.Store(cert)
+	}
+	return nil
+}
+
+func resolveAPIKeys(ctx context.Context, keys []APIKey) ([]APIKey, error) {
+	resolved := slices.Clone(keys)
+	for i := range resolved {
+		key, err := resolveSecret(ctx, resolved[i].Key)
+		if err != nil {
+			return nil, fmt.Errorf("API key #%d (%s): %w", i+1, resolved[i].Name, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("API key #%d (%s) resolved to an empty key", i+1, resolved[i].Name)
+		}
+		resolved[i].Key = key
+	}
+	return resolved, nil
+}
+
+// needsSecretRefresh reports whether any secret can change while the proxy
+// runs: a secret reference or the keys file.
+func needsSecretRefresh() bool {
+	if config.KeysFile != "" || isSecretRef(secretSources.adminKey) || isSecretRef(secretSources.tlsCert) || isSecretRef(secretSources.tlsKey) {
+		return true
+	}
+	for _, k := range secretSources.apiKeys {
+		if isSecretRef(k.Key) {
+			return true
+		}
+	}
+	for _, key := range secretSources.providers {
+		if isSecretRef(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSecrets re-reads the keys file and resolves the secret references
+// every secrets.refresh_interval, so rotated secrets take effect without a
+// restart. A secret that fails to resolve keeps its previous value.
+func refreshSecrets() {
+	for {
+		time.Sleep(config.Secrets.RefreshInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), config.Secrets.RefreshInterval)
+		reloadSecrets(ctx)
+		cancel()
+	}
+}
+
+func reloadSecrets(ctx context.Context) {
+	if key, err := resolveSecret(ctx, secretSources.adminKey); err != nil {
+		log.Printf("failed to refresh admin_api_key: %v", err)
+	} else {
+		adminKey.Store(&key)
+	}
+
+	providerKeys.Lock()
+	for name, source := range secretSources.providers {
+		if key, err := resolveSecret(ctx, source); err != nil {
+			log.Printf("failed to refresh API key of provider %s: %v", name, err)
+		} else {
+			providerKeys.keys[name] = key
+		}
+	}
+	providerKeys.Unlock()
+
+	if secretSources.tlsCert != "" {
+		if cert, err := loadTLSCertificate(ctx); err != nil {
+			log.Printf("failed to refresh the TLS certificate: %v", err)
+		} else if !slices.EqualFunc(cert.Certificate, tlsCertificate.Load().Certificate, bytes.Equal) {
+			tlsCertificate.Store(cert)
+			log.Printf("refreshed the TLS certificate")
+		}
+	}
+
+	keys := secretSources.apiKeys
+	if config.KeysFile != "" {
+		fileKeys, err := loadKeysFile(config.KeysFile)
+		if err != nil {
+			log.Printf("failed to refresh API keys: %v", err)
+			return
+		}
+		keys = append(slices.Clone(keys), fileKeys...)
+	}
+	keys, err := resolveAPIKeys(ctx, keys)
+	if err != nil {
+		log.Printf("failed to refresh API keys: %v", err)
+		return
+	}
+	if apiKeys.replace(keys) {
+		log.Printf("refreshed API keys, %d configured", len(keys))
+	}
+}
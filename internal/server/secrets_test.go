@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setSecrets runs a test with cfg set up by setupSecrets and the API keys it
+// resolved, and puts back the secrets of before when it ends.
+func setSecrets(t *testing.T, cfg Config) {
+	t.Helper()
+	setConfig(t, cfg, cfg.APIKeys...)
+	oldSources, oldAdminKey := secretSources, adminKey.Load()
+	providerKeys.Lock()
+	oldProviderKeys := providerKeys.keys
+	providerKeys.keys = make(map[string]string)
+	providerKeys.Unlock()
+	t.Cleanup(func() {
+		secretSources = oldSources
+		adminKey.Store(oldAdminKey)
+		providerKeys.Lock()
+		providerKeys.keys = oldProviderKeys
+		providerKeys.Unlock()
+	})
+	adminKey.Store(nil)
+	if err := setupSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	apiKeys = newKeyStore(config.APIKeys)
+}
+
+func writeSecret(t *testing.T, path, value string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(t, filepath.Join(dir, "admin-key"), "sk-admin-from-file\n")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/proxy":
+			w.Write([]byte(`{"data": {"admin_key": "sk-admin-from-kv1"}}`))
+		case "/v1/secret/data/proxy":
+			w.Write([]byte(`{"data": {"data": {"admin_key": "sk-admin-from-kv2"}, "metadata": {"version": 3}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"SecretString": "{\"key\": \"sk-admin-from-aws\"}"}`))
+	}))
+	defer aws.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL_SECRETS_MANAGER", aws.URL)
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		// in the error, empty for none
+		wantErr string
+	}{
+		{"plain value", "sk-admin", "sk-admin", ""},
+		{"file", "file:" + filepath.Join(dir, "admin-key"), "sk-admin-from-file", ""},
+		{"missing file", "file:" + filepath.Join(dir, "missing"), "", "no such file"},
+		{"vault kv v1", "vault:secret/proxy#admin_key", "sk-admin-from-kv1", ""},
+		{"vault kv v2", "vault:secret/data/proxy#admin_key", "sk-admin-from-kv2", ""},
+		{"vault without field", "vault:secret/proxy", "", "names no #field"},
+		{"vault missing field", "vault:secret/proxy#other", "", "no string field other"},
+		{"vault missing secret", "vault:secret/other#admin_key", "", "404"},
+		{"aws field", "aws-sm:proxy/admin#key", "sk-admin-from-aws", ""},
+		{"aws whole secret", "aws-sm:proxy/admin", `{"key": "sk-admin-from-aws"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, Config{Secrets: SecretsConfig{VaultAddr: vault.URL, VaultToken: "vault-token", AWSRegion: "eu-west-1"}})
+			got, err := resolveSecret(context.Background(), tt.value)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("error %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error %v, want one with %q", err, tt.wantErr)
+			case got != tt.want:
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadSecrets(t *testing.T) {
+	tests := []struct {
+		name string
+		// the secret files before and after the refresh
+		before, after map[string]string
+		// keys accepted after the refresh, and the admin key
+		wantKeys     []string
+		wantRejected []string
+		wantAdminKey string
+	}{
+		{
+			"nothing changed",
+			map[string]string{"admin-key": "sk-admin-1", "team-key": "sk-team-1", "keys.yaml": "- key: sk-file-1\n"},
+			nil,
+			[]string{"sk-team-1", "sk-file-1"}, nil, "sk-admin-1",
+		},
+		{
+			"rotated",
+			map[string]string{"admin-key": "sk-admin-1", "team-key": "sk-team-1", "keys.yaml": "- key: sk-file-1\n"},
+			map[string]string{"admin-key": "sk-admin-2", "team-key": "sk-team-2", "keys.yaml": "- key: sk-file-2\n"},
+			[]string{"sk-team-2", "sk-file-2"}, []string{"sk-team-1", "sk-file-1"}, "sk-admin-2",
+		},
+		{
+			"keys file broken",
+			map[string]string{"admin-key": "sk-admin-1", "team-key": "sk-team-1", "keys.yaml": "- key: sk-file-1\n"},
+			map[string]string{"team-key": "sk-team-2", "keys.yaml": "- key: [\n"},
+			[]string{"sk-team-1", "sk-file-1"}, []string{"sk-team-2"}, "sk-admin-1",
+		},
+		{
+			"secret file gone",
+			map[string]string{"admin-key": "sk-admin-1", "team-key": "sk-team-1", "keys.yaml": "- key: sk-file-1\n"},
+			map[string]string{"admin-key": "", "team-key": ""},
+			[]string{"sk-team-1", "sk-file-1"}, nil, "sk-admin-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, value := range tt.before {
+				writeSecret(t, filepath.Join(dir, name), value)
+			}
+			cfg := DefaultConfig()
+			cfg.AdminAPIKey = "file:" + filepath.Join(dir, "admin-key")
+			cfg.APIKeys = []APIKey{{Key: "file:" + filepath.Join(dir, "team-key"), Name: "team"}}
+			cfg.KeysFile = filepath.Join(dir, "keys.yaml")
+			setSecrets(t, cfg)
+			if !needsSecretRefresh() {
+				t.Fatal("secret references and a keys file need no refresh")
+			}
+
+			for name, value := range tt.after {
+				if value == "" {
+					os.Remove(filepath.Join(dir, name))
+					continue
+				}
+				writeSecret(t, filepath.Join(dir, name), value)
+			}
+			reloadSecrets(context.Background())
+
+			for _, key := range tt.wantKeys {
+				if apiKeys.lookup(key) == nil {
+					t.Errorf("key %s rejected", key)
+				}
+			}
+			for _, key := range tt.wantRejected {
+				if apiKeys.lookup(key) != nil {
+					t.Errorf("key %s accepted", key)
+				}
+			}
+			if got := adminAPIKey(); got != tt.wantAdminKey {
+				t.Errorf("admin key %q, want %q", got, tt.wantAdminKey)
+			}
+		})
+	}
+}
+
+// Keys that survive a refresh keep their rate limit state.
+func TestReloadSecretsKeepsLimits(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret(t, filepath.Join(dir, "keys.yaml"), "- key: sk-file-1\n  requests_per_minute: 1\n")
+	cfg := DefaultConfig()
+	cfg.KeysFile = filepath.Join(dir, "keys.yaml")
+	setSecrets(t, cfg)
+	limits := apiKeys.lookup("sk-file-1").limits
+	limits.requests.allow()
+
+	writeSecret(t, filepath.Join(dir, "keys.yaml"), "- key: sk-file-1\n  requests_per_minute: 1\n- key: sk-file-2\n")
+	reloadSecrets(context.Background())
+	if apiKeys.lookup("sk-file-2") == nil {
+		t.Fatal("added key rejected")
+	}
+	if _, ok := apiKeys.lookup("sk-file-1").limits.requests.allow(); ok {
+		t.Error("a refresh reset the rate limit of a key that stayed")
+	}
+}
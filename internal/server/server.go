@@ -0,0 +1,550 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ollama-openai-proxy/translate"
+)
+
+const CONTENT_TYPE_JSON = "application/json"
+
+// Main runs the ollama-openai-proxy command: it reads the configuration
+// from os.Args, the environment and the config file, and serves every
+// listener until one fails.
+func Main() {
+	// subcommands take their own flags but still read the config file and
+	// environment, for the listen address and admin key
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && (args[0] == "top" || args[0] == "test" || args[0] == "decrypt") {
+		command, args = args[0], nil
+	}
+	cfg, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config = cfg
+	if err := setupSecrets(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "top":
+		runTop(os.Args[2:])
+		return
+	case "test":
+		runFixtures(os.Args[2:])
+		return
+	case "decrypt":
+		runDecrypt()
+		return
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+	}
+	mux := routes()
+
+	listeners := config.Listeners
+	if len(listeners) == 0 {
+		listeners = []Listener{{Addr: config.ListenAddr}}
+	}
+
+	errs := make(chan error, len(listeners)+1)
+	if config.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", handleMetrics)
+		server := &http.Server{Addr: config.MetricsAddr, Handler: metricsMux, ReadHeaderTimeout: config.ReadHeaderTimeout}
+		log.Printf("Serving metrics on %s", config.MetricsAddr)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	listenerTenants := make([]*tenant, len(listeners))
+	for i, l := range listeners {
+		if listenerTenants[i], err = openTenant(l); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := start(); err != nil {
+		log.Fatal(err)
+	}
+	for i, l := range listeners {
+		t := listenerTenants[i]
+		t.logger.Printf("Starting server on %s", l.Addr)
+		server := &http.Server{
+			Addr:              l.Addr,
+			Handler:           listenerHandler(l, t, mux),
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			TLSConfig:         listenerTLSConfig(),
+		}
+		go func() {
+			if server.TLSConfig != nil {
+				// the certificate comes from GetCertificate
+				errs <- server.ListenAndServeTLS("", "")
+				return
+			}
+			errs <- server.ListenAndServe()
+		}()
+	}
+	log.Fatal(<-errs)
+}
+
+// New sets up the proxy for cfg and returns the handler of its routes, as
+// served on listen_addr, for programs that embed the proxy instead of
+// running the command. listeners, metrics_addr and serving tls_cert, see
+// TLSConfig, are left to the caller.
+// The proxy keeps its state in package variables, so a program runs one.
+func New(cfg Config) (http.Handler, error) {
+	sources := make(map[string]string)
+	for _, s := range settings {
+		sources[s.key] = "Config"
+	}
+	for _, key := range fileSettings {
+		sources[key] = "Config"
+	}
+	if err := cfg.validate(sources); err != nil {
+		return nil, err
+	}
+	config = cfg
+	if err := setupSecrets(); err != nil {
+		return nil, err
+	}
+	if err := setup(); err != nil {
+		return nil, err
+	}
+	l := Listener{Addr: config.ListenAddr}
+	t, err := openTenant(l)
+	if err != nil {
+		return nil, err
+	}
+	if err := start(); err != nil {
+		return nil, err
+	}
+	return listenerHandler(l, t, routes()), nil
+}
+
+// TLSConfig is the TLS config the command serves tls_cert with, for
+// programs that serve the handler of New; nil without tls_cert.
+func TLSConfig() *tls.Config {
+	return listenerTLSConfig()
+}
+
+// setup creates what handlers use from the configuration: logging,
+// clients, stores and keys.
+func setup() error {
+	if err := setupLogging(config.Log); err != nil {
+		return err
+	}
+	spanTracer = newTracer(config.Tracing)
+	upstreamClient = newUpstreamClient(config.Upstream)
+	ollamaBackends = newBackendPool(backendTiers())
+	apiKeys = newKeyStore(config.APIKeys)
+	completionCache = newResponseCache(config.ResponseCache)
+	setupPolicies()
+	var err error
+	if dataStore, err = openStore(config.Storage); err != nil {
+		return err
+	}
+	if config.Signing.KeyFile != "" {
+		if signer, err = loadResponseSigner(config.Signing.KeyFile, config.Signing.KeyID); err != nil {
+			return err
+		}
+	}
+	if config.VectorStore.Path != "" {
+		if vectorIndex, err = openVectorStore(config.VectorStore.Path); err != nil {
+			return err
+		}
+	}
+	if config.EmbeddingJobsDir != "" {
+		if err := os.MkdirAll(config.EmbeddingJobsDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create the embedding jobs directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupPolicies compiles the request policies of the configuration, which
+// validate checked.
+func setupPolicies() {
+	scheduleRules = nil
+	for _, rule := range config.ScheduleRules {
+		compiled, _ := compileScheduleRule(rule)
+		scheduleRules = append(scheduleRules, compiled)
+	}
+	modelAliases, _ = compileModelAliases(config.ModelAliases.Patterns)
+	allowedModelPatterns = compileGlobPatterns(config.ModelAllowlist)
+	deniedModelPatterns = compileGlobPatterns(config.ModelDenylist)
+	rewriteRules = compileRewriteRules(config.RewriteRules)
+	parameterLimitPatterns = compileParameterLimitPatterns(config.ParameterLimits)
+	generationSlots = newGenerationQueue(config.MaxConcurrentGenerations, config.MaxQueuedGenerations)
+	modelSlots = newModelQueues(config.ModelConcurrency)
+	stopPatterns, _ = compileStopRegexes(config.StopRegexes)
+	alternatingRoleModels = compileGlobPatterns(config.AlternatingRoleModels)
+	systemMessageRules = compileSystemMessageRules(config.SystemMessageRules)
+	outputFilterPatterns = compileCategoryPatterns(config.OutputFilter)
+	outputFilterLookahead = longestEntry(config.OutputFilter)
+}
+
+// start opens the tenants of organizations, sets up content encryption
+// once every tenant is open, and starts the background jobs.
+func start() error {
+	if err := openOrganizationTenants(); err != nil {
+		return err
+	}
+	if err := setupEncryption(); err != nil {
+		return err
+	}
+	if err := hashUsageFileKeys(); err != nil {
+		return err
+	}
+	if config.Secrets.RefreshInterval > 0 && needsSecretRefresh() {
+		go refreshSecrets()
+	}
+	if config.Retention.RequestsDays > 0 || config.Retention.UsageDays > 0 {
+		go runRetention()
+	}
+	if config.Eval.SamplePercent > 0 && config.Eval.JudgeModel != "" {
+		go runEvalJudge()
+	}
+	if config.EmbeddingJobsDir != "" {
+		restoreEmbeddingJobs()
+	}
+	return nil
+}
+
+// listenerHandler serves mux on listener l for its tenant t.
+func listenerHandler(l Listener, t *tenant, mux http.Handler) http.Handler {
+	return tenantMiddleware(t, tracingMiddleware(requestLogMiddleware(signingMiddleware(listenerRoutesMiddleware(l.Routes, mux)))))
+}
+
+// routes is every endpoint of the proxy.
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	handler := corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleChatCompletions))))
+	mux.Handle("/v1/chat/completions", metricsMiddleware("/v1/chat/completions", handler))
+	mux.Handle("/v1/chat/completions:validate", metricsMiddleware("/v1/chat/completions:validate", handler))
+	mux.Handle("/v1/chat/completions/shared/", metricsMiddleware("/v1/chat/completions/shared/{token}", corsMiddleware(http.HandlerFunc(handleSharedStream))))
+	mux.Handle("/v1/completions", metricsMiddleware("/v1/completions", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleCompletions))))))
+	mux.Handle("/v1/embeddings", metricsMiddleware("/v1/embeddings", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleEmbeddings))))))
+	mux.Handle("/v1/embeddings/jobs", metricsMiddleware("/v1/embeddings/jobs", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleEmbeddingJobs))))))
+	mux.Handle("/v1/embeddings/jobs/", metricsMiddleware("/v1/embeddings/jobs/{id}", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleEmbeddingJobs))))))
+	mux.Handle("/v1/models", metricsMiddleware("/v1/models", corsMiddleware(authMiddleware(http.HandlerFunc(handleModels)))))
+	mux.Handle("/v1/models/", metricsMiddleware("/v1/models/{id}", corsMiddleware(authMiddleware(http.HandlerFunc(handleModels)))))
+	mux.Handle("/v1/search", metricsMiddleware("/v1/search", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleSearch))))))
+	mux.Handle("/v1/collections", metricsMiddleware("/v1/collections", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleCollections))))))
+	mux.Handle("/v1/collections/", metricsMiddleware("/v1/collections/{name}", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleCollections))))))
+	mux.Handle("/v1/chunks", metricsMiddleware("/v1/chunks", corsMiddleware(authMiddleware(http.HandlerFunc(handleChunks)))))
+	mux.Handle("/v1/templates", metricsMiddleware("/v1/templates", corsMiddleware(authMiddleware(http.HandlerFunc(handleTemplates)))))
+	mux.Handle("/v1/templates/render", metricsMiddleware("/v1/templates/render", corsMiddleware(authMiddleware(http.HandlerFunc(handleTemplates)))))
+	mux.Handle("/v1/extensions/schema", metricsMiddleware("/v1/extensions/schema", corsMiddleware(authMiddleware(http.HandlerFunc(handleExtensionSchema)))))
+	mux.Handle("/v1/audio/transcriptions/stream", metricsMiddleware("/v1/audio/transcriptions/stream", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleTranscriptionStream))))))
+	mux.Handle("/v1/audio/chat", metricsMiddleware("/v1/audio/chat", corsMiddleware(authMiddleware(drainMiddleware(http.HandlerFunc(handleVoiceChat))))))
+	mux.Handle("/admin/prompt", adminMiddleware(http.HandlerFunc(handleAdminPrompt)))
+	mux.Handle("/admin/drain", adminMiddleware(http.HandlerFunc(handleAdminDrain)))
+	mux.Handle("/admin/cancel", adminMiddleware(http.HandlerFunc(handleAdminCancel)))
+	mux.Handle("/admin/events", adminMiddleware(http.HandlerFunc(handleAdminEvents)))
+	mux.Handle("/admin/purge", adminMiddleware(http.HandlerFunc(handleAdminPurge)))
+	mux.Handle("/admin/eval/samples", adminMiddleware(http.HandlerFunc(handleAdminEvalSamples)))
+	mux.Handle("/admin/eval/trends", adminMiddleware(http.HandlerFunc(handleAdminEvalTrends)))
+	mux.Handle("/admin/aliases", adminMiddleware(http.HandlerFunc(handleAdminAliases)))
+	mux.Handle("/admin/models", adminMiddleware(http.HandlerFunc(handleAdminModels)))
+	mux.Handle("/admin/models/", adminMiddleware(http.HandlerFunc(handleAdminModels)))
+	mux.HandleFunc("/.well-known/jwks.json", handleJWKS)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	return mux
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := allowedOrigin(r.Header.Get("Origin"))
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.CORS.AllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORS.MaxAge.Seconds())))
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin is the Access-Control-Allow-Origin value for a request from
+// origin, empty when the origin isn't allowed.
+func allowedOrigin(origin string) string {
+	for _, allowed := range config.CORS.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	newChatPipeline(w, r).run()
+}
+
+// resolveRequest applies everything the proxy changes about a request before
+// it is rendered: aliases, presets, schedules, experiments, routing and
+// per-model instructions. It returns the model name the client asked for
+// and the schedule rule that applied, whose rate limit is left to the
+// caller, and false if strict model aliases reject it.
+func resolveRequest(ctx context.Context, openAIReq *OpenAIChatRequest, apiKey string) (string, *compiledScheduleRule, bool) {
+	requestedModel := openAIReq.Model
+	model, ok := resolveSessionModel(ctx, openAIReq.Session, requestedModel)
+	if !ok {
+		return requestedModel, nil, false
+	}
+	openAIReq.Model = model
+	applyPresets(openAIReq, apiKey)
+	rule := applyScheduleRules(openAIReq, time.Now())
+	applyExperiment(ctx, openAIReq, requestedModel)
+
+	openAIReq.Model = routeModelBySize(openAIReq.Model, translate.EstimateTokens(translate.Prompt(openAIReq.Messages)))
+	injectLanguageInstruction(openAIReq, config.ResponseLanguages[requestedModel])
+	arrangeSystemMessages(openAIReq)
+	return requestedModel, rule, true
+}
+
+func buildOllamaRequest(ctx context.Context, openAIReq OpenAIChatRequest) (OllamaRequest, error) {
+	provider, model := splitProviderModel(openAIReq.Model)
+	cfg := translate.Config{LegacyGenerateAPI: config.LegacyGenerateAPI, KeepAlive: modelKeepAlive(model)}
+
+	if providerFor(OllamaRequest{Provider: provider}).Type == PROVIDER_OPENAI {
+		// the provider fetches images itself and takes tools as they are
+		ollamaReq := translate.Request(openAIReq, cfg)
+		ollamaReq.Model, ollamaReq.Provider = model, provider
+		ollamaReq.OpenAIMessages = openAIReq.Messages
+		ollamaReq.Prompt = translate.Prompt(openAIReq.Messages)
+		ollamaReq.Tools = openAIReq.Tools
+		ollamaReq.ToolChoice = openAIReq.ToolChoice
+		ollamaReq.ResponseFormat = openAIReq.ResponseFormat
+		return ollamaReq, nil
+	}
+
+	tools, instruction, err := toolChoice(openAIReq)
+	if err != nil {
+		return OllamaRequest{Model: model, Provider: provider}, err
+	}
+	images := make([][]string, len(openAIReq.Messages))
+	for i, msg := range openAIReq.Messages {
+		for _, url := range msg.ImageURLs {
+			image, err := resolveImage(ctx, url)
+			if err != nil {
+				return OllamaRequest{Model: model, Provider: provider}, err
+			}
+			images[i] = append(images[i], image)
+		}
+	}
+	ollamaReq := translate.Chat(openAIReq, images, cfg)
+	ollamaReq.Model, ollamaReq.Provider = model, provider
+	ollamaReq.Tools = tools
+	if instruction != "" && len(ollamaReq.Messages) > 0 {
+		ollamaReq.Messages = translate.AddSystemInstruction(ollamaReq.Messages, instruction)
+	}
+	return ollamaReq, nil
+}
+
+// ollamaEndpoint is the Ollama API path for req.
+func ollamaEndpoint(req OllamaRequest) string {
+	if len(req.Messages) > 0 {
+		return "/api/chat"
+	}
+	return "/api/generate"
+}
+
+// sendToOllama streams a generation and accumulates it, calling onChunk with
+// every piece of text before it is kept; an error from onChunk stops the
+// generation. On error the returned response holds whatever was generated
+// before the failure.
+func sendToOllama(ctx context.Context, req OllamaRequest, onChunk func(text string) error) (*OllamaResponse, error) {
+	ollamaResp := &OllamaResponse{Model: req.Model}
+
+	var jsonData bytes.Buffer
+	if err := writeJSON(&jsonData, req); err != nil {
+		return ollamaResp, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// a retry may pick another backend
+	var b *backend
+	var probe bool
+	defer func() {
+		if b != nil {
+			b.end(probe)
+		}
+	}()
+	send := func() (*http.Response, error) {
+		url := upstreamURL(req)
+		if b != nil {
+			b.end(probe)
+			b = nil
+		}
+		if usesBackendTiers(req) {
+			picked := ollamaBackends.pick(req.Session)
+			isProbe, err := picked.allow()
+			if err != nil {
+				return nil, err
+			}
+			pinBackend(req.Session, picked.url)
+			b, probe = picked, isProbe
+			url = b.url + ollamaEndpoint(req)
+			b.begin()
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonData.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		httpReq.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+		tagUpstreamRequest(ctx, httpReq, req.Model)
+
+		start := time.Now()
+		resp, err := upstreamClient.Do(httpReq)
+		if b != nil && ctx.Err() == nil {
+			b.observe(time.Since(start), backendFailed(resp, err), probe)
+		}
+		return resp, err
+	}
+	resp, err := retryUpstream(ctx, req.Model, send)
+	if err == nil && resp.StatusCode == http.StatusNotFound && b != nil && autoPullAllowed(req.Model) {
+		resp.Body.Close()
+		if err := pullModel(ctx, b.url, req.Model); err != nil {
+			return ollamaResp, err
+		}
+		resp, err = retryUpstream(ctx, req.Model, send)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ollamaResp, ctx.Err()
+		}
+		return ollamaResp, fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ollamaResp, &upstreamError{upstream: "ollama", model: req.Model, status: resp.StatusCode, body: string(body)}
+	}
+
+	var text strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for !ollamaResp.Done {
+		var chunk OllamaResponse
+		if err := decoder.Decode(&chunk); err != nil {
+			ollamaResp.Response = text.String()
+			if ctx.Err() != nil {
+				return ollamaResp, ctx.Err()
+			}
+			return ollamaResp, fmt.Errorf("failed to read response: %w", err)
+		}
+		if chunk.Error != "" {
+			ollamaResp.Response = text.String()
+			return ollamaResp, &upstreamError{upstream: "ollama", model: req.Model, body: chunk.Error}
+		}
+		if chunk.Message != nil {
+			chunk.Response = chunk.Message.Content
+			ollamaResp.Images = append(ollamaResp.Images, chunk.Message.Images...)
+			ollamaResp.ToolCalls = append(ollamaResp.ToolCalls, chunk.Message.ToolCalls...)
+		}
+		if chunk.Image != "" {
+			ollamaResp.Images = append(ollamaResp.Images, chunk.Image)
+		}
+		if chunk.Response != "" && onChunk != nil {
+			if err := onChunk(chunk.Response); err != nil {
+				ollamaResp.Response = text.String()
+				return ollamaResp, err
+			}
+		}
+		text.WriteString(chunk.Response)
+		ollamaResp.Done = chunk.Done
+		if chunk.Done {
+			ollamaResp.PromptEvalCount = chunk.PromptEvalCount
+			ollamaResp.EvalCount = chunk.EvalCount
+			ollamaResp.LoadDuration = chunk.LoadDuration
+			ollamaResp.DoneReason = chunk.DoneReason
+		}
+	}
+	ollamaResp.Response = text.String()
+
+	return ollamaResp, nil
+}
+
+// remarshal converts between two JSON-shaped values, e.g. a generic body map
+// and a request struct.
+func remarshal(from any, to any) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+func getCurrentUnixTimestamp() int64 {
+	return time.Now().Unix()
+}
+
+// this literally doesn't matter, but some ppl think it does so we're going to just give them a dumb response
+func generateRandomString(n int) string {
+	const letters = "greatJobOnThatUselessRegex000"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// sendError writes an OpenAI-style error. message is an English format
+// string, translated for the client's Accept-Language and filled with args.
+func sendError(w http.ResponseWriter, r *http.Request, message string, errorType string, code string, status int, args ...any) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(status)
+	resp := ErrorResponse{}
+	resp.Error.Message = localizeError(r, message, args...)
+	resp.Error.Type = errorType
+	resp.Error.Code = code
+	writeJSON(w, resp)
+}
+
+// sendParamError is sendError for an invalid_request_error caused by one
+// specific request parameter.
+func sendParamError(w http.ResponseWriter, r *http.Request, message string, code string, param string, status int, args ...any) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(status)
+	resp := ErrorResponse{}
+	resp.Error.Message = localizeError(r, message, args...)
+	resp.Error.Type = "invalid_request_error"
+	resp.Error.Param = param
+	resp.Error.Code = code
+	writeJSON(w, resp)
+}
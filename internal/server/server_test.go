@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setConfig runs a test with cfg as the configuration and keys as the API
+// keys, and puts back the ones before when it ends.
+func setConfig(t *testing.T, cfg Config, keys ...APIKey) {
+	t.Helper()
+	oldConfig, oldKeys, oldStore := config, apiKeys, dataStore
+	t.Cleanup(func() {
+		config, apiKeys, dataStore = oldConfig, oldKeys, oldStore
+	})
+	cfg.APIKeys = keys
+	config = cfg
+	apiKeys = newKeyStore(keys)
+}
+
+// errorCode is the code of the error response w holds, "" for any other
+// response.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code < http.StatusBadRequest {
+		return ""
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error response %s: %v", w.Body, err)
+	}
+	return resp.Error.Code
+}
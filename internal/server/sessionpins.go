@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionPin is what a conversation was served with, kept for its later
+// turns, see model_aliases.session_pin_ttl.
+type sessionPin struct {
+	// model each alias resolved to, by lowercased requested name
+	models  map[string]string
+	backend string
+	used    time.Time
+}
+
+var sessionPins = struct {
+	sync.Mutex
+	pins  map[string]*sessionPin
+	swept time.Time
+}{pins: make(map[string]*sessionPin)}
+
+// resolveSessionModel resolves the alias of model like resolveModelAlias,
+// but a conversation keeps the model its first turn resolved to, so
+// switching an alias or pulling a model doesn't change models mid-chat.
+// Switching with migrate moves pinned conversations too, see unpinAlias.
+func resolveSessionModel(ctx context.Context, session, model string) (string, bool) {
+	if config.ModelAliases.SessionPinTTL <= 0 || session == "" {
+		return resolveModelAlias(ctx, model)
+	}
+	name := strings.ToLower(model)
+	sessionPins.Lock()
+	pin := liveSessionPin(session, time.Now())
+	target, ok := pin.models[name]
+	sessionPins.Unlock()
+	if ok {
+		return target, true
+	}
+
+	// resolving may ask Ollama, which the lock doesn't wait for
+	target, ok = resolveModelAlias(ctx, model)
+	if !ok {
+		return target, false
+	}
+	sessionPins.Lock()
+	defer sessionPins.Unlock()
+	pin = liveSessionPin(session, time.Now())
+	if pinned, ok := pin.models[name]; ok {
+		// a turn sent at the same time pinned it first
+		return pinned, true
+	}
+	pin.models[name] = target
+	return target, true
+}
+
+// pinnedBackend is the URL of the backend the session was last served by,
+// empty when it has none.
+func pinnedBackend(session string) string {
+	if config.ModelAliases.SessionPinTTL <= 0 || session == "" {
+		return ""
+	}
+	sessionPins.Lock()
+	defer sessionPins.Unlock()
+	return liveSessionPin(session, time.Now()).backend
+}
+
+// pinBackend records the backend a turn of the session went to.
+func pinBackend(session, url string) {
+	if config.ModelAliases.SessionPinTTL <= 0 || session == "" {
+		return
+	}
+	sessionPins.Lock()
+	defer sessionPins.Unlock()
+	liveSessionPin(session, time.Now()).backend = url
+}
+
+// liveSessionPin returns the pin of session, a new one if it has none or
+// its conversation was idle for longer than the TTL. Callers hold the lock.
+func liveSessionPin(session string, now time.Time) *sessionPin {
+	ttl := config.ModelAliases.SessionPinTTL
+	if now.Sub(sessionPins.swept) > ttl {
+		sessionPins.swept = now
+		for key, pin := range sessionPins.pins {
+			if now.Sub(pin.used) > ttl {
+				delete(sessionPins.pins, key)
+			}
+		}
+	}
+	pin, ok := sessionPins.pins[session]
+	if !ok || now.Sub(pin.used) > ttl {
+		pin = &sessionPin{models: make(map[string]string)}
+		sessionPins.pins[session] = pin
+	}
+	pin.used = now
+	return pin
+}
+
+// unpinAlias lets the conversations pinned to a target of alias resolve it
+// again on their next turn. It returns how many there were.
+func unpinAlias(alias string) int {
+	name := strings.ToLower(alias)
+	sessionPins.Lock()
+	defer sessionPins.Unlock()
+	n := 0
+	for _, pin := range sessionPins.pins {
+		if _, ok := pin.models[name]; ok {
+			delete(pin.models, name)
+			n++
+		}
+	}
+	return n
+}
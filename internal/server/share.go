@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a streamed chat completion others may watch, see sharedStream
+const (
+	SHARE_REQUEST_HEADER = "X-Share-Stream"
+	SHARE_TOKEN_HEADER   = "X-Share-Token"
+)
+
+// How long a finished shared stream can still be watched, from the start
+const SHARE_LINGER = time.Minute
+
+// sharedStream keeps the events of a streamed chat completion so watchers
+// can follow it read-only, replayed from the first event however late they
+// join.
+type sharedStream struct {
+	mu     sync.Mutex
+	events [][]byte
+	done   bool
+	// closed and replaced whenever an event arrives or the stream is done
+	changed chan struct{}
+}
+
+var sharedStreams = &shareRegistry{streams: make(map[string]*sharedStream)}
+
+type shareRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*sharedStream
+}
+
+// shareRequested reports whether a request asked for its stream to be
+// shared with X-Share-Stream: true.
+func shareRequested(r *http.Request) bool {
+	share, _ := strconv.ParseBool(r.Header.Get(SHARE_REQUEST_HEADER))
+	return share
+}
+
+// open registers a new shared stream under a random token.
+func (reg *shareRegistry) open() (string, *sharedStream) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s := &sharedStream{changed: make(chan struct{})}
+	reg.mu.Lock()
+	reg.streams[token] = s
+	reg.mu.Unlock()
+	return token, s
+}
+
+func (reg *shareRegistry) get(token string) *sharedStream {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.streams[token]
+}
+
+// close ends the stream for its watchers and forgets it after SHARE_LINGER.
+func (reg *shareRegistry) close(token string, s *sharedStream) {
+	s.mu.Lock()
+	if !s.done {
+		s.done = true
+		close(s.changed)
+	}
+	s.mu.Unlock()
+	time.AfterFunc(SHARE_LINGER, func() {
+		reg.mu.Lock()
+		delete(reg.streams, token)
+		reg.mu.Unlock()
+	})
+}
+
+// append passes an event written to the requester on to the watchers.
+func (s *sharedStream) append(event []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.events = append(s.events, event)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// since returns the events from index on, whether the stream is done, and
+// a channel closed once there is more.
+func (s *sharedStream) since(index int) ([][]byte, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events[index:], s.done, s.changed
+}
+
+// handleSharedStream serves /v1/chat/completions/shared/{token}, the events
+// of a shared stream as server-sent events. The token is all it takes.
+func handleSharedStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := sharedStreams.get(strings.TrimPrefix(r.URL.Path, "/v1/chat/completions/shared/"))
+	if s == nil {
+		sendError(w, r, "No shared stream with this token, it may have ended", "invalid_request_error", "share_not_found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	sw := newStreamWriter(w)
+	defer sw.close()
+
+	sent := 0
+	for {
+		events, done, changed := s.since(sent)
+		for _, event := range events {
+			if _, err := sw.Write(event); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
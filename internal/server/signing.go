@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// SIGNATURE_HEADER carries the detached JWS of a signed response.
+const SIGNATURE_HEADER = "X-Signature"
+
+// responseSigner signs response bodies as detached JWS (RFC 7515 appendix
+// F): the compact serialization with the payload left out, since the
+// payload is the body itself.
+type responseSigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+}
+
+// signer is set at startup when signing.key_file is configured.
+var signer *responseSigner
+
+// loadResponseSigner reads a PEM private key: Ed25519 (EdDSA), ECDSA P-256
+// (ES256) or RSA (RS256). The key ID defaults to a thumbprint of the public
+// key.
+func loadResponseSigner(path, kid string) (*responseSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", path, err)
+	}
+
+	s := &responseSigner{kid: kid}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		s.key, s.alg = k, "EdDSA"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("signing key %s: only P-256 ECDSA keys are supported", path)
+		}
+		s.key, s.alg = k, "ES256"
+	case *rsa.PrivateKey:
+		s.key, s.alg = k, "RS256"
+	default:
+		return nil, fmt.Errorf("signing key %s: unsupported key type %T", path, key)
+	}
+	if s.kid == "" {
+		der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		s.kid = base64.RawURLEncoding.EncodeToString(sum[:12])
+	}
+	return s, nil
+}
+
+// sign returns the detached JWS of payload, `header..signature`.
+func (s *responseSigner) sign(payload []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	input := protected + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(input))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS wants the fixed-size R || S, not ASN.1
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		sv.FillBytes(signature[32:])
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	}
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwk is the public key as a JSON Web Key.
+func (s *responseSigner) jwk() map[string]string {
+	jwk := map[string]string{"kid": s.kid, "alg": s.alg, "use": "sig"}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch key := s.key.Public().(type) {
+	case ed25519.PublicKey:
+		jwk["kty"], jwk["crv"], jwk["x"] = "OKP", "Ed25519", b64(key)
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		jwk["kty"], jwk["crv"], jwk["x"], jwk["y"] = "EC", "P-256", b64(x), b64(y)
+	case *rsa.PublicKey:
+		jwk["kty"], jwk["n"], jwk["e"] = "RSA", b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes())
+	}
+	return jwk
+}
+
+// handleJWKS serves the signing key for verifiers at
+// /.well-known/jwks.json.
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	if signer == nil {
+		sendError(w, r, "Response signing is not enabled on this proxy", "invalid_request_error", "not_found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"keys": []map[string]string{signer.jwk()}})
+}
+
+// signingMiddleware signs every response body with the configured key. JSON
+// responses are held back and get the signature in SIGNATURE_HEADER; streams
+// and anything else are passed on as they are written and get it as a
+// trailer. WebSockets aren't signed.
+func signingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signer == nil || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &signingWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		sw.finish()
+	})
+}
+
+type signingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	// JSON is held back until it is signed
+	buffered bool
+	body     bytes.Buffer
+}
+
+func (s *signingWriter) WriteHeader(status int) {
+	if s.wroteHeader {
+		return
+	}
+	s.status, s.wroteHeader = status, true
+	contentType := s.Header().Get("Content-Type")
+	if strings.HasPrefix(contentType, CONTENT_TYPE_JSON) || contentType == "" {
+		s.buffered = true
+		return
+	}
+	s.Header().Add("Trailer", SIGNATURE_HEADER)
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *signingWriter) Write(p []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	s.body.Write(p)
+	if s.buffered {
+		return len(p), nil
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush only reaches the client once the body is no longer held back.
+func (s *signingWriter) Flush() {
+	if s.wroteHeader && !s.buffered {
+		http.NewResponseController(s.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach write deadlines.
+func (s *signingWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *signingWriter) finish() {
+	if !s.wroteHeader {
+		// nothing was written, an empty 200 is signed like any body
+		s.WriteHeader(http.StatusOK)
+	}
+	// after the body has been written this sets the trailer
+	if signature, err := signer.sign(s.body.Bytes()); err == nil {
+		s.Header().Set(SIGNATURE_HEADER, signature)
+	} else {
+		log.Printf("failed to sign response: %v", err)
+	}
+	if s.buffered {
+		s.ResponseWriter.WriteHeader(s.status)
+		s.ResponseWriter.Write(s.body.Bytes())
+	}
+}
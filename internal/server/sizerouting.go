@@ -0,0 +1,21 @@
+package server
+
+// SizeRoute sends a request to Model when its estimated prompt fits in
+// MaxPromptTokens. A zero MaxPromptTokens matches any size. size_routes in
+// the config file maps a requested model name to variants picked by prompt
+// size, first match wins, so the unbounded variant goes last.
+type SizeRoute struct {
+	MaxPromptTokens int    `yaml:"max_prompt_tokens"`
+	Model           string `yaml:"model"`
+}
+
+// routeModelBySize returns the variant of model that should serve a prompt of
+// the given estimated size, or model itself when no route applies.
+func routeModelBySize(model string, promptTokens int) string {
+	for _, route := range config.SizeRoutes[model] {
+		if route.MaxPromptTokens == 0 || promptTokens <= route.MaxPromptTokens {
+			return route.Model
+		}
+	}
+	return model
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var errStopMatched = errors.New("stop pattern matched")
+
+// STOP_REGEX_WINDOW is how many bytes of earlier output a stop pattern sees
+// besides the newest chunk. Rescanning the whole output on every chunk would
+// be quadratic in its length.
+const STOP_REGEX_WINDOW = 16 << 10
+
+// stopPatterns are the compiled stop_regexes, see setup. They end
+// generation for a model as soon as its output matches one of them, e.g.
+// "(?s)```.*?```.*?```.*?```" to stop after the second code block. The
+// output is cut right after the match.
+var stopPatterns map[string][]*regexp.Regexp
+
+// compileStopRegexes compiles the patterns by model; validate reports its
+// error.
+func compileStopRegexes(regexes map[string][]string) (map[string][]*regexp.Regexp, error) {
+	compiled := make(map[string][]*regexp.Regexp, len(regexes))
+	for model, exprs := range regexes {
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%q of model %s is not a regular expression: %w", expr, model, err)
+			}
+			compiled[model] = append(compiled[model], re)
+		}
+	}
+	return compiled, nil
+}
+
+// stopMonitor watches a generation's output and reports errStopMatched once
+// a stop pattern matches, which makes sendToOllama cancel the upstream call.
+type stopMonitor struct {
+	patterns []*regexp.Regexp
+	output   strings.Builder
+	// how much of the output was matched against already
+	scanned int
+	cut     int
+}
+
+func newStopMonitor(model string) *stopMonitor {
+	return &stopMonitor{patterns: stopPatterns[model]}
+}
+
+func (m *stopMonitor) write(text string) error {
+	if len(m.patterns) == 0 {
+		return nil
+	}
+	m.output.WriteString(text)
+	output := m.output.String()
+	start := max(0, m.scanned-STOP_REGEX_WINDOW)
+	m.scanned = len(output)
+	for _, re := range m.patterns {
+		if loc := re.FindStringIndex(output[start:]); loc != nil {
+			m.cut = start + loc[1]
+			return errStopMatched
+		}
+	}
+	return nil
+}
+
+// text is the output up to and including the match.
+func (m *stopMonitor) text() string {
+	return m.output.String()[:m.cut]
+}
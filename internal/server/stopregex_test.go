@@ -0,0 +1,61 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStopMonitor(t *testing.T) {
+	fence := "```"
+	tests := []struct {
+		name    string
+		pattern string
+		chunks  []string
+		// the text up to the match, empty when nothing matches
+		want string
+	}{
+		{"no match", "STOP", []string{"hello ", "world"}, ""},
+		{"in one chunk", "STOP", []string{"hello ", "wor STOP ld"}, "hello wor STOP"},
+		{"across chunks", "STOP", []string{"hello ST", "OP world"}, "hello STOP"},
+		{
+			"second code block",
+			"(?s)```.*?```.*?```.*?```",
+			[]string{"a\n", fence + "go\nx\n", fence + "\nb\n" + fence, "py\ny\n" + fence, "\nc"},
+			"a\n" + fence + "go\nx\n" + fence + "\nb\n" + fence + "py\ny\n" + fence,
+		},
+		{
+			"within the window",
+			"(?s)BEGIN.*END",
+			[]string{"BEGIN", strings.Repeat("x", STOP_REGEX_WINDOW-5), "END"},
+			"BEGIN" + strings.Repeat("x", STOP_REGEX_WINDOW-5) + "END",
+		},
+		{"beyond the window", "(?s)BEGIN.*END", []string{"BEGIN", strings.Repeat("x", STOP_REGEX_WINDOW), "END"}, ""},
+		{
+			"after a long output",
+			"STOP",
+			[]string{strings.Repeat("x", 3*STOP_REGEX_WINDOW), "ST", "OP", "y"},
+			strings.Repeat("x", 3*STOP_REGEX_WINDOW) + "STOP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &stopMonitor{patterns: []*regexp.Regexp{regexp.MustCompile(tt.pattern)}}
+			matched := false
+			for _, chunk := range tt.chunks {
+				if m.write(chunk) != nil {
+					matched = true
+					break
+				}
+			}
+			switch {
+			case tt.want == "" && matched:
+				t.Errorf("matched %q, want no match", m.text())
+			case tt.want != "" && !matched:
+				t.Errorf("no match, want %q", tt.want)
+			case matched && m.text() != tt.want:
+				t.Errorf("text %q, want %q", m.text(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,586 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage records the SQL storage's UpdateUsage reads at a time
+const USAGE_PAGE_SIZE = 1000
+
+// Storage drivers of the storage config. Without one, usage goes to the
+// usage files of the listeners and everything else is kept in memory.
+const (
+	STORAGE_MEMORY   = "memory"
+	STORAGE_SQLITE   = "sqlite"
+	STORAGE_POSTGRES = "postgres"
+)
+
+// database/sql driver names of the SQL storage drivers. Their drivers are
+// only linked into builds with the sqlite or postgres tag, see
+// storage_sqlite.go and storage_postgres.go.
+var sqlDriverNames = map[string]string{
+	STORAGE_SQLITE:   "sqlite",
+	STORAGE_POSTGRES: "pgx",
+}
+
+// Store persists what the proxy keeps beyond a single request: usage
+// records, and state such as quotas, sessions and batch jobs as opaque
+// values by kind and key.
+type Store interface {
+	AppendUsage(ctx context.Context, record UsageRecord) error
+	// UpdateUsage passes every usage record to keep, which may change it,
+	// and deletes those it returns false for. It returns how many records
+	// were deleted or changed.
+	UpdateUsage(ctx context.Context, keep func(*UsageRecord) bool) (int, error)
+
+	Put(ctx context.Context, kind, key string, value []byte) error
+	// Get reports false for a key that isn't stored.
+	Get(ctx context.Context, kind, key string) ([]byte, bool, error)
+	Delete(ctx context.Context, kind, key string) error
+	// List returns every value of a kind by key.
+	List(ctx context.Context, kind string) (map[string][]byte, error)
+
+	Close() error
+}
+
+// dataStore is set at startup from the storage config, nil for files.
+var dataStore Store
+
+func openStore(c StorageConfig) (Store, error) {
+	switch c.Driver {
+	case "":
+		return nil, nil
+	case STORAGE_MEMORY:
+		return newMemoryStore(), nil
+	}
+	name := sqlDriverNames[c.Driver]
+	if !slices.Contains(sql.Drivers(), name) {
+		return nil, fmt.Errorf("storage driver %s is not built in, build with -tags %s", c.Driver, c.Driver)
+	}
+	db, err := sql.Open(name, c.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s storage: %w", c.Driver, err)
+	}
+	s := &sqlStore{db: db, postgres: c.Driver == STORAGE_POSTGRES}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up %s storage: %w", c.Driver, err)
+	}
+	return s, nil
+}
+
+// errBlobMissing is a content blob a stored prompt refers to that isn't
+// stored.
+var errBlobMissing = errors.New("not stored")
+
+// memoryStore keeps everything until the proxy exits.
+type memoryStore struct {
+	mu sync.Mutex
+	// prompts as encodeContent stores them, their blobs by hash
+	usage   []UsageRecord
+	blobs   map[string]string
+	records map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: make(map[string]string), records: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) AppendUsage(_ context.Context, record UsageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage = append(s.usage, s.encode(record))
+	return nil
+}
+
+func (s *memoryStore) encode(record UsageRecord) UsageRecord {
+	prompt, blobs := encodeContent(record.Prompt)
+	for hash, blob := range blobs {
+		s.blobs[hash] = blob
+	}
+	record.Prompt = prompt
+	return record
+}
+
+func (s *memoryStore) blob(hash string) (string, error) {
+	if blob, ok := s.blobs[hash]; ok {
+		return blob, nil
+	}
+	return "", errBlobMissing
+}
+
+func (s *memoryStore) UpdateUsage(_ context.Context, keep func(*UsageRecord) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := 0
+	kept := s.usage[:0]
+	live := make(map[string]bool)
+	for _, stored := range s.usage {
+		record := stored
+		prompt, err := decodeContent(stored.Prompt, s.blob)
+		if err != nil {
+			return changed, err
+		}
+		record.Prompt = prompt
+		before := record
+		if !keep(&record) {
+			changed++
+			continue
+		}
+		if record != before {
+			changed++
+			stored = s.encode(record)
+		}
+		for _, hash := range contentHashes(stored.Prompt) {
+			live[hash] = true
+		}
+		kept = append(kept, stored)
+	}
+	s.usage = kept
+	for hash := range s.blobs {
+		if !live[hash] {
+			delete(s.blobs, hash)
+		}
+	}
+	return changed, nil
+}
+
+func (s *memoryStore) Put(_ context.Context, kind, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string][]byte)
+	}
+	s.records[kind][key] = slices.Clone(value)
+	return nil
+}
+
+func (s *memoryStore) Get(_ context.Context, kind, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.records[kind][key]
+	return slices.Clone(value), ok, nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, kind, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records[kind], key)
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, kind string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string][]byte, len(s.records[kind]))
+	for key, value := range s.records[kind] {
+		values[key] = slices.Clone(value)
+	}
+	return values, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sqlStore keeps usage records and state in SQLite or Postgres, which only
+// differ in placeholders and a few column types.
+type sqlStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// query rewrites the ? placeholders of q for Postgres.
+func (s *sqlStore) query(q string) string {
+	if !s.postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) migrate(ctx context.Context) error {
+	id, timestamp, blob := "INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP", "BLOB"
+	if s.postgres {
+		id, timestamp, blob = "BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ", "BYTEA"
+	}
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS usage_records (
+			id ` + id + `,
+			time ` + timestamp + ` NOT NULL,
+			tenant TEXT NOT NULL,
+			key_name TEXT NOT NULL,
+			key_hash TEXT NOT NULL DEFAULT '',
+			model TEXT NOT NULL,
+			organization TEXT NOT NULL,
+			project TEXT NOT NULL,
+			prompt_tokens INTEGER NOT NULL,
+			completion_tokens INTEGER NOT NULL,
+			total_tokens INTEGER NOT NULL,
+			prompt TEXT NOT NULL,
+			response TEXT NOT NULL,
+			experiment TEXT NOT NULL DEFAULT '',
+			variant TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS usage_records_time ON usage_records (time)`,
+		`CREATE TABLE IF NOT EXISTS content_blobs (
+			hash TEXT PRIMARY KEY,
+			content TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS records (
+			kind TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value ` + blob + ` NOT NULL,
+			updated ` + timestamp + ` NOT NULL,
+			PRIMARY KEY (kind, key)
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	// columns added to usage_records since it was first created
+	for _, column := range []string{"experiment", "variant", "key_hash"} {
+		if _, err := s.db.ExecContext(ctx, `SELECT `+column+` FROM usage_records WHERE 1 = 0`); err == nil {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, `ALTER TABLE usage_records ADD COLUMN `+column+` TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `SELECT api_key FROM usage_records WHERE 1 = 0`); err == nil {
+		return s.hashAPIKeys(ctx)
+	}
+	return nil
+}
+
+// hashAPIKeys replaces the api_key column, which usage_records had before
+// key_hash, by the usageKeyHash of its keys, so the table keeps no working
+// credentials.
+func (s *sqlStore) hashAPIKeys(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT api_key FROM usage_records WHERE api_key <> ''`)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, s.query(`UPDATE usage_records SET key_hash = ? WHERE api_key = ?`), usageKeyHash(key), key); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE usage_records DROP COLUMN api_key`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AppendUsage stores the large messages of the prompt as content blobs,
+// see encodeContent.
+func (s *sqlStore) AppendUsage(ctx context.Context, r UsageRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	prompt, err := s.putBlobs(ctx, tx, r.Prompt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.query(`INSERT INTO usage_records
+		(time, tenant, key_name, key_hash, model, organization, project, prompt_tokens, completion_tokens, total_tokens, prompt, response, experiment, variant)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		r.Time, r.Tenant, r.KeyName, r.KeyHash, r.Model, r.Organization, r.Project,
+		r.PromptTokens, r.CompletionTokens, r.TotalTokens, prompt, r.Response, r.Experiment, r.Variant); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// putBlobs stores the blobs of prompt that aren't stored yet and returns
+// what to store for it.
+func (s *sqlStore) putBlobs(ctx context.Context, tx *sql.Tx, prompt string) (string, error) {
+	stored, blobs := encodeContent(prompt)
+	for hash, content := range blobs {
+		if _, err := tx.ExecContext(ctx, s.query(`INSERT INTO content_blobs (hash, content) VALUES (?, ?)
+			ON CONFLICT (hash) DO NOTHING`), hash, content); err != nil {
+			return "", err
+		}
+	}
+	return stored, nil
+}
+
+// UpdateUsage passes records to keep with their prompts reassembled, a page
+// of USAGE_PAGE_SIZE at a time, and deletes the content blobs no record
+// refers to anymore.
+func (s *sqlStore) UpdateUsage(ctx context.Context, keep func(*UsageRecord) bool) (int, error) {
+	changed := 0
+	var after int64
+	for {
+		page, err := s.usagePage(ctx, after)
+		if err != nil {
+			return changed, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1].id
+		n, err := s.updateUsagePage(ctx, page, keep)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, s.deleteUnusedBlobs(ctx)
+}
+
+// storedUsage is a usage record with its row ID, its prompt as stored.
+type storedUsage struct {
+	id     int64
+	record UsageRecord
+}
+
+// usagePage reads the next USAGE_PAGE_SIZE usage records after the row ID
+// after.
+func (s *sqlStore) usagePage(ctx context.Context, after int64) ([]storedUsage, error) {
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT id, time, tenant, key_name, key_hash, model, organization, project,
+		prompt_tokens, completion_tokens, total_tokens, prompt, response, experiment, variant FROM usage_records
+		WHERE id > ? ORDER BY id LIMIT ?`), after, USAGE_PAGE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []storedUsage
+	for rows.Next() {
+		var su storedUsage
+		r := &su.record
+		if err := rows.Scan(&su.id, &r.Time, &r.Tenant, &r.KeyName, &r.KeyHash, &r.Model, &r.Organization, &r.Project,
+			&r.PromptTokens, &r.CompletionTokens, &r.TotalTokens, &r.Prompt, &r.Response, &r.Experiment, &r.Variant); err != nil {
+			return nil, err
+		}
+		page = append(page, su)
+	}
+	return page, rows.Err()
+}
+
+// updateUsagePage passes a page of records to keep and stores what it
+// changed in one transaction.
+func (s *sqlStore) updateUsagePage(ctx context.Context, page []storedUsage, keep func(*UsageRecord) bool) (int, error) {
+	blobs := make(map[string]string)
+	blob := func(hash string) (string, error) {
+		if content, ok := blobs[hash]; ok {
+			return content, nil
+		}
+		var content string
+		err := s.db.QueryRowContext(ctx, s.query(`SELECT content FROM content_blobs WHERE hash = ?`), hash).Scan(&content)
+		if err == sql.ErrNoRows {
+			return "", errBlobMissing
+		}
+		if err != nil {
+			return "", err
+		}
+		blobs[hash] = content
+		return content, nil
+	}
+	var deleted []int64
+	var updated []storedUsage
+	for _, su := range page {
+		r := su.record
+		var err error
+		if r.Prompt, err = decodeContent(r.Prompt, blob); err != nil {
+			return 0, err
+		}
+		before := r
+		switch {
+		case !keep(&r):
+			deleted = append(deleted, su.id)
+		case r != before:
+			updated = append(updated, storedUsage{su.id, r})
+		}
+	}
+	if len(deleted) == 0 && len(updated) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, id := range deleted {
+		if _, err := tx.ExecContext(ctx, s.query(`DELETE FROM usage_records WHERE id = ?`), id); err != nil {
+			return 0, err
+		}
+	}
+	for _, su := range updated {
+		r := su.record
+		prompt, err := s.putBlobs(ctx, tx, r.Prompt)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, s.query(`UPDATE usage_records SET time = ?, tenant = ?, key_name = ?, key_hash = ?,
+			model = ?, organization = ?, project = ?, prompt_tokens = ?, completion_tokens = ?, total_tokens = ?,
+			prompt = ?, response = ?, experiment = ?, variant = ? WHERE id = ?`),
+			r.Time, r.Tenant, r.KeyName, r.KeyHash, r.Model, r.Organization, r.Project,
+			r.PromptTokens, r.CompletionTokens, r.TotalTokens, prompt, r.Response, r.Experiment, r.Variant, su.id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(deleted) + len(updated), nil
+}
+
+// deleteUnusedBlobs deletes the content blobs no usage record refers to.
+// An AppendUsage running meanwhile may refer to a blob that is already
+// stored, which putBlobs leaves alone, so the transaction first takes the
+// lock that writing blobs needs: it waits for the appends that wrote blobs
+// to commit, so their records are seen, and holds off new ones until the
+// unused blobs are gone, so they store theirs anew.
+func (s *sqlStore) deleteUnusedBlobs(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	lock := `LOCK TABLE content_blobs IN EXCLUSIVE MODE`
+	if !s.postgres {
+		// SQLite has a single writer, which a write takes even when it
+		// changes nothing
+		lock = `DELETE FROM content_blobs WHERE 1 = 0`
+	}
+	if _, err := tx.ExecContext(ctx, lock); err != nil {
+		return err
+	}
+
+	live := make(map[string]bool)
+	rows, err := tx.QueryContext(ctx, s.query(`SELECT prompt FROM usage_records WHERE prompt LIKE ?`), CONTENT_MANIFEST_MARKER+"%")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var prompt string
+		if err := rows.Scan(&prompt); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, hash := range contentHashes(prompt) {
+			live[hash] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT hash FROM content_blobs`)
+	if err != nil {
+		return err
+	}
+	var unused []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		if !live[hash] {
+			unused = append(unused, hash)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, hash := range unused {
+		if _, err := tx.ExecContext(ctx, s.query(`DELETE FROM content_blobs WHERE hash = ?`), hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Put(ctx context.Context, kind, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx, s.query(`INSERT INTO records (kind, key, value, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, key) DO UPDATE SET value = excluded.value, updated = excluded.updated`),
+		kind, key, value, time.Now().UTC())
+	return err
+}
+
+func (s *sqlStore) Get(ctx context.Context, kind, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.query(`SELECT value FROM records WHERE kind = ? AND key = ?`), kind, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *sqlStore) Delete(ctx context.Context, kind, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM records WHERE kind = ? AND key = ?`), kind, key)
+	return err
+}
+
+func (s *sqlStore) List(ctx context.Context, kind string) (map[string][]byte, error) {
+	rows, err := s.db.QueryContext(ctx, s.query(`SELECT key, value FROM records WHERE kind = ?`), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,7 @@
+//go:build postgres
+
+package server
+
+// Postgres storage, `go get github.com/jackc/pgx/v5` and build with
+// -tags postgres.
+import _ "github.com/jackc/pgx/v5/stdlib"
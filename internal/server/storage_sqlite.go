@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package server
+
+// SQLite storage, `go get modernc.org/sqlite` and build with -tags sqlite.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores are the stores built in: memory, and SQLite with -tags sqlite.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{STORAGE_MEMORY: newMemoryStore()}
+	if slices.Contains(sql.Drivers(), sqlDriverNames[STORAGE_SQLITE]) {
+		dsn := filepath.Join(t.TempDir(), "proxy.db") + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(wal)&_pragma=synchronous(off)"
+		store, err := openStore(StorageConfig{Driver: STORAGE_SQLITE, DSN: dsn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[STORAGE_SQLITE] = store
+	}
+	return stores
+}
+
+// storedUsageRecords reads every usage record back, failing on prompts
+// whose blobs are missing.
+func storedUsageRecords(t *testing.T, store Store) []UsageRecord {
+	t.Helper()
+	var records []UsageRecord
+	if _, err := store.UpdateUsage(context.Background(), func(r *UsageRecord) bool {
+		records = append(records, *r)
+		return true
+	}); err != nil {
+		t.Fatalf("reading the usage records: %v", err)
+	}
+	return records
+}
+
+func blobCount(t *testing.T, store Store) int {
+	t.Helper()
+	switch s := store.(type) {
+	case *memoryStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.blobs)
+	case *sqlStore:
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM content_blobs`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	t.Fatalf("no blob count for %T", store)
+	return 0
+}
+
+func TestUpdateUsageBlobs(t *testing.T) {
+	system := "system: " + strings.Repeat("Answer briefly. ", CONTENT_BLOB_MIN_SIZE/16+1) + "\n"
+	other := "system: " + strings.Repeat("Answer at length. ", CONTENT_BLOB_MIN_SIZE/18+1) + "\n"
+	tests := []struct {
+		name        string
+		keep        func(*UsageRecord) bool
+		wantChanged int
+		wantModels  []string
+		wantBlobs   int
+	}{
+		{"keep all", func(*UsageRecord) bool { return true }, 0, []string{"a", "b", "c"}, 2},
+		{"delete a record of a shared blob", func(r *UsageRecord) bool { return r.Model != "a" }, 1, []string{"b", "c"}, 2},
+		{"delete every record of a blob", func(r *UsageRecord) bool { return r.Model == "c" }, 2, []string{"c"}, 1},
+		{"delete all", func(*UsageRecord) bool { return false }, 3, nil, 0},
+		{
+			"change a prompt to another blob",
+			func(r *UsageRecord) bool {
+				if r.Model == "c" {
+					r.Prompt = system + "user: hi\n"
+				}
+				return true
+			},
+			1, []string{"a", "b", "c"}, 1,
+		},
+	}
+	for _, tt := range tests {
+		for driver, store := range testStores(t) {
+			t.Run(tt.name+"/"+driver, func(t *testing.T) {
+				ctx := context.Background()
+				for _, r := range []UsageRecord{
+					{Model: "a", Prompt: system + "user: first\n"},
+					{Model: "b", Prompt: system + "user: second\n"},
+					{Model: "c", Prompt: other + "user: third\n"},
+				} {
+					r.Time = time.Now().UTC()
+					if err := store.AppendUsage(ctx, r); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				changed, err := store.UpdateUsage(ctx, tt.keep)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if changed != tt.wantChanged {
+					t.Errorf("changed %d records, want %d", changed, tt.wantChanged)
+				}
+				var models []string
+				for _, r := range storedUsageRecords(t, store) {
+					models = append(models, r.Model)
+					if !strings.HasPrefix(r.Prompt, "system: Answer") {
+						t.Errorf("record %s has prompt %.30q...", r.Model, r.Prompt)
+					}
+				}
+				if !slices.Equal(models, tt.wantModels) {
+					t.Errorf("records %v left, want %v", models, tt.wantModels)
+				}
+				if n := blobCount(t, store); n != tt.wantBlobs {
+					t.Errorf("%d blobs left, want %d", n, tt.wantBlobs)
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateUsagePages(t *testing.T) {
+	for driver, store := range testStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			ctx := context.Background()
+			n := 2*USAGE_PAGE_SIZE + 1
+			for i := 0; i < n; i++ {
+				if err := store.AppendUsage(ctx, UsageRecord{Time: time.Now().UTC(), Model: "llama3", Usage: Usage{TotalTokens: i}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			seen := 0
+			changed, err := store.UpdateUsage(ctx, func(r *UsageRecord) bool {
+				seen++
+				return r.TotalTokens%2 == 0
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen != n || changed != n/2 {
+				t.Errorf("saw %d records and deleted %d, want %d and %d", seen, changed, n, n/2)
+			}
+			if left := len(storedUsageRecords(t, store)); left != n-n/2 {
+				t.Errorf("%d records left, want %d", left, n-n/2)
+			}
+		})
+	}
+}
+
+// Records appended while blobs are collected must never refer to one that
+// was deleted.
+func TestUpdateUsageWhileAppending(t *testing.T) {
+	system := "system: " + strings.Repeat("Shared instructions. ", CONTENT_BLOB_MIN_SIZE/21+1) + "\n"
+	for driver, store := range testStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			ctx := context.Background()
+			var wg sync.WaitGroup
+			errs := make(chan error, 100)
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 25; i++ {
+						r := UsageRecord{Time: time.Now().UTC(), Model: fmt.Sprintf("keep-%d", w), Prompt: system + "user: hi\n"}
+						if i%2 == 0 {
+							r.Model = "purge"
+						}
+						if err := store.AppendUsage(ctx, r); err != nil {
+							errs <- err
+						}
+					}
+				}(w)
+			}
+			for i := 0; i < 10; i++ {
+				if _, err := store.UpdateUsage(ctx, func(r *UsageRecord) bool { return r.Model != "purge" }); err != nil {
+					t.Errorf("purge %d: %v", i, err)
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("append: %v", err)
+			}
+
+			for _, r := range storedUsageRecords(t, store) {
+				if r.Prompt != system+"user: hi\n" {
+					t.Errorf("record %s has prompt %.30q...", r.Model, r.Prompt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sseStream writes a chat completion as OpenAI `chat.completion.chunk`
+// server-sent events. Nothing is written until the first delta, so a
+// request can still fail with a normal error response before that. A
+// stream sends the chunks of its choice; the other choices of an n > 1
+// request send theirs through a stream of their own, see choice.
+type sseStream struct {
+	*sseEvents
+	index int
+	// whether the first chunk of the choice, with the role, went out
+	opened bool
+	// the content deltas sent so far
+	content strings.Builder
+}
+
+// sseEvents is the event stream the choices of a completion share, which
+// they may write to at the same time.
+type sseEvents struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	sw       *streamWriter
+	id       string
+	model    string
+	created  int64
+	metadata map[string]string
+	// watchers of the stream, nil unless it is shared
+	share *sharedStream
+}
+
+func newSSEStream(w http.ResponseWriter, id string, model string, metadata map[string]string) *sseStream {
+	return &sseStream{sseEvents: &sseEvents{w: w, id: id, model: model, created: getCurrentUnixTimestamp(), metadata: metadata}}
+}
+
+// choice returns the stream of another choice of the same completion.
+func (s *sseStream) choice(index int) *sseStream {
+	return &sseStream{sseEvents: s.sseEvents, index: index}
+}
+
+func (s *sseStream) started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sw != nil
+}
+
+func (s *sseStream) start() error {
+	s.mu.Lock()
+	if s.sw == nil {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.Header().Set("Connection", "keep-alive")
+		s.w.WriteHeader(http.StatusOK)
+		s.sw = newStreamWriter(s.w)
+	}
+	s.mu.Unlock()
+	if s.opened {
+		return nil
+	}
+	s.opened = true
+	return s.send(ChunkChoice{Delta: ChunkDelta{Role: "assistant"}})
+}
+
+// delta sends a piece of the answer.
+func (s *sseStream) delta(content string) error {
+	if content == "" {
+		return nil
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.content.WriteString(content)
+	return s.send(ChunkChoice{Delta: ChunkDelta{Content: content}})
+}
+
+// images sends generated images as one delta of image parts.
+func (s *sseStream) images(images []string) error {
+	if len(images) == 0 {
+		return nil
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.send(ChunkChoice{Delta: ChunkDelta{Images: images}})
+}
+
+// toolCalls sends the model's tool calls as one delta, each with its index.
+func (s *sseStream) toolCalls(calls []ToolCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	for i := range calls {
+		index := i
+		calls[i].Index = &index
+	}
+	return s.send(ChunkChoice{Delta: ChunkDelta{ToolCalls: calls}})
+}
+
+// finish sends the final chunk with the finish reason, then [DONE], see
+// end and done.
+func (s *sseStream) finish(finishReason string, filterResults map[string]ContentFilterResult, usage *Usage) error {
+	if err := s.end(finishReason, filterResults); err != nil {
+		return err
+	}
+	return s.done(usage)
+}
+
+// end sends the final chunk of the choice, with its finish reason.
+func (s *sseStream) end(finishReason string, filterResults map[string]ContentFilterResult) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.send(ChunkChoice{Delta: ChunkDelta{}, FinishReason: &finishReason, ContentFilterResults: filterResults})
+}
+
+// done ends the stream with [DONE] once every choice ended. With usage, as
+// asked for with stream_options.include_usage, a chunk without choices
+// carrying it goes out first.
+func (s *sseStream) done(usage *Usage) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	if usage != nil {
+		if err := s.event(ChatCompletionChunk{
+			ID:       s.id,
+			Object:   "chat.completion.chunk",
+			Created:  s.created,
+			Model:    s.model,
+			Choices:  []ChunkChoice{},
+			Metadata: s.metadata,
+			Usage:    usage,
+		}); err != nil {
+			return err
+		}
+	}
+	return s.write([]byte("data: [DONE]\n\n"))
+}
+
+// fail ends a stream that already started with an error event, the way
+// OpenAI reports errors mid-stream.
+func (s *sseStream) fail(r *http.Request, format, errorType, code string, args ...any) error {
+	resp := ErrorResponse{}
+	resp.Error.Message = localizeError(r, format, args...)
+	resp.Error.Type = errorType
+	resp.Error.Code = code
+	return s.event(resp)
+}
+
+func (s *sseStream) send(choice ChunkChoice) error {
+	choice.Index = s.index
+	return s.event(ChatCompletionChunk{
+		ID:       s.id,
+		Object:   "chat.completion.chunk",
+		Created:  s.created,
+		Model:    s.model,
+		Choices:  []ChunkChoice{choice},
+		Metadata: s.metadata,
+	})
+}
+
+func (s *sseStream) event(v any) error {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	if err := writeJSON(&buf, v); err != nil {
+		return err
+	}
+	// writeJSON ends with a newline, an event needs a blank line after it
+	buf.WriteString("\n")
+	return s.write(buf.Bytes())
+}
+
+// comment sends an SSE comment, which clients skip.
+func (s *sseStream) comment(text string) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.write([]byte(": " + text + "\n\n"))
+}
+
+// namedEvent sends a vendor event that isn't a chunk, under its own event
+// name so clients can tell it apart.
+func (s *sseStream) namedEvent(name string, v any) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("event: " + name + "\ndata: ")
+	if err := writeJSON(&buf, v); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	return s.write(buf.Bytes())
+}
+
+func (s *sseStream) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.share.append(data)
+	_, err := s.sw.Write(data)
+	return err
+}
+
+// close waits for everything written to reach the client.
+func (s *sseStream) close() error {
+	if s.sw == nil {
+		return nil
+	}
+	return s.sw.close()
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// streamCounter counts the open SSE streams of each API key. Streams hold a
+// connection and a generation for as long as they run, so they are limited
+// separately from the request rate.
+type streamCounter struct {
+	mu   sync.Mutex
+	open map[string]int
+}
+
+var openStreams = &streamCounter{open: make(map[string]int)}
+
+// maxStreams is the stream limit of apiKey, 0 for none. Requests without a
+// key share one limit.
+func maxStreams(apiKey string) int {
+	if entry := apiKeys.lookup(apiKey); entry != nil && entry.MaxStreams > 0 {
+		return entry.MaxStreams
+	}
+	return config.MaxStreamsPerKey
+}
+
+// acquire opens a stream for apiKey, or fails with a 429 when the key
+// already has as many open as it may.
+func (c *streamCounter) acquire(apiKey string) (func(), error) {
+	limit := maxStreams(apiKey)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit > 0 && c.open[apiKey] >= limit {
+		return nil, newAPIError(http.StatusTooManyRequests, "requests", "too_many_streams", "Too many concurrent streams for this API key, the limit is %d", limit)
+	}
+	c.open[apiKey]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.open[apiKey]--; c.open[apiKey] <= 0 {
+				delete(c.open, apiKey)
+			}
+		})
+	}, nil
+}
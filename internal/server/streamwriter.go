@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What to do with a client that reads slower than we generate
+const (
+	SLOW_CLIENT_BACKPRESSURE = "backpressure" // stop reading upstream until it catches up
+	SLOW_CLIENT_TERMINATE    = "terminate"    // end the response as soon as the buffer is full
+)
+
+const (
+	SLOW_CLIENT_POLICY = SLOW_CLIENT_BACKPRESSURE
+	// Bytes written but not yet sent to the client before the policy kicks in
+	CLIENT_MAX_BUFFERED_BYTES = 256 << 10
+)
+
+var errSlowClient = errors.New("client is not reading fast enough")
+
+// streamWriter decouples producing a response from the client reading it.
+// Writes are queued and sent by a separate goroutine with a write deadline.
+// Once CLIENT_MAX_BUFFERED_BYTES are queued, Write either blocks (which stops
+// the caller from reading more from upstream) or fails, per SLOW_CLIENT_POLICY,
+// so one stalled client can't pin a generation slot forever. A write, or a
+// backpressure wait, that takes longer than client_write_timeout ends the
+// response too.
+type streamWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    [][]byte
+	buffered int
+	err      error
+	closed   bool
+	done     chan struct{}
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	s := &streamWriter{
+		w:    w,
+		rc:   http.NewResponseController(w),
+		done: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil && s.buffered > 0 && s.buffered+len(p) > CLIENT_MAX_BUFFERED_BYTES {
+		if SLOW_CLIENT_POLICY == SLOW_CLIENT_TERMINATE {
+			s.err = errSlowClient
+		} else {
+			deadline := time.Now().Add(config.ClientWriteTimeout)
+			wake := time.AfterFunc(config.ClientWriteTimeout, func() {
+				s.mu.Lock()
+				s.cond.Broadcast()
+				s.mu.Unlock()
+			})
+			for s.err == nil && s.buffered > 0 && s.buffered+len(p) > CLIENT_MAX_BUFFERED_BYTES {
+				if !time.Now().Before(deadline) {
+					s.err = errSlowClient
+					break
+				}
+				s.cond.Wait()
+			}
+			wake.Stop()
+		}
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	s.queue = append(s.queue, append([]byte(nil), p...))
+	s.buffered += len(p)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// close sends whatever is queued and returns the first error seen. The
+// response must not be touched by the handler until close returns.
+func (s *streamWriter) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	<-s.done
+	return s.err
+}
+
+func (s *streamWriter) run() {
+	defer close(s.done)
+	var panicErr error
+	defer func() {
+		if panicErr != nil {
+			s.mu.Lock()
+			s.err = panicErr
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		}
+	}()
+	defer recoverAsError(&panicErr)
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil || len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		pending := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		err := s.send(pending)
+
+		s.mu.Lock()
+		for _, p := range pending {
+			s.buffered -= len(p)
+		}
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *streamWriter) send(pending [][]byte) error {
+	// not every ResponseWriter supports deadlines, the buffer limit still applies then
+	s.rc.SetWriteDeadline(time.Now().Add(config.ClientWriteTimeout))
+	defer s.rc.SetWriteDeadline(time.Time{})
+
+	for _, p := range pending {
+		if _, err := s.w.Write(p); err != nil {
+			return fmt.Errorf("%w: %v", errSlowClient, err)
+		}
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return fmt.Errorf("%w: %v", errSlowClient, err)
+	}
+	return nil
+}
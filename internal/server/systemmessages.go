@@ -0,0 +1,88 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+// How system messages are arranged before rendering
+const (
+	SYSTEM_KEEP            = "keep"            // leave them where the client put them
+	SYSTEM_MERGE_FIRST     = "merge_first"     // one system message at the start
+	SYSTEM_MERGE_INTO_USER = "merge_into_user" // prefix the first user message, for templates without a system role
+)
+
+// SystemMessageRule picks a strategy for the models matching Model, from
+// system_message_rules in the config file. The first match wins; models
+// that match nothing keep their system messages as sent.
+type SystemMessageRule struct {
+	Model    string `yaml:"model"` // glob
+	Strategy string `yaml:"strategy"`
+}
+
+type compiledSystemMessageRule struct {
+	model    *regexp.Regexp
+	strategy string
+}
+
+// systemMessageRules are the compiled system_message_rules, see setup.
+var systemMessageRules []compiledSystemMessageRule
+
+func compileSystemMessageRules(rules []SystemMessageRule) []compiledSystemMessageRule {
+	compiled := make([]compiledSystemMessageRule, 0, len(rules))
+	for _, rule := range rules {
+		compiled = append(compiled, compiledSystemMessageRule{
+			model:    compileGlobPatterns([]string{rule.Model})[0],
+			strategy: rule.Strategy,
+		})
+	}
+	return compiled
+}
+
+func systemMessageStrategy(model string) string {
+	for _, rule := range systemMessageRules {
+		if rule.model.MatchString(model) {
+			return rule.strategy
+		}
+	}
+	return SYSTEM_KEEP
+}
+
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
+
+// arrangeSystemMessages merges or moves system messages the way the target
+// model's template expects them.
+func arrangeSystemMessages(req *OpenAIChatRequest) {
+	strategy := systemMessageStrategy(req.Model)
+	if strategy == SYSTEM_KEEP {
+		return
+	}
+
+	var system []string
+	rest := make([]ChatMessage, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		if isSystemRole(msg.Role) {
+			system = append(system, msg.Content)
+			continue
+		}
+		rest = append(rest, msg)
+	}
+	if len(system) == 0 {
+		return
+	}
+	merged := strings.Join(system, "\n\n")
+
+	if strategy == SYSTEM_MERGE_INTO_USER {
+		for i, msg := range rest {
+			if msg.Role == "user" {
+				rest[i].Content = merged + "\n\n" + msg.Content
+				req.Messages = rest
+				return
+			}
+		}
+		// no user message to fold into, a lone system prompt is better than none
+	}
+	req.Messages = append([]ChatMessage{{Role: "system", Content: merged}}, rest...)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Extra chat templates listed and previewed by /v1/templates next to the
+// built-in ones, in Ollama's template syntax: Go text/template over
+// .Messages, or .System, .Prompt and .Response for older templates.
+var PROMPT_TEMPLATES = map[string]string{
+	// "markdown-turns": "{{- range .Messages }}### {{ .Role }}\n{{ .Content }}\n\n{{ end }}### assistant\n",
+}
+
+// Common chat formats, and the flattened prompt legacy_generate_api sends.
+var builtinTemplates = map[string]string{
+	"chatml": "{{- range .Messages }}<|im_start|>{{ .Role }}\n{{ .Content }}<|im_end|>\n{{ end }}<|im_start|>assistant\n",
+	"llama3": "{{- range .Messages }}<|start_header_id|>{{ .Role }}<|end_header_id|>\n\n{{ .Content }}<|eot_id|>{{ end }}<|start_header_id|>assistant<|end_header_id|>\n\n",
+	"mistral": "{{- range .Messages }}{{ if eq .Role \"user\" }}[INST] {{ .Content }} [/INST]" +
+		"{{ else if eq .Role \"assistant\" }} {{ .Content }}</s>{{ end }}{{ end }}",
+	"gemma": "{{- range .Messages }}<start_of_turn>{{ if eq .Role \"assistant\" }}model{{ else }}{{ .Role }}{{ end }}\n" +
+		"{{ .Content }}<end_of_turn>\n{{ end }}<start_of_turn>model\n",
+	"legacy": "{{- range .Messages }}{{ .Role }}: {{ .Content }}\n{{ end }}",
+}
+
+// Conversation rendered when a preview request brings no messages
+var sampleTemplateMessages = []ChatMessage{
+	{Role: "system", Content: "You are a helpful assistant."},
+	{Role: "user", Content: "Hi!"},
+	{Role: "assistant", Content: "Hello! How can I help you today?"},
+	{Role: "user", Content: "What is the capital of France?"},
+}
+
+type PromptTemplate struct {
+	ID       string `json:"id"`
+	Object   string `json:"object"`
+	Source   string `json:"source"` // "builtin" or "configured"
+	Template string `json:"template"`
+}
+
+type PromptTemplateList struct {
+	Object string           `json:"object"`
+	Data   []PromptTemplate `json:"data"`
+}
+
+// TemplateRenderRequest names either a model, to preview exactly what the
+// proxy would send it, or a template from the list.
+type TemplateRenderRequest struct {
+	Model    string        `json:"model,omitempty"`
+	Template string        `json:"template,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+}
+
+type TemplateRenderResponse struct {
+	Object string `json:"object"`
+	// the model the request resolved to, for model previews
+	Model    string `json:"model,omitempty"`
+	Template string `json:"template"`
+	Source   string `json:"source"` // "builtin", "configured" or "model"
+	Prompt   string `json:"prompt"`
+}
+
+// handleTemplates serves GET /v1/templates and POST /v1/templates/render.
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.URL.Path == "/v1/templates/render" {
+		if r.Method != http.MethodPost {
+			sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleTemplateRender(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := PromptTemplateList{Object: "list", Data: []PromptTemplate{}}
+	for _, name := range sortedKeys(builtinTemplates) {
+		list.Data = append(list.Data, PromptTemplate{ID: name, Object: "template", Source: "builtin", Template: builtinTemplates[name]})
+	}
+	for _, name := range sortedKeys(PROMPT_TEMPLATES) {
+		list.Data = append(list.Data, PromptTemplate{ID: name, Object: "template", Source: "configured", Template: PROMPT_TEMPLATES[name]})
+	}
+	writeJSON(w, list)
+}
+
+func handleTemplateRender(w http.ResponseWriter, r *http.Request) {
+	var req TemplateRenderRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body", "invalid_request_error", "invalid_body", http.StatusBadRequest)
+		return
+	}
+	if (req.Model == "") == (req.Template == "") {
+		sendError(w, r, "Exactly one of model or template is required", "invalid_request_error", "invalid_template", http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		req.Messages = sampleTemplateMessages
+	}
+	if err := validateMessageRoles(req.Messages); err != nil {
+		sendMessageError(w, r, err)
+		return
+	}
+
+	resp := TemplateRenderResponse{Object: "template.render", Template: req.Template}
+	text, messages := "", ollamaMessages(req.Messages)
+	switch {
+	case builtinTemplates[req.Template] != "":
+		text, resp.Source = builtinTemplates[req.Template], "builtin"
+	case PROMPT_TEMPLATES[req.Template] != "":
+		text, resp.Source = PROMPT_TEMPLATES[req.Template], "configured"
+	case req.Template != "":
+		sendParamError(w, r, "Template `%s` does not exist", "template_not_found", "template", http.StatusNotFound, req.Template)
+		return
+	default:
+		// go through everything a chat completion would, so the preview
+		// shows presets, injected instructions and merged system messages
+		openAIReq := OpenAIChatRequest{Model: req.Model, Messages: req.Messages}
+		apiKey := apiKeyFromRequest(r)
+		requestedModel, _, ok := resolveRequest(r.Context(), &openAIReq, apiKey)
+		if !ok {
+			sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, requestedModel)
+			return
+		}
+		if !modelPermitted(apiKey, requestedModel, openAIReq.Model) {
+			sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, requestedModel)
+			return
+		}
+		if err := enforceRoleAlternation(&openAIReq, len(openAIReq.Messages)-len(req.Messages)); err != nil {
+			sendMessageError(w, r, err)
+			return
+		}
+		provider, model := splitProviderModel(openAIReq.Model)
+		if providerFor(OllamaRequest{Provider: provider}).Type != PROVIDER_OLLAMA {
+			sendError(w, r, "The model `%s` is not served by Ollama, its template is unknown", "invalid_request_error", "template_unavailable", http.StatusBadRequest, openAIReq.Model)
+			return
+		}
+		resp.Model, messages = model, ollamaMessages(openAIReq.Messages)
+
+		if config.LegacyGenerateAPI {
+			text, resp.Template, resp.Source = builtinTemplates["legacy"], "legacy", "builtin"
+			break
+		}
+		info, err := showModel(r.Context(), model)
+		if errors.Is(err, errModelNotFound) {
+			sendError(w, r, "The model `%s` does not exist", "invalid_request_error", "model_not_found", http.StatusNotFound, model)
+			return
+		}
+		if err != nil {
+			sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+			return
+		}
+		text, resp.Template, resp.Source = info.Template, model, "model"
+	}
+
+	prompt, err := renderPromptTemplate(text, messages)
+	if err != nil {
+		sendError(w, r, "Error rendering template: %s", "invalid_request_error", "invalid_template", http.StatusUnprocessableEntity, err)
+		return
+	}
+	resp.Prompt = prompt
+	writeJSON(w, resp)
+}
+
+// ollamaMessages converts messages the way buildOllamaRequest does, minus
+// the images.
+func ollamaMessages(messages []ChatMessage) []OllamaMessage {
+	converted := make([]OllamaMessage, 0, len(messages))
+	for _, msg := range messages {
+		converted = append(converted, OllamaMessage{Role: translate.Role(msg.Role), Content: msg.Content})
+	}
+	return converted
+}
+
+// templateValues mirrors what Ollama hands its templates, so templates that
+// refer to tools or thinking still execute.
+type templateValues struct {
+	System   string
+	Prompt   string
+	Response string
+	Messages []templateMessage
+	Tools    []any
+	Think    bool
+}
+
+type templateMessage struct {
+	Role      string
+	Content   string
+	Thinking  string
+	ToolCalls []any
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+	"currentDate": func() string {
+		return time.Now().Format("2006-01-02")
+	},
+}
+
+// renderPromptTemplate renders messages with a template the way Ollama
+// does. Templates without .Messages are run once per user/assistant turn,
+// and the last turn is cut off where the response would go.
+func renderPromptTemplate(text string, messages []OllamaMessage) (string, error) {
+	tmpl, err := template.New("prompt").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if strings.Contains(text, ".Messages") {
+		values := templateValues{}
+		for _, msg := range messages {
+			values.Messages = append(values.Messages, templateMessage{Role: msg.Role, Content: msg.Content})
+		}
+		err := tmpl.Execute(&out, values)
+		return out.String(), err
+	}
+
+	// stands in for the response of the last turn, which isn't written yet
+	const marker = "\x00response\x00"
+	var turn templateValues
+	var system []string
+	render := func(last bool) error {
+		turn.System = strings.Join(system, "\n\n")
+		system = nil
+		if last {
+			turn.Response = marker
+		}
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, turn); err != nil {
+			return err
+		}
+		rendered := buf.String()
+		if last {
+			rendered, _, _ = strings.Cut(rendered, marker)
+		}
+		out.WriteString(rendered)
+		turn = templateValues{}
+		return nil
+	}
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system":
+			system = append(system, msg.Content)
+		case "user":
+			if turn.Prompt != "" {
+				if err := render(false); err != nil {
+					return "", err
+				}
+			}
+			turn.Prompt = msg.Content
+		case "assistant":
+			turn.Response = msg.Content
+			if err := render(false); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := render(true); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
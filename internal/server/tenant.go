@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener serves the proxy on its own address for one tenant, so several
+// teams can share a proxy while keeping their logs and usage apart.
+type Listener struct {
+	Addr      string `yaml:"addr"`
+	Tenant    string `yaml:"tenant"`
+	LogFile   string `yaml:"log_file"`   // empty logs to stderr, prefixed with the tenant
+	UsageFile string `yaml:"usage_file"` // optional JSON lines file with one record per request
+	// override the routes of the config on this listener
+	Routes map[string]RoutePolicy `yaml:"routes"`
+}
+
+// Headers OpenAI client libraries send to name the organization and project
+// a request is for
+const (
+	ORGANIZATION_HEADER = "OpenAI-Organization"
+	PROJECT_HEADER      = "OpenAI-Project"
+)
+
+// UsageRecord is one line of a tenant usage file, or one usage record of
+// the storage.
+type UsageRecord struct {
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant"`
+	// name of the API key, see APIKey, and its usageKeyHash; the key
+	// itself is never recorded
+	KeyName string `json:"key_name,omitempty"`
+	KeyHash string `json:"key_hash,omitempty"`
+	Model   string `json:"model"`
+	// OpenAI-Organization and OpenAI-Project headers of the request
+	Organization string `json:"organization,omitempty"`
+	Project      string `json:"project,omitempty"`
+	Usage
+	// experiment and variant of the request, see Experiment
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	// prompt and response as the key's store_content keeps them
+	Prompt   string `json:"prompt,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+type tenant struct {
+	name   string
+	log    *slog.Logger
+	logger *log.Logger
+	// encrypts stored prompts and responses, nil stores them as they are
+	aead cipher.AEAD
+
+	usageMu   sync.Mutex
+	usage     io.WriteCloser
+	usageFile string
+}
+
+type tenantContextKey struct{}
+
+// organization is who a request says it is for, see ORGANIZATION_HEADER.
+type organization struct {
+	id      string
+	project string
+}
+
+type organizationContextKey struct{}
+
+var defaultTenant = &tenant{log: slog.Default(), logger: log.Default()}
+
+// tenants are the tenants opened so far by name, listeners of the same
+// tenant share one.
+var tenants = make(map[string]*tenant)
+
+func openTenant(l Listener) (*tenant, error) {
+	if l.Tenant == "" {
+		return defaultTenant, nil
+	}
+	if t, ok := tenants[l.Tenant]; ok {
+		return t, nil
+	}
+
+	t := &tenant{name: l.Tenant}
+	output := logOutput
+	if l.LogFile != "" {
+		f, err := os.OpenFile(l.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file for tenant %s: %w", l.Tenant, err)
+		}
+		output = f
+	}
+	t.log, t.logger = newTenantLoggers(output, l.Tenant)
+
+	if l.UsageFile != "" {
+		f, err := os.OpenFile(l.UsageFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open usage file for tenant %s: %w", l.Tenant, err)
+		}
+		t.usage, t.usageFile = f, l.UsageFile
+	}
+	tenants[l.Tenant] = t
+	return t, nil
+}
+
+// openOrganizationTenants opens the tenants of organization_tenants that no
+// listener has opened. Those log to stderr.
+func openOrganizationTenants() error {
+	for _, name := range config.OrganizationTenants {
+		if _, err := openTenant(Listener{Tenant: name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantMiddleware attributes requests to the listener's tenant or, on a
+// listener without one, to the tenant organization_tenants has for their
+// organization, or for "organization/project" for a single project of it. The organization headers are echoed like OpenAI does.
+func tenantMiddleware(t *tenant, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org := organization{id: r.Header.Get(ORGANIZATION_HEADER), project: r.Header.Get(PROJECT_HEADER)}
+		requestTenant := t
+		if t == defaultTenant && org.id != "" {
+			name, ok := config.OrganizationTenants[org.id+"/"+org.project]
+			if !ok {
+				name, ok = config.OrganizationTenants[org.id]
+			}
+			if ok {
+				requestTenant = tenants[name]
+			}
+		}
+		if org.id != "" {
+			w.Header().Set(ORGANIZATION_HEADER, org.id)
+		}
+		if org.project != "" {
+			w.Header().Set(PROJECT_HEADER, org.project)
+		}
+
+		ctx := context.WithValue(r.Context(), tenantContextKey{}, requestTenant)
+		ctx = context.WithValue(ctx, organizationContextKey{}, org)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func tenantFromContext(ctx context.Context) *tenant {
+	if t, ok := ctx.Value(tenantContextKey{}).(*tenant); ok {
+		return t
+	}
+	return defaultTenant
+}
+
+// recordUsage adds a finished generation to the request's log line and span,
+// charges its tokens to the rate limit, samples it for evaluation and
+// appends it to the usage file or the storage, with as much of prompt and
+// response as the key's store_content allows.
+func (t *tenant) recordUsage(ctx context.Context, apiKey string, model string, usage Usage, prompt, response string) {
+	chargeTokens(ctx, usage.TotalTokens)
+	requestLogFromContext(ctx).addUsage(model, usage)
+	s := spanFromContext(ctx)
+	s.setAttr("gen_ai.response.model", model)
+	s.setAttr("gen_ai.usage.input_tokens", usage.PromptTokens)
+	s.setAttr("gen_ai.usage.output_tokens", usage.CompletionTokens)
+	var keyName string
+	if entry := apiKeys.lookup(apiKey); entry != nil {
+		keyName = entry.Name
+	}
+	sampleForEval(t, apiKey, keyName, model, prompt, response)
+	org, _ := ctx.Value(organizationContextKey{}).(organization)
+	if t.usage == nil && dataStore == nil {
+		return
+	}
+
+	storeContent := storeContentFor(apiKey)
+	experiment, variant := experimentFromContext(ctx)
+	record := UsageRecord{
+		Time:         time.Now().UTC(),
+		Tenant:       t.name,
+		KeyName:      keyName,
+		KeyHash:      usageKeyHash(apiKey),
+		Model:        model,
+		Organization: org.id,
+		Project:      org.project,
+		Usage:        usage,
+		Experiment:   experiment,
+		Variant:      variant,
+		Prompt:       sealContent(t.aead, redact(storeContent, prompt)),
+		Response:     sealContent(t.aead, redact(storeContent, response)),
+	}
+	if dataStore != nil {
+		// the record is kept even when the client is gone by now
+		if err := dataStore.AppendUsage(context.WithoutCancel(ctx), record); err != nil {
+			t.logger.Printf("failed to store usage record: %v", err)
+		}
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	t.usageMu.Lock()
+	defer t.usageMu.Unlock()
+	if _, err := t.usage.Write(append(line, '\n')); err != nil {
+		t.logger.Printf("failed to write usage record: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantMiddlewareOrganizations(t *testing.T) {
+	setConfig(t, Config{OrganizationTenants: map[string]string{"org-research": "research", "org-research/proj_gpu": "research-gpu"}})
+	oldTenants := tenants
+	tenants = make(map[string]*tenant)
+	t.Cleanup(func() { tenants = oldTenants })
+	if err := openOrganizationTenants(); err != nil {
+		t.Fatal(err)
+	}
+	pinned := &tenant{name: "team-a"}
+
+	tests := []struct {
+		name     string
+		listener *tenant
+		org      string
+		project  string
+		want     string
+	}{
+		{"no organization", defaultTenant, "", "", ""},
+		{"organization", defaultTenant, "org-research", "", "research"},
+		{"other project of the organization", defaultTenant, "org-research", "proj_cpu", "research"},
+		{"project", defaultTenant, "org-research", "proj_gpu", "research-gpu"},
+		{"unknown organization", defaultTenant, "org-other", "", ""},
+		{"listener with a tenant", pinned, "org-research", "proj_gpu", "team-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *tenant
+			handler := tenantMiddleware(tt.listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Context().Value(tenantContextKey{}).(*tenant)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			if tt.org != "" {
+				r.Header.Set(ORGANIZATION_HEADER, tt.org)
+			}
+			if tt.project != "" {
+				r.Header.Set(PROJECT_HEADER, tt.project)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got.name != tt.want {
+				t.Errorf("tenant %q, want %q", got.name, tt.want)
+			}
+			if w.Header().Get(ORGANIZATION_HEADER) != tt.org || w.Header().Get(PROJECT_HEADER) != tt.project {
+				t.Errorf("echoed %q and %q, want %q and %q", w.Header().Get(ORGANIZATION_HEADER), w.Header().Get(PROJECT_HEADER), tt.org, tt.project)
+			}
+		})
+	}
+}
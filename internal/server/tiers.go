@@ -0,0 +1,254 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendTier is a group of Ollama backends at the same distance, e.g. the
+// local LAN, a remote datacenter or cloud GPUs. MaxInflight bounds the
+// generations each backend takes before the tier counts as full, 0 means
+// unbounded.
+type BackendTier struct {
+	Name        string   `yaml:"name"`
+	URLs        []string `yaml:"urls"`
+	MaxInflight int      `yaml:"max_inflight"`
+}
+
+const (
+	// How long a backend that failed is skipped
+	BACKEND_RETRY_AFTER = 30 * time.Second
+	// Weight of the newest sample in a backend's latency average
+	BACKEND_LATENCY_WEIGHT = 0.2
+	// Consecutive failed calls that open a backend's circuit: calls to it
+	// then fail right away for CIRCUIT_OPEN_DURATION, after which a single
+	// probe call decides whether it closes again or stays open
+	CIRCUIT_FAILURE_THRESHOLD = 5
+	CIRCUIT_OPEN_DURATION     = 30 * time.Second
+)
+
+type backend struct {
+	url         string
+	tier        string
+	maxInflight int
+	inflight    atomic.Int64
+
+	mu        sync.Mutex
+	latency   time.Duration
+	downUntil time.Time
+	// circuit breaker, see allow
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.After(b.downUntil) && (b.failures < CIRCUIT_FAILURE_THRESHOLD || now.After(b.openUntil) && !b.probing)
+}
+
+// allow reports whether a call may go to the backend, or should fail fast
+// because its circuit is open. Once CIRCUIT_OPEN_DURATION is over the call
+// it lets through is the probe, reported by probe: only that call passes
+// probe on to end and observe, which hear how it went.
+func (b *backend) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < CIRCUIT_FAILURE_THRESHOLD {
+		return false, nil
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) || b.probing {
+		return false, &circuitOpenError{backend: b.url, retryIn: max(b.openUntil.Sub(now), time.Second)}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// circuitOpen reports whether calls to the backend fail fast.
+func (b *backend) circuitOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= CIRCUIT_FAILURE_THRESHOLD
+}
+
+func (b *backend) full() bool {
+	return b.maxInflight > 0 && b.inflight.Load() >= int64(b.maxInflight)
+}
+
+func (b *backend) observedLatency() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latency
+}
+
+// begin and end bracket a call to the backend, probe as returned by allow.
+func (b *backend) begin() {
+	b.inflight.Add(1)
+}
+
+func (b *backend) end(probe bool) {
+	b.inflight.Add(-1)
+	if !probe {
+		return
+	}
+	// a probe whose client went away before an answer proves nothing
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// observe records how long the backend took to answer, up to the response
+// headers. Failed calls, see backendFailed, take it out for
+// BACKEND_RETRY_AFTER and count towards opening its circuit.
+func (b *backend) observe(latency time.Duration, failed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if failed {
+		now := time.Now()
+		b.downUntil = now.Add(BACKEND_RETRY_AFTER)
+		b.failures++
+		if b.failures == CIRCUIT_FAILURE_THRESHOLD || probe {
+			b.openUntil = now.Add(CIRCUIT_OPEN_DURATION)
+			log.Printf("backend %s failed %d times in a row, failing its calls for %s", b.url, b.failures, CIRCUIT_OPEN_DURATION)
+		}
+		return
+	}
+	if b.failures >= CIRCUIT_FAILURE_THRESHOLD {
+		log.Printf("backend %s answered again, closing its circuit", b.url)
+	}
+	b.failures = 0
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency = time.Duration(BACKEND_LATENCY_WEIGHT*float64(latency) + (1-BACKEND_LATENCY_WEIGHT)*float64(b.latency))
+	}
+}
+
+// backendFailed reports whether a call counts against the backend: it could
+// not be reached or timed out, or answered 502, 503 or 504. Other errors are
+// down to the request or the model, not the backend's health.
+func backendFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type backendPool struct {
+	tiers [][]*backend
+}
+
+var ollamaBackends = newBackendPool(backendTiers())
+
+// backendTiers are the tiers of backend_tiers, or a single one with
+// ollama_api_base.
+func backendTiers() []BackendTier {
+	if len(config.BackendTiers) > 0 {
+		return config.BackendTiers
+	}
+	return []BackendTier{{Name: "local", URLs: []string{config.OllamaAPIBase}}}
+}
+
+func newBackendPool(tiers []BackendTier) *backendPool {
+	pool := &backendPool{}
+	for _, tier := range tiers {
+		var backends []*backend
+		for _, url := range tier.URLs {
+			backends = append(backends, &backend{url: url, tier: tier.Name, maxInflight: tier.MaxInflight})
+		}
+		pool.tiers = append(pool.tiers, backends)
+	}
+	return pool
+}
+
+// find returns the backend with url, nil if there is none.
+func (p *backendPool) find(url string) *backend {
+	for _, tier := range p.tiers {
+		for _, b := range tier {
+			if b.url == url {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// pick returns the backend for the next call: the fastest healthy backend
+// with room in the first tier that has one. When every tier is full it
+// spills over to the fastest healthy backend anywhere, and when none is
+// healthy to the first one, so a request still gets a chance.
+//
+// Calls of a session go to the same backend within the tier instead, so its
+// prompt cache stays warm, as long as that backend is healthy and has room.
+// A session pinned to a backend, see pinBackend, stays on it in any tier.
+func (p *backendPool) pick(session string) *backend {
+	now := time.Now()
+	if b := p.find(pinnedBackend(session)); b != nil && b.available(now) && !b.full() {
+		return b
+	}
+	var fallback *backend
+	for _, tier := range p.tiers {
+		var best *backend
+		for _, b := range tier {
+			if !b.available(now) {
+				continue
+			}
+			if fallback == nil || b.observedLatency() < fallback.observedLatency() {
+				fallback = b
+			}
+			if b.full() {
+				continue
+			}
+			switch {
+			case best == nil:
+				best = b
+			case session != "":
+				if affinityScore(session, b) > affinityScore(session, best) {
+					best = b
+				}
+			// backends without samples yet are tried first to get one
+			case b.observedLatency() < best.observedLatency():
+				best = b
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return p.tiers[0][0]
+}
+
+// circuitOpenError fails a call to a backend whose circuit is open.
+type circuitOpenError struct {
+	backend string
+	retryIn time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("backend %s is failing, calls to it are suspended for %s", e.backend, e.retryIn.Round(time.Second))
+}
+
+// sendCircuitOpenError answers a request that couldn't be sent because its
+// backend's circuit is open, with a Retry-After for when it is probed again.
+func sendCircuitOpenError(w http.ResponseWriter, r *http.Request, err *circuitOpenError) {
+	seconds := int(err.retryIn.Round(time.Second).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(w, r, "The model backend is failing and temporarily unavailable, retry in %d seconds", "server_error", "backend_unavailable", http.StatusServiceUnavailable, seconds)
+}
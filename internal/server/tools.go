@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// validateTools rejects malformed tools, tool_choice values and tool calls
+// in the conversation before anything is sent upstream.
+func validateTools(req OpenAIChatRequest) error {
+	for i, tool := range req.Tools {
+		if tool.Type != "function" || tool.Function.Name == "" {
+			return &apiError{
+				status: http.StatusBadRequest, errorType: "invalid_request_error", code: "invalid_tools",
+				param: "tools", format: "tools[%d] must be a function with a name", args: []any{i},
+			}
+		}
+	}
+	if _, _, err := toolChoice(req); err != nil {
+		return err
+	}
+	for i, msg := range req.Messages {
+		for j, call := range msg.ToolCalls {
+			if !json.Valid([]byte(call.Function.Arguments)) && call.Function.Arguments != "" {
+				return &messageError{index: i, field: "tool_calls", format: "tool_calls[%d].function.arguments is not valid JSON", args: []any{j}}
+			}
+		}
+		if msg.Role == "tool" && msg.ToolCallID == "" {
+			return &messageError{index: i, field: "tool_call_id", format: "tool_call_id is required for tool messages"}
+		}
+	}
+	return nil
+}
+
+// toolChoice returns the tools to offer the model given tool_choice, and an
+// instruction for what Ollama can't enforce: that a tool must be called.
+func toolChoice(req OpenAIChatRequest) ([]Tool, string, error) {
+	switch choice := req.ToolChoice.(type) {
+	case nil:
+		return req.Tools, "", nil
+	case string:
+		switch choice {
+		case "auto":
+			return req.Tools, "", nil
+		case "none":
+			return nil, "", nil
+		case "required":
+			return req.Tools, "You must answer by calling one of the provided tools.", nil
+		}
+	case map[string]any:
+		function, _ := choice["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		for _, tool := range req.Tools {
+			if tool.Function.Name == name {
+				return []Tool{tool}, "You must answer by calling the " + name + " tool.", nil
+			}
+		}
+		if name != "" {
+			return nil, "", &apiError{
+				status: http.StatusBadRequest, errorType: "invalid_request_error", code: "invalid_tool_choice",
+				param: "tool_choice", format: "Tool `%s` in tool_choice is not among tools", args: []any{name},
+			}
+		}
+	}
+	return nil, "", &apiError{
+		status: http.StatusBadRequest, errorType: "invalid_request_error", code: "invalid_tool_choice",
+		param: "tool_choice", format: "tool_choice must be none, auto, required or a function",
+	}
+}
+
+// openAIToolCalls converts the model's calls back, with fresh IDs for the
+// client to answer them by.
+func openAIToolCalls(calls []OllamaToolCall) []ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	converted := make([]ToolCall, 0, len(calls))
+	for _, call := range calls {
+		arguments := string(call.Function.Arguments)
+		if arguments == "" {
+			arguments = "{}"
+		}
+		converted = append(converted, ToolCall{
+			ID:       "call_" + generateRandomString(24),
+			Type:     "function",
+			Function: ToolCallFunction{Name: call.Function.Name, Arguments: arguments},
+		})
+	}
+	return converted
+}
+
+// dropToolIncapableAttempts checks the models of a request with tools
+// against their Ollama capabilities. A fallback that can't call tools is
+// skipped, the requested model failing is an error. Models whose
+// capabilities are unknown are left to try.
+func dropToolIncapableAttempts(ctx context.Context, attempts []*upstreamAttempt, logger *log.Logger) ([]*upstreamAttempt, error) {
+	kept := attempts[:0:0]
+	for i, attempt := range attempts {
+		req := attempt.ollamaReq
+		if len(req.Tools) > 0 && usesBackendTiers(req) {
+			info, err := showModel(ctx, req.Model)
+			if err == nil && len(info.Capabilities) > 0 && !slices.Contains(info.Capabilities, "tools") {
+				if i == 0 {
+					return nil, newAPIError(http.StatusBadRequest, "invalid_request_error", "tools_not_supported", "The model `%s` does not support tools", attempt.requestedModel)
+				}
+				logger.Printf("fallback model %s skipped: it does not support tools", req.Model)
+				continue
+			}
+		}
+		kept = append(kept, attempt)
+	}
+	return kept, nil
+}
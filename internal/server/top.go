@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Window over which `top` computes throughput and error counts
+const TOP_WINDOW = time.Minute
+
+type topRequest struct {
+	id      string
+	model   string
+	tenant  string
+	state   string
+	started time.Time
+}
+
+type topCompletion struct {
+	at     time.Time
+	model  string
+	tokens int
+}
+
+// topState is everything `top` knows, rebuilt from the admin event stream.
+type topState struct {
+	mu          sync.Mutex
+	connected   bool
+	lastErr     string
+	live        map[string]*topRequest
+	completions []topCompletion
+	errors      []time.Time
+}
+
+// runTop implements the `top` subcommand: a live terminal view of a running
+// proxy fed by /admin/events.
+func runTop(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	proxyURL := fs.String("url", localProxyURL(config.ListenAddr), "base URL of the proxy")
+	adminKey := fs.String("key", config.AdminAPIKey, "admin API key")
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	fs.Parse(args)
+
+	base, err := url.Parse(strings.TrimSuffix(*proxyURL, "/"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -url: %v\n", err)
+		os.Exit(2)
+	}
+
+	state := &topState{live: make(map[string]*topRequest)}
+	go state.follow(base, *adminKey)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		state.render(base, ready(base), evalTrends(base, *adminKey))
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			fmt.Print("\033[0m\n")
+			return
+		}
+	}
+}
+
+// follow keeps a WebSocket to the event stream open, reconnecting on failure.
+func (s *topState) follow(base *url.URL, adminKey string) {
+	wsURL := *base
+	wsURL.Scheme = strings.Replace(wsURL.Scheme, "http", "ws", 1)
+	wsURL.Path += "/admin/events"
+	header := http.Header{"Authorization": {"Bearer " + adminKey}}
+
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL.String(), header)
+		if err != nil {
+			s.setConnected(false, err.Error())
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		s.setConnected(true, "")
+		for {
+			var ev Event
+			if err := conn.ReadJSON(&ev); err != nil {
+				s.setConnected(false, err.Error())
+				break
+			}
+			s.apply(ev)
+		}
+		conn.Close()
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (s *topState) setConnected(connected bool, lastErr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.lastErr = lastErr
+	if !connected {
+		// whatever was live may have finished while we weren't looking
+		s.live = make(map[string]*topRequest)
+	}
+}
+
+func (s *topState) apply(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch ev.Type {
+	case EVENT_ACCEPTED, EVENT_QUEUED:
+		req, ok := s.live[ev.RequestID]
+		if !ok {
+			req = &topRequest{id: ev.RequestID, model: ev.Model, tenant: ev.Tenant, started: ev.Time}
+			s.live[ev.RequestID] = req
+		}
+		req.state = ev.Type
+	case EVENT_FIRST_TOKEN:
+		if req, ok := s.live[ev.RequestID]; ok {
+			req.state = "generating"
+		}
+	case EVENT_DONE:
+		delete(s.live, ev.RequestID)
+		tokens := 0
+		if ev.Usage != nil {
+			tokens = ev.Usage.CompletionTokens
+		}
+		s.completions = append(s.completions, topCompletion{at: ev.Time, model: ev.Model, tokens: tokens})
+	case EVENT_ERROR:
+		delete(s.live, ev.RequestID)
+		s.errors = append(s.errors, ev.Time)
+	}
+}
+
+func ready(base *url.URL) string {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(base.String() + "/readyz")
+	if err != nil {
+		return "down"
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "not ready"
+	}
+	return "ready"
+}
+
+// evalTrends fetches the quality trends of the sampled models, nil when
+// evaluation is off or they can't be had.
+func evalTrends(base *url.URL, adminKey string) map[string]EvalTrend {
+	client := http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, base.String()+"/admin/eval/trends", nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+adminKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	var trends EvalTrendsResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&trends) != nil {
+		return nil
+	}
+	byModel := make(map[string]EvalTrend, len(trends.Data))
+	for _, trend := range trends.Data {
+		byModel[trend.Model] = trend
+	}
+	return byModel
+}
+
+func (s *topState) render(base *url.URL, readiness string, trends map[string]EvalTrend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-TOP_WINDOW)
+	for len(s.completions) > 0 && s.completions[0].at.Before(cutoff) {
+		s.completions = s.completions[1:]
+	}
+	for len(s.errors) > 0 && s.errors[0].Before(cutoff) {
+		s.errors = s.errors[1:]
+	}
+
+	type modelStats struct {
+		requests, tokens, live int
+	}
+	models := make(map[string]*modelStats)
+	statsFor := func(model string) *modelStats {
+		if models[model] == nil {
+			models[model] = &modelStats{}
+		}
+		return models[model]
+	}
+	for _, c := range s.completions {
+		stats := statsFor(c.model)
+		stats.requests++
+		stats.tokens += c.tokens
+	}
+	for model := range trends {
+		statsFor(model)
+	}
+	queued := 0
+	for _, req := range s.live {
+		statsFor(req.model).live++
+		if req.state == EVENT_QUEUED {
+			queued++
+		}
+	}
+
+	upstream := "ok"
+	if len(s.errors) > 0 {
+		upstream = fmt.Sprintf("%d errors in the last %s", len(s.errors), TOP_WINDOW)
+	}
+	events := "connected"
+	if !s.connected {
+		events = "disconnected: " + s.lastErr
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "ollama-openai-proxy top - %s - %s\n", base, now.Format("15:04:05"))
+	fmt.Fprintf(&b, "proxy: %s   upstream: %s   events: %s\n", readiness, upstream, events)
+	fmt.Fprintf(&b, "live: %d   queued: %d\n\n", len(s.live), queued)
+
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tREQ/MIN\tTOK/S\tLIVE\tQUALITY\tTREND")
+	names := make([]string, 0, len(models))
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := models[name]
+		// judge scores of the latest samples, and how they moved from the
+		// ones before
+		quality, trend := "-", "-"
+		if t := trends[name]; t.RecentScore != nil {
+			quality = fmt.Sprintf("%.1f", *t.RecentScore)
+			if t.PreviousScore != nil {
+				trend = fmt.Sprintf("%+.1f", *t.RecentScore-*t.PreviousScore)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%.1f\t%d\t%s\t%s\n", name,
+			float64(stats.requests)/TOP_WINDOW.Minutes(), float64(stats.tokens)/TOP_WINDOW.Seconds(), stats.live, quality, trend)
+	}
+	tw.Flush()
+	b.WriteString("\n")
+
+	live := make([]*topRequest, 0, len(s.live))
+	for _, req := range s.live {
+		live = append(live, req)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].started.Before(live[j].started) })
+	tw = tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REQUEST\tMODEL\tTENANT\tSTATE\tAGE")
+	for _, req := range live {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", req.id, req.model, req.tenant, req.state, now.Sub(req.started).Round(100*time.Millisecond))
+	}
+	tw.Flush()
+
+	fmt.Print(b.String())
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace context header, read from clients and sent upstream
+const TRACEPARENT_HEADER = "traceparent"
+
+// Finished spans are sent in batches of up to TRACE_BATCH_SIZE at least
+// every TRACE_EXPORT_INTERVAL. Beyond TRACE_QUEUE_SIZE waiting spans new
+// ones are dropped rather than slowing requests down.
+const (
+	TRACE_BATCH_SIZE      = 512
+	TRACE_EXPORT_INTERVAL = 5 * time.Second
+	TRACE_QUEUE_SIZE      = 4096
+	TRACE_EXPORT_TIMEOUT  = 10 * time.Second
+)
+
+// OTLP span kinds
+const (
+	SPAN_KIND_SERVER = 2
+	SPAN_KIND_CLIENT = 3
+)
+
+// span is one timed operation of a trace, exported as OTLP when it ends.
+// Its methods do nothing on a nil span, which is what requests get while
+// tracing is off or their trace isn't sampled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]any
+	err   string
+	ended bool
+}
+
+type spanContextKey struct{}
+
+// tracer exports finished spans to an OTLP/HTTP collector.
+type tracer struct {
+	endpoint string
+	service  string
+	queue    chan *span
+	client   *http.Client
+}
+
+// spanTracer is nil while tracing.endpoint is unset.
+var spanTracer *tracer
+
+func newTracer(c TracingConfig) *tracer {
+	if c.Endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint: strings.TrimSuffix(c.Endpoint, "/") + "/v1/traces",
+		service:  c.ServiceName,
+		queue:    make(chan *span, TRACE_QUEUE_SIZE),
+		client:   &http.Client{Timeout: TRACE_EXPORT_TIMEOUT},
+	}
+	go t.run()
+	return t
+}
+
+// startSpan starts a span in the trace of ctx, or a new trace.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spanTracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// setError marks the span as failed.
+func (s *span) setError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = message
+}
+
+// elapsed is how long the span has been running.
+func (s *span) elapsed() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Since(s.start)
+}
+
+// finish ends the span and queues it for export, only the first call counts.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	select {
+	case spanTracer.queue <- s:
+	default:
+	}
+}
+
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceparent reads the trace and parent span of a traceparent header.
+// Traces the caller didn't sample aren't recorded, ok is false for them and
+// for malformed headers.
+func parseTraceparent(header string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || flags&1 == 0 {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// tracingMiddleware records a server span per request, continuing the
+// client's trace when it sends a sampled traceparent.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spanTracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if header := r.Header.Get(TRACEPARENT_HEADER); header != "" {
+			traceID, spanID, ok := parseTraceparent(header)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx = context.WithValue(ctx, spanContextKey{}, &span{traceID: traceID, spanID: spanID})
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, SPAN_KIND_SERVER)
+		defer s.finish()
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		if name := tenantFromContext(ctx).name; name != "" {
+			s.setAttr("tenant", name)
+		}
+		if entry := apiKeys.lookup(apiKeyFromRequest(r)); entry != nil && entry.Name != "" {
+			s.setAttr("api_key.name", entry.Name)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		s.setAttr("http.response.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			s.setError(http.StatusText(rec.status))
+		}
+	})
+}
+
+// tracingTransport records a client span per upstream call and passes the
+// trace on in traceparent. The span lasts until the body is read or closed,
+// so it covers a streamed generation.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if spanFromContext(req.Context()) == nil {
+		return t.base.RoundTrip(req)
+	}
+	_, s := startSpan(req.Context(), req.Method+" "+req.URL.Path, SPAN_KIND_CLIENT)
+	s.setAttr("http.request.method", req.Method)
+	s.setAttr("server.address", req.URL.Host)
+	s.setAttr("url.path", req.URL.Path)
+	req = req.Clone(req.Context())
+	req.Header.Set(TRACEPARENT_HEADER, s.traceparent())
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		s.setError(err.Error())
+		s.finish()
+		return nil, err
+	}
+	s.setAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusBadRequest {
+		s.setError(resp.Status)
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: s}
+	return resp, nil
+}
+
+// spanBody ends its span once the body is done with.
+type spanBody struct {
+	io.ReadCloser
+	span *span
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.span.finish()
+	} else if err != nil {
+		b.span.setError(err.Error())
+		b.span.finish()
+	}
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	b.span.finish()
+	return b.ReadCloser.Close()
+}
+
+// run sends the queued spans in batches.
+func (t *tracer) run() {
+	ticker := time.NewTicker(TRACE_EXPORT_INTERVAL)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) < TRACE_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// OTLP/HTTP JSON, see opentelemetry-proto's trace service
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 unset, 2 error
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: key, Value: otlpValue(value)})
+	}
+	if s.err != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return out
+}
+
+func (t *tracer) export(batch []*span) error {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, len(batch))}
+	scope.Scope.Name = "ollama-openai-proxy"
+	for i, s := range batch {
+		scope.Spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue(t.service)}}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, CONTENT_TYPE_JSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limits of streaming transcription sessions
+const (
+	TRANSCRIPTION_MAX_FRAME = 1 << 20 // bytes of audio per WebSocket message
+	// how long to wait for the backend's final transcript after the client
+	// has gone
+	TRANSCRIPTION_CLOSE_GRACE = 5 * time.Second
+)
+
+// TranscriptionEvent is what clients of /v1/audio/transcriptions/stream
+// receive: the current guess at the segment being spoken while it is
+// (transcript.partial), then its final text (transcript.final).
+type TranscriptionEvent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// TranscriptionErrorEvent ends a stream that failed.
+type TranscriptionErrorEvent struct {
+	Type string `json:"type"` // always "error"
+	ErrorResponse
+}
+
+// backendTranscript is a message of the whisper backend. Backends differ in
+// how they flag a finished segment, both common spellings are understood.
+type backendTranscript struct {
+	Text    string `json:"text"`
+	Final   bool   `json:"final"`
+	IsFinal bool   `json:"is_final"`
+}
+
+var transcriptionUpgrader = websocket.Upgrader{
+	// authenticated by API key like any other endpoint, CORS doesn't apply
+	// to WebSockets
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleTranscriptionStream relays a WebSocket of microphone audio to the
+// streaming whisper backend at audio.transcription_url and its transcripts
+// back as TranscriptionEvents. Binary messages are audio and text messages
+// control messages for the backend, both passed through as they are; the
+// model, language and sample_rate query parameters are passed on too. A
+// client that is done sends {"type": "end"}, the backend then has
+// TRANSCRIPTION_CLOSE_GRACE to send the rest of the transcript before the
+// proxy closes the stream.
+func handleTranscriptionStream(w http.ResponseWriter, r *http.Request) {
+	if config.Audio.TranscriptionURL == "" {
+		sendError(w, r, "Streaming transcription is not enabled on this proxy", "invalid_request_error", "not_found", http.StatusNotFound)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		sendError(w, r, "This endpoint only accepts WebSocket connections", "invalid_request_error", "websocket_required", http.StatusBadRequest)
+		return
+	}
+	model := r.URL.Query().Get("model")
+	if model != "" && !modelPermitted(apiKeyFromRequest(r), model, model) {
+		sendError(w, r, "The model `%s` is not available on this proxy", "invalid_request_error", "model_not_allowed", http.StatusForbidden, model)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout(r))
+	defer cancel()
+	backend, resp, err := websocket.DefaultDialer.DialContext(ctx, transcriptionBackendURL(r.URL.Query()), nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		sendError(w, r, "Error connecting to the transcription backend: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	defer backend.Close()
+
+	client, err := transcriptionUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	client.SetReadLimit(TRANSCRIPTION_MAX_FRAME)
+
+	requestID := "stt-" + generateRandomString(10)
+	log.Printf("[%s] transcription stream opened", requestID)
+	defer log.Printf("[%s] transcription stream closed", requestID)
+
+	// client to backend; after the end of the audio the backend gets a
+	// moment to send what it still has
+	clientDone, audioEnded := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		for {
+			kind, data, err := client.ReadMessage()
+			if err != nil {
+				cancel()
+				return
+			}
+			backend.SetWriteDeadline(time.Now().Add(config.ClientWriteTimeout))
+			if err := backend.WriteMessage(kind, data); err != nil {
+				cancel()
+				return
+			}
+			if kind == websocket.TextMessage && isEndOfAudio(data) {
+				backend.SetReadDeadline(time.Now().Add(TRANSCRIPTION_CLOSE_GRACE))
+				close(audioEnded)
+				// anything after the end is ignored, reading only notices
+				// the client going away
+				for {
+					if _, _, err := client.NextReader(); err != nil {
+						cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		backend.Close()
+	}()
+
+	send := func(ev any) error {
+		client.SetWriteDeadline(time.Now().Add(config.ClientWriteTimeout))
+		return client.WriteJSON(ev)
+	}
+	fail := func(format, code string, args ...any) {
+		ev := TranscriptionErrorEvent{Type: "error"}
+		ev.Error.Message = localizeError(r, format, args...)
+		ev.Error.Type = "server_error"
+		ev.Error.Code = code
+		send(ev)
+	}
+	for {
+		kind, data, err := backend.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			break
+		}
+		if err != nil {
+			select {
+			case <-clientDone:
+				// nobody is listening anymore
+			case <-audioEnded:
+				// the backend had its chance to finish
+			default:
+				if ctx.Err() == context.DeadlineExceeded {
+					fail("Transcription stream exceeded the request timeout", "timeout")
+				} else {
+					fail("Transcription backend failed: %s", "internal_error", err)
+				}
+			}
+			break
+		}
+		var transcript backendTranscript
+		if kind != websocket.TextMessage || json.Unmarshal(data, &transcript) != nil || strings.TrimSpace(transcript.Text) == "" {
+			continue
+		}
+		ev := TranscriptionEvent{Type: "transcript.partial", Text: transcript.Text}
+		if transcript.Final || transcript.IsFinal {
+			ev.Type = "transcript.final"
+		}
+		if err := send(ev); err != nil {
+			return
+		}
+	}
+	client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// isEndOfAudio reports whether a client's text message is {"type": "end"}.
+func isEndOfAudio(data []byte) bool {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &msg) == nil && msg.Type == "end"
+}
+
+// transcriptionBackendURL is audio.transcription_url with the client's
+// session parameters added.
+func transcriptionBackendURL(query url.Values) string {
+	u, _ := url.Parse(config.Audio.TranscriptionURL)
+	backendQuery := u.Query()
+	for _, param := range []string{"model", "language", "sample_rate"} {
+		if value := query.Get(param); value != "" {
+			backendQuery.Set(param, value)
+		}
+	}
+	u.RawQuery = backendQuery.Encode()
+	return u.String()
+}
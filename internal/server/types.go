@@ -0,0 +1,41 @@
+package server
+
+import (
+	"ollama-openai-proxy/ollama"
+	"ollama-openai-proxy/openai"
+)
+
+// Names the proxy uses for the wire types of the openai and ollama
+// packages.
+type (
+	OpenAIChatRequest       = openai.ChatRequest
+	StreamOptions           = openai.StreamOptions
+	ProxyExtensions         = openai.ProxyExtensions
+	OllamaExtension         = openai.OllamaExtension
+	ChatMessage             = openai.ChatMessage
+	ContentPart             = openai.ContentPart
+	ImageURL                = openai.ImageURL
+	StopSequences           = openai.StopSequences
+	ResponseFormat          = openai.ResponseFormat
+	JSONSchemaFormat        = openai.JSONSchemaFormat
+	Tool                    = openai.Tool
+	ToolFunction            = openai.ToolFunction
+	ToolCall                = openai.ToolCall
+	ToolCallFunction        = openai.ToolCallFunction
+	OpenAIChatResponse      = openai.ChatResponse
+	Choice                  = openai.Choice
+	Usage                   = openai.Usage
+	ContentFilterResult     = openai.ContentFilterResult
+	ContentFilterInnerError = openai.ContentFilterInnerError
+	ErrorResponse           = openai.ErrorResponse
+	ChatCompletionChunk     = openai.ChatCompletionChunk
+	ChunkChoice             = openai.ChunkChoice
+	ChunkDelta              = openai.ChunkDelta
+
+	OllamaRequest          = ollama.Request
+	OllamaOptions          = ollama.Options
+	OllamaMessage          = ollama.Message
+	OllamaToolCall         = ollama.ToolCall
+	OllamaToolCallFunction = ollama.ToolCallFunction
+	OllamaResponse         = ollama.Response
+)
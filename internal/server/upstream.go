@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamClient makes the calls to Ollama, OpenAI-compatible providers and
+// the speech backends, reusing connections across requests. It is rebuilt
+// from the upstream settings at startup.
+var upstreamClient = newUpstreamClient(DefaultConfig().Upstream)
+
+// newUpstreamClient has no overall timeout, a generation can take as long
+// as the request's deadline allows. Instead connecting is bounded, and so is
+// any wait for data from upstream, which catches a backend that hangs in
+// the middle of a generation.
+func newUpstreamClient(c UpstreamConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &tracingTransport{base: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &idleTimeoutConn{Conn: conn, timeout: c.ReadTimeout}, nil
+			},
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   c.ConnectTimeout,
+			MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+			IdleConnTimeout:       c.IdleConnTimeout,
+			ExpectContinueTimeout: time.Second,
+		}},
+	}
+}
+
+// idleTimeoutConn fails a read that waits longer than timeout for data.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
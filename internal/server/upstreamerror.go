@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Phrases of upstream errors about a prompt too long for the model: Ollama's
+// embed endpoint and runner, and OpenAI-compatible providers
+var CONTEXT_LENGTH_PHRASES = []string{"context length", "context_length_exceeded", "context window"}
+
+// Phrases of upstream errors about a busy server, e.g. Ollama beyond
+// OLLAMA_MAX_QUEUE answers "server busy, please try again"
+var OVERLOADED_PHRASES = []string{"server busy", "overloaded", "too many requests"}
+
+// upstreamError is an error answer of Ollama or an OpenAI-compatible
+// provider.
+type upstreamError struct {
+	upstream string // "ollama" or the provider
+	model    string
+	status   int // 0 for an error reported mid-stream
+	body     string
+}
+
+func (e *upstreamError) Error() string {
+	if e.status == 0 {
+		return fmt.Sprintf("%s API error: %s", e.upstream, e.body)
+	}
+	return fmt.Sprintf("%s API error (status %d): %s", e.upstream, e.status, e.body)
+}
+
+// upstreamAPIError maps an upstream failure to the OpenAI error clients
+// expect for it: an unknown model, a prompt too long or an overloaded
+// upstream. Other failures give nil and stay an internal error.
+func upstreamAPIError(err error) *apiError {
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		return nil
+	}
+	body := strings.ToLower(upErr.body)
+	switch {
+	case upErr.upstream == "ollama" && (upErr.status == http.StatusNotFound || strings.Contains(body, "not found")):
+		return newAPIError(http.StatusNotFound, "invalid_request_error", "model_not_found", "The model `%s` is not installed on Ollama", upErr.model)
+	case upErr.status == http.StatusNotFound || strings.Contains(body, "model") && strings.Contains(body, "not found"):
+		return newAPIError(http.StatusNotFound, "invalid_request_error", "model_not_found", "The model `%s` does not exist", upErr.model)
+	case containsAny(body, CONTEXT_LENGTH_PHRASES):
+		apiErr := newAPIError(http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", "The input exceeds the context length of the model `%s`", upErr.model)
+		apiErr.param = "messages"
+		return apiErr
+	case upErr.status == http.StatusTooManyRequests || upErr.status == http.StatusServiceUnavailable || containsAny(body, OVERLOADED_PHRASES):
+		return newAPIError(http.StatusTooManyRequests, "server_error", "model_overloaded", "The model `%s` is overloaded, please retry later", upErr.model)
+	}
+	return nil
+}
+
+func containsAny(s string, phrases []string) bool {
+	for _, phrase := range phrases {
+		if strings.Contains(s, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendUpstreamAPIError sends an error of upstreamAPIError, naming param
+// as the request field a context length error is about.
+func sendUpstreamAPIError(w http.ResponseWriter, r *http.Request, apiErr *apiError, param string) {
+	if apiErr.param != "" {
+		sendParamError(w, r, apiErr.format, apiErr.code, param, apiErr.status, apiErr.args...)
+		return
+	}
+	sendError(w, r, apiErr.format, apiErr.errorType, apiErr.code, apiErr.status, apiErr.args...)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Roles the proxy accepts in messages
+var KNOWN_ROLES = map[string]bool{
+	"system":    true,
+	"developer": true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+}
+
+// alternatingRoleModels are the compiled alternating_role_models, see
+// setup: models whose templates only work with strictly alternating
+// user/assistant turns after the system prompt, like Mistral and Gemma.
+var alternatingRoleModels []*regexp.Regexp
+
+// messageError points at the offending message of a request. format and
+// args describe the problem, so it can be translated.
+type messageError struct {
+	index  int
+	field  string
+	format string
+	args   []any
+}
+
+func (e *messageError) Error() string {
+	return fmt.Sprintf("messages[%d]: "+e.format, append([]any{e.index}, e.args...)...)
+}
+
+func (e *messageError) param() string {
+	return fmt.Sprintf("messages[%d].%s", e.index, e.field)
+}
+
+func sendMessageError(w http.ResponseWriter, r *http.Request, err *messageError) {
+	sendParamError(w, r, "messages[%d]: "+err.format, "invalid_messages", err.param(), http.StatusBadRequest, append([]any{err.index}, err.args...)...)
+}
+
+func validateMessageRoles(messages []ChatMessage) *messageError {
+	for i, msg := range messages {
+		if msg.Role == "" {
+			return &messageError{index: i, field: "role", format: "role is required"}
+		}
+		if !KNOWN_ROLES[msg.Role] {
+			return &messageError{index: i, field: "role", format: "unknown role %q", args: []any{msg.Role}}
+		}
+	}
+	return nil
+}
+
+// enforceRoleAlternation checks, and with repair_role_alternation fixes, the
+// user/assistant alternation for models that need it. offset is how many
+// messages the proxy prepended, so errors point at the client's own indices.
+func enforceRoleAlternation(req *OpenAIChatRequest, offset int) *messageError {
+	if !matchesAnyPattern(alternatingRoleModels, req.Model) {
+		return nil
+	}
+
+	repaired := make([]ChatMessage, 0, len(req.Messages))
+	expected := "user"
+	for i, msg := range req.Messages {
+		if msg.Role == "system" || msg.Role == "developer" || msg.Role == "tool" {
+			repaired = append(repaired, msg)
+			continue
+		}
+
+		if msg.Role != expected {
+			last := len(repaired) - 1
+			if !config.RepairRoleAlternation || last < 0 || repaired[last].Role != msg.Role {
+				return &messageError{
+					index:  i - offset,
+					field:  "role",
+					format: "expected a %s message, %s requires alternating user/assistant roles starting with user",
+					args:   []any{expected, req.Model},
+				}
+			}
+			repaired[last].Content += "\n\n" + msg.Content
+			repaired[last].ImageURLs = append(repaired[last].ImageURLs, msg.ImageURLs...)
+			repaired[last].ToolCalls = append(repaired[last].ToolCalls, msg.ToolCalls...)
+			continue
+		}
+
+		repaired = append(repaired, msg)
+		if expected == "user" {
+			expected = "assistant"
+		} else {
+			expected = "user"
+		}
+	}
+	req.Messages = repaired
+	return nil
+}
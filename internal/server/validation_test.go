@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnforceRoleAlternation(t *testing.T) {
+	oldModels := alternatingRoleModels
+	alternatingRoleModels = compileGlobPatterns([]string{"mistral*"})
+	t.Cleanup(func() { alternatingRoleModels = oldModels })
+
+	tests := []struct {
+		name   string
+		model  string
+		repair bool
+		roles  []string
+		// roles after the repair, or the message out of turn with the error
+		want string
+	}{
+		{"alternating", "mistral:7b", false, []string{"system", "user", "assistant", "user"}, "system user assistant user"},
+		{"other model", "llama3", false, []string{"user", "user"}, "user user"},
+		{"repaired", "mistral:7b", true, []string{"system", "user", "user", "assistant", "assistant", "user"}, "system user assistant user"},
+		{"not repaired", "mistral:7b", false, []string{"system", "user", "user"}, "messages[2]"},
+		{"starting with assistant", "mistral:7b", true, []string{"assistant", "user"}, "messages[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.RepairRoleAlternation = tt.repair
+			setConfig(t, cfg)
+			req := OpenAIChatRequest{Model: tt.model}
+			for _, role := range tt.roles {
+				req.Messages = append(req.Messages, ChatMessage{Role: role, Content: role})
+			}
+			if err := enforceRoleAlternation(&req, 0); err != nil {
+				if !strings.HasPrefix(err.Error(), tt.want) {
+					t.Errorf("error %v, want one about %s", err, tt.want)
+				}
+				return
+			}
+			var roles []string
+			for _, msg := range req.Messages {
+				roles = append(roles, msg.Role)
+			}
+			if got := strings.Join(roles, " "); got != tt.want {
+				t.Errorf("roles %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
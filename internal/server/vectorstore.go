@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"ollama-openai-proxy/translate"
+)
+
+// Results of POST /v1/search
+const (
+	SEARCH_DEFAULT_TOP_K = 5
+	SEARCH_MAX_TOP_K     = 100
+)
+
+// Collection searched when a request names none
+const DEFAULT_COLLECTION = "default"
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var (
+	errCollectionExists   = errors.New("collection exists")
+	errCollectionNotFound = errors.New("collection not found")
+)
+
+// VectorRecord is one embedded chunk of a collection, a line of its file.
+type VectorRecord struct {
+	ID        string            `json:"id"`
+	Text      string            `json:"text"`
+	Embedding []float64         `json:"embedding"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// CollectionInfo describes a collection and is the first line of its file.
+type CollectionInfo struct {
+	Namespace      string `json:"namespace"`
+	Name           string `json:"name"`
+	EmbeddingModel string `json:"embedding_model"`
+	Created        int64  `json:"created"`
+}
+
+// vectorStore is the RAG index: collections of embedded chunks, each owned
+// by one namespace (see ragNamespace) and invisible to every other. Each
+// collection is a JSONL file under vector_store.path, held in memory and
+// searched exhaustively by cosine similarity. Nil when no path is configured.
+type vectorStore struct {
+	dir string
+
+	mu          sync.RWMutex
+	collections map[string]*collection // by namespace and name, see collectionKey
+}
+
+type collection struct {
+	CollectionInfo
+	file string
+
+	mu         sync.RWMutex
+	records    []VectorRecord
+	norms      []float64
+	dimensions int
+}
+
+var vectorIndex *vectorStore
+
+func collectionKey(namespace, name string) string {
+	return namespace + "\x00" + name
+}
+
+// openVectorStore loads every collection under dir, creating it if needed.
+func openVectorStore(dir string) (*vectorStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create vector store: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vector store: %w", err)
+	}
+
+	store := &vectorStore{dir: dir, collections: make(map[string]*collection)}
+	for _, file := range files {
+		c, err := loadCollection(file)
+		if err != nil {
+			return nil, err
+		}
+		store.collections[collectionKey(c.Namespace, c.Name)] = c
+	}
+	return store, nil
+}
+
+func loadCollection(file string) (*collection, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open collection: %w", err)
+	}
+	defer f.Close()
+
+	c := &collection{file: file}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("collection %s: missing header: %v", file, scanner.Err())
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &c.CollectionInfo); err != nil {
+		return nil, fmt.Errorf("collection %s, header: %w", file, err)
+	}
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record VectorRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("collection %s, line %d: %w", file, line, err)
+		}
+		if err := c.check(record); err != nil {
+			return nil, fmt.Errorf("collection %s, line %d: %w", file, line, err)
+		}
+		c.add(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read collection %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// collectionFile is where a collection is kept. Namespaces go through a hash
+// since they are made of tenant and key names.
+func (s *vectorStore) collectionFile(namespace, name string) string {
+	hash := sha256.Sum256([]byte(namespace))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:8]), name+".jsonl")
+}
+
+func (s *vectorStore) create(namespace, name, embeddingModel string) (*collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := collectionKey(namespace, name)
+	if _, ok := s.collections[key]; ok {
+		return nil, errCollectionExists
+	}
+
+	c := &collection{
+		CollectionInfo: CollectionInfo{Namespace: namespace, Name: name, EmbeddingModel: embeddingModel, Created: getCurrentUnixTimestamp()},
+		file:           s.collectionFile(namespace, name),
+	}
+	var header bytes.Buffer
+	if err := writeJSON(&header, c.CollectionInfo); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %w", err)
+	}
+	if err := os.WriteFile(c.file, header.Bytes(), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %w", err)
+	}
+	s.collections[key] = c
+	return c, nil
+}
+
+func (s *vectorStore) get(namespace, name string) *collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.collections[collectionKey(namespace, name)]
+}
+
+// list returns the collections of namespace by name.
+func (s *vectorStore) list(namespace string) []*collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*collection
+	for _, c := range s.collections {
+		if c.Namespace == namespace {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *vectorStore) delete(namespace, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := collectionKey(namespace, name)
+	c, ok := s.collections[key]
+	if !ok {
+		return errCollectionNotFound
+	}
+	if err := os.Remove(c.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete collection: %w", err)
+	}
+	delete(s.collections, key)
+	return nil
+}
+
+// check rejects a record that doesn't fit the collection. Every record has
+// to have been embedded with the same model, so they all need the same
+// number of dimensions.
+func (c *collection) check(record VectorRecord) error {
+	if len(record.Embedding) == 0 {
+		return fmt.Errorf("record %q has no embedding", record.ID)
+	}
+	if c.dimensions != 0 && len(record.Embedding) != c.dimensions {
+		return fmt.Errorf("record %q has %d dimensions, the collection has %d", record.ID, len(record.Embedding), c.dimensions)
+	}
+	return nil
+}
+
+func (c *collection) add(record VectorRecord) {
+	if c.dimensions == 0 {
+		c.dimensions = len(record.Embedding)
+	}
+	c.records = append(c.records, record)
+	c.norms = append(c.norms, vectorNorm(record.Embedding))
+}
+
+// append stores records in the collection's file, then makes them
+// searchable.
+func (c *collection) append(records []VectorRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines bytes.Buffer
+	dimensions := c.dimensions
+	for _, record := range records {
+		if dimensions == 0 {
+			dimensions = len(record.Embedding)
+		}
+		if len(record.Embedding) != dimensions {
+			return fmt.Errorf("record %q has %d dimensions, the collection has %d", record.ID, len(record.Embedding), dimensions)
+		}
+		if err := writeJSON(&lines, record); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(c.file, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open collection: %w", err)
+	}
+	_, err = f.Write(lines.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write collection: %w", err)
+	}
+	for _, record := range records {
+		c.add(record)
+	}
+	return nil
+}
+
+func (c *collection) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.records)
+}
+
+type SearchResult struct {
+	Object   string            `json:"object"`
+	ID       string            `json:"id"`
+	Score    float64           `json:"score"`
+	Text     string            `json:"text"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// search returns the k records most similar to query, best first.
+func (c *collection) search(query []float64, k int) ([]SearchResult, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.dimensions != 0 && len(query) != c.dimensions {
+		return nil, fmt.Errorf("the query embedding has %d dimensions, the collection %d", len(query), c.dimensions)
+	}
+
+	queryNorm := vectorNorm(query)
+	results := make([]SearchResult, 0, len(c.records))
+	for i, record := range c.records {
+		var dot float64
+		for j, x := range record.Embedding {
+			dot += x * query[j]
+		}
+		score := 0.0
+		if queryNorm > 0 && c.norms[i] > 0 {
+			// clamped, rounding can take it just past ±1
+			score = min(max(dot/(queryNorm*c.norms[i]), -1), 1)
+		}
+		results = append(results, SearchResult{Object: "search.result", ID: record.ID, Score: score, Text: record.Text, Metadata: record.Metadata})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results[:min(k, len(results))], nil
+}
+
+func vectorNorm(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// ragNamespace is the namespace owning the collections a request sees: its
+// tenant plus its API key's namespace, which defaults to the key's name.
+// Unnamed keys get one of their own derived from the key. Without API keys
+// everyone on a listener shares one namespace.
+func ragNamespace(r *http.Request) string {
+	namespace := tenantFromContext(r.Context()).name + "/"
+	key := apiKeyFromRequest(r)
+	entry := apiKeys.lookup(key)
+	switch {
+	case entry == nil:
+		return namespace
+	case entry.Namespace != "":
+		return namespace + entry.Namespace
+	case entry.Name != "":
+		return namespace + entry.Name
+	}
+	hash := sha256.Sum256([]byte(key))
+	return namespace + "key-" + hex.EncodeToString(hash[:6])
+}
+
+type SearchRequest struct {
+	Query      string `json:"query"`
+	Collection string `json:"collection,omitempty"`
+	TopK       int    `json:"top_k,omitempty"`
+}
+
+type SearchResponse struct {
+	Object     string         `json:"object"`
+	Model      string         `json:"model"`
+	Collection string         `json:"collection"`
+	Data       []SearchResult `json:"data"`
+	Usage      EmbeddingUsage `json:"usage"`
+}
+
+// handleSearch serves POST /v1/search: the query is embedded with the
+// collection's embedding model and its closest records are returned.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if vectorIndex == nil {
+		sendError(w, r, "No vector store is configured", "invalid_request_error", "vector_store_disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req SearchRequest
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	if req.Query == "" {
+		sendParamError(w, r, "Query is required", "invalid_query", "query", http.StatusBadRequest)
+		return
+	}
+	if req.Collection == "" {
+		req.Collection = DEFAULT_COLLECTION
+	}
+	if req.TopK == 0 {
+		req.TopK = SEARCH_DEFAULT_TOP_K
+	}
+	if req.TopK < 0 || req.TopK > SEARCH_MAX_TOP_K {
+		sendParamError(w, r, "top_k must be between 1 and %d", "invalid_top_k", "top_k", http.StatusBadRequest, SEARCH_MAX_TOP_K)
+		return
+	}
+	c := vectorIndex.get(ragNamespace(r), req.Collection)
+	if c == nil {
+		sendParamError(w, r, "Collection `%s` does not exist", "collection_not_found", "collection", http.StatusNotFound, req.Collection)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout(r))
+	defer cancel()
+	query, _, err := embed(ctx, c.EmbeddingModel, req.Query)
+	if err != nil {
+		sendError(w, r, "Error calling Ollama API: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	results, err := c.search(query, req.TopK)
+	if err != nil {
+		sendError(w, r, "Error searching the vector store: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := SearchResponse{Object: "list", Model: c.EmbeddingModel, Collection: c.Name, Data: results}
+	resp.Usage.PromptTokens = translate.EstimateTokens(req.Query)
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	tenantFromContext(r.Context()).recordUsage(r.Context(), apiKeyFromRequest(r), c.EmbeddingModel, Usage{PromptTokens: resp.Usage.PromptTokens, TotalTokens: resp.Usage.TotalTokens}, "", "")
+	writeJSON(w, resp)
+}
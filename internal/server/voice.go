@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Defaults of POST /v1/audio/chat, in the OpenAI names speech backends
+// usually accept
+const (
+	VOICE_MAX_AUDIO_BYTES      = 25 << 20
+	VOICE_DEFAULT_STT_MODEL    = "whisper-1"
+	VOICE_DEFAULT_TTS_MODEL    = "tts-1"
+	VOICE_DEFAULT_VOICE        = "alloy"
+	VOICE_DEFAULT_AUDIO_FORMAT = "mp3"
+)
+
+// VoiceChatResponse is the answer of a voice turn: what was heard, what the
+// model replied and the reply spoken.
+type VoiceChatResponse struct {
+	Object     string     `json:"object"`
+	Model      string     `json:"model"`
+	Transcript string     `json:"transcript"`
+	Text       string     `json:"text"`
+	Audio      VoiceAudio `json:"audio"`
+	Usage      Usage      `json:"usage"`
+}
+
+type VoiceAudio struct {
+	Format string `json:"format"`
+	Data   string `json:"data"` // base64
+}
+
+// handleVoiceChat serves POST /v1/audio/chat: a multipart form with the
+// spoken `file` and the chat `model` is transcribed by the speech-to-text
+// backend, answered like a chat completion and the answer synthesized by
+// the text-to-speech backend, so a voice assistant needs one call per turn.
+// Earlier turns can be given as a JSON `messages` array. With stream=true
+// the audio is passed on as the backend produces it instead of being
+// returned as base64 JSON, with the texts in X-Transcript and X-Reply-Text.
+func handleVoiceChat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+
+	if r.Method != http.MethodPost {
+		sendError(w, r, "Method not allowed", "invalid_request_error", "method_not_allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.Audio.STTURL == "" || config.Audio.TTSURL == "" {
+		sendError(w, r, "Voice chat is not enabled on this proxy", "invalid_request_error", "not_found", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, VOICE_MAX_AUDIO_BYTES+1<<20)
+	if err := r.ParseMultipartForm(VOICE_MAX_AUDIO_BYTES); err != nil {
+		sendError(w, r, "Invalid request body: %s", "invalid_request_error", "invalid_body", http.StatusBadRequest, err)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	audio, header, err := r.FormFile("file")
+	if err != nil {
+		sendParamError(w, r, "file must be an audio file", "invalid_file", "file", http.StatusBadRequest)
+		return
+	}
+	defer audio.Close()
+	model := r.FormValue("model")
+	if model == "" {
+		sendError(w, r, "Model is required", "invalid_request_error", "invalid_model", http.StatusBadRequest)
+		return
+	}
+	var messages []ChatMessage
+	if history := r.FormValue("messages"); history != "" {
+		if err := json.Unmarshal([]byte(history), &messages); err != nil {
+			sendParamError(w, r, "messages must be a JSON array of chat messages", "invalid_messages", "messages", http.StatusBadRequest)
+			return
+		}
+	}
+	format := formValue(r, "response_format", VOICE_DEFAULT_AUDIO_FORMAT)
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout(r))
+	defer cancel()
+
+	transcript, err := transcribe(ctx, audio, header.Filename, formValue(r, "stt_model", VOICE_DEFAULT_STT_MODEL), r.FormValue("language"))
+	if err != nil {
+		sendError(w, r, "Error calling the speech-to-text backend: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	if strings.TrimSpace(transcript) == "" {
+		sendParamError(w, r, "No speech was recognized in the audio", "no_speech", "file", http.StatusUnprocessableEntity)
+		return
+	}
+
+	messages = append(messages, ChatMessage{Role: "user", Content: transcript})
+	completion := voiceReply(ctx, r, OpenAIChatRequest{Model: model, Messages: messages})
+	for k, v := range completion.header {
+		w.Header()[k] = v
+	}
+	if completion.status != http.StatusOK {
+		// the completion's own error
+		w.WriteHeader(completion.status)
+		w.Write(completion.body.Bytes())
+		return
+	}
+	var reply OpenAIChatResponse
+	if err := json.Unmarshal(completion.body.Bytes(), &reply); err != nil {
+		sendError(w, r, "Error reading the chat completion: %s", "server_error", "internal_error", http.StatusInternalServerError, err)
+		return
+	}
+	text := ""
+	if len(reply.Choices) > 0 {
+		text = reply.Choices[0].Message.Content
+	}
+
+	speech, err := synthesize(ctx, text, formValue(r, "tts_model", VOICE_DEFAULT_TTS_MODEL), formValue(r, "voice", VOICE_DEFAULT_VOICE), format)
+	if err != nil {
+		sendError(w, r, "Error calling the text-to-speech backend: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	defer speech.Body.Close()
+
+	if stream, _ := strconv.ParseBool(r.FormValue("stream")); stream {
+		w.Header().Set("Content-Type", speech.Header.Get("Content-Type"))
+		w.Header().Set("X-Transcript", url.PathEscape(transcript))
+		w.Header().Set("X-Reply-Text", url.PathEscape(text))
+		sw := newStreamWriter(w)
+		io.Copy(sw, speech.Body)
+		sw.close()
+		return
+	}
+	data, err := io.ReadAll(speech.Body)
+	if err != nil {
+		sendError(w, r, "Error calling the text-to-speech backend: %s", "server_error", "internal_error", http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, VoiceChatResponse{
+		Object:     "voice.chat",
+		Model:      reply.Model,
+		Transcript: transcript,
+		Text:       text,
+		Audio:      VoiceAudio{Format: format, Data: base64.StdEncoding.EncodeToString(data)},
+		Usage:      reply.Usage,
+	})
+}
+
+func formValue(r *http.Request, key, fallback string) string {
+	if value := r.FormValue(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// responseBuffer keeps a response in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// voiceReply runs the chat turn of a voice request through the chat
+// completion pipeline, so it gets the same aliases, limits, slots and events
+// as any other completion, and returns the completion's response.
+func voiceReply(ctx context.Context, r *http.Request, chatReq OpenAIChatRequest) *responseBuffer {
+	var body bytes.Buffer
+	writeJSON(&body, chatReq)
+	internal := r.Clone(ctx)
+	internal.Method = http.MethodPost
+	internal.URL.Path = "/v1/chat/completions"
+	internal.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	internal.Body = io.NopCloser(&body)
+	internal.ContentLength = int64(body.Len())
+
+	buf := &responseBuffer{header: make(http.Header)}
+	newChatPipeline(buf, internal).run()
+	return buf
+}
+
+// transcribe sends audio to the OpenAI-compatible transcription endpoint at
+// audio.stt_url.
+func transcribe(ctx context.Context, audio io.Reader, filename, model, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, audio); err != nil {
+		return "", fmt.Errorf("failed to read audio: %w", err)
+	}
+	form.WriteField("model", model)
+	form.WriteField("response_format", "json")
+	if language != "" {
+		form.WriteField("language", language)
+	}
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(config.Audio.STTURL, "/")+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := doAudioRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var transcription struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&transcription); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	return transcription.Text, nil
+}
+
+// synthesize asks the OpenAI-compatible speech endpoint at audio.tts_url to
+// speak text. The caller reads the audio from the response body.
+func synthesize(ctx context.Context, text, model, voice, format string) (*http.Response, error) {
+	var body bytes.Buffer
+	writeJSON(&body, map[string]string{"model": model, "input": text, "voice": voice, "response_format": format})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(config.Audio.TTSURL, "/")+"/audio/speech", &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	return doAudioRequest(req)
+}
+
+func doAudioRequest(req *http.Request) (*http.Response, error) {
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("backend error (status %d): %s", resp.StatusCode, string(data))
+	}
+	return resp, nil
+}
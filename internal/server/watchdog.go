@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-side caps on a single generation, whatever max_tokens the client
+// sent. They catch models stuck in repetition loops.
+// The time limit is max_generation_time in the config.
+const MAX_COMPLETION_TOKENS = 8192
+
+var errWatchdogTripped = errors.New("output length watchdog tripped")
+
+// watchdog counts chunks (roughly one token each) and elapsed time of a
+// generation and trips once either cap is exceeded.
+type watchdog struct {
+	started time.Time
+	tokens  int
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{started: time.Now()}
+}
+
+func (d *watchdog) write(string) error {
+	d.tokens++
+	if d.tokens > MAX_COMPLETION_TOKENS || time.Since(d.started) > config.MaxGenerationTime {
+		return errWatchdogTripped
+	}
+	return nil
+}
+
+func setWatchdogWarning(w http.ResponseWriter) {
+	w.Header().Set("Warning", fmt.Sprintf(`199 ollama-openai-proxy "generation stopped after %d tokens or %s by the output length watchdog"`, MAX_COMPLETION_TOKENS, config.MaxGenerationTime))
+}
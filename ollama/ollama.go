@@ -0,0 +1,127 @@
+// Package ollama holds the wire types of Ollama's /api/generate and
+// /api/chat.
+package ollama
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"ollama-openai-proxy/openai"
+)
+
+type Request struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt,omitempty"`
+	// /api/generate only: text after the insertion point, and whether the
+	// prompt skips the model's template
+	Suffix   string          `json:"suffix,omitempty"`
+	Raw      bool            `json:"raw,omitempty"`
+	Messages []Message       `json:"messages,omitempty"`
+	Images   []string        `json:"images,omitempty"`
+	Tools    []openai.Tool   `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" or a JSON schema
+	Stream   bool            `json:"stream"`
+	Options  Options         `json:"options"`
+	// how long Ollama keeps the model loaded, as a Go duration
+	KeepAlive string `json:"keep_alive,omitempty"`
+
+	// where the request goes and, for OpenAI-compatible providers, the
+	// messages sent as they came in
+	Provider       string                 `json:"-"`
+	OpenAIMessages []openai.ChatMessage   `json:"-"`
+	ToolChoice     any                    `json:"-"`
+	ResponseFormat *openai.ResponseFormat `json:"-"`
+	Session        string                 `json:"-"`
+}
+
+// PromptText is the prompt as text, for token estimates. For /api/chat the
+// model's template renders it, the messages are flattened instead.
+func (r Request) PromptText() string {
+	if r.Prompt != "" || len(r.Messages) == 0 {
+		return r.Prompt
+	}
+	var prompt strings.Builder
+	for _, msg := range r.Messages {
+		prompt.WriteString(msg.Role + ": " + msg.Content + "\n")
+	}
+	return prompt.String()
+}
+
+// Options are the model options of a request.
+type Options struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+
+	// options the client passed as they are, e.g. num_ctx
+	Extra map[string]any `json:"-"`
+}
+
+// MarshalJSON adds Extra to the options above.
+func (o Options) MarshalJSON() ([]byte, error) {
+	type known Options
+	data, err := json.Marshal(known(o))
+	if err != nil || len(o.Extra) == 0 {
+		return data, err
+	}
+	options := make(map[string]any, len(o.Extra))
+	for name, value := range o.Extra {
+		options[name] = value
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&options); err != nil {
+		return nil, err
+	}
+	return json.Marshal(options)
+}
+
+// Message is a message of an /api/chat request or response.
+type Message struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// the function a tool message is the result of
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+// ToolCall is a function call on /api/chat, with the arguments as a JSON
+// object and no ID.
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type Response struct {
+	Model    string   `json:"model"`
+	Response string   `json:"response"`
+	Message  *Message `json:"message,omitempty"` // /api/chat
+	Done     bool     `json:"done"`
+	Error    string   `json:"error,omitempty"`
+	// base64 output of image generation models on /api/generate
+	Image string `json:"image,omitempty"`
+	// every image generated, accumulated over the chunks
+	Images []string `json:"-"`
+	// tool calls of /api/chat, accumulated over the chunks
+	ToolCalls []ToolCall `json:"-"`
+
+	// token counts, only in the final chunk
+	PromptEvalCount int `json:"prompt_eval_count,omitempty"`
+	EvalCount       int `json:"eval_count,omitempty"`
+	// nanoseconds spent loading the model
+	LoadDuration int64 `json:"load_duration,omitempty"`
+	// why the generation ended, only in the final chunk
+	DoneReason string `json:"done_reason,omitempty"`
+}
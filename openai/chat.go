@@ -0,0 +1,319 @@
+// Package openai holds the wire types of the OpenAI chat completions API,
+// with the extensions the proxy accepts.
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type ChatRequest struct {
+	Model     string        `json:"model"`
+	Messages  []ChatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens,omitempty"`
+	// choices to generate, 1 when not given
+	N      int  `json:"n,omitempty"`
+	Stream bool `json:"stream,omitempty"`
+	// only for streams
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// sampling parameters, nil when not given so 0 is a value of its own
+	Temperature      *float64      `json:"temperature,omitempty"`
+	TopP             *float64      `json:"top_p,omitempty"`
+	TopK             *int          `json:"top_k,omitempty"` // extension, see ProxyExtensions
+	Seed             *int          `json:"seed,omitempty"`
+	Stop             StopSequences `json:"stop,omitempty"`
+	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
+	// OpenRouter-style fallbacks, tried in order when the model fails; an
+	// extension, see ProxyExtensions
+	Models []string `json:"models,omitempty"`
+	User   string   `json:"user,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	Tools []Tool `json:"tools,omitempty"`
+	// "none", "auto", "required" or {"type": "function", "function": {"name": ...}}
+	ToolChoice any `json:"tool_choice,omitempty"`
+
+	// vendor extensions, see ProxyExtensions; the fields below are their
+	// older top-level forms
+	Proxy  *ProxyExtensions `json:"x_proxy,omitempty"`
+	Ollama *OllamaExtension `json:"ollama,omitempty"`
+	// raw Ollama options such as num_ctx, passed on as they are
+	OllamaOptions map[string]any `json:"ollama_options,omitempty"`
+	Options       map[string]any `json:"options,omitempty"`
+
+	// conversation the request belongs to, set by the proxy
+	Session string `json:"-"`
+	// keep_alive the client asked for, set by the proxy
+	KeepAlive string `json:"-"`
+}
+
+type StreamOptions struct {
+	// send a last chunk with the usage of the whole request before [DONE]
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ProxyExtensions are the proxy's own request fields, under x_proxy so
+// they can't collide with fields OpenAI adds later. Each endpoint takes
+// some of them, as GET /v1/extensions/schema publishes.
+type ProxyExtensions struct {
+	TopK   *int     `json:"top_k,omitempty"`
+	Models []string `json:"models,omitempty"`
+	// a duration such as "30m" or seconds, see OllamaExtension
+	KeepAlive any `json:"keep_alive,omitempty"`
+	// raw Ollama options such as num_ctx
+	OllamaOptions map[string]any `json:"ollama_options,omitempty"`
+	// embeddings only: L2-normalize the vectors
+	Normalize *bool `json:"normalize,omitempty"`
+}
+
+// OllamaExtension holds the vendor extension fields of a request under
+// `ollama`, for Ollama features OpenAI has no field for.
+type OllamaExtension struct {
+	// how long the model stays loaded after the request: a duration such as
+	// "30m" or seconds; negative keeps it loaded, 0 unloads it right away
+	KeepAlive any `json:"keep_alive,omitempty"`
+}
+
+type ChatMessage struct {
+	Role      string   `json:"role"`
+	Content   string   `json:"content"`
+	ImageURLs []string `json:"-"`
+	// base64 images the model generated, see MarshalJSON
+	Images []string `json:"-"`
+
+	// calls of an assistant message, and the call a tool message answers
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// ContentPart is one element of an array-style message content, as sent by
+// OpenAI vision clients.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+	// base64 image of an "image" part, as generated by the model
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON also takes image_url as a bare URL string, as some older
+// clients send it.
+func (u *ImageURL) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &u.URL)
+	}
+	type imageURL ImageURL
+	return json.Unmarshal(data, (*imageURL)(u))
+}
+
+// UnmarshalJSON accepts content either as a plain string or as an array of
+// text and image_url parts. Text parts are joined into Content, image URLs are
+// kept aside for the upstream images field.
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type chatMessage ChatMessage
+	aux := struct {
+		*chatMessage
+		Content json.RawMessage `json:"content"`
+	}{chatMessage: (*chatMessage)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	m.Content = ""
+	m.ImageURLs = nil
+	if len(aux.Content) == 0 || string(aux.Content) == "null" {
+		return nil
+	}
+	if aux.Content[0] == '"' {
+		return json.Unmarshal(aux.Content, &m.Content)
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(aux.Content, &parts); err != nil {
+		return err
+	}
+	var texts []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL != nil {
+				m.ImageURLs = append(m.ImageURLs, part.ImageURL.URL)
+			}
+		case "image":
+			// an earlier answer's image sent back as part of the conversation
+			if part.B64JSON != "" {
+				m.ImageURLs = append(m.ImageURLs, "data:image/png;base64,"+part.B64JSON)
+			}
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// MarshalJSON writes content as a plain string, or as text and image parts
+// when the model generated images. Like OpenAI, it is null for a message
+// that only calls tools.
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type chatMessage ChatMessage
+	content := messageContent(m.Content, m.Images)
+	if m.Content == "" && len(m.Images) == 0 && len(m.ToolCalls) > 0 {
+		content = nil
+	}
+	return marshal(struct {
+		chatMessage
+		Content any `json:"content"`
+	}{chatMessage: chatMessage(m), Content: content})
+}
+
+// marshal is json.Marshal without HTML escaping, which an encoder that has
+// it turned off doesn't undo in the output of a MarshalJSON method.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// messageContent is text as is, or an array of content parts holding the
+// text and one "image" part with the base64 data of each image.
+func messageContent(text string, images []string) any {
+	if len(images) == 0 {
+		return text
+	}
+	var parts []ContentPart
+	if text != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: text})
+	}
+	for _, image := range images {
+		parts = append(parts, ContentPart{Type: "image", B64JSON: image})
+	}
+	return parts
+}
+
+// StopSequences is OpenAI's stop: a single string or an array of them.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = nil
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var stop string
+		if err := json.Unmarshal(data, &stop); err != nil {
+			return err
+		}
+		*s = StopSequences{stop}
+		return nil
+	}
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = stops
+	return nil
+}
+
+// ResponseFormat is OpenAI's response_format: "text", "json_object" for JSON
+// mode, or "json_schema" for structured outputs.
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// Tool is an OpenAI function tool. Ollama takes tools in the same shape.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a function call of the model as OpenAI reports it, with the
+// arguments as a JSON string.
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"` // stream deltas only
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type ChatResponse struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   Usage    `json:"usage"`
+	// operator-defined extension
+	Metadata map[string]string `json:"x_metadata,omitempty"`
+	Warning  string            `json:"warning,omitempty"`
+}
+
+type Choice struct {
+	Index                int                            `json:"index"`
+	Message              ChatMessage                    `json:"message"`
+	FinishReason         string                         `json:"finish_reason"`
+	ContentFilterResults map[string]ContentFilterResult `json:"content_filter_results,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ContentFilterResult follows the Azure OpenAI content_filter_results shape.
+type ContentFilterResult struct {
+	Filtered bool `json:"filtered"`
+	Detected bool `json:"detected"`
+}
+
+// ContentFilterInnerError details a prompt rejected by the content filter,
+// like Azure OpenAI's innererror.
+type ContentFilterInnerError struct {
+	Code                string                         `json:"code"`
+	ContentFilterResult map[string]ContentFilterResult `json:"content_filter_result"`
+}
+
+type ErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Param   string `json:"param,omitempty"`
+		Code    string `json:"code"`
+		// what the content filter flagged in a rejected prompt
+		InnerError *ContentFilterInnerError `json:"innererror,omitempty"`
+	} `json:"error"`
+}
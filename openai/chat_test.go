@@ -0,0 +1,62 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// encode writes v the way the proxy sends responses, without HTML escaping.
+func encode(t *testing.T, v any) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestMarshalKeepsHTML(t *testing.T) {
+	const text = "Hello <b>world</b> & \"friends\""
+	stop := "stop"
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{
+			"message",
+			ChatMessage{Role: "assistant", Content: text},
+			`{"role":"assistant","content":"Hello <b>world</b> & \"friends\""}` + "\n",
+		},
+		{
+			"message with images",
+			ChatMessage{Role: "assistant", Content: text, Images: []string{"aW1hZ2U="}},
+			`{"role":"assistant","content":[{"type":"text","text":"Hello <b>world</b> & \"friends\""},{"type":"image","b64_json":"aW1hZ2U="}]}` + "\n",
+		},
+		{
+			"tool call arguments",
+			ChatMessage{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "html", Arguments: `{"tag":"<b>"}`}}}},
+			`{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"html","arguments":"{\"tag\":\"<b>\"}"}}],"content":null}` + "\n",
+		},
+		{
+			"delta",
+			ChunkDelta{Content: text},
+			`{"content":"Hello <b>world</b> & \"friends\""}` + "\n",
+		},
+		{
+			"chunk",
+			ChatCompletionChunk{ID: "chatcmpl-1", Object: "chat.completion.chunk", Choices: []ChunkChoice{{Delta: ChunkDelta{Content: "<|im_end|>"}, FinishReason: &stop}}},
+			`{"id":"chatcmpl-1","object":"chat.completion.chunk","created":0,"model":"","choices":[{"index":0,"delta":{"content":"<|im_end|>"},"finish_reason":"stop"}]}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encode(t, tt.v); got != tt.want {
+				t.Errorf("encoded\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package openai
+
+// ChatCompletionChunk is one server-sent event of a streamed chat completion.
+type ChatCompletionChunk struct {
+	ID       string            `json:"id"`
+	Object   string            `json:"object"`
+	Created  int64             `json:"created"`
+	Model    string            `json:"model"`
+	Choices  []ChunkChoice     `json:"choices"`
+	Metadata map[string]string `json:"x_metadata,omitempty"`
+	Usage    *Usage            `json:"usage,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index                int                            `json:"index"`
+	Delta                ChunkDelta                     `json:"delta"`
+	FinishReason         *string                        `json:"finish_reason"`
+	ContentFilterResults map[string]ContentFilterResult `json:"content_filter_results,omitempty"`
+}
+
+type ChunkDelta struct {
+	Role      string     `json:"role,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	Images    []string   `json:"-"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+func (d ChunkDelta) MarshalJSON() ([]byte, error) {
+	type chunkDelta ChunkDelta
+	var content any
+	if d.Content != "" || len(d.Images) > 0 {
+		content = messageContent(d.Content, d.Images)
+	}
+	return marshal(struct {
+		chunkDelta
+		Content any `json:"content,omitempty"`
+	}{chunkDelta: chunkDelta(d), Content: content})
+}
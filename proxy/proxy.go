@@ -0,0 +1,81 @@
+// Package proxy embeds the OpenAI-compatible Ollama proxy in another Go
+// program, as an http.Handler serving the routes of the ollama-openai-proxy
+// command.
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"ollama-openai-proxy/internal/server"
+)
+
+// Config is the configuration of the proxy, the settings of the config
+// file, environment and flags.
+type Config = server.Config
+
+// The types of Config's fields, to build one in Go rather than YAML.
+type (
+	APIKey              = server.APIKey
+	AudioConfig         = server.AudioConfig
+	BackendTier         = server.BackendTier
+	CORSConfig          = server.CORSConfig
+	Deprecation         = server.Deprecation
+	EncryptionConfig    = server.EncryptionConfig
+	EvalConfig          = server.EvalConfig
+	Experiment          = server.Experiment
+	Listener            = server.Listener
+	LogConfig           = server.LogConfig
+	ModelAlias          = server.ModelAlias
+	ModelAliasConfig    = server.ModelAliasConfig
+	ModelConcurrency    = server.ModelConcurrency
+	OutputFilter        = server.OutputFilter
+	ParamRange          = server.ParamRange
+	ParameterLimit      = server.ParameterLimit
+	Preset              = server.Preset
+	Provider            = server.Provider
+	RateLimitConfig     = server.RateLimitConfig
+	ResponseCacheConfig = server.ResponseCacheConfig
+	RetentionConfig     = server.RetentionConfig
+	RewriteRule         = server.RewriteRule
+	RoutePolicy         = server.RoutePolicy
+	Schedule            = server.Schedule
+	ScheduleRule        = server.ScheduleRule
+	SecretsConfig       = server.SecretsConfig
+	SigningConfig       = server.SigningConfig
+	SizeRoute           = server.SizeRoute
+	StorageConfig       = server.StorageConfig
+	SystemMessageRule   = server.SystemMessageRule
+	TracingConfig       = server.TracingConfig
+	UpstreamConfig      = server.UpstreamConfig
+	VectorStoreConfig   = server.VectorStoreConfig
+)
+
+// DefaultConfig is the configuration with every setting at its default.
+func DefaultConfig() Config {
+	return server.DefaultConfig()
+}
+
+// LoadConfig reads the configuration like the command does: from the
+// config file (-config or $PROXY_CONFIG), the environment and args as
+// command line flags.
+func LoadConfig(args []string) (Config, error) {
+	return server.LoadConfig(args)
+}
+
+// New sets up the proxy for cfg and returns the handler of its routes,
+// e.g. to mount on a mux of the program or to call from tests with
+// httptest. The proxy keeps its state in package variables, so a program
+// runs one.
+func New(cfg Config) (http.Handler, error) {
+	return server.New(cfg)
+}
+
+// TLSConfig is the TLS config to serve the handler of New with when
+// tls_cert is set, nil otherwise. It picks up refreshed certificates, e.g.
+//
+//	server := &http.Server{Addr: ":8443", Handler: handler, TLSConfig: proxy.TLSConfig()}
+//	server.ListenAndServeTLS("", "")
+func TLSConfig() *tls.Config {
+	return server.TLSConfig()
+}
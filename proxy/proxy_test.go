@@ -0,0 +1,51 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ollama-openai-proxy/proxy"
+)
+
+// A program builds the whole Config in Go, nested types included.
+func TestNew(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"models": [{"name": "llama3:latest"}]}`))
+	}))
+	defer ollama.Close()
+
+	cfg := proxy.DefaultConfig()
+	cfg.OllamaAPIBase = ollama.URL
+	cfg.APIKeys = []proxy.APIKey{{Key: "sk-proxy-test", Name: "team-a"}}
+	cfg.Presets = map[string]proxy.Preset{"team-a": {MaxTokens: 256}}
+	cfg.BackendTiers = []proxy.BackendTier{{Name: "local", URLs: []string{ollama.URL}}}
+	handler, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"without key", "", http.StatusUnauthorized},
+		{"wrong key", "sk-other", http.StatusUnauthorized},
+		{"configured key", "sk-proxy-test", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			if tt.key != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
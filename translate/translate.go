@@ -0,0 +1,190 @@
+// Package translate converts between the OpenAI and Ollama wire types. It
+// reads no configuration of its own: what a conversion depends on is passed
+// in as a Config.
+package translate
+
+import (
+	"encoding/json"
+
+	"ollama-openai-proxy/ollama"
+	"ollama-openai-proxy/openai"
+)
+
+// Config is what a conversion takes from the proxy's configuration.
+type Config struct {
+	// flatten messages into a prompt for /api/generate, see
+	// legacy_generate_api; requests with tools stay on /api/chat
+	LegacyGenerateAPI bool
+	// keep_alive of the model, for requests that ask for none
+	KeepAlive string
+}
+
+// Request is the Ollama request for req without its conversation: the
+// model options, format and keep_alive. Model and provider are left to
+// the caller, which splits off the provider prefix.
+func Request(req openai.ChatRequest, cfg Config) ollama.Request {
+	ollamaReq := ollama.Request{
+		// always streamed upstream so partial output survives a deadline
+		Stream:    true,
+		Session:   req.Session,
+		KeepAlive: req.KeepAlive,
+		Format:    Format(req.ResponseFormat),
+	}
+	if ollamaReq.KeepAlive == "" {
+		ollamaReq.KeepAlive = cfg.KeepAlive
+	}
+	ollamaReq.Options = ollama.Options{
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		TopK:             req.TopK,
+		Seed:             req.Seed,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Extra:            req.OllamaOptions,
+	}
+	if req.MaxTokens > 0 {
+		ollamaReq.Options.NumPredict = req.MaxTokens
+	}
+	return ollamaReq
+}
+
+// Chat is Request with the conversation: messages for /api/chat, or a
+// flattened prompt for /api/generate with cfg.LegacyGenerateAPI. images
+// are the resolved ImageURLs of each message, fetching them is up to the
+// caller, and so are the tools to offer.
+func Chat(req openai.ChatRequest, images [][]string, cfg Config) ollama.Request {
+	ollamaReq := Request(req, cfg)
+	// only /api/chat knows tools
+	if cfg.LegacyGenerateAPI && len(req.Tools) == 0 {
+		ollamaReq.Prompt = Prompt(req.Messages)
+		for i := range req.Messages {
+			if i < len(images) {
+				ollamaReq.Images = append(ollamaReq.Images, images[i]...)
+			}
+		}
+		return ollamaReq
+	}
+	names := ToolNames(req.Messages)
+	for i, msg := range req.Messages {
+		message := ollama.Message{Role: Role(msg.Role), Content: msg.Content}
+		if i < len(images) {
+			message.Images = images[i]
+		}
+		if len(msg.ToolCalls) > 0 {
+			message.ToolCalls = OllamaToolCalls(msg.ToolCalls)
+		}
+		if msg.Role == "tool" {
+			message.ToolName = names[msg.ToolCallID]
+		}
+		ollamaReq.Messages = append(ollamaReq.Messages, message)
+	}
+	return ollamaReq
+}
+
+// Format is Ollama's format parameter for a response format: "json" for
+// JSON mode, or the schema itself to constrain generation to it.
+func Format(format *openai.ResponseFormat) json.RawMessage {
+	switch {
+	case format == nil:
+		return nil
+	case format.Type == "json_object":
+		return json.RawMessage(`"json"`)
+	case format.Type == "json_schema" && format.JSONSchema != nil:
+		return format.JSONSchema.Schema
+	}
+	return nil
+}
+
+// ToolNames maps tool call IDs in a conversation to the function called,
+// since Ollama identifies tool results by name.
+func ToolNames(messages []openai.ChatMessage) map[string]string {
+	names := make(map[string]string)
+	for _, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			names[call.ID] = call.Function.Name
+		}
+	}
+	return names
+}
+
+// AddSystemInstruction appends instruction to the first system message, or
+// puts it in a new one up front.
+func AddSystemInstruction(messages []ollama.Message, instruction string) []ollama.Message {
+	for i, msg := range messages {
+		if msg.Role == "system" {
+			messages[i].Content = msg.Content + "\n\n" + instruction
+			return messages
+		}
+	}
+	return append([]ollama.Message{{Role: "system", Content: instruction}}, messages...)
+}
+
+// Prompt flattens messages into a "role: content" prompt, for
+// /api/generate and templates that know no chat format.
+func Prompt(messages []openai.ChatMessage) string {
+	var prompt string
+	for _, msg := range messages {
+		prompt += msg.Role + ": " + msg.Content + "\n"
+	}
+	return prompt
+}
+
+// Role is the Ollama role of an OpenAI message role.
+func Role(role string) string {
+	if role == "developer" {
+		// Ollama templates know no developer role
+		return "system"
+	}
+	return role
+}
+
+// OllamaToolCalls converts the tool calls of an assistant message for
+// /api/chat, which takes the arguments as a JSON object.
+func OllamaToolCalls(calls []openai.ToolCall) []ollama.ToolCall {
+	converted := make([]ollama.ToolCall, 0, len(calls))
+	for _, call := range calls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if len(arguments) == 0 {
+			arguments = json.RawMessage("{}")
+		}
+		converted = append(converted, ollama.ToolCall{Function: ollama.ToolCallFunction{Name: call.Function.Name, Arguments: arguments}})
+	}
+	return converted
+}
+
+// FinishReason is the finish_reason of a generation that ran to its end.
+// Ollama's done_reason is stop, length for num_predict, or load and unload
+// for requests that only (un)load a model; OpenAI-compatible upstreams give
+// their own finish_reason, content_filter included.
+func FinishReason(resp *ollama.Response) string {
+	switch resp.DoneReason {
+	case "length", "content_filter", "tool_calls":
+		return resp.DoneReason
+	}
+	return "stop"
+}
+
+// Usage is the token usage of a generation as counted by the upstream,
+// falling back to estimates for counts it didn't report, e.g. because the
+// generation was cut off before its final chunk.
+func Usage(req ollama.Request, resp *ollama.Response) openai.Usage {
+	promptTokens := resp.PromptEvalCount
+	if promptTokens == 0 {
+		promptTokens = EstimateTokens(req.PromptText())
+	}
+	completionTokens := resp.EvalCount
+	if completionTokens == 0 {
+		completionTokens = EstimateTokens(resp.Response)
+	}
+	return openai.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// EstimateTokens is a rough estimate, Ollama doesn't expose a tokenizer.
+func EstimateTokens(s string) int {
+	return len(s) / 4
+}
@@ -0,0 +1,325 @@
+package translate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"ollama-openai-proxy/ollama"
+	"ollama-openai-proxy/openai"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []openai.ChatMessage
+		want     string
+	}{
+		{"empty", nil, ""},
+		{"one", []openai.ChatMessage{{Role: "user", Content: "hi"}}, "user: hi\n"},
+		{
+			"conversation",
+			[]openai.ChatMessage{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}},
+			"system: Be brief.\nuser: hi\nassistant: hello\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Prompt(tt.messages); got != tt.want {
+				t.Errorf("Prompt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRole(t *testing.T) {
+	tests := []struct {
+		role string
+		want string
+	}{
+		{"developer", "system"},
+		{"system", "system"},
+		{"user", "user"},
+		{"assistant", "assistant"},
+		{"tool", "tool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			if got := Role(tt.role); got != tt.want {
+				t.Errorf("Role(%q) = %q, want %q", tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOllamaToolCalls(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []openai.ToolCall
+		want  []ollama.ToolCall
+	}{
+		{"none", nil, []ollama.ToolCall{}},
+		{
+			"arguments",
+			[]openai.ToolCall{{ID: "call_1", Type: "function", Function: openai.ToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`}}},
+			[]ollama.ToolCall{{Function: ollama.ToolCallFunction{Name: "weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}}},
+		},
+		{
+			"no arguments",
+			[]openai.ToolCall{{ID: "call_2", Type: "function", Function: openai.ToolCallFunction{Name: "time"}}},
+			[]ollama.ToolCall{{Function: ollama.ToolCallFunction{Name: "time", Arguments: json.RawMessage("{}")}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OllamaToolCalls(tt.calls); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("OllamaToolCalls() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinishReason(t *testing.T) {
+	tests := []struct {
+		doneReason string
+		want       string
+	}{
+		{"", "stop"},
+		{"stop", "stop"},
+		{"length", "length"},
+		{"load", "stop"},
+		{"unload", "stop"},
+		{"content_filter", "content_filter"},
+		{"tool_calls", "tool_calls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.doneReason, func(t *testing.T) {
+			if got := FinishReason(&ollama.Response{DoneReason: tt.doneReason}); got != tt.want {
+				t.Errorf("FinishReason(%q) = %q, want %q", tt.doneReason, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ollama.Request
+		resp ollama.Response
+		want openai.Usage
+	}{
+		{
+			"reported",
+			ollama.Request{Prompt: "ignored"},
+			ollama.Response{PromptEvalCount: 12, EvalCount: 30, Response: "ignored"},
+			openai.Usage{PromptTokens: 12, CompletionTokens: 30, TotalTokens: 42},
+		},
+		{
+			"estimated",
+			ollama.Request{Prompt: "sixteen bytes..."},
+			ollama.Response{Response: "eight..."},
+			openai.Usage{PromptTokens: 4, CompletionTokens: 2, TotalTokens: 6},
+		},
+		{
+			"estimated from messages",
+			ollama.Request{Messages: []ollama.Message{{Role: "user", Content: "hello world!"}}},
+			ollama.Response{EvalCount: 5},
+			openai.Usage{PromptTokens: 4, CompletionTokens: 5, TotalTokens: 9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Usage(tt.req, &tt.resp); got != tt.want {
+				t.Errorf("Usage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"abcd", 1},
+		{"a sentence of 25 letters.", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := EstimateTokens(tt.s); got != tt.want {
+				t.Errorf("EstimateTokens(%q) = %d, want %d", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	schema := json.RawMessage(`{"type":"object"}`)
+	tests := []struct {
+		name   string
+		format *openai.ResponseFormat
+		want   json.RawMessage
+	}{
+		{"none", nil, nil},
+		{"text", &openai.ResponseFormat{Type: "text"}, nil},
+		{"json object", &openai.ResponseFormat{Type: "json_object"}, json.RawMessage(`"json"`)},
+		{"json schema", &openai.ResponseFormat{Type: "json_schema", JSONSchema: &openai.JSONSchemaFormat{Schema: schema}}, schema},
+		{"json schema without one", &openai.ResponseFormat{Type: "json_schema"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Format(tt.format); string(got) != string(tt.want) {
+				t.Errorf("Format() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddSystemInstruction(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []ollama.Message
+		want     []ollama.Message
+	}{
+		{
+			"appended to the system message",
+			[]ollama.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "hi"}},
+			[]ollama.Message{{Role: "system", Content: "Be brief.\n\nCall a tool."}, {Role: "user", Content: "hi"}},
+		},
+		{
+			"new system message",
+			[]ollama.Message{{Role: "user", Content: "hi"}},
+			[]ollama.Message{{Role: "system", Content: "Call a tool."}, {Role: "user", Content: "hi"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AddSystemInstruction(tt.messages, "Call a tool."); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AddSystemInstruction() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  openai.ChatRequest
+		cfg  Config
+		want ollama.Request
+	}{
+		{
+			"defaults",
+			openai.ChatRequest{},
+			Config{},
+			ollama.Request{Stream: true},
+		},
+		{
+			"options",
+			openai.ChatRequest{
+				MaxTokens: 100, Temperature: ptr(0.0), TopP: ptr(0.9), TopK: ptr(40), Seed: ptr(7),
+				Stop: openai.StopSequences{"\n\n"}, PresencePenalty: ptr(0.5), FrequencyPenalty: ptr(-0.5),
+				OllamaOptions: map[string]any{"num_ctx": 8192}, Session: "s1",
+			},
+			Config{},
+			ollama.Request{Stream: true, Session: "s1", Options: ollama.Options{
+				Temperature: ptr(0.0), TopP: ptr(0.9), TopK: ptr(40), Seed: ptr(7), Stop: []string{"\n\n"}, NumPredict: 100,
+				PresencePenalty: ptr(0.5), FrequencyPenalty: ptr(-0.5), Extra: map[string]any{"num_ctx": 8192},
+			}},
+		},
+		{
+			"keep_alive of the model",
+			openai.ChatRequest{},
+			Config{KeepAlive: "1h"},
+			ollama.Request{Stream: true, KeepAlive: "1h"},
+		},
+		{
+			"keep_alive of the request",
+			openai.ChatRequest{KeepAlive: "30m"},
+			Config{KeepAlive: "1h"},
+			ollama.Request{Stream: true, KeepAlive: "30m"},
+		},
+		{
+			"format",
+			openai.ChatRequest{ResponseFormat: &openai.ResponseFormat{Type: "json_object"}},
+			Config{},
+			ollama.Request{Stream: true, Format: json.RawMessage(`"json"`)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Request(tt.req, tt.cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Request() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChat(t *testing.T) {
+	messages := []openai.ChatMessage{
+		{Role: "developer", Content: "Be brief."},
+		{Role: "user", Content: "What is this?", ImageURLs: []string{"https://example.com/cat.png"}},
+	}
+	toolConversation := []openai.ChatMessage{
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []openai.ToolCall{{ID: "call_1", Type: "function", Function: openai.ToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`}}}},
+		{Role: "tool", Content: "sunny", ToolCallID: "call_1"},
+	}
+	tools := []openai.Tool{{Type: "function", Function: openai.ToolFunction{Name: "weather"}}}
+	tests := []struct {
+		name   string
+		req    openai.ChatRequest
+		images [][]string
+		cfg    Config
+		want   ollama.Request
+	}{
+		{
+			"messages",
+			openai.ChatRequest{Messages: messages},
+			[][]string{nil, {"aW1hZ2U="}},
+			Config{},
+			ollama.Request{Stream: true, Messages: []ollama.Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "What is this?", Images: []string{"aW1hZ2U="}},
+			}},
+		},
+		{
+			"legacy prompt",
+			openai.ChatRequest{Messages: messages},
+			[][]string{nil, {"aW1hZ2U="}},
+			Config{LegacyGenerateAPI: true},
+			ollama.Request{Stream: true, Prompt: "developer: Be brief.\nuser: What is this?\n", Images: []string{"aW1hZ2U="}},
+		},
+		{
+			"tool calls and results",
+			openai.ChatRequest{Messages: toolConversation, Tools: tools},
+			nil,
+			Config{},
+			ollama.Request{Stream: true, Messages: []ollama.Message{
+				{Role: "user", Content: "Weather in Paris?"},
+				{Role: "assistant", ToolCalls: []ollama.ToolCall{{Function: ollama.ToolCallFunction{Name: "weather", Arguments: json.RawMessage(`{"city":"Paris"}`)}}}},
+				{Role: "tool", Content: "sunny", ToolName: "weather"},
+			}},
+		},
+		{
+			"legacy keeps messages with tools",
+			openai.ChatRequest{Messages: toolConversation[:1], Tools: tools},
+			nil,
+			Config{LegacyGenerateAPI: true},
+			ollama.Request{Stream: true, Messages: []ollama.Message{{Role: "user", Content: "Weather in Paris?"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Chat(tt.req, tt.images, tt.cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Chat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}